@@ -51,8 +51,13 @@ for site in marketing app; do
   fi
 done
 
-for func in get-sounds get-upload test-auth-token ws-pub ws-sub create-clips get-clips uploads; do
-  rev=$(find ./lambda/${func}/ -type f -exec md5sum {} + | sort -k 2 | md5sum | awk '{print $1}');
+for func in get-sounds get-upload test-auth-token ws-pub ws-sub create-clips get-clips uploads create-export exports get-job render-clip list-clips update-clip delete-clip create-clip-pack clip-packs get-markers import-markers create-share list-shares delete-share get-share-access get-share get-sound delete-sound sound-deletions list-trash restore-trash trash-purge list-tags set-tags update-tag delete-tag search-index search similar-sounds list-collections create-collection get-collection update-collection reorder-collection add-collection-items remove-collection-item delete-collection formats-backfill update-sound get-sound-history clips-backfill; do
+  srcs="./lambda/${func}/"
+  if [[ -f "./lambda/${func}/go.mod" ]]; then
+    # go functions build against the shared module in lambda/pkg.
+    srcs="${srcs} ./lambda/pkg/"
+  fi
+  rev=$(find ${srcs} -type f -exec md5sum {} + | sort -k 2 | md5sum | awk '{print $1}');
   mkdir -p ".artifacts/functions/${rev}/${func}"
   sed -i.bak "s/__rev__\/${func}/${rev}\/${func}/g" ${TEMPLATE}
   mkdir -p ".artifacts/functions/${GIT_REV}/${func}/"
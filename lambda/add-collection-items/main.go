@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/collections"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	store := collections.New(dynamodb.NewFromConfig(cfg), os.Getenv("COLLECTIONS_TABLE_NAME"),
+		os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("CLIPS_TABLE_NAME"))
+
+	h := handler{store, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	store *collections.Store
+	log   *zerolog.Logger
+}
+
+// Request is the body of POST /collections/{collectionId}/items. Without a
+// position the items go at the end.
+type Request struct {
+	Items    []collections.Item `json:"items"`
+	Position *int               `json:"position"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+	// Missing are the items that can't be added.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// POST /collections/{collectionId}/items adds {"items": [{"kind": "sound"
+// | "clip", "key": ...}]} to the user's collection, before the item at
+// "position" if one is given, and returns the collection. Items already in
+// it stay where they are. Items that aren't the user's, or are in the
+// trash, are a 422 listing them.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	collectionId := event.PathParameters["collectionId"]
+	if collectionId == "" {
+		h.log.Error().Msgf("Cannot get collectionid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	var req Request
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+		return h.respond(http.StatusBadRequest, &ErrorResponse{
+			Message: "Invalid JSON body",
+		}), nil
+	}
+	position := -1
+	if req.Position != nil {
+		if *req.Position < 0 {
+			return h.respond(http.StatusUnprocessableEntity, &ErrorResponse{
+				Message: "position must not be negative",
+			}), nil
+		}
+		position = *req.Position
+	}
+
+	missing, err := h.store.Check(ctx, user, req.Items)
+	if errors.Is(err, collections.ErrKind) {
+		return h.respond(http.StatusUnprocessableEntity, &ErrorResponse{
+			Message: err.Error(),
+		}), nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error checking items")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if len(missing) > 0 {
+		return h.respond(http.StatusUnprocessableEntity, &ErrorResponse{
+			Message: "Some items can't be added",
+			Missing: missing,
+		}), nil
+	}
+
+	c, err := h.store.Add(ctx, user, collectionId, req.Items, position)
+	if errors.Is(err, collections.ErrTooMany) || errors.Is(err, collections.ErrBusy) {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, collections.ErrBusy) {
+			status = http.StatusConflict
+		}
+		return h.respond(status, &ErrorResponse{
+			Message: err.Error(),
+		}), nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error adding to collection")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if c == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	v, err := h.store.View(ctx, user, c)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error resolving collection items")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	return h.respond(http.StatusOK, v), nil
+}
+
+// respond writes v as the JSON body of a response with the given status.
+func (h handler) respond(status int, v interface{}) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(v)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
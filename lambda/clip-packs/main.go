@@ -0,0 +1,528 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/audio"
+	"wavey.ai/pkg/jobs"
+	"wavey.ai/pkg/s3io"
+	"wavey.ai/pkg/timebase"
+)
+
+// progressInterval is the least time between progress events.
+const progressInterval = time.Second
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+
+	invocationId := ksuid.New().String()
+	log := log.With().Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	s3Cl := s3.NewFromConfig(cfg)
+
+	h := handler{
+		dbCl,
+		s3Cl,
+		manager.NewUploader(s3Cl),
+		sns.NewFromConfig(cfg),
+		os.Getenv("JOBS_TABLE_NAME"),
+		os.Getenv("CLIPS_TABLE_NAME"),
+		os.Getenv("EXPORTS_BUCKET_NAME"),
+		os.Getenv("TOPIC_ARN"),
+		&log,
+	}
+
+	lambda.Start(h.handler)
+}
+
+type handler struct {
+	dbCl          *dynamodb.Client
+	s3Cl          *s3.Client
+	uploader      *manager.Uploader
+	snsCl         *sns.Client
+	jobsTbl       string
+	clipsTbl      string
+	exportsBucket string
+	topicArn      string
+	log           *zerolog.Logger
+}
+
+type Message struct {
+	Job string `json:"job"`
+}
+
+type Job struct {
+	Key      string   `dynamodbav:"key"`
+	User     string   `dynamodbav:"user"`
+	Status   string   `dynamodbav:"status"`
+	Sound    string   `dynamodbav:"sound"`
+	Bucket   string   `dynamodbav:"bucket"`
+	BitDepth int      `dynamodbav:"bitDepth"`
+	Clips    []string `dynamodbav:"clips,stringset"`
+	Topic    string   `dynamodbav:"topic"`
+}
+
+type Clip struct {
+	Key    string   `dynamodbav:"key"`
+	Start  int64    `dynamodbav:"start"`
+	End    int64    `dynamodbav:"end"`
+	Hz     int64    `dynamodbav:"hz"`
+	Name   string   `dynamodbav:"name"`
+	Colour string   `dynamodbav:"colour"`
+	Notes  string   `dynamodbav:"notes"`
+	Labels []string `dynamodbav:"labels"`
+	Loop   bool     `dynamodbav:"loop"`
+}
+
+// Manifest is written to manifest.json at the root of the zip.
+type Manifest struct {
+	Sound      string         `json:"sound"`
+	SampleRate int            `json:"sampleRate"`
+	Channels   int            `json:"channels"`
+	BitDepth   int            `json:"bitDepth"`
+	Clips      []ManifestClip `json:"clips"`
+	Skipped    []SkippedClip  `json:"skipped,omitempty"`
+}
+
+// ManifestClip describes one file in the zip. Start, end and hz are the
+// clip as stored; startFrame and frames locate it in the sound at the
+// file's sample rate.
+type ManifestClip struct {
+	Key        string   `json:"key"`
+	File       string   `json:"file"`
+	Name       string   `json:"name,omitempty"`
+	Colour     string   `json:"colour,omitempty"`
+	Notes      string   `json:"notes,omitempty"`
+	Labels     []string `json:"labels,omitempty"`
+	Loop       bool     `json:"loop,omitempty"`
+	Start      int64    `json:"start"`
+	End        int64    `json:"end"`
+	Hz         int64    `json:"hz"`
+	StartFrame int64    `json:"startFrame"`
+	Frames     int64    `json:"frames"`
+}
+
+// SkippedClip is a clip that lies outside the sound.
+type SkippedClip struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// Event is published to the job's websocket topic as the pack progresses.
+type Event struct {
+	Type   string `json:"type"`
+	Job    string `json:"job"`
+	Status string `json:"status"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Notification is the message format ws-pub fans out to subscribers.
+type Notification struct {
+	Topic string `json:"topic"`
+	Data  Event  `json:"data"`
+}
+
+func (h handler) handler(evt events.SQSEvent) error {
+	for _, message := range evt.Records {
+		var msg Message
+		if err := json.Unmarshal([]byte(message.Body), &msg); err != nil {
+			h.log.Error().Msgf("Error unmarshalling SQS message: %v", err)
+			continue
+		}
+
+		res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+			TableName: &h.jobsTbl,
+			Key: map[string]dynamodbTypes.AttributeValue{
+				"key": &dynamodbTypes.AttributeValueMemberS{Value: msg.Job},
+			},
+		})
+		if err != nil {
+			h.log.Err(err).Msg("Error getting job from DynamoDB")
+			return err
+		}
+		if res.Item == nil {
+			h.log.Error().Str("job", msg.Job).Msg("Job not found")
+			continue
+		}
+
+		var job Job
+		if err := attributevalue.UnmarshalMap(res.Item, &job); err != nil {
+			h.log.Err(err).Msg("Error unmarshaling job")
+			continue
+		}
+		if job.Status == "done" {
+			// Redelivered after completing.
+			continue
+		}
+
+		log := h.log.With().Str("job", job.Key).Str("sound", job.Sound).Logger()
+
+		if err := h.update(job.Key, "running", nil); err != nil {
+			return err
+		}
+		h.publish(job, Event{Type: "progress", Status: "running"})
+
+		object, total, err := h.pack(job)
+		if err != nil {
+			if !jobs.IsPermanent(err) {
+				// S3 and DynamoDB errors are left for SQS to redeliver,
+				// with the job still running.
+				log.Err(err).Msg("Error packing clips")
+				return err
+			}
+			// Decoding and encoding errors won't go away on retry, so the
+			// job is failed rather than redelivered.
+			log.Err(err).Msg("Clip pack failed")
+			if err := h.update(job.Key, "failed", map[string]string{"error": err.Error()}); err != nil {
+				return err
+			}
+			h.publish(job, Event{Type: "failed", Status: "failed", Error: err.Error()})
+			continue
+		}
+
+		if err := h.update(job.Key, "done", map[string]string{"object": object}); err != nil {
+			return err
+		}
+		h.publish(job, Event{Type: "done", Status: "done", Done: total, Total: total})
+		log.Info().Str("object", object).Msgf("Packed %d clips", total)
+	}
+	return nil
+}
+
+// pack renders the job's clips as WAV files and streams them into a zip in
+// the exports bucket, returning its object key and the number of clips.
+func (h handler) pack(job Job) (string, int, error) {
+	clips, err := h.clips(job)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(clips) == 0 {
+		return "", 0, jobs.Permanent(errors.New("no clips to pack"))
+	}
+
+	src, err := h.download(job)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	object := path.Join("clip-packs", job.Key, job.Key+".zip")
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		contentType := "application/zip"
+		_, err := h.uploader.Upload(context.TODO(), &s3.PutObjectInput{
+			Bucket:      &h.exportsBucket,
+			Key:         &object,
+			Body:        pr,
+			ContentType: &contentType,
+		})
+		// Unblock the writer if the upload gave up early.
+		pr.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	last := time.Now()
+	err = h.writeZip(pw, src, job, clips, func(done int) {
+		if time.Since(last) < progressInterval {
+			return
+		}
+		last = time.Now()
+		h.publish(job, Event{Type: "progress", Status: "running", Done: done, Total: len(clips)})
+	})
+	pw.CloseWithError(err)
+	// A failed upload fails the writer with its own error, which is left
+	// unmarked so that it's retried.
+	if uerr := <-uploaded; err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return object, len(clips), nil
+}
+
+// download copies the job's sound to a temporary file, since each clip
+// opens its own decoder over it.
+func (h handler) download(job Job) (*os.File, error) {
+	obj, err := s3io.Open(context.TODO(), h.s3Cl, job.Bucket, job.Sound)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", "source-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(tmp, io.NewSectionReader(obj, 0, obj.Size())); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// writeZip writes one WAV per clip and then the manifest to w, calling
+// progress after each clip. Errors decoding or encoding the sound are
+// marked permanent.
+func (h handler) writeZip(w io.Writer, src *os.File, job Job, clips []Clip, progress func(done int)) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dec, err := audio.Open(src, info.Size())
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	in := dec.Format()
+	bitDepth := job.BitDepth
+	if bitDepth == 0 {
+		bitDepth = in.BitDepth
+		if in.Float || audio.Validate(audio.WAV, audio.Format{SampleRate: in.SampleRate, Channels: in.Channels, BitDepth: bitDepth}) != nil {
+			bitDepth = 24
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "clip-*.wav")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	manifest := Manifest{
+		Sound:      job.Sound,
+		SampleRate: in.SampleRate,
+		Channels:   in.Channels,
+		BitDepth:   bitDepth,
+		Clips:      []ManifestClip{},
+	}
+	zw := zip.NewWriter(w)
+	names := map[string]bool{}
+	now := time.Now()
+	rate := int64(in.SampleRate)
+
+	for i, clip := range clips {
+		start := timebase.Convert(clip.Start, clip.Hz, rate, timebase.Nearest)
+		end := timebase.Convert(clip.End, clip.Hz, rate, timebase.Nearest)
+
+		dec, err := audio.Open(src, info.Size())
+		if err != nil {
+			return jobs.Permanent(err)
+		}
+		if n := dec.Frames(); n >= 0 && end > n {
+			end = n
+		}
+		if end <= start {
+			manifest.Skipped = append(manifest.Skipped, SkippedClip{clip.Key, "clip is outside the sound"})
+			progress(i + 1)
+			continue
+		}
+		sec, err := audio.Section(dec, start, end)
+		if err != nil {
+			return jobs.Permanent(err)
+		}
+
+		if err := tmp.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := audio.Convert(tmp, sec, audio.WAV, in.SampleRate, bitDepth); err != nil {
+			return jobs.Permanent(fmt.Errorf("clip %s: %w", clip.Key, err))
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		name := entryName(i+1, clip, names)
+		// Audio barely deflates, so entries are stored as is.
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store,
+			Modified: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fw, tmp); err != nil {
+			return err
+		}
+
+		manifest.Clips = append(manifest.Clips, ManifestClip{
+			Key:        clip.Key,
+			File:       name,
+			Name:       clip.Name,
+			Colour:     clip.Colour,
+			Notes:      clip.Notes,
+			Labels:     clip.Labels,
+			Loop:       clip.Loop,
+			Start:      clip.Start,
+			End:        clip.End,
+			Hz:         clip.Hz,
+			StartFrame: start,
+			Frames:     end - start,
+		})
+		progress(i + 1)
+	}
+
+	b, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "manifest.json",
+		Method:   zip.Deflate,
+		Modified: now,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(b); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// clips loads the job's clips in the order they occur in the sound. Clips
+// without an owner belong to the sound's owner, which was checked when the
+// job was created. Clips trashed since then are left out.
+func (h handler) clips(job Job) ([]Clip, error) {
+	indexName := "soundIndex"
+	keyEx := expression.Key("sound").Equal(expression.Value(job.Sound))
+	filt := expression.Name("user").AttributeNotExists().
+		Or(expression.Name("user").Equal(expression.Value(job.User))).
+		And(expression.Name("trashedAt").AttributeNotExists())
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := map[string]bool{}
+	for _, k := range job.Clips {
+		selected[k] = true
+	}
+
+	var clips []Clip
+	p := dynamodb.NewQueryPaginator(h.dbCl, &dynamodb.QueryInput{
+		TableName:                 &h.clipsTbl,
+		IndexName:                 &indexName,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		var page []Clip
+		if err := attributevalue.UnmarshalListOfMaps(res.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, c := range page {
+			if c.Hz <= 0 {
+				continue
+			}
+			if len(selected) == 0 || selected[c.Key] {
+				clips = append(clips, c)
+			}
+		}
+	}
+
+	sort.Slice(clips, func(i, j int) bool {
+		a, b := clips[i], clips[j]
+		// Compare positions across timebases without rounding.
+		if l, r := a.Start*b.Hz, b.Start*a.Hz; l != r {
+			return l < r
+		}
+		return a.Key < b.Key
+	})
+	return clips, nil
+}
+
+// entryName names a clip's file after its position in the pack and its
+// name, keeping names unique within the zip.
+func entryName(n int, clip Clip, used map[string]bool) string {
+	label := clip.Name
+	if label == "" {
+		label = fmt.Sprintf("%.3f-%.3f", timebase.Seconds(clip.Start, clip.Hz), timebase.Seconds(clip.End, clip.Hz))
+	}
+	label = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\' || r == ':' || r < 0x20:
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(label))
+
+	name := fmt.Sprintf("%03d %s.wav", n, label)
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%03d %s (%d).wav", n, label, i)
+	}
+	used[name] = true
+	return name
+}
+
+// publish sends a job event to its websocket topic. Events are best effort;
+// clients can always poll GET /jobs/{jobId}.
+func (h handler) publish(job Job, e Event) {
+	if job.Topic == "" || h.topicArn == "" {
+		return
+	}
+	e.Job = job.Key
+	b, err := json.Marshal(&Notification{Topic: job.Topic, Data: e})
+	if err != nil {
+		h.log.Err(err).Msg("Error marshalling job event")
+		return
+	}
+	msg := string(b)
+	if _, err := h.snsCl.Publish(context.TODO(), &sns.PublishInput{
+		Message:  &msg,
+		TopicArn: &h.topicArn,
+	}); err != nil {
+		h.log.Err(err).Str("job", job.Key).Msg("Error publishing job event")
+	}
+}
+
+// update sets the status of a job along with any extra string attributes.
+func (h handler) update(key, status string, attrs map[string]string) error {
+	err := jobs.Update(context.TODO(), h.dbCl, h.jobsTbl, key, status, attrs)
+	if err != nil {
+		h.log.Err(err).Str("job", key).Msg("Error updating job")
+	}
+	return err
+}
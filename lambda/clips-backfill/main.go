@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+)
+
+// margin is the time left for the last update to finish before the
+// invocation times out.
+const margin = 30 * time.Second
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+
+	invocationId := ksuid.New().String()
+	log := log.With().Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	h := handler{
+		dynamodb.NewFromConfig(cfg),
+		os.Getenv("CLIPS_TABLE_NAME"),
+		os.Getenv("UPLOADS_TABLE_NAME"),
+		&log,
+	}
+
+	lambda.Start(h.handler)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	clipsTbl   string
+	uploadsTbl string
+	log        *zerolog.Logger
+}
+
+// Progress is both the input and the output of a run. A run that stops
+// before the end of the table returns the key to carry on from, to be
+// passed back as the input of the next one.
+type Progress struct {
+	Key     string `json:"key,omitempty"`
+	Updated int    `json:"updated"`
+	Done    bool   `json:"done"`
+}
+
+// Clip is the part of a clips row the backfill reads.
+type Clip struct {
+	Key   string `dynamodbav:"key"`
+	Sound string `dynamodbav:"sound"`
+}
+
+// handler is invoked by hand to record the owner of clips saved before
+// clips had one, so they are listed by GET /clips. A clip belongs to the
+// owner of its sound. Clips that already have an owner are never changed,
+// so it is safe to run again, or alongside new clips being saved.
+func (h handler) handler(ctx context.Context, in Progress) (Progress, error) {
+	out := Progress{Key: in.Key, Updated: in.Updated}
+
+	filt := expression.AttributeNotExists(expression.Name("user"))
+	proj := expression.NamesList(expression.Name("key"), expression.Name("sound"))
+	expr, err := expression.NewBuilder().WithFilter(filt).WithProjection(proj).Build()
+	if err != nil {
+		return out, err
+	}
+	scan := &dynamodb.ScanInput{
+		TableName:                 &h.clipsTbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+	}
+	if in.Key != "" {
+		scan.ExclusiveStartKey = map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: in.Key},
+		}
+	}
+
+	// Clips of one sound tend to come together, and share its owner.
+	owners := map[string]string{}
+	deadline, _ := ctx.Deadline()
+	for {
+		res, err := h.dbCl.Scan(ctx, scan)
+		if err != nil {
+			return out, err
+		}
+		var clips []Clip
+		if err := attributevalue.UnmarshalListOfMaps(res.Items, &clips); err != nil {
+			return out, err
+		}
+		for _, c := range clips {
+			if time.Until(deadline) < margin {
+				// Carry on from the last clip finished.
+				h.log.Info().Int("updated", out.Updated).Str("key", out.Key).Msg("Out of time")
+				return out, nil
+			}
+			updated, err := h.backfill(ctx, c, owners)
+			if err != nil {
+				h.log.Error().Err(err).Str("clip", c.Key).Msg("Error backfilling clip")
+			}
+			if updated {
+				out.Updated++
+			}
+			out.Key = c.Key
+		}
+		if len(res.LastEvaluatedKey) == 0 {
+			break
+		}
+		scan.ExclusiveStartKey = res.LastEvaluatedKey
+		if k, ok := res.LastEvaluatedKey["key"].(*dynamodbTypes.AttributeValueMemberS); ok {
+			// Pages can be filtered down to nothing.
+			out.Key = k.Value
+		}
+	}
+
+	h.log.Info().Int("updated", out.Updated).Msg("Backfill done")
+	return Progress{Updated: out.Updated, Done: true}, nil
+}
+
+// backfill sets the clip's owner to its sound's, and reports whether it
+// did. Clips of sounds that no longer exist are left for the deletion
+// worker to sweep up.
+func (h handler) backfill(ctx context.Context, c Clip, owners map[string]string) (bool, error) {
+	if c.Sound == "" {
+		return false, nil
+	}
+	user, ok := owners[c.Sound]
+	if !ok {
+		var err error
+		if user, err = h.owner(ctx, c.Sound); err != nil {
+			return false, err
+		}
+		owners[c.Sound] = user
+	}
+	if user == "" {
+		h.log.Info().Str("clip", c.Key).Str("sound", c.Sound).Msg("Sound not found, skipping")
+		return false, nil
+	}
+
+	upd := expression.Set(expression.Name("user"), expression.Value(user))
+	// Don't bring back a clip deleted since the scan, or overwrite an
+	// owner recorded since.
+	cond := expression.AttributeExists(expression.Name("key")).
+		And(expression.AttributeNotExists(expression.Name("user")))
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		return false, err
+	}
+	_, err = h.dbCl.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &h.clipsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: c.Key},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		var ccf *dynamodbTypes.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// owner returns the user who uploaded the sound, or "" if it is gone. The
+// uploads table is keyed by the sound's key, so this is a single read.
+func (h handler) owner(ctx context.Context, sound string) (string, error) {
+	keyEx := expression.Key("key").Equal(expression.Value(sound))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return "", err
+	}
+	res, err := h.dbCl.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 &h.uploadsTbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	if err != nil || len(res.Items) == 0 {
+		return "", err
+	}
+	if u, ok := res.Items[0]["user"].(*dynamodbTypes.AttributeValueMemberS); ok {
+		return u.Value, nil
+	}
+	return "", nil
+}
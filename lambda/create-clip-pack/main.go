@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+)
+
+// maxClips bounds the number of clips selected by one request.
+const maxClips = 1000
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	sqsCl := sqs.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+	jobsTbl := os.Getenv("JOBS_TABLE_NAME")
+	queueUrl := os.Getenv("QUEUE_URL")
+
+	h := handler{dbCl, sqsCl, formatsTbl, clipsTbl, jobsTbl, queueUrl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	sqsCl      *sqs.Client
+	formatsTbl string
+	clipsTbl   string
+	jobsTbl    string
+	queueUrl   string
+	log        *zerolog.Logger
+}
+
+// PackRequest is the body of POST /sounds/{soundId}/clip-pack. Without
+// clips every clip of the sound is packed. A zero bitDepth keeps the source
+// depth where WAV allows it.
+type PackRequest struct {
+	Clips    []string `json:"clips"`
+	BitDepth int      `json:"bitDepth"`
+}
+
+type Sound struct {
+	Key      string `dynamodbav:"key"`
+	Bucket   string `dynamodbav:"bucket"`
+	Filename string `dynamodbav:"filename"`
+}
+
+// Job is the response. Progress events for the job are published to Topic,
+// which clients subscribe to over the websocket API.
+type Job struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Topic  string `json:"topic"`
+}
+
+// Message is the clip pack queue message body.
+type Message struct {
+	Job string `json:"job"`
+}
+
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	soundId := event.PathParameters["soundId"]
+	if soundId == "" {
+		h.log.Error().Msgf("Cannot get soundid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	var req PackRequest
+	if event.Body != "" {
+		if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+			h.log.Error().Err(err).Msg("Error unmarshalling request body")
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "Bad Request",
+			}, nil
+		}
+	}
+	switch req.BitDepth {
+	case 0, 16, 24, 32:
+	default:
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "bitDepth must be 16, 24 or 32",
+		}, nil
+	}
+	if len(req.Clips) > maxClips {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "at most " + strconv.Itoa(maxClips) + " clips can be packed",
+		}, nil
+	}
+
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if res.Item == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	var sound Sound
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	keys, err := h.clipKeys(soundId, user)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error querying clips")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	var selected []string
+	seen := map[string]bool{}
+	for _, k := range req.Clips {
+		if !keys[k] {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusUnprocessableEntity,
+				Body:       "clip " + k + " is not a clip of this sound",
+			}, nil
+		}
+		if !seen[k] {
+			seen[k] = true
+			selected = append(selected, k)
+		}
+	}
+	if len(keys) == 0 {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusUnprocessableEntity,
+			Body:       "sound has no clips",
+		}, nil
+	}
+
+	job := Job{Key: ksuid.New().String(), Status: "pending"}
+	job.Topic = "jobs/" + job.Key
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	item := map[string]dynamodbTypes.AttributeValue{
+		"key": &dynamodbTypes.AttributeValueMemberS{
+			Value: job.Key,
+		},
+		"user": &dynamodbTypes.AttributeValueMemberS{
+			Value: user,
+		},
+		"type": &dynamodbTypes.AttributeValueMemberS{
+			Value: "clip-pack",
+		},
+		"status": &dynamodbTypes.AttributeValueMemberS{
+			Value: job.Status,
+		},
+		"sound": &dynamodbTypes.AttributeValueMemberS{
+			Value: soundId,
+		},
+		"bucket": &dynamodbTypes.AttributeValueMemberS{
+			Value: sound.Bucket,
+		},
+		"format": &dynamodbTypes.AttributeValueMemberS{
+			Value: "zip",
+		},
+		"bitDepth": &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.Itoa(req.BitDepth),
+		},
+		"filename": &dynamodbTypes.AttributeValueMemberS{
+			Value: packFilename(sound.Filename, soundId),
+		},
+		"topic": &dynamodbTypes.AttributeValueMemberS{
+			Value: job.Topic,
+		},
+		"createdAt": &dynamodbTypes.AttributeValueMemberN{
+			Value: now,
+		},
+		"updatedAt": &dynamodbTypes.AttributeValueMemberN{
+			Value: now,
+		},
+	}
+	if len(selected) > 0 {
+		item["clips"] = &dynamodbTypes.AttributeValueMemberSS{
+			Value: selected,
+		}
+	}
+
+	if _, err := h.dbCl.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: &h.jobsTbl,
+		Item:      item,
+	}); err != nil {
+		h.log.Error().Err(err).Msg("Error putting job to DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	msg, err := json.Marshal(&Message{Job: job.Key})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling queue message")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	body := string(msg)
+	if _, err := h.sqsCl.SendMessage(context.TODO(), &sqs.SendMessageInput{
+		QueueUrl:    &h.queueUrl,
+		MessageBody: &body,
+	}); err != nil {
+		h.log.Error().Err(err).Msg("Error queueing clip pack job")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	h.log.Info().Str("job", job.Key).Msg("Queued clip pack job")
+
+	b, err := json.Marshal(&job)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusAccepted,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// clipKeys returns the keys of the user's untrashed clips of a sound. Clips
+// without an owner belong to the sound's owner, who has already been checked.
+func (h handler) clipKeys(soundId, user string) (map[string]bool, error) {
+	indexName := "soundIndex"
+	keyEx := expression.Key("sound").Equal(expression.Value(soundId))
+	filt := expression.Name("user").AttributeNotExists().
+		Or(expression.Name("user").Equal(expression.Value(user))).
+		And(expression.Name("trashedAt").AttributeNotExists())
+	proj := expression.NamesList(expression.Name("key"))
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(keyEx).
+		WithFilter(filt).
+		WithProjection(proj).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	p := dynamodb.NewQueryPaginator(h.dbCl, &dynamodb.QueryInput{
+		TableName:                 &h.clipsTbl,
+		IndexName:                 &indexName,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range res.Items {
+			if k, ok := item["key"].(*dynamodbTypes.AttributeValueMemberS); ok {
+				keys[k.Value] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+// packFilename names the zip after the original upload.
+func packFilename(filename, key string) string {
+	if filename == "" {
+		filename = key
+	}
+	return strings.TrimSuffix(filename, path.Ext(filename)) + " clips.zip"
+}
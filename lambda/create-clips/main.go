@@ -3,18 +3,31 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/clips"
+	"wavey.ai/pkg/idempotency"
+)
+
+const (
+	// maxClips bounds the number of clips created by one request.
+	maxClips = 1000
+	// maxTransactItems is the DynamoDB limit on items in one transaction.
+	maxTransactItems = 100
 )
 
 func main() {
@@ -30,24 +43,47 @@ func main() {
 
 	dbCl := dynamodb.NewFromConfig(cfg)
 	tableName := os.Getenv("TABLE_NAME")
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	idem := idempotency.New(dbCl, os.Getenv("IDEMPOTENCY_TABLE_NAME"))
 
-	h := handler{dbCl, tableName, &log}
+	h := handler{dbCl, tableName, formatsTbl, idem, &log}
 
 	lambda.Start(h.handleRequest)
 }
 
 type handler struct {
-	dbCl      *dynamodb.Client
-	tableName string
-	log       *zerolog.Logger
+	dbCl       *dynamodb.Client
+	tableName  string
+	formatsTbl string
+	idem       *idempotency.Store
+	log        *zerolog.Logger
 }
 
 type Clip struct {
-	Key   string `json:"key"`
-	Sound string `json:"sound"`
-	Start int    `json:"start"`
-	End   int    `json:"end"`
-	Hz    int    `json:"hz"`
+	Key     string   `json:"key"`
+	Sound   string   `json:"sound"`
+	Start   int64    `json:"start"`
+	End     int64    `json:"end"`
+	Hz      int64    `json:"hz"`
+	Name    string   `json:"name,omitempty"`
+	Colour  string   `json:"colour,omitempty"`
+	Notes   string   `json:"notes,omitempty"`
+	Labels  []string `json:"labels,omitempty"`
+	Loop    bool     `json:"loop,omitempty"`
+	Version int64    `json:"version"`
+}
+
+// ClipError describes why a clip in the request was rejected. Index is the
+// clip's position in the request body.
+type ClipError struct {
+	Index   int    `json:"index"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Message string      `json:"message"`
+	Errors  []ClipError `json:"errors,omitempty"`
 }
 
 func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
@@ -61,7 +97,7 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 	}
 
 	if !ok {
-		h.log.Fatal().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer)
 		return events.APIGatewayV2HTTPResponse{
 			StatusCode: http.StatusInternalServerError,
 		}, nil
@@ -69,53 +105,169 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 
 	h.log.Info().Msgf("Got user %s from claims", user)
 
+	idemKey := event.Headers[idempotency.Header]
+	if len(idemKey) > idempotency.MaxKeyLength {
+		return h.errorResponse(http.StatusBadRequest, ErrorResponse{
+			Message: fmt.Sprintf("Idempotency-Key must be at most %d characters", idempotency.MaxKeyLength),
+		}), nil
+	}
+
 	var clips []Clip
 
 	if err := json.Unmarshal([]byte(event.Body), &clips); err != nil {
-		h.log.Fatal().Err(err).Msg("Error unmarshalling request body")
+		h.log.Error().Err(err).Msg("Error unmarshalling request body")
+		return h.errorResponse(http.StatusBadRequest, ErrorResponse{
+			Message: "Request body must be a JSON array of clips",
+		}), nil
+	}
+	if len(clips) > maxClips {
+		return h.errorResponse(http.StatusBadRequest, ErrorResponse{
+			Message: fmt.Sprintf("At most %d clips can be created at once", maxClips),
+		}), nil
+	}
+
+	// Keys are scoped to the caller and endpoint so they can't collide
+	// across users.
+	scope := user + "#create-clips"
+	var claim *idempotency.Claim
+	if idemKey != "" {
+		var prev *idempotency.Response
+		var err error
+		claim, prev, err = h.idem.Begin(context.TODO(), scope, idemKey, []byte(event.Body))
+		switch {
+		case errors.Is(err, idempotency.ErrMismatch):
+			return h.errorResponse(http.StatusUnprocessableEntity, ErrorResponse{
+				Message: "Idempotency-Key was already used with a different request",
+			}), nil
+		case errors.Is(err, idempotency.ErrInProgress):
+			return h.errorResponse(http.StatusConflict, ErrorResponse{
+				Message: "A request with this Idempotency-Key is in progress",
+			}), nil
+		case err != nil:
+			h.log.Error().Err(err).Msg("Error claiming idempotency key")
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusInternalServerError,
+			}, nil
+		case prev != nil:
+			h.log.Info().Str("idempotencyKey", idemKey).Msg("Replaying stored response")
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: prev.StatusCode,
+				Body:       prev.Body,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+			}, nil
+		}
+	}
+
+	// Validated only once the key is claimed, so a replay returns the
+	// stored response even if the clips' sounds have changed since. The
+	// claim is released on failure so that a retry validates again.
+	errs, err := h.validate(user, clips)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sounds from DynamoDB")
+		h.abort(claim)
 		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusBadRequest,
+			StatusCode: http.StatusInternalServerError,
 		}, nil
 	}
+	if len(errs) > 0 {
+		h.log.Info().Msgf("Rejected %d of %d clips", len(errs), len(clips))
+		h.abort(claim)
+		return h.errorResponse(http.StatusUnprocessableEntity, ErrorResponse{
+			Message: "Invalid clips",
+			Errors:  errs,
+		}), nil
+	}
 
+	items := make([]map[string]dynamodbTypes.AttributeValue, len(clips))
 	for i, clip := range clips {
 		id := ksuid.New().String()
-		clip.Key = id
 
-		input := &dynamodb.PutItemInput{
-			TableName: &h.tableName,
-			Item: map[string]dynamodbTypes.AttributeValue{
-				"sound": &dynamodbTypes.AttributeValueMemberS{
-					Value: clip.Sound,
-				},
-				"key": &dynamodbTypes.AttributeValueMemberS{
-					Value: id,
-				},
-				"start": &dynamodbTypes.AttributeValueMemberN{
-					Value: strconv.Itoa(clip.Start),
-				},
-				"end": &dynamodbTypes.AttributeValueMemberN{
-					Value: strconv.Itoa(clip.End),
-				},
-				"hz": &dynamodbTypes.AttributeValueMemberN{
-					Value: strconv.Itoa(clip.Hz),
-				},
+		items[i] = map[string]dynamodbTypes.AttributeValue{
+			"sound": &dynamodbTypes.AttributeValueMemberS{
+				Value: clip.Sound,
+			},
+			"key": &dynamodbTypes.AttributeValueMemberS{
+				Value: id,
+			},
+			"user": &dynamodbTypes.AttributeValueMemberS{
+				Value: user,
+			},
+			"start": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.FormatInt(clip.Start, 10),
+			},
+			"end": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.FormatInt(clip.End, 10),
+			},
+			"hz": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.FormatInt(clip.Hz, 10),
+			},
+			"version": &dynamodbTypes.AttributeValueMemberN{
+				Value: "1",
+			},
+			"loop": &dynamodbTypes.AttributeValueMemberBOOL{
+				Value: clip.Loop,
 			},
 		}
+		if clip.Name != "" {
+			items[i]["name"] = &dynamodbTypes.AttributeValueMemberS{
+				Value: clip.Name,
+			}
+		}
+		if clip.Colour != "" {
+			items[i]["colour"] = &dynamodbTypes.AttributeValueMemberS{
+				Value: clip.Colour,
+			}
+		}
+		if clip.Notes != "" {
+			items[i]["notes"] = &dynamodbTypes.AttributeValueMemberS{
+				Value: clip.Notes,
+			}
+		}
+		if len(clip.Labels) > 0 {
+			labels := make([]dynamodbTypes.AttributeValue, len(clip.Labels))
+			for j, l := range clip.Labels {
+				labels[j] = &dynamodbTypes.AttributeValueMemberS{Value: l}
+			}
+			items[i]["labels"] = &dynamodbTypes.AttributeValueMemberL{
+				Value: labels,
+			}
+		}
 
 		clips[i].Key = id
+		clips[i].Version = 1
+	}
+
+	b, err := json.Marshal(&clips)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshalling clip")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
 
-		if _, err := h.dbCl.PutItem(context.TODO(), input); err != nil {
-			h.log.Fatal().Err(err).Msg("Error putting to DynamoDB")
+	// The response is stored in the same transaction as the last of the
+	// clips, so a retry either finds it or does the work again.
+	var done *dynamodbTypes.TransactWriteItem
+	if claim != nil {
+		item, err := h.idem.CompleteItem(claim, idempotency.Response{StatusCode: http.StatusOK, Body: string(b)})
+		if err != nil {
+			h.log.Error().Err(err).Msg("Error building idempotent response")
 			return events.APIGatewayV2HTTPResponse{
 				StatusCode: http.StatusInternalServerError,
 			}, nil
 		}
+		done = &item
 	}
 
-	b, err := json.Marshal(&clips)
-	if err != nil {
-		h.log.Fatal().Err(err).Msg("Error marshalling clip")
+	if err := h.putAll(items, done); err != nil {
+		if errors.Is(err, idempotency.ErrLeaseLost) {
+			// Took too long; a retry holds the key now and does the work.
+			return h.errorResponse(http.StatusConflict, ErrorResponse{
+				Message: "A request with this Idempotency-Key is in progress",
+			}), nil
+		}
+		h.log.Error().Err(err).Msg("Error putting to DynamoDB")
+		h.abort(claim)
 		return events.APIGatewayV2HTTPResponse{
 			StatusCode: http.StatusInternalServerError,
 		}, nil
@@ -127,3 +279,183 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 		Headers:    map[string]string{"Content-Type": "application/json"},
 	}, nil
 }
+
+// abort releases claim, if there is one, so that a retry with its key does
+// the work again.
+func (h handler) abort(claim *idempotency.Claim) {
+	if claim == nil {
+		return
+	}
+	if err := h.idem.Abort(context.TODO(), claim); err != nil {
+		h.log.Error().Err(err).Msg("Error releasing idempotency key")
+	}
+}
+
+// validate checks every clip and returns one error per problem found. Clips
+// must refer to one of the user's sounds and lie within it. Colours and
+// labels are normalised in place.
+func (h handler) validate(user string, cs []Clip) ([]ClipError, error) {
+	sounds := map[string]*clips.Sound{}
+	var errs []ClipError
+
+	for i, clip := range cs {
+		cs[i].Colour = clips.Colour(clip.Colour)
+		cs[i].Labels = clips.Labels(clip.Labels)
+		for _, e := range clips.CheckMeta(clip.Name, cs[i].Colour, clip.Notes, cs[i].Labels) {
+			errs = append(errs, ClipError{Index: i, Field: e.Field, Message: e.Message})
+		}
+
+		if clip.Sound == "" {
+			errs = append(errs, ClipError{Index: i, Field: "sound", Message: "sound is required"})
+			continue
+		}
+
+		sound, seen := sounds[clip.Sound]
+		if !seen {
+			var err error
+			if sound, err = h.getSound(user, clip.Sound); err != nil {
+				return nil, err
+			}
+			sounds[clip.Sound] = sound
+		}
+		if sound == nil {
+			// Other users' sounds are indistinguishable from missing ones.
+			errs = append(errs, ClipError{Index: i, Field: "sound", Message: fmt.Sprintf("sound %s not found", clip.Sound)})
+			continue
+		}
+
+		for _, e := range clips.CheckRange(clip.Start, clip.End, clip.Hz, sound) {
+			errs = append(errs, ClipError{Index: i, Field: e.Field, Message: e.Message})
+		}
+	}
+
+	return errs, nil
+}
+
+// putAll writes items in transactions of up to maxTransactItems, adding
+// last, if any, to the final one. If a later transaction fails, the items
+// already written are deleted again so the request has no effect. It
+// returns idempotency.ErrLeaseLost if last was an idempotent response
+// whose lease ran out.
+func (h handler) putAll(items []map[string]dynamodbTypes.AttributeValue, last *dynamodbTypes.TransactWriteItem) error {
+	cond := "attribute_not_exists(#key)"
+	names := map[string]string{"#key": "key"}
+
+	if len(items) == 0 && last != nil {
+		_, err := h.dbCl.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+			TransactItems: []dynamodbTypes.TransactWriteItem{*last},
+		})
+		var tce *dynamodbTypes.TransactionCanceledException
+		if errors.As(err, &tce) {
+			return idempotency.ErrLeaseLost
+		}
+		return err
+	}
+
+	for i, end := 0, 0; i < len(items); i = end {
+		end = i + maxTransactItems
+		if end > len(items) {
+			end = len(items)
+		}
+		// Leave room for last in the final transaction.
+		if last != nil && end == len(items) && end-i == maxTransactItems {
+			end--
+		}
+		final := end == len(items)
+
+		tx := make([]dynamodbTypes.TransactWriteItem, 0, end-i+1)
+		for _, item := range items[i:end] {
+			tx = append(tx, dynamodbTypes.TransactWriteItem{
+				Put: &dynamodbTypes.Put{
+					TableName:                &h.tableName,
+					Item:                     item,
+					ConditionExpression:      &cond,
+					ExpressionAttributeNames: names,
+				},
+			})
+		}
+		if final && last != nil {
+			tx = append(tx, *last)
+		}
+
+		_, err := h.dbCl.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+			TransactItems: tx,
+		})
+		if err != nil {
+			h.rollback(items[:i])
+			var tce *dynamodbTypes.TransactionCanceledException
+			if final && last != nil && errors.As(err, &tce) && len(tce.CancellationReasons) == len(tx) &&
+				aws.ToString(tce.CancellationReasons[len(tx)-1].Code) == "ConditionalCheckFailed" {
+				return idempotency.ErrLeaseLost
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback deletes items written by an earlier transaction of putAll.
+func (h handler) rollback(items []map[string]dynamodbTypes.AttributeValue) {
+	for i := 0; i < len(items); i += maxTransactItems {
+		end := i + maxTransactItems
+		if end > len(items) {
+			end = len(items)
+		}
+
+		tx := make([]dynamodbTypes.TransactWriteItem, 0, end-i)
+		for _, item := range items[i:end] {
+			tx = append(tx, dynamodbTypes.TransactWriteItem{
+				Delete: &dynamodbTypes.Delete{
+					TableName: &h.tableName,
+					Key: map[string]dynamodbTypes.AttributeValue{
+						"key": item["key"],
+					},
+				},
+			})
+		}
+
+		if _, err := h.dbCl.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+			TransactItems: tx,
+		}); err != nil {
+			h.log.Error().Err(err).Msgf("Error rolling back %d clips", end-i)
+		}
+	}
+}
+
+// getSound returns the user's sound, or nil if they have no such sound or
+// it is being deleted.
+func (h handler) getSound(user, key string) (*clips.Sound, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var sound clips.Sound
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		return nil, err
+	}
+	if sound.Deleting != "" || sound.TrashedAt != 0 {
+		return nil, nil
+	}
+	return &sound, nil
+}
+
+func (h handler) errorResponse(status int, body ErrorResponse) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(&body)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshalling error response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: status,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
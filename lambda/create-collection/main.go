@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/collections"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	store := collections.New(dynamodb.NewFromConfig(cfg), os.Getenv("COLLECTIONS_TABLE_NAME"),
+		os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("CLIPS_TABLE_NAME"))
+
+	h := handler{store, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	store *collections.Store
+	log   *zerolog.Logger
+}
+
+// Request is the body of POST /collections.
+type Request struct {
+	Name  string             `json:"name"`
+	Items []collections.Item `json:"items"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+	// Missing are the items that can't be added.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// POST /collections creates a collection from {"name": ..., "items":
+// [{"kind": "sound" | "clip", "key": ...}]}, with the items in the order
+// given. Items are optional. Items that aren't the user's, or are in the
+// trash, are a 422 listing them. The collection is returned with a 201.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	var req Request
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+		return h.respond(http.StatusBadRequest, &ErrorResponse{
+			Message: "Invalid JSON body",
+		}), nil
+	}
+	name, err := collections.NormalizeName(req.Name)
+	if err != nil {
+		return h.respond(http.StatusUnprocessableEntity, &ErrorResponse{
+			Message: err.Error(),
+		}), nil
+	}
+
+	missing, err := h.store.Check(ctx, user, req.Items)
+	if errors.Is(err, collections.ErrKind) {
+		return h.respond(http.StatusUnprocessableEntity, &ErrorResponse{
+			Message: err.Error(),
+		}), nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error checking items")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if len(missing) > 0 {
+		return h.respond(http.StatusUnprocessableEntity, &ErrorResponse{
+			Message: "Some items can't be added",
+			Missing: missing,
+		}), nil
+	}
+
+	c, err := h.store.Create(ctx, user, name, req.Items)
+	if errors.Is(err, collections.ErrTooMany) {
+		return h.respond(http.StatusUnprocessableEntity, &ErrorResponse{
+			Message: err.Error(),
+		}), nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error creating collection")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	h.log.Info().Str("collection", c.Key).Msgf("Created collection of %d items", len(c.Items))
+
+	v, err := h.store.View(ctx, user, c)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error resolving collection items")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	return h.respond(http.StatusCreated, v), nil
+}
+
+// respond writes v as the JSON body of a response with the given status.
+func (h handler) respond(status int, v interface{}) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(v)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
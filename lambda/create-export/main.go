@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/audio"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	sqsCl := sqs.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	jobsTbl := os.Getenv("JOBS_TABLE_NAME")
+	queueUrl := os.Getenv("QUEUE_URL")
+
+	h := handler{dbCl, sqsCl, formatsTbl, jobsTbl, queueUrl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	sqsCl      *sqs.Client
+	formatsTbl string
+	jobsTbl    string
+	queueUrl   string
+	log        *zerolog.Logger
+}
+
+// ExportRequest is the body of POST /sounds/{soundId}/export. A zero
+// sampleRate keeps the original rate and a zero bitDepth keeps the original
+// depth where the format allows it. Markers embeds the sound's clips as cue
+// points, regions and loops, and is only supported for WAV.
+type ExportRequest struct {
+	Format     string `json:"format"`
+	SampleRate int    `json:"sampleRate"`
+	BitDepth   int    `json:"bitDepth"`
+	Markers    bool   `json:"markers"`
+}
+
+type Sound struct {
+	User     string `dynamodbav:"user"`
+	Key      string `dynamodbav:"key"`
+	Bucket   string `dynamodbav:"bucket"`
+	Filename string `dynamodbav:"filename"`
+}
+
+type Job struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+}
+
+// Message is the export queue message body.
+type Message struct {
+	Job string `json:"job"`
+}
+
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	soundId := event.PathParameters["soundId"]
+	if soundId == "" {
+		h.log.Error().Msgf("Cannot get soundid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	var req ExportRequest
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshalling request body")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	container := audio.Container(strings.ToLower(req.Format))
+	if err := validate(container, req.SampleRate, req.BitDepth); err != nil {
+		h.log.Info().Err(err).Msg("Invalid export request")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+	if req.Markers && container != audio.WAV {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "markers can only be embedded in wav exports",
+		}, nil
+	}
+
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if res.Item == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	var sound Sound
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	job := Job{Key: ksuid.New().String(), Status: "pending"}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	input := &dynamodb.PutItemInput{
+		TableName: &h.jobsTbl,
+		Item: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{
+				Value: job.Key,
+			},
+			"user": &dynamodbTypes.AttributeValueMemberS{
+				Value: user,
+			},
+			"type": &dynamodbTypes.AttributeValueMemberS{
+				Value: "export",
+			},
+			"status": &dynamodbTypes.AttributeValueMemberS{
+				Value: job.Status,
+			},
+			"sound": &dynamodbTypes.AttributeValueMemberS{
+				Value: soundId,
+			},
+			"bucket": &dynamodbTypes.AttributeValueMemberS{
+				Value: sound.Bucket,
+			},
+			"format": &dynamodbTypes.AttributeValueMemberS{
+				Value: string(container),
+			},
+			"sampleRate": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.Itoa(req.SampleRate),
+			},
+			"bitDepth": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.Itoa(req.BitDepth),
+			},
+			"filename": &dynamodbTypes.AttributeValueMemberS{
+				Value: exportFilename(sound.Filename, soundId, container),
+			},
+			"markers": &dynamodbTypes.AttributeValueMemberBOOL{
+				Value: req.Markers,
+			},
+			"createdAt": &dynamodbTypes.AttributeValueMemberN{
+				Value: now,
+			},
+			"updatedAt": &dynamodbTypes.AttributeValueMemberN{
+				Value: now,
+			},
+		},
+	}
+
+	if _, err := h.dbCl.PutItem(context.TODO(), input); err != nil {
+		h.log.Error().Err(err).Msg("Error putting job to DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	msg, err := json.Marshal(&Message{Job: job.Key})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling queue message")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	body := string(msg)
+	if _, err := h.sqsCl.SendMessage(context.TODO(), &sqs.SendMessageInput{
+		QueueUrl:    &h.queueUrl,
+		MessageBody: &body,
+	}); err != nil {
+		h.log.Error().Err(err).Msg("Error queueing export job")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	h.log.Info().Str("job", job.Key).Msg("Queued export job")
+
+	b, err := json.Marshal(&job)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusAccepted,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// validate checks the requested output against what the encoders support.
+// Zero values are resolved against the source by the worker, so stand-ins
+// are checked here.
+func validate(c audio.Container, sampleRate, bitDepth int) error {
+	f := audio.Format{SampleRate: sampleRate, Channels: 1, BitDepth: bitDepth}
+	if f.SampleRate == 0 {
+		f.SampleRate = 48000
+	}
+	if f.BitDepth == 0 {
+		f.BitDepth = 24
+	}
+	return audio.Validate(c, f)
+}
+
+// exportFilename swaps the extension of the original filename for the
+// export format's.
+func exportFilename(filename, key string, c audio.Container) string {
+	if filename == "" {
+		filename = key
+	}
+	return strings.TrimSuffix(filename, path.Ext(filename)) + c.Ext()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/share"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	signer, err := share.NewSigner(os.Getenv("SHARE_SECRET"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading share secret")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	sharesTbl := os.Getenv("SHARES_TABLE_NAME")
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+
+	h := handler{dbCl, signer, sharesTbl, clipsTbl, formatsTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	signer     *share.Signer
+	sharesTbl  string
+	clipsTbl   string
+	formatsTbl string
+	log        *zerolog.Logger
+}
+
+// ShareRequest is the body of POST /shares. Leaving out clip shares the
+// whole sound. ExpiresIn is in seconds and defaults to share.DefaultTTL.
+type ShareRequest struct {
+	Sound     string `json:"sound"`
+	Clip      string `json:"clip"`
+	ExpiresIn int64  `json:"expiresIn"`
+}
+
+type Share struct {
+	Key       string `json:"key"`
+	Token     string `json:"token"`
+	Type      string `json:"type"`
+	Sound     string `json:"sound"`
+	Clip      string `json:"clip,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+type Clip struct {
+	Key   string `dynamodbav:"key"`
+	Sound string `dynamodbav:"sound"`
+	User  string `dynamodbav:"user"`
+}
+
+// POST /shares mints a link to one of the user's sounds or clips that works
+// without signing in, until it expires or is revoked.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	var req ShareRequest
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil || req.Sound == "" {
+		h.log.Info().Err(err).Msg("Invalid share request")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	ttl := share.DefaultTTL
+	if req.ExpiresIn != 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+		if req.ExpiresIn < 60 || ttl > share.MaxTTL {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "expiresIn must be between 60 and " + strconv.FormatInt(int64(share.MaxTTL/time.Second), 10) + " seconds",
+			}, nil
+		}
+	}
+
+	found, err := h.owns(user, req.Sound, req.Clip)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if !found {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	now := time.Now()
+	expires := now.Add(ttl).Truncate(time.Second)
+	s := Share{
+		Key:       ksuid.New().String(),
+		Type:      "sound",
+		Sound:     req.Sound,
+		Clip:      req.Clip,
+		CreatedAt: now.Unix(),
+		ExpiresAt: expires.Unix(),
+	}
+	if s.Clip != "" {
+		s.Type = "clip"
+	}
+	s.Token = h.signer.Sign(share.Token{ID: s.Key, Expires: expires})
+
+	item := map[string]dynamodbTypes.AttributeValue{
+		"key": &dynamodbTypes.AttributeValueMemberS{
+			Value: s.Key,
+		},
+		"user": &dynamodbTypes.AttributeValueMemberS{
+			Value: user,
+		},
+		"type": &dynamodbTypes.AttributeValueMemberS{
+			Value: s.Type,
+		},
+		"sound": &dynamodbTypes.AttributeValueMemberS{
+			Value: s.Sound,
+		},
+		"accessCount": &dynamodbTypes.AttributeValueMemberN{
+			Value: "0",
+		},
+		"createdAt": &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.FormatInt(s.CreatedAt, 10),
+		},
+		"expiresAt": &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.FormatInt(s.ExpiresAt, 10),
+		},
+	}
+	if s.Clip != "" {
+		item["clip"] = &dynamodbTypes.AttributeValueMemberS{
+			Value: s.Clip,
+		}
+	}
+
+	if _, err := h.dbCl.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: &h.sharesTbl,
+		Item:      item,
+	}); err != nil {
+		h.log.Error().Err(err).Msg("Error putting share to DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	h.log.Info().Str("share", s.Key).Str("sound", s.Sound).Str("clip", s.Clip).Msg("Created share")
+
+	b, err := json.Marshal(&s)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusCreated,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// owns reports whether the user has the sound and, if clipId is set, whether
+// the clip is theirs and belongs to it. Clips saved before clips had owners
+// belong to the sound's owner.
+func (h handler) owns(user, soundId, clipId string) (bool, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+	})
+	if err != nil || res.Item == nil || clipId == "" {
+		return err == nil && res.Item != nil, err
+	}
+
+	res, err = h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.clipsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: clipId},
+		},
+	})
+	if err != nil || res.Item == nil {
+		return false, err
+	}
+	var clip Clip
+	if err := attributevalue.UnmarshalMap(res.Item, &clip); err != nil {
+		return false, err
+	}
+	return clip.Sound == soundId && (clip.User == "" || clip.User == user), nil
+}
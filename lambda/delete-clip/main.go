@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/clips"
+	"wavey.ai/pkg/collections"
+	"wavey.ai/pkg/tagging"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	tableName := os.Getenv("TABLE_NAME")
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	tagger := tagging.New(dbCl, os.Getenv("TAGS_TABLE_NAME"), os.Getenv("TAGGINGS_TABLE_NAME"), formatsTbl, tableName)
+	colls := collections.New(dbCl, os.Getenv("COLLECTIONS_TABLE_NAME"), formatsTbl, tableName)
+
+	h := handler{dbCl, tableName, formatsTbl, tagger, colls, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	tableName  string
+	formatsTbl string
+	tagger     *tagging.Tagger
+	colls      *collections.Store
+	log        *zerolog.Logger
+}
+
+type Item struct {
+	Key     string   `json:"key" dynamodbav:"key"`
+	Sound   string   `json:"sound" dynamodbav:"sound"`
+	User    string   `json:"-" dynamodbav:"user"`
+	Start   int64    `json:"start" dynamodbav:"start"`
+	End     int64    `json:"end" dynamodbav:"end"`
+	Hz      int64    `json:"hz" dynamodbav:"hz"`
+	Name    string   `json:"name,omitempty" dynamodbav:"name"`
+	Colour  string   `json:"colour,omitempty" dynamodbav:"colour"`
+	Notes   string   `json:"notes,omitempty" dynamodbav:"notes"`
+	Labels  []string `json:"labels,omitempty" dynamodbav:"labels"`
+	Loop    bool     `json:"loop,omitempty" dynamodbav:"loop"`
+	Version int64    `json:"version" dynamodbav:"version"`
+	// TrashedAt is set while the clip is in the trash.
+	TrashedAt int64 `json:"-" dynamodbav:"trashedAt"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+	// Current is the stored clip when a delete lost a race.
+	Current *Item `json:"current,omitempty"`
+}
+
+// DELETE /clips/{clipId}?version=N moves a clip to the trash if it is still
+// at the version the client last read. With permanent=true the clip is
+// removed for good instead, whether or not it is in the trash.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	clipId := event.PathParameters["clipId"]
+	if clipId == "" {
+		h.log.Error().Msgf("Cannot get clipid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	version, err := strconv.ParseInt(event.QueryStringParameters["version"], 10, 64)
+	if err != nil || version < 0 {
+		return h.errorResponse(http.StatusBadRequest, ErrorResponse{
+			Message: "version is required",
+		}), nil
+	}
+
+	clip, err := h.load(clipId, user)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting clip from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	permanent := event.QueryStringParameters["permanent"] == "true"
+	if clip == nil || clip.TrashedAt != 0 && !permanent {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	if clip.Version != version {
+		return h.errorResponse(http.StatusConflict, ErrorResponse{
+			Message: "Clip has been changed since it was read",
+			Current: clip,
+		}), nil
+	}
+
+	if permanent {
+		err = h.delete(clipId, version)
+	} else {
+		err = h.trash(clipId, user, version)
+	}
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		h.log.Info().Str("clip", clipId).Msg("Lost delete race")
+		current, _ := h.load(clipId, user)
+		return h.errorResponse(http.StatusConflict, ErrorResponse{
+			Message: "Clip has been changed since it was read",
+			Current: current,
+		}), nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error deleting clip")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	h.log.Info().Str("clip", clipId).Bool("permanent", permanent).Msg("Deleted clip")
+
+	if permanent {
+		// Taggings left behind are dropped by the next rename or delete of
+		// the tag, so failing here doesn't fail the request.
+		if err := h.tagger.Untag(ctx, clipId); err != nil {
+			h.log.Error().Err(err).Msg("Error untagging clip")
+		}
+		// Collections leave out items that are gone, so this can fail too.
+		if err := h.colls.RemoveEverywhere(ctx, user, clipId); err != nil {
+			h.log.Error().Err(err).Msg("Error removing clip from collections")
+		}
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusNoContent,
+	}, nil
+}
+
+// delete removes the clip if it is still at version.
+func (h handler) delete(clipId string, version int64) error {
+	expr, err := expression.NewBuilder().WithCondition(clips.VersionCondition(version)).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = h.dbCl.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: &h.tableName,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: clipId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+	})
+	return err
+}
+
+// trash moves the clip to the trash if it is still at version. Like any
+// other write it bumps the version, and claims clips from before owners
+// were recorded. trashed puts the clip in trashIndex, for trash-purge.
+func (h handler) trash(clipId, user string, version int64) error {
+	upd := expression.Set(expression.Name("trashedAt"), expression.Value(time.Now().Unix())).
+		Set(expression.Name("trashed"), expression.Value(1)).
+		Set(expression.Name("user"), expression.Value(user)).
+		Set(expression.Name("version"), expression.Value(version+1))
+	expr, err := expression.NewBuilder().
+		WithUpdate(upd).
+		WithCondition(clips.VersionCondition(version)).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = h.dbCl.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: &h.tableName,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: clipId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	return err
+}
+
+// load gets a clip, returning nil if it is missing or belongs to another
+// user. Clips without an owner belong to the owner of their sound.
+func (h handler) load(clipId, user string) (*Item, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.tableName,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: clipId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var clip Item
+	if err := attributevalue.UnmarshalMap(res.Item, &clip); err != nil {
+		return nil, err
+	}
+	if clip.User != "" {
+		if clip.User != user {
+			return nil, nil
+		}
+		return &clip, nil
+	}
+
+	res, err = h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: clip.Sound},
+		},
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	return &clip, nil
+}
+
+func (h handler) errorResponse(status int, body ErrorResponse) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(&body)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshalling error response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: status,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/collections"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	store := collections.New(dynamodb.NewFromConfig(cfg), os.Getenv("COLLECTIONS_TABLE_NAME"),
+		os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("CLIPS_TABLE_NAME"))
+
+	h := handler{store, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	store *collections.Store
+	log   *zerolog.Logger
+}
+
+// DELETE /collections/{collectionId} deletes the user's collection. The
+// sounds and clips in it are left alone.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	collectionId := event.PathParameters["collectionId"]
+	if collectionId == "" {
+		h.log.Error().Msgf("Cannot get collectionid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	c, err := h.store.Get(ctx, user, collectionId)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting collection")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if c == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	if err := h.store.Delete(ctx, user, collectionId); err != nil {
+		h.log.Error().Err(err).Msg("Error deleting collection")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	h.log.Info().Str("collection", collectionId).Msg("Deleted collection")
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusNoContent,
+	}, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	sharesTbl := os.Getenv("SHARES_TABLE_NAME")
+
+	h := handler{dbCl, sharesTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl      *dynamodb.Client
+	sharesTbl string
+	log       *zerolog.Logger
+}
+
+// DELETE /shares/{shareId} revokes a share link. The share is kept, marked
+// with when it was revoked, so its access history stays attached to it.
+// Revoking twice keeps the first time.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	shareId := event.PathParameters["shareId"]
+	if shareId == "" {
+		h.log.Error().Msgf("Cannot get shareid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	upd := expression.Set(expression.Name("revokedAt"),
+		expression.IfNotExists(expression.Name("revokedAt"), expression.Value(time.Now().Unix())))
+	cond := expression.Name("user").Equal(expression.Value(user))
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error building expression")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	_, err = h.dbCl.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: &h.sharesTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: shareId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		// Missing, or another user's.
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error revoking share")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	h.log.Info().Str("share", shareId).Msg("Revoked share")
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusNoContent,
+	}, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/deletion"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	sqsCl := sqs.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	jobsTbl := os.Getenv("JOBS_TABLE_NAME")
+	queueUrl := os.Getenv("QUEUE_URL")
+
+	h := handler{dbCl, deletion.NewStarter(dbCl, sqsCl, formatsTbl, jobsTbl, queueUrl), formatsTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	starter    *deletion.Starter
+	formatsTbl string
+	log        *zerolog.Logger
+}
+
+// DELETE /sounds/{soundId} moves a sound to the trash, hiding it until it
+// is restored or purged. With ?permanent=true it instead starts deleting
+// the sound and everything derived from it, which the sound-deletions
+// worker carries out. Repeating a permanent delete for a sound that is
+// being deleted returns the same job and queues it again, which resumes
+// it if it had stopped.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	soundId := event.PathParameters["soundId"]
+	if soundId == "" {
+		h.log.Error().Msgf("Cannot get soundid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	if event.QueryStringParameters["permanent"] != "true" {
+		return h.trash(user, soundId), nil
+	}
+
+	job, err := h.starter.Start(ctx, user, soundId, 0)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error starting deletion job")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if job == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	h.log.Info().Str("job", job.Key).Str("sound", soundId).Msg("Queued deletion job")
+
+	b, err := json.Marshal(job)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusAccepted,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// trash records when the sound was moved to the trash, keeping the
+// original time if it is already there. trashed puts the sound in
+// trashIndex, for trash-purge.
+func (h handler) trash(user, soundId string) events.APIGatewayV2HTTPResponse {
+	now := time.Now().Unix()
+	upd := expression.Set(expression.Name("trashedAt"),
+		expression.IfNotExists(expression.Name("trashedAt"), expression.Value(now))).
+		Set(expression.Name("trashed"), expression.Value(1))
+	cond := expression.AttributeExists(expression.Name("key")).
+		And(expression.AttributeNotExists(expression.Name("deleting")))
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error building expression")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	_, err = h.dbCl.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		// Missing, or already being deleted for good.
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error moving sound to trash")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	h.log.Info().Str("sound", soundId).Msg("Moved sound to trash")
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusNoContent,
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/tagging"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	tagger := tagging.New(dbCl, os.Getenv("TAGS_TABLE_NAME"), os.Getenv("TAGGINGS_TABLE_NAME"),
+		os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("CLIPS_TABLE_NAME"))
+
+	h := handler{tagger, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	tagger *tagging.Tagger
+	log    *zerolog.Logger
+}
+
+// DELETE /tags/{tag} removes one of the user's tags from every sound and
+// clip carrying it. Like a rename, a delete cut short by the timeout is
+// finished by repeating it.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	// Tags never contain %, so unescaping is safe whether or not API
+	// Gateway already has.
+	raw, err := url.PathUnescape(event.PathParameters["tag"])
+	if err != nil {
+		raw = ""
+	}
+	name, err := tagging.Normalize(raw)
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	tag, err := h.tagger.Get(ctx, user, name)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting tag")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if tag == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	err = h.tagger.Delete(ctx, user, name)
+	if errors.Is(err, tagging.ErrChanged) {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusConflict,
+			Body:       "Tagged items kept changing, try again",
+		}, nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error deleting tag")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	h.log.Info().Str("tag", name).Msg("Deleted tag")
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusNoContent,
+	}, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/audio"
+	"wavey.ai/pkg/jobs"
+	"wavey.ai/pkg/markers"
+	"wavey.ai/pkg/s3io"
+	"wavey.ai/pkg/timebase"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+
+	invocationId := ksuid.New().String()
+	log := log.With().Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	s3Cl := s3.NewFromConfig(cfg)
+
+	jobsTbl := os.Getenv("JOBS_TABLE_NAME")
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+	exportsBucket := os.Getenv("EXPORTS_BUCKET_NAME")
+
+	h := handler{
+		dbCl,
+		s3Cl,
+		manager.NewUploader(s3Cl),
+		jobsTbl,
+		clipsTbl,
+		exportsBucket,
+		&log,
+	}
+
+	lambda.Start(h.handler)
+}
+
+type handler struct {
+	dbCl          *dynamodb.Client
+	s3Cl          *s3.Client
+	uploader      *manager.Uploader
+	jobsTbl       string
+	clipsTbl      string
+	exportsBucket string
+	log           *zerolog.Logger
+}
+
+type Message struct {
+	Job string `json:"job"`
+}
+
+type Job struct {
+	Key        string `dynamodbav:"key"`
+	User       string `dynamodbav:"user"`
+	Status     string `dynamodbav:"status"`
+	Sound      string `dynamodbav:"sound"`
+	Bucket     string `dynamodbav:"bucket"`
+	Format     string `dynamodbav:"format"`
+	SampleRate int    `dynamodbav:"sampleRate"`
+	BitDepth   int    `dynamodbav:"bitDepth"`
+	Filename   string `dynamodbav:"filename"`
+	Markers    bool   `dynamodbav:"markers"`
+}
+
+type Clip struct {
+	Start int64  `dynamodbav:"start"`
+	End   int64  `dynamodbav:"end"`
+	Hz    int64  `dynamodbav:"hz"`
+	Name  string `dynamodbav:"name"`
+	Notes string `dynamodbav:"notes"`
+	Loop  bool   `dynamodbav:"loop"`
+}
+
+func (h handler) handler(evt events.SQSEvent) error {
+	for _, message := range evt.Records {
+		var msg Message
+		if err := json.Unmarshal([]byte(message.Body), &msg); err != nil {
+			h.log.Error().Msgf("Error unmarshalling SQS message: %v", err)
+			continue
+		}
+
+		res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+			TableName: &h.jobsTbl,
+			Key: map[string]dynamodbTypes.AttributeValue{
+				"key": &dynamodbTypes.AttributeValueMemberS{Value: msg.Job},
+			},
+		})
+		if err != nil {
+			h.log.Err(err).Msg("Error getting job from DynamoDB")
+			return err
+		}
+		if res.Item == nil {
+			h.log.Error().Str("job", msg.Job).Msg("Job not found")
+			continue
+		}
+
+		var job Job
+		if err := attributevalue.UnmarshalMap(res.Item, &job); err != nil {
+			h.log.Err(err).Msg("Error unmarshaling job")
+			continue
+		}
+		if job.Status == "done" {
+			// Redelivered after completing.
+			continue
+		}
+
+		log := h.log.With().Str("job", job.Key).Str("sound", job.Sound).Logger()
+
+		if err := h.update(job.Key, "running", nil); err != nil {
+			return err
+		}
+
+		object, err := h.export(job)
+		if err != nil {
+			if !jobs.IsPermanent(err) {
+				// S3 and DynamoDB errors are left for SQS to redeliver,
+				// with the job still running.
+				log.Err(err).Msg("Error exporting")
+				return err
+			}
+			// Decoding and encoding errors won't go away on retry, so the
+			// job is failed rather than redelivered.
+			log.Err(err).Msg("Export failed")
+			if err := h.update(job.Key, "failed", map[string]string{"error": err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := h.update(job.Key, "done", map[string]string{"object": object}); err != nil {
+			return err
+		}
+		log.Info().Str("object", object).Msg("Export done")
+	}
+	return nil
+}
+
+// export converts the job's sound into a temporary file and uploads it,
+// returning the object key in the exports bucket. Errors decoding or
+// encoding the sound are marked permanent.
+func (h handler) export(job Job) (string, error) {
+	src, err := s3io.Open(context.TODO(), h.s3Cl, job.Bucket, job.Sound)
+	if err != nil {
+		return "", err
+	}
+	dec, err := audio.Open(src, src.Size())
+	if err != nil {
+		return "", decodeErr(src, err)
+	}
+
+	in := dec.Format()
+	sampleRate := job.SampleRate
+	if sampleRate == 0 {
+		sampleRate = in.SampleRate
+	}
+	container := audio.Container(job.Format)
+	bitDepth := job.BitDepth
+	if bitDepth == 0 {
+		bitDepth = in.BitDepth
+		if in.Float || audio.Validate(container, audio.Format{SampleRate: sampleRate, Channels: in.Channels, BitDepth: bitDepth}) != nil {
+			bitDepth = 24
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "export-*"+container.Ext())
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	start := time.Now()
+	if err := audio.Convert(tmp, dec, container, sampleRate, bitDepth); err != nil {
+		return "", decodeErr(src, err)
+	}
+	h.log.Info().Msgf("Converted %+v to %s %d Hz %d bit in %s", in, container, sampleRate, bitDepth, time.Since(start))
+
+	if job.Markers {
+		ms, err := h.markers(job, sampleRate)
+		if err != nil {
+			return "", err
+		}
+		fi, err := tmp.Stat()
+		if err != nil {
+			return "", err
+		}
+		if _, err := markers.AppendWAV(tmp, fi.Size(), ms, sampleRate); err != nil {
+			return "", jobs.Permanent(err)
+		}
+		h.log.Info().Msgf("Embedded %d markers", len(ms))
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	object := path.Join("exports", job.Key, job.Key+container.Ext())
+	contentType := container.ContentType()
+	if _, err := h.uploader.Upload(context.TODO(), &s3.PutObjectInput{
+		Bucket:      &h.exportsBucket,
+		Key:         &object,
+		Body:        tmp,
+		ContentType: &contentType,
+	}); err != nil {
+		return "", err
+	}
+
+	return object, nil
+}
+
+// decodeErr classifies an error decoding src. Decoders may wrap or replace
+// read errors, so src is asked whether S3 failed, which is worth retrying;
+// otherwise the sound itself is at fault.
+func decodeErr(src *s3io.Reader, err error) error {
+	if serr := src.Err(); serr != nil {
+		return serr
+	}
+	return jobs.Permanent(err)
+}
+
+// markers returns the clips of the job's sound that its user can see as
+// markers at hz, in order of position.
+func (h handler) markers(job Job, hz int) ([]markers.Marker, error) {
+	indexName := "soundIndex"
+	keyEx := expression.Key("sound").Equal(expression.Value(job.Sound))
+	filt := expression.Name("user").AttributeNotExists().
+		Or(expression.Name("user").Equal(expression.Value(job.User))).
+		And(expression.Name("trashedAt").AttributeNotExists())
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []markers.Marker
+	p := dynamodb.NewQueryPaginator(h.dbCl, &dynamodb.QueryInput{
+		TableName:                 &h.clipsTbl,
+		IndexName:                 &indexName,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		var page []Clip
+		if err := attributevalue.UnmarshalListOfMaps(res.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, c := range page {
+			if c.Hz <= 0 {
+				continue
+			}
+			ms = append(ms, markers.Marker{
+				Name:  c.Name,
+				Notes: c.Notes,
+				Start: timebase.Convert(c.Start, c.Hz, int64(hz), timebase.Nearest),
+				End:   timebase.Convert(c.End, c.Hz, int64(hz), timebase.Nearest),
+				Loop:  c.Loop,
+			})
+		}
+	}
+
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].Start < ms[j].Start
+	})
+	for i := range ms {
+		ms[i].ID = uint32(i + 1)
+	}
+	return ms, nil
+}
+
+// update sets the status of a job along with any extra string attributes.
+func (h handler) update(key, status string, attrs map[string]string) error {
+	err := jobs.Update(context.TODO(), h.dbCl, h.jobsTbl, key, status, attrs)
+	if err != nil {
+		h.log.Err(err).Str("job", key).Msg("Error updating job")
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/audio"
+	"wavey.ai/pkg/features"
+	"wavey.ai/pkg/s3io"
+)
+
+// margin is the time left for the last update to finish before the
+// invocation times out.
+const margin = 30 * time.Second
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+
+	invocationId := ksuid.New().String()
+	log := log.With().Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	h := handler{
+		dynamodb.NewFromConfig(cfg),
+		s3.NewFromConfig(cfg),
+		os.Getenv("FORMATS_TABLE_NAME"),
+		&log,
+	}
+
+	lambda.Start(h.handler)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	s3Cl       *s3.Client
+	formatsTbl string
+	log        *zerolog.Logger
+}
+
+// Progress is both the input and the output of a run. A run that stops
+// before the end of the table returns the user and key to carry on from,
+// to be passed back as the input of the next one.
+type Progress struct {
+	User    string `json:"user,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Updated int    `json:"updated"`
+	Done    bool   `json:"done"`
+}
+
+// Sound is the part of a formats row the backfill reads.
+type Sound struct {
+	User       string             `dynamodbav:"user"`
+	Key        string             `dynamodbav:"key"`
+	Bucket     string             `dynamodbav:"bucket"`
+	SampleRate int                `dynamodbav:"sampleRate"`
+	Frames     int64              `dynamodbav:"frames"`
+	CreatedAt  *int64             `dynamodbav:"createdAt"`
+	Duration   *float64           `dynamodbav:"duration"`
+	Format     *string            `dynamodbav:"format"`
+	Features   *features.Features `dynamodbav:"features"`
+}
+
+// handler is invoked by hand to add the createdAt, duration and format
+// attributes that get-sounds sorts and filters on, and the features that
+// similar-sounds compares, to sounds uploaded before the uploads worker
+// recorded them. Attributes already present are never overwritten, except
+// features computed by an older version, so it is safe to run again, or
+// alongside uploads.
+func (h handler) handler(ctx context.Context, in Progress) (Progress, error) {
+	out := Progress{User: in.User, Key: in.Key, Updated: in.Updated}
+
+	proj := expression.NamesList(expression.Name("user"), expression.Name("key"),
+		expression.Name("bucket"), expression.Name("sampleRate"), expression.Name("frames"),
+		expression.Name("createdAt"), expression.Name("duration"), expression.Name("format"),
+		expression.Name("features"))
+	expr, err := expression.NewBuilder().WithProjection(proj).Build()
+	if err != nil {
+		return out, err
+	}
+	scan := &dynamodb.ScanInput{
+		TableName:                &h.formatsTbl,
+		ExpressionAttributeNames: expr.Names(),
+		ProjectionExpression:     expr.Projection(),
+	}
+	if in.User != "" && in.Key != "" {
+		scan.ExclusiveStartKey = map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: in.User},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: in.Key},
+		}
+	}
+
+	deadline, _ := ctx.Deadline()
+	for {
+		res, err := h.dbCl.Scan(ctx, scan)
+		if err != nil {
+			return out, err
+		}
+		var sounds []Sound
+		if err := attributevalue.UnmarshalListOfMaps(res.Items, &sounds); err != nil {
+			return out, err
+		}
+		for _, s := range sounds {
+			if time.Until(deadline) < margin {
+				// Carry on from the last sound finished.
+				h.log.Info().Int("updated", out.Updated).Str("key", out.Key).Msg("Out of time")
+				return out, nil
+			}
+			updated, err := h.backfill(ctx, s)
+			if err != nil {
+				h.log.Error().Err(err).Str("sound", s.Key).Msg("Error backfilling sound")
+			}
+			if updated {
+				out.Updated++
+			}
+			out.User, out.Key = s.User, s.Key
+		}
+		if len(res.LastEvaluatedKey) == 0 {
+			break
+		}
+		scan.ExclusiveStartKey = res.LastEvaluatedKey
+	}
+
+	h.log.Info().Int("updated", out.Updated).Msg("Backfill done")
+	return Progress{Updated: out.Updated, Done: true}, nil
+}
+
+// backfill sets whichever of createdAt, duration, format and features the
+// sound is missing and can be worked out, and reports whether it changed
+// anything.
+func (h handler) backfill(ctx context.Context, s Sound) (bool, error) {
+	var upd expression.UpdateBuilder
+	var changed bool
+	set := func(name string, v interface{}) {
+		upd = upd.Set(expression.Name(name),
+			expression.IfNotExists(expression.Name(name), expression.Value(v)))
+		changed = true
+	}
+
+	if s.CreatedAt == nil {
+		// Keys are ksuids, made when the upload started.
+		if id, err := ksuid.Parse(s.Key); err == nil {
+			set("createdAt", id.Time().Unix())
+		}
+	}
+	if s.Duration == nil && s.Frames > 0 && s.SampleRate > 0 {
+		set("duration", math.Round(float64(s.Frames)/float64(s.SampleRate)*1000)/1000)
+	}
+	if (s.Format == nil || !s.Features.Valid()) && s.Bucket != "" {
+		obj, err := s3io.Open(ctx, h.s3Cl, s.Bucket, s.Key)
+		if err != nil {
+			return false, err
+		}
+		if s.Format == nil {
+			format, err := audio.Sniff(obj, obj.Size())
+			if err != nil {
+				return false, err
+			}
+			if format != "" {
+				set("format", format)
+			}
+		}
+		if !s.Features.Valid() {
+			f, err := h.features(obj)
+			if err != nil {
+				return false, err
+			}
+			if f != nil {
+				// Replaces vectors from older versions, which can't be
+				// compared with new ones.
+				upd = upd.Set(expression.Name("features"), expression.Value(f))
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	// Don't bring back a sound deleted since the scan.
+	cond := expression.AttributeExists(expression.Name("key"))
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		return false, err
+	}
+	_, err = h.dbCl.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: s.User},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: s.Key},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		var ccf *dynamodbTypes.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// features extracts the feature vector of the sound in obj the way the
+// uploads worker does, or returns nil if it has none.
+func (h handler) features(obj *s3io.Reader) (*features.Features, error) {
+	dec, err := audio.Open(obj, obj.Size())
+	if errors.Is(err, audio.ErrUnsupported) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := features.Extract(dec)
+	if errors.Is(err, features.ErrSilent) || errors.Is(err, audio.ErrUnsupported) {
+		return nil, nil
+	}
+	return f, err
+}
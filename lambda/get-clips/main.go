@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -12,9 +14,12 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/clips"
+	"wavey.ai/pkg/timebase"
 )
 
 func main() {
@@ -30,26 +35,55 @@ func main() {
 
 	dbCl := dynamodb.NewFromConfig(cfg)
 	tableName := os.Getenv("TABLE_NAME")
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
 
-	h := handler{dbCl, &tableName, &log}
+	h := handler{dbCl, &tableName, &formatsTbl, &log}
 
 	lambda.Start(h.handleRequest)
 }
 
+// Item is a clip row. Clips imported from WAV markers also carry the marker
+// label as Name, its note, and whether it was a sampler loop.
 type Item struct {
-	Key   string `json:"key"`
-	Sound string `json:"sound"`
-	Start int    `json:"start"`
-	End   int    `json:"end"`
-	Hz    int    `json:"hz"`
+	Key     string   `json:"key"`
+	Sound   string   `json:"sound"`
+	Start   int      `json:"start"`
+	End     int      `json:"end"`
+	Hz      int      `json:"hz"`
+	Name    string   `json:"name,omitempty"`
+	Colour  string   `json:"colour,omitempty"`
+	Notes   string   `json:"notes,omitempty"`
+	Labels  []string `json:"labels,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Loop    bool     `json:"loop,omitempty"`
+	Version int      `json:"version"`
+}
+
+// SecondsItem is an Item with its start and end in seconds. Its hz is
+// omitted.
+type SecondsItem struct {
+	Item
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Hz    *int    `json:"hz,omitempty"`
 }
 
 type handler struct {
-	dbCl      *dynamodb.Client
-	tableName *string
-	log       *zerolog.Logger
+	dbCl       *dynamodb.Client
+	tableName  *string
+	formatsTbl *string
+	log        *zerolog.Logger
 }
 
+// GET /clips/{soundId} lists a sound's clips. Query parameters:
+//
+//	label     only clips with this label; repeat or comma-separate to
+//	          require several
+//	q         only clips whose name contains this text, ignoring case
+//	timebase  return start and end as frames at this rate in Hz, or in
+//	          seconds (to the microsecond) for "seconds"
+//	rounding  how converted positions are rounded: "nearest" (default,
+//	          halves away from zero), "floor" or "ceil"
 func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
 	if !ok {
@@ -70,9 +104,65 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 		}, nil
 	}
 
+	var rate int64
+	seconds := false
+	switch tb := event.QueryStringParameters["timebase"]; tb {
+	case "":
+	case "seconds":
+		seconds = true
+	default:
+		n, err := strconv.ParseInt(tb, 10, 64)
+		if err != nil || n <= 0 || n > clips.MaxHz {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "timebase must be seconds or a rate between 1 and " + strconv.Itoa(clips.MaxHz),
+			}, nil
+		}
+		rate = n
+	}
+	rounding, err := timebase.ParseRounding(event.QueryStringParameters["rounding"])
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "rounding must be nearest, floor or ceil",
+		}, nil
+	}
+
+	sound, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	// Sounds in the trash or being deleted are hidden along with their clips.
+	_, trashed := sound.Item["trashedAt"]
+	_, deleting := sound.Item["deleting"]
+	if sound.Item == nil || trashed || deleting {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	// Clips created before owners were recorded belong to the sound's owner.
 	indexName := "soundIndex"
 	keyEx := expression.Key("sound").Equal(expression.Value(soundId))
-	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	filt := expression.Name("user").AttributeNotExists().
+		Or(expression.Name("user").Equal(expression.Value(user))).
+		And(expression.Name("trashedAt").AttributeNotExists())
+	// API Gateway joins repeated query parameters with commas.
+	for _, l := range clips.Labels(strings.Split(event.QueryStringParameters["label"], ",")) {
+		filt = filt.And(expression.Contains(expression.Name("labels"), l))
+	}
+	q := strings.ToLower(strings.TrimSpace(event.QueryStringParameters["q"]))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
 	if err != nil {
 		h.log.Error().Err(err).Msg("Error building expression")
 		return events.APIGatewayV2HTTPResponse{
@@ -80,29 +170,74 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 		}, nil
 	}
 
-	response, err := h.dbCl.Query(context.TODO(), &dynamodb.QueryInput{
+	items := []Item{}
+	p := dynamodb.NewQueryPaginator(h.dbCl, &dynamodb.QueryInput{
 		TableName:                 h.tableName,
 		IndexName:                 &indexName,
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
 	})
-	if err != nil {
-		h.log.Error().Err(err).Msg("Error querying dynamodb")
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusInternalServerError,
-		}, nil
-	}
+	for p.HasMorePages() {
+		response, err := p.NextPage(context.TODO())
+		if err != nil {
+			h.log.Error().Err(err).Msg("Error querying dynamodb")
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusInternalServerError,
+			}, nil
+		}
 
-	var items []Item
-	if err := attributevalue.UnmarshalListOfMaps(response.Items, &items); err != nil {
-		h.log.Error().Err(err).Msg("Error unmarshaling dynamodb response")
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusInternalServerError,
-		}, nil
+		var page []Item
+		if err := attributevalue.UnmarshalListOfMaps(response.Items, &page); err != nil {
+			h.log.Error().Err(err).Msg("Error unmarshaling dynamodb response")
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusInternalServerError,
+			}, nil
+		}
+		for _, item := range page {
+			if q == "" || strings.Contains(strings.ToLower(item.Name), q) {
+				items = append(items, item)
+			}
+		}
 	}
 
-	b, err := json.Marshal(&items)
+	var b []byte
+	switch {
+	case seconds:
+		out := make([]SecondsItem, len(items))
+		for i, item := range items {
+			if item.Hz <= 0 {
+				// Legacy clips without a timebase can't be converted, so
+				// they keep their raw positions and hz.
+				out[i] = SecondsItem{
+					Item:  item,
+					Start: float64(item.Start),
+					End:   float64(item.End),
+					Hz:    &items[i].Hz,
+				}
+				continue
+			}
+			out[i] = SecondsItem{
+				Item:  item,
+				Start: toSeconds(int64(item.Start), int64(item.Hz), rounding),
+				End:   toSeconds(int64(item.End), int64(item.Hz), rounding),
+			}
+		}
+		b, err = json.Marshal(&out)
+	case rate > 0:
+		for i, item := range items {
+			if item.Hz <= 0 {
+				continue
+			}
+			items[i].Start = int(timebase.Convert(int64(item.Start), int64(item.Hz), rate, rounding))
+			items[i].End = int(timebase.Convert(int64(item.End), int64(item.Hz), rate, rounding))
+			items[i].Hz = int(rate)
+		}
+		b, err = json.Marshal(&items)
+	default:
+		b, err = json.Marshal(&items)
+	}
 	if err != nil {
 		h.log.Error().Err(err).Msg("Error marshaling JSON response")
 		return events.APIGatewayV2HTTPResponse{
@@ -116,3 +251,8 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 		Headers:    map[string]string{"Content-Type": "application/json"},
 	}, nil
 }
+
+// toSeconds converts pos frames at hz to seconds rounded to the microsecond.
+func toSeconds(pos, hz int64, r timebase.Rounding) float64 {
+	return float64(timebase.Convert(pos, hz, timebase.Micros, r)) / timebase.Micros
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/attachment"
+)
+
+// urlExpiry is how long a download link stays valid.
+const urlExpiry = time.Hour
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	s3Cl := s3.NewPresignClient(s3.NewFromConfig(cfg))
+	tableName := os.Getenv("TABLE_NAME")
+	bucketName := os.Getenv("BUCKET_NAME")
+
+	h := handler{dbCl, s3Cl, tableName, bucketName, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	s3Cl       *s3.PresignClient
+	tableName  string
+	bucketName string
+	log        *zerolog.Logger
+}
+
+type Job struct {
+	Key        string `json:"key" dynamodbav:"key"`
+	User       string `json:"-" dynamodbav:"user"`
+	Type       string `json:"type" dynamodbav:"type"`
+	Status     string `json:"status" dynamodbav:"status"`
+	Sound      string `json:"sound,omitempty" dynamodbav:"sound"`
+	Format     string `json:"format,omitempty" dynamodbav:"format"`
+	SampleRate int    `json:"sampleRate,omitempty" dynamodbav:"sampleRate"`
+	BitDepth   int    `json:"bitDepth,omitempty" dynamodbav:"bitDepth"`
+	Filename   string `json:"filename,omitempty" dynamodbav:"filename"`
+	Topic      string `json:"topic,omitempty" dynamodbav:"topic"`
+	Object     string `json:"-" dynamodbav:"object"`
+	Error      string `json:"error,omitempty" dynamodbav:"error"`
+	CreatedAt  int64  `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt  int64  `json:"updatedAt" dynamodbav:"updatedAt"`
+	URL        string `json:"url,omitempty" dynamodbav:"-"`
+}
+
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	jobId := event.PathParameters["jobId"]
+	if jobId == "" {
+		h.log.Error().Msgf("Cannot get jobid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.tableName,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: jobId},
+		},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting job from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	var job Job
+	if res.Item != nil {
+		if err := attributevalue.UnmarshalMap(res.Item, &job); err != nil {
+			h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusInternalServerError,
+			}, nil
+		}
+	}
+	// Other users' jobs are indistinguishable from missing ones.
+	if res.Item == nil || job.User != user {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	if job.Status == "done" && job.Object != "" {
+		disposition := attachment.ContentDisposition(job.Filename)
+		req, err := h.s3Cl.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+			Bucket:                     &h.bucketName,
+			Key:                        &job.Object,
+			ResponseContentDisposition: &disposition,
+		}, func(opts *s3.PresignOptions) {
+			opts.Expires = urlExpiry
+		})
+		if err != nil {
+			h.log.Error().Err(err).Msg("Error generating Presigned URL")
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusInternalServerError,
+			}, nil
+		}
+		job.URL = req.URL
+	}
+
+	b, err := json.Marshal(&job)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/attachment"
+	"wavey.ai/pkg/markers"
+	"wavey.ai/pkg/stream"
+	"wavey.ai/pkg/timebase"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+
+	h := handler{dbCl, clipsTbl, formatsTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	clipsTbl   string
+	formatsTbl string
+	log        *zerolog.Logger
+}
+
+type Sound struct {
+	Key        string `dynamodbav:"key"`
+	Filename   string `dynamodbav:"filename"`
+	SampleRate int    `dynamodbav:"sampleRate"`
+}
+
+type Clip struct {
+	Key   string `dynamodbav:"key"`
+	Start int64  `dynamodbav:"start"`
+	End   int64  `dynamodbav:"end"`
+	Hz    int64  `dynamodbav:"hz"`
+	Name  string `dynamodbav:"name"`
+	Notes string `dynamodbav:"notes"`
+	Loop  bool   `dynamodbav:"loop"`
+}
+
+// formats maps the format query parameter to a file extension and content
+// type.
+var formats = map[string][2]string{
+	"audacity": {".txt", "text/plain; charset=utf-8"},
+	"reaper":   {".csv", "text/csv; charset=utf-8"},
+	"cue":      {".cue", "application/x-cue; charset=utf-8"},
+}
+
+// GET /sounds/{soundId}/markers?format=audacity|reaper|cue downloads a
+// sound's clips as an Audacity label track, a REAPER region/marker CSV or a
+// CUE sheet. A WAV with the clips as cue points is an export job: POST
+// /sounds/{soundId}/export with {"format": "wav", "markers": true}.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	soundId := event.PathParameters["soundId"]
+	if soundId == "" {
+		h.log.Error().Msgf("Cannot get soundid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	format := strings.ToLower(event.QueryStringParameters["format"])
+	f, ok := formats[format]
+	if !ok {
+		body := "format must be audacity, reaper or cue"
+		if format == "wav" {
+			body = "WAV markers are exported with POST /sounds/{soundId}/export"
+		}
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       body,
+		}, nil
+	}
+
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if res.Item == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	var sound Sound
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	clips, err := h.clips(soundId, user)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error querying clips")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	// Positions are written at the sound's own rate so they line up with
+	// the original file in a DAW.
+	hz := sound.SampleRate
+	if hz <= 0 {
+		hz = stream.SampleRate
+	}
+	ms := toMarkers(clips, int64(hz))
+
+	stem := sound.Filename
+	if stem == "" {
+		stem = sound.Key
+	}
+	stem = strings.TrimSuffix(stem, path.Ext(stem))
+
+	var b bytes.Buffer
+	switch format {
+	case "audacity":
+		err = markers.WriteAudacity(&b, ms, hz)
+	case "reaper":
+		err = markers.WriteReaper(&b, ms, hz)
+	case "cue":
+		err = markers.WriteCue(&b, ms, hz, sound.Filename)
+	}
+	if errors.Is(err, markers.ErrTooManyTracks) {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusUnprocessableEntity,
+			Body:       err.Error(),
+		}, nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error writing markers")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	h.log.Info().Str("format", format).Msgf("Exported %d markers", len(ms))
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       b.String(),
+		Headers: map[string]string{
+			"Content-Type":        f[1],
+			"Content-Disposition": attachment.ContentDisposition(stem + f[0]),
+		},
+	}, nil
+}
+
+// clips loads the user's untrashed clips of a sound in the order they occur.
+// Clips without an owner belong to the sound's owner, who has been checked.
+func (h handler) clips(soundId, user string) ([]Clip, error) {
+	indexName := "soundIndex"
+	keyEx := expression.Key("sound").Equal(expression.Value(soundId))
+	filt := expression.Name("user").AttributeNotExists().
+		Or(expression.Name("user").Equal(expression.Value(user))).
+		And(expression.Name("trashedAt").AttributeNotExists())
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var clips []Clip
+	p := dynamodb.NewQueryPaginator(h.dbCl, &dynamodb.QueryInput{
+		TableName:                 &h.clipsTbl,
+		IndexName:                 &indexName,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		var page []Clip
+		if err := attributevalue.UnmarshalListOfMaps(res.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, c := range page {
+			if c.Hz > 0 {
+				clips = append(clips, c)
+			}
+		}
+	}
+	return clips, nil
+}
+
+// toMarkers converts clips to markers at hz, ordered by start.
+func toMarkers(clips []Clip, hz int64) []markers.Marker {
+	ms := make([]markers.Marker, len(clips))
+	for i, c := range clips {
+		ms[i] = markers.Marker{
+			Name:  c.Name,
+			Notes: c.Notes,
+			Start: timebase.Convert(c.Start, c.Hz, hz, timebase.Nearest),
+			End:   timebase.Convert(c.End, c.Hz, hz, timebase.Nearest),
+			Loop:  c.Loop,
+		}
+	}
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].Start < ms[j].Start
+	})
+	for i := range ms {
+		ms[i].ID = uint32(i + 1)
+	}
+	return ms
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+)
+
+// maxLimit bounds the number of records returned.
+const maxLimit = 500
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	sharesTbl := os.Getenv("SHARES_TABLE_NAME")
+	shareAccessTbl := os.Getenv("SHARE_ACCESS_TABLE_NAME")
+
+	h := handler{dbCl, sharesTbl, shareAccessTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl           *dynamodb.Client
+	sharesTbl      string
+	shareAccessTbl string
+	log            *zerolog.Logger
+}
+
+type Access struct {
+	At        int64  `json:"at" dynamodbav:"at"`
+	Status    int    `json:"status" dynamodbav:"status"`
+	Outcome   string `json:"outcome" dynamodbav:"outcome"`
+	IP        string `json:"ip" dynamodbav:"ip"`
+	UserAgent string `json:"userAgent,omitempty" dynamodbav:"userAgent"`
+}
+
+// GET /shares/{shareId}/access?limit=N lists the most recent requests made
+// with a share link, newest first.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	shareId := event.PathParameters["shareId"]
+	if shareId == "" {
+		h.log.Error().Msgf("Cannot get shareid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	limit := 100
+	if s := event.QueryStringParameters["limit"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxLimit {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "limit must be between 1 and " + strconv.Itoa(maxLimit),
+			}, nil
+		}
+		limit = n
+	}
+
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.sharesTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: shareId},
+		},
+		ProjectionExpression:     aws.String("#user"),
+		ExpressionAttributeNames: map[string]string{"#user": "user"},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting share from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	owner, _ := res.Item["user"].(*dynamodbTypes.AttributeValueMemberS)
+	if owner == nil || owner.Value != user {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("share").Equal(expression.Value(shareId))).
+		Build()
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error building expression")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	out, err := h.dbCl.Query(context.TODO(), &dynamodb.QueryInput{
+		TableName:                 &h.shareAccessTbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error querying DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	access := []Access{}
+	if err := attributevalue.UnmarshalListOfMaps(out.Items, &access); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	b, err := json.Marshal(&access)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
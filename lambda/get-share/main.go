@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/share"
+)
+
+// urlExpiry is how long a stream link stays valid, unless the share
+// expires sooner.
+const urlExpiry = 15 * time.Minute
+
+// accessRetention is how long access records are kept.
+const accessRetention = 90 * 24 * time.Hour
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	signer, err := share.NewSigner(os.Getenv("SHARE_SECRET"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading share secret")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	s3Cl := s3.NewFromConfig(cfg)
+
+	h := handler{
+		dbCl,
+		s3.NewPresignClient(s3Cl),
+		signer,
+		os.Getenv("SHARES_TABLE_NAME"),
+		os.Getenv("SHARE_ACCESS_TABLE_NAME"),
+		os.Getenv("CLIPS_TABLE_NAME"),
+		os.Getenv("FORMATS_TABLE_NAME"),
+		&log,
+	}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl           *dynamodb.Client
+	presignCl      *s3.PresignClient
+	signer         *share.Signer
+	sharesTbl      string
+	shareAccessTbl string
+	clipsTbl       string
+	formatsTbl     string
+	log            *zerolog.Logger
+}
+
+type Share struct {
+	Key       string `dynamodbav:"key"`
+	User      string `dynamodbav:"user"`
+	Type      string `dynamodbav:"type"`
+	Sound     string `dynamodbav:"sound"`
+	Clip      string `dynamodbav:"clip"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+	RevokedAt int64  `dynamodbav:"revokedAt"`
+}
+
+type Sound struct {
+	Key        string `json:"key" dynamodbav:"key"`
+	Bucket     string `json:"-" dynamodbav:"bucket"`
+	Filename   string `json:"filename" dynamodbav:"filename"`
+	Format     string `json:"format" dynamodbav:"format"`
+	SampleRate int64  `json:"sampleRate" dynamodbav:"sampleRate"`
+	Channels   int64  `json:"channels,omitempty" dynamodbav:"channels"`
+	Frames     int64  `json:"frames,omitempty" dynamodbav:"frames"`
+	TrashedAt  int64  `json:"-" dynamodbav:"trashedAt"`
+	Deleting   string `json:"-" dynamodbav:"deleting"`
+}
+
+type Clip struct {
+	Key       string   `json:"key" dynamodbav:"key"`
+	Sound     string   `json:"-" dynamodbav:"sound"`
+	User      string   `json:"-" dynamodbav:"user"`
+	Start     int64    `json:"start" dynamodbav:"start"`
+	End       int64    `json:"end" dynamodbav:"end"`
+	Hz        int64    `json:"hz" dynamodbav:"hz"`
+	Name      string   `json:"name,omitempty" dynamodbav:"name"`
+	Colour    string   `json:"colour,omitempty" dynamodbav:"colour"`
+	Notes     string   `json:"notes,omitempty" dynamodbav:"notes"`
+	Labels    []string `json:"labels,omitempty" dynamodbav:"labels"`
+	Loop      bool     `json:"loop,omitempty" dynamodbav:"loop"`
+	TrashedAt int64    `json:"-" dynamodbav:"trashedAt"`
+	Deleting  string   `json:"-" dynamodbav:"deleting"`
+}
+
+// Shared is what a share link shows. StreamURL is the sound's 96k Opus
+// stream, which clips are played from by seeking to their range.
+type Shared struct {
+	Type            string `json:"type"`
+	ExpiresAt       int64  `json:"expiresAt"`
+	Sound           Sound  `json:"sound"`
+	Clip            *Clip  `json:"clip,omitempty"`
+	StreamURL       string `json:"streamUrl"`
+	StreamExpiresAt int64  `json:"streamExpiresAt"`
+}
+
+// GET /shared/{token} is the public side of a share link and sits outside
+// the authorizer. Every request carrying a genuine token is recorded
+// against its share, whether or not access is granted.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	now := time.Now()
+
+	token, err := h.signer.Parse(event.PathParameters["token"], now)
+	if errors.Is(err, share.ErrMalformed) || errors.Is(err, share.ErrSignature) {
+		h.log.Info().Err(err).Str("ip", event.RequestContext.HTTP.SourceIP).Msg("Rejected share token")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	if errors.Is(err, share.ErrExpired) {
+		return h.deny(event, token.ID, http.StatusGone, "expired")
+	}
+
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.sharesTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: token.ID},
+		},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting share from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if res.Item == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	var s Share
+	if err := attributevalue.UnmarshalMap(res.Item, &s); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if s.ExpiresAt != token.Expires.Unix() {
+		// Signed for this share, but not with its expiry.
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	if s.RevokedAt != 0 {
+		return h.deny(event, s.Key, http.StatusGone, "revoked")
+	}
+
+	shared, err := h.load(s)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error loading shared sound")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if shared == nil {
+		return h.deny(event, s.Key, http.StatusGone, "deleted")
+	}
+
+	expiry := urlExpiry
+	if left := token.Expires.Sub(now); left < expiry {
+		expiry = left
+	}
+	object := path.Join("stream", s.Sound, s.Sound+"_stream_96k")
+	req, err := h.presignCl.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &shared.Sound.Bucket,
+		Key:    &object,
+	}, func(opts *s3.PresignOptions) {
+		opts.Expires = expiry
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error generating Presigned URL")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	shared.StreamURL = req.URL
+	shared.StreamExpiresAt = now.Add(expiry).Unix()
+
+	if err := h.record(event, s.Key, http.StatusOK, "granted"); err != nil {
+		h.log.Error().Err(err).Msg("Error recording share access")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	b, err := json.Marshal(shared)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": "no-store",
+		},
+	}, nil
+}
+
+// load gets the shared sound and clip as they are now, returning nil if
+// either has been deleted, trashed or is being deleted, or the clip has
+// changed hands.
+func (h handler) load(s Share) (*Shared, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: s.User},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: s.Sound},
+		},
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	shared := Shared{Type: s.Type, ExpiresAt: s.ExpiresAt}
+	if err := attributevalue.UnmarshalMap(res.Item, &shared.Sound); err != nil {
+		return nil, err
+	}
+	if shared.Sound.TrashedAt != 0 || shared.Sound.Deleting != "" {
+		return nil, nil
+	}
+	if s.Clip == "" {
+		return &shared, nil
+	}
+
+	res, err = h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.clipsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: s.Clip},
+		},
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var clip Clip
+	if err := attributevalue.UnmarshalMap(res.Item, &clip); err != nil {
+		return nil, err
+	}
+	if clip.Sound != s.Sound || (clip.User != "" && clip.User != s.User) ||
+		clip.TrashedAt != 0 || clip.Deleting != "" {
+		return nil, nil
+	}
+	shared.Clip = &clip
+	return &shared, nil
+}
+
+// deny records a refused request for a share and responds with status.
+func (h handler) deny(event events.APIGatewayV2HTTPRequest, shareId string, status int, outcome string) (events.APIGatewayV2HTTPResponse, error) {
+	if err := h.record(event, shareId, status, outcome); err != nil {
+		h.log.Error().Err(err).Msg("Error recording share access")
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       http.StatusText(status),
+	}, nil
+}
+
+// record appends a request to the share's access log, and counts granted
+// requests on the share.
+func (h handler) record(event events.APIGatewayV2HTTPRequest, shareId string, status int, outcome string) error {
+	now := time.Now()
+	h.log.Info().
+		Str("share", shareId).
+		Str("outcome", outcome).
+		Str("ip", event.RequestContext.HTTP.SourceIP).
+		Str("userAgent", event.RequestContext.HTTP.UserAgent).
+		Msg("Share accessed")
+
+	item := map[string]dynamodbTypes.AttributeValue{
+		"share": &dynamodbTypes.AttributeValueMemberS{
+			Value: shareId,
+		},
+		"key": &dynamodbTypes.AttributeValueMemberS{
+			Value: ksuid.New().String(),
+		},
+		"at": &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.FormatInt(now.Unix(), 10),
+		},
+		"status": &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.Itoa(status),
+		},
+		"outcome": &dynamodbTypes.AttributeValueMemberS{
+			Value: outcome,
+		},
+		"ip": &dynamodbTypes.AttributeValueMemberS{
+			Value: event.RequestContext.HTTP.SourceIP,
+		},
+		"expiresAt": &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.FormatInt(now.Add(accessRetention).Unix(), 10),
+		},
+	}
+	if ua := event.RequestContext.HTTP.UserAgent; ua != "" {
+		item["userAgent"] = &dynamodbTypes.AttributeValueMemberS{
+			Value: ua,
+		}
+	}
+	if _, err := h.dbCl.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: &h.shareAccessTbl,
+		Item:      item,
+	}); err != nil {
+		return err
+	}
+	if outcome != "granted" {
+		return nil
+	}
+
+	upd := expression.Add(expression.Name("accessCount"), expression.Value(1)).
+		Set(expression.Name("lastAccessedAt"), expression.Value(now.Unix()))
+	expr, err := expression.NewBuilder().WithUpdate(upd).Build()
+	if err != nil {
+		return err
+	}
+	_, err = h.dbCl.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: &h.sharesTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: shareId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	return err
+}
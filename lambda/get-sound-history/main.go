@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/details"
+	"wavey.ai/pkg/pagination"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	pager, err := pagination.New(os.Getenv("CURSOR_SECRET"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading cursor secret")
+	}
+
+	store := details.New(dynamodb.NewFromConfig(cfg), os.Getenv("FORMATS_TABLE_NAME"),
+		os.Getenv("HISTORY_TABLE_NAME"))
+
+	h := handler{store, pager, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	store *details.Store
+	pager *pagination.Paginator
+	log   *zerolog.Logger
+}
+
+// Response lists edits newest first. NextCursor is passed back as the
+// cursor parameter to get older ones, and is empty once there are none.
+type Response struct {
+	Edits      []details.Edit `json:"edits"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+// GET /sounds/{soundId}/history?limit=N&cursor=C lists the edits made to
+// the details of the user's sound, newest first, each with what it
+// changed from and to.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	soundId := event.PathParameters["soundId"]
+	if soundId == "" {
+		h.log.Error().Msgf("Cannot get soundid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	limit, err := pagination.ParseLimit(event.QueryStringParameters["limit"])
+	if err != nil {
+		return h.respond(http.StatusBadRequest, &ErrorResponse{Message: err.Error()}), nil
+	}
+
+	// Only the owner sees the history, and only while the sound is there.
+	d, err := h.store.Get(ctx, user, soundId)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound details")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if d == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	scope := "history/" + user + "/" + soundId
+	edits, next, err := h.store.History(ctx, h.pager, scope, soundId, event.QueryStringParameters["cursor"], limit)
+	if errors.Is(err, pagination.ErrCursor) {
+		return h.respond(http.StatusBadRequest, &ErrorResponse{Message: err.Error()}), nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error querying sound history")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	res := Response{Edits: edits, NextCursor: next}
+	return h.respond(http.StatusOK, &res), nil
+}
+
+// respond writes v as the JSON body of a response with the given status.
+func (h handler) respond(status int, v interface{}) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(v)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
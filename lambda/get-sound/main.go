@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/details"
+	"wavey.ai/pkg/tags"
+)
+
+// Processing states. A sound is ready once its stream and waveform have
+// been rendered, until it is trashed or deleted.
+const (
+	stateProcessing = "processing"
+	stateReady      = "ready"
+	stateTrashed    = "trashed"
+	stateDeleting   = "deleting"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	s3Cl := s3.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+	streamHost := os.Getenv("STREAM_HOST")
+
+	h := handler{dbCl, s3Cl, formatsTbl, clipsTbl, streamHost, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	s3Cl       *s3.Client
+	formatsTbl string
+	clipsTbl   string
+	streamHost string
+	log        *zerolog.Logger
+}
+
+// Row is the sound's formats row.
+type Row struct {
+	User        string           `dynamodbav:"user"`
+	Key         string           `dynamodbav:"key"`
+	Bucket      string           `dynamodbav:"bucket"`
+	Filename    string           `dynamodbav:"filename"`
+	Format      string           `dynamodbav:"format"`
+	SampleRate  int64            `dynamodbav:"sampleRate"`
+	Channels    int64            `dynamodbav:"channels"`
+	Frames      int64            `dynamodbav:"frames"`
+	Metadata    *tags.Metadata   `dynamodbav:"metadata"`
+	RawMetadata string           `dynamodbav:"rawMetadata"`
+	Deleting    string           `dynamodbav:"deleting"`
+	TrashedAt   int64            `dynamodbav:"trashedAt"`
+	Tags        []string         `dynamodbav:"tags"`
+	Details     *details.Details `dynamodbav:"details"`
+}
+
+// Sound is everything known about a sound.
+type Sound struct {
+	Key        string           `json:"key"`
+	Filename   string           `json:"filename"`
+	Format     string           `json:"format,omitempty"`
+	CreatedAt  int64            `json:"createdAt,omitempty"`
+	Technical  Technical        `json:"technical"`
+	Metadata   *tags.Metadata   `json:"metadata,omitempty"`
+	Raw        json.RawMessage  `json:"rawMetadata,omitempty"`
+	Tags       []string         `json:"tags,omitempty"`
+	Details    *details.Details `json:"details,omitempty"`
+	Analysis   Analysis         `json:"analysis"`
+	Renditions []Rendition      `json:"renditions"`
+	Clips      int              `json:"clips"`
+	Processing Processing       `json:"processing"`
+}
+
+// Technical describes the uploaded file. Fields the upload's decoder
+// couldn't read are left out.
+type Technical struct {
+	Size        int64   `json:"size,omitempty"`
+	ContentType string  `json:"contentType,omitempty"`
+	SampleRate  int64   `json:"sampleRate,omitempty"`
+	Channels    int64   `json:"channels,omitempty"`
+	Frames      int64   `json:"frames,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+}
+
+// Analysis holds URLs of the waveform and sonographs rendered from the
+// sound, on the stream host. Each is empty until it has been rendered.
+type Analysis struct {
+	Waveform      string `json:"waveform,omitempty"`
+	WaveformImage string `json:"waveformImage,omitempty"`
+	SonographEq   string `json:"sonographEq,omitempty"`
+	SonographUe   string `json:"sonographUe,omitempty"`
+}
+
+// Rendition is an encoding of the sound that can be played or downloaded.
+type Rendition struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+}
+
+type Processing struct {
+	State string `json:"state"`
+	// Job is the deletion job while the sound is being deleted.
+	Job string `json:"job,omitempty"`
+	// TrashedAt is when the sound was moved to the trash.
+	TrashedAt int64 `json:"trashedAt,omitempty"`
+	// Pending names the renditions and analyses not yet available.
+	Pending []string `json:"pending,omitempty"`
+}
+
+// GET /sounds/{soundId} returns the user's sound with its technical
+// metadata, embedded tags, analysis, renditions, clip count and
+// processing state.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	soundId := event.PathParameters["soundId"]
+	if soundId == "" {
+		h.log.Error().Msgf("Cannot get soundid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+	})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if res.Item == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	var row Row
+	if err := attributevalue.UnmarshalMap(res.Item, &row); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	sound := Sound{
+		Key:      row.Key,
+		Filename: row.Filename,
+		Format:   row.Format,
+		Technical: Technical{
+			SampleRate: row.SampleRate,
+			Channels:   row.Channels,
+			Frames:     row.Frames,
+		},
+		Metadata:   row.Metadata,
+		Tags:       row.Tags,
+		Details:    row.Details,
+		Renditions: []Rendition{},
+	}
+	if id, err := ksuid.Parse(row.Key); err == nil {
+		sound.CreatedAt = id.Time().Unix()
+	}
+	if row.SampleRate > 0 && row.Frames > 0 {
+		sound.Technical.Duration = float64(row.Frames) / float64(row.SampleRate)
+	}
+	if row.RawMetadata != "" && json.Valid([]byte(row.RawMetadata)) {
+		sound.Raw = json.RawMessage(row.RawMetadata)
+	}
+
+	if err := h.addObjects(&sound, row.Bucket); err != nil {
+		h.log.Error().Err(err).Msg("Error listing sound objects")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	if sound.Clips, err = h.countClips(user, soundId); err != nil {
+		h.log.Error().Err(err).Msg("Error counting clips")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if row.TrashedAt != 0 {
+		sound.Processing = Processing{State: stateTrashed, TrashedAt: row.TrashedAt}
+	}
+	if row.Deleting != "" {
+		sound.Processing = Processing{State: stateDeleting, Job: row.Deleting}
+	}
+
+	b, err := json.Marshal(&sound)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// addObjects fills in what the sound's objects in its bucket say about it:
+// the upload's size and type, the renditions and analyses rendered so far,
+// and so whether processing has finished.
+func (h handler) addObjects(sound *Sound, bucket string) error {
+	if bucket == "" {
+		sound.Processing = Processing{State: stateProcessing, Pending: []string{"stream", "waveform"}}
+		return nil
+	}
+
+	head, err := h.s3Cl.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &sound.Key,
+	})
+	var nf *s3Types.NotFound
+	switch {
+	case errors.As(err, &nf):
+	case err != nil:
+		return err
+	default:
+		sound.Technical.Size = head.ContentLength
+		if head.ContentType != nil {
+			sound.Technical.ContentType = *head.ContentType
+		}
+	}
+
+	streams, err := h.list(bucket, path.Join("stream", sound.Key)+"/")
+	if err != nil {
+		return err
+	}
+	for _, o := range streams {
+		sound.Renditions = append(sound.Renditions, Rendition{
+			Name: strings.TrimPrefix(path.Base(*o.Key), sound.Key+"_"),
+			URL:  h.url(*o.Key),
+			Size: o.Size,
+		})
+	}
+
+	av, err := h.list(bucket, path.Join("av", sound.Key)+"/")
+	if err != nil {
+		return err
+	}
+	pngs, err := h.list(bucket, path.Join("png-fs8", sound.Key)+"/")
+	if err != nil {
+		return err
+	}
+	assets := map[string]bool{}
+	for _, o := range append(av, pngs...) {
+		assets[*o.Key] = true
+	}
+	a := &sound.Analysis
+	for _, asset := range []struct {
+		dst *string
+		key string
+	}{
+		{&a.Waveform, path.Join("av", sound.Key, sound.Key+"_waveform.dat")},
+		{&a.WaveformImage, path.Join("png-fs8", sound.Key, "wave.png")},
+		{&a.SonographEq, path.Join("png-fs8", sound.Key, "sono-eq.png")},
+		{&a.SonographUe, path.Join("png-fs8", sound.Key, "sono-ue.png")},
+	} {
+		if assets[asset.key] {
+			*asset.dst = h.url(asset.key)
+		}
+	}
+
+	sound.Processing.State = stateReady
+	if len(streams) == 0 {
+		sound.Processing.Pending = append(sound.Processing.Pending, "stream")
+	}
+	if a.Waveform == "" {
+		sound.Processing.Pending = append(sound.Processing.Pending, "waveform")
+	}
+	if len(sound.Processing.Pending) > 0 {
+		sound.Processing.State = stateProcessing
+	}
+	return nil
+}
+
+// list returns the objects under prefix.
+func (h handler) list(bucket, prefix string) ([]s3Types.Object, error) {
+	var objects []s3Types.Object
+	p := s3.NewListObjectsV2Paginator(h.s3Cl, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, res.Contents...)
+	}
+	return objects, nil
+}
+
+// url is where the client fetches an object from, through the stream
+// distribution with its usual credentials.
+func (h handler) url(key string) string {
+	return "https://" + h.streamHost + "/" + key
+}
+
+// countClips counts the clips of a sound that the user can see.
+func (h handler) countClips(user, soundId string) (int, error) {
+	indexName := "soundIndex"
+	keyEx := expression.Key("sound").Equal(expression.Value(soundId))
+	filt := expression.Name("user").AttributeNotExists().
+		Or(expression.Name("user").Equal(expression.Value(user))).
+		And(expression.Name("trashedAt").AttributeNotExists())
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	p := dynamodb.NewQueryPaginator(h.dbCl, &dynamodb.QueryInput{
+		TableName:                 &h.clipsTbl,
+		IndexName:                 &indexName,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		Select:                    dynamodbTypes.SelectCount,
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(context.TODO())
+		if err != nil {
+			return 0, err
+		}
+		n += int(res.Count)
+	}
+	return n, nil
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
@@ -15,6 +20,10 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/details"
+	"wavey.ai/pkg/pagination"
+	"wavey.ai/pkg/search"
+	"wavey.ai/pkg/tagging"
 )
 
 func main() {
@@ -28,27 +37,70 @@ func main() {
 		log.Fatal().Err(err).Msgf("Error loading SDK config")
 	}
 
+	pager, err := pagination.New(os.Getenv("CURSOR_SECRET"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading cursor secret")
+	}
+
+	if index := os.Getenv("SAMPLE_RATE_INDEX"); index != "" {
+		sortIndexes["sampleRate"] = index
+	}
+
 	dbCl := dynamodb.NewFromConfig(cfg)
 	tableName := os.Getenv("TABLE_NAME")
 
-	h := handler{dbCl, &tableName, &log}
+	h := handler{dbCl, pager, &tableName, &log}
 
 	lambda.Start(h.handleRequest)
 }
 
 type Item struct {
-	User     string `json:"user"`
-	Key      string `json:"key"`
-	Filename string `json:"filename"`
-	Format   string `json:"format"`
+	User       string           `json:"user"`
+	Key        string           `json:"key"`
+	Filename   string           `json:"filename"`
+	Format     string           `json:"format"`
+	CreatedAt  int64            `json:"createdAt,omitempty"`
+	Duration   float64          `json:"duration,omitempty"`
+	SampleRate int              `json:"sampleRate,omitempty"`
+	Channels   int              `json:"channels,omitempty"`
+	Tags       []string         `json:"tags,omitempty"`
+	Details    *details.Details `json:"details,omitempty"`
+}
+
+// sortIndexes maps the fields sounds can be sorted by to the index that
+// orders them. Sounds are keyed by ksuids, which sort by creation time, so
+// the table itself is in createdAt order. sampleRate is added by main once
+// the stack has its index.
+var sortIndexes = map[string]string{
+	"createdAt": "",
+	"duration":  "durationIndex",
+}
+
+// Page is one page of sounds. NextCursor is passed back as the cursor
+// parameter to get the next page, and is empty on the last.
+type Page struct {
+	Items      []Item `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
 }
 
 type handler struct {
 	dbCl      *dynamodb.Client
+	pager     *pagination.Paginator
 	tableName *string
 	log       *zerolog.Logger
 }
 
+// GET /sounds?limit=N&cursor=C lists the user's sounds a page at a time.
+// With tag=a,b only sounds carrying any of the tags are listed, or all of
+// them with match=all.
+//
+// sort=createdAt|duration|sampleRate and order=asc|desc set the order,
+// oldest first by default. createdAt, duration, sampleRate and channels
+// take inclusive ranges as "min..max" with either end optional, or a
+// single value; createdAt's ends are unix times, RFC 3339 times or dates,
+// a date covering the whole day. format=wav,aiff lists sounds in any of
+// the formats. Sorting by duration or sample rate leaves out sounds whose
+// length or rate isn't known.
 func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
 	if ok {
@@ -61,11 +113,92 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 		}, nil
 	}
 
-	var err error
-	var response *dynamodb.QueryOutput
-	var items []Item
+	limit, err := pagination.ParseLimit(event.QueryStringParameters["limit"])
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	params := event.QueryStringParameters
+	sort := params["sort"]
+	if sort == "" {
+		sort = "createdAt"
+	}
+	index, ok := sortIndexes[sort]
+	if !ok && sort == "sampleRate" {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "sorting by sampleRate is not available yet",
+		}, nil
+	}
+	if !ok {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "sort must be createdAt, duration or sampleRate",
+		}, nil
+	}
+	order := params["order"]
+	if order != "" && order != "asc" && order != "desc" {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "order must be asc or desc",
+		}, nil
+	}
+
+	created, err := parseTimeRange(params["createdAt"])
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "createdAt: " + err.Error(),
+		}, nil
+	}
+	ranges := map[string]search.Range{"createdAt": created}
+	for _, name := range []string{"duration", "sampleRate", "channels"} {
+		if ranges[name], err = search.ParseRange(params[name]); err != nil {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       name + ": " + err.Error(),
+			}, nil
+		}
+	}
+
 	keyEx := expression.Key("user").Equal(expression.Value(user))
-	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	// A range on the sort field narrows the query itself rather than
+	// filtering what it reads.
+	if r := ranges[sort]; r.HasMin || r.HasMax {
+		if sort == "createdAt" {
+			keyEx = keyEx.And(createdKey(r))
+		} else {
+			keyEx = keyEx.And(keyRange(sort, r))
+		}
+	}
+	delete(ranges, sort)
+
+	// Sounds in the trash or being deleted are already gone as far as the
+	// user is concerned.
+	filt := expression.AttributeNotExists(expression.Name("deleting")).
+		And(expression.AttributeNotExists(expression.Name("trashedAt")))
+	for name, r := range ranges {
+		if r.HasMin || r.HasMax {
+			filt = filt.And(rangeFilter(name, r))
+		}
+	}
+	if s := params["format"]; s != "" {
+		filt = filt.And(formatFilter(strings.Split(s, ",")))
+	}
+	if s := params["tag"]; s != "" {
+		tagFilt, err := tagFilter(strings.Split(s, ","), params["match"])
+		if err != nil {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       err.Error(),
+			}, nil
+		}
+		filt = filt.And(tagFilt)
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
 	if err != nil {
 		h.log.Error().Err(err).Msg("Error building expression")
 		return events.APIGatewayV2HTTPResponse{
@@ -74,12 +207,26 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 		}, nil
 	}
 
-	response, err = h.dbCl.Query(context.TODO(), &dynamodb.QueryInput{
+	in := &dynamodb.QueryInput{
 		TableName:                 h.tableName,
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		KeyConditionExpression:    expr.KeyCondition(),
-	})
+		FilterExpression:          expr.Filter(),
+		ScanIndexForward:          aws.Bool(order != "desc"),
+	}
+	if index != "" {
+		in.IndexName = &index
+	}
+	// A cursor only makes sense in the order it was made for.
+	scope := "sounds/" + user + "/" + sort + "/" + order
+	rows, next, err := h.pager.Query(context.TODO(), h.dbCl, in, scope, params["cursor"], limit)
+	if errors.Is(err, pagination.ErrCursor) {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
 	if err != nil {
 		h.log.Error().Err(err).Msg("Error querying DynamoDB")
 		return events.APIGatewayV2HTTPResponse{
@@ -88,7 +235,8 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 		}, nil
 	}
 
-	if err := attributevalue.UnmarshalListOfMaps(response.Items, &items); err != nil {
+	page := Page{Items: []Item{}, NextCursor: next}
+	if err := attributevalue.UnmarshalListOfMaps(rows, &page.Items); err != nil {
 		h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
 		return events.APIGatewayV2HTTPResponse{
 			StatusCode: http.StatusInternalServerError,
@@ -96,7 +244,7 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 		}, nil
 	}
 
-	b, err := json.Marshal(&items)
+	b, err := json.Marshal(&page)
 	if err != nil {
 		h.log.Error().Err(err).Msg("Error marshaling JSON response")
 		return events.APIGatewayV2HTTPResponse{
@@ -111,3 +259,140 @@ func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTT
 		Headers:    map[string]string{"Content-Type": "application/json"},
 	}, nil
 }
+
+// tagFilter matches sounds carrying any of tags, or all of them when match
+// is "all". API Gateway joins repeated query parameters with commas.
+func tagFilter(tags []string, match string) (expression.ConditionBuilder, error) {
+	if match != "" && match != "any" && match != "all" {
+		return expression.ConditionBuilder{}, errors.New("match must be any or all")
+	}
+	tags, err := tagging.NormalizeAll(tags)
+	if err != nil {
+		return expression.ConditionBuilder{}, err
+	}
+	filt := expression.Contains(expression.Name("tags"), tags[0])
+	for _, t := range tags[1:] {
+		if match == "all" {
+			filt = filt.And(expression.Contains(expression.Name("tags"), t))
+		} else {
+			filt = filt.Or(expression.Contains(expression.Name("tags"), t))
+		}
+	}
+	return filt, nil
+}
+
+// formatFilter matches sounds in any of formats.
+func formatFilter(formats []string) expression.ConditionBuilder {
+	values := make([]expression.OperandBuilder, len(formats))
+	for i, f := range formats {
+		values[i] = expression.Value(strings.ToLower(strings.TrimSpace(f)))
+	}
+	if len(values) == 1 {
+		return expression.Name("format").Equal(values[0])
+	}
+	return expression.Name("format").In(values[0], values[1:]...)
+}
+
+// rangeFilter matches sounds whose attribute name is within r.
+func rangeFilter(name string, r search.Range) expression.ConditionBuilder {
+	switch {
+	case r.HasMin && r.HasMax:
+		return expression.Name(name).Between(expression.Value(r.Min), expression.Value(r.Max))
+	case r.HasMin:
+		return expression.Name(name).GreaterThanEqual(expression.Value(r.Min))
+	default:
+		return expression.Name(name).LessThanEqual(expression.Value(r.Max))
+	}
+}
+
+// keyRange is rangeFilter for an index's sort key.
+func keyRange(name string, r search.Range) expression.KeyConditionBuilder {
+	switch {
+	case r.HasMin && r.HasMax:
+		return expression.Key(name).Between(expression.Value(r.Min), expression.Value(r.Max))
+	case r.HasMin:
+		return expression.Key(name).GreaterThanEqual(expression.Value(r.Min))
+	default:
+		return expression.Key(name).LessThanEqual(expression.Value(r.Max))
+	}
+}
+
+// createdKey turns a range of creation times into a range of the ksuid
+// keys made in them, which also covers sounds from before createdAt was
+// recorded.
+func createdKey(r search.Range) expression.KeyConditionBuilder {
+	lo := make([]byte, 16)
+	hi := make([]byte, 16)
+	for i := range hi {
+		hi[i] = 0xff
+	}
+	from, to := ksuid.Nil, ksuid.Max
+	if r.HasMin {
+		from, _ = ksuid.FromParts(unixTime(r.Min), lo)
+	}
+	if r.HasMax {
+		to, _ = ksuid.FromParts(unixTime(r.Max), hi)
+	}
+	return expression.Key("key").Between(expression.Value(from.String()), expression.Value(to.String()))
+}
+
+// unixTime clamps t to the times a ksuid can hold.
+func unixTime(t float64) time.Time {
+	if t < ksuidEpoch {
+		t = ksuidEpoch
+	}
+	if t > ksuidEpoch+(1<<32-1) {
+		t = ksuidEpoch + (1<<32 - 1)
+	}
+	return time.Unix(int64(t), 0)
+}
+
+// ksuidEpoch is the unix time of a ksuid's zero timestamp.
+const ksuidEpoch = 1400000000
+
+// parseTimeRange parses a range of times as unix seconds. Its ends are
+// unix times, RFC 3339 times or YYYY-MM-DD dates in UTC.
+func parseTimeRange(s string) (search.Range, error) {
+	if s == "" {
+		return search.Range{}, nil
+	}
+	lo, hi, ok := strings.Cut(s, "..")
+	if !ok {
+		hi = lo
+	}
+	var r search.Range
+	var err error
+	if lo != "" {
+		if r.Min, _, err = parseTime(lo); err != nil {
+			return search.Range{}, err
+		}
+		r.HasMin = true
+	}
+	if hi != "" {
+		if _, r.Max, err = parseTime(hi); err != nil {
+			return search.Range{}, err
+		}
+		r.HasMax = true
+	}
+	if !r.HasMin && !r.HasMax || r.HasMin && r.HasMax && r.Min > r.Max {
+		return search.Range{}, errTime
+	}
+	return r, nil
+}
+
+var errTime = errors.New("times are unix seconds, RFC 3339 or YYYY-MM-DD, as min..max with either end optional")
+
+// parseTime returns the first and last unix second s covers, which
+// differ when s is a date.
+func parseTime(s string) (start, end float64, err error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return float64(n), float64(n), nil
+	}
+	if tm, err := time.Parse(time.RFC3339, s); err == nil {
+		return float64(tm.Unix()), float64(tm.Unix()), nil
+	}
+	if tm, err := time.Parse("2006-01-02", s); err == nil {
+		return float64(tm.Unix()), float64(tm.AddDate(0, 0, 1).Unix() - 1), nil
+	}
+	return 0, 0, errTime
+}
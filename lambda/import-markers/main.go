@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/clips"
+	"wavey.ai/pkg/markers"
+	"wavey.ai/pkg/riff"
+	"wavey.ai/pkg/stream"
+	"wavey.ai/pkg/timebase"
+)
+
+// maxMarkers bounds the number of clips imported by one request.
+const maxMarkers = 1000
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+
+	h := handler{dbCl, clipsTbl, formatsTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	clipsTbl   string
+	formatsTbl string
+	log        *zerolog.Logger
+}
+
+type Clip struct {
+	Key     string `json:"key"`
+	Sound   string `json:"sound"`
+	Start   int64  `json:"start"`
+	End     int64  `json:"end"`
+	Hz      int64  `json:"hz"`
+	Name    string `json:"name,omitempty"`
+	Notes   string `json:"notes,omitempty"`
+	Loop    bool   `json:"loop,omitempty"`
+	Version int64  `json:"version"`
+}
+
+// Skipped is a marker that was not imported. Index is its position in the
+// file, counting from 0.
+type Skipped struct {
+	Index   int    `json:"index"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportResponse lists the clips created. Existing counts markers already
+// imported by an earlier request with the same file.
+type ImportResponse struct {
+	Clips    []Clip    `json:"clips"`
+	Existing int       `json:"existing"`
+	Skipped  []Skipped `json:"skipped,omitempty"`
+}
+
+// POST /sounds/{soundId}/markers?format=audacity|reaper|cue|wav imports a
+// marker file as clips of the sound, converting positions to the sound's
+// sample rate. The body is the file; WAV files must be sent base64 encoded
+// and only their marker chunks are read. Point markers become clips that
+// run to the next marker, or to the end of the sound.
+//
+// Clip keys are derived from the sound and the marker, so importing the same
+// file again creates only the clips that are missing.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	soundId := event.PathParameters["soundId"]
+	if soundId == "" {
+		h.log.Error().Msgf("Cannot get soundid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	format := strings.ToLower(event.QueryStringParameters["format"])
+	switch format {
+	case "audacity", "reaper", "cue", "wav":
+	default:
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "format must be audacity, reaper, cue or wav",
+		}, nil
+	}
+
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(event.Body); err != nil {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "Bad Request",
+			}, nil
+		}
+	}
+
+	sound, err := h.getSound(user, soundId)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if sound == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	hz := int(sound.SampleRate)
+	if hz <= 0 {
+		hz = stream.SampleRate
+	}
+
+	ms, err := read(format, body, hz)
+	var serr *markers.SyntaxError
+	switch {
+	case errors.As(err, &serr):
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       serr.Error(),
+		}, nil
+	case errors.Is(err, riff.ErrFormat), errors.Is(err, markers.ErrNotWAVE):
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "body is not a WAV file",
+		}, nil
+	case err != nil:
+		h.log.Info().Err(err).Msg("Error reading markers")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+	if len(ms) > maxMarkers {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "at most " + strconv.Itoa(maxMarkers) + " markers can be imported",
+		}, nil
+	}
+
+	fillPoints(ms, sound.Frames)
+
+	resp := ImportResponse{Clips: []Clip{}}
+	for i, m := range ms {
+		errs := clips.CheckRange(m.Start, m.End, int64(hz), sound)
+		errs = append(errs, clips.CheckMeta(m.Name, "", m.Notes, nil)...)
+		if len(errs) > 0 {
+			for _, e := range errs {
+				resp.Skipped = append(resp.Skipped, Skipped{i, e.Field, e.Message})
+			}
+			continue
+		}
+
+		clip := Clip{
+			Key:     clipKey(soundId, format, m),
+			Sound:   soundId,
+			Start:   m.Start,
+			End:     m.End,
+			Hz:      int64(hz),
+			Name:    m.Name,
+			Notes:   m.Notes,
+			Loop:    m.Loop,
+			Version: 1,
+		}
+		created, err := h.put(user, clip)
+		if err != nil {
+			h.log.Error().Err(err).Msg("Error putting to DynamoDB")
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusInternalServerError,
+			}, nil
+		}
+		if !created {
+			resp.Existing++
+			continue
+		}
+		resp.Clips = append(resp.Clips, clip)
+	}
+
+	h.log.Info().Str("format", format).Msgf("Imported %d of %d markers", len(resp.Clips), len(ms))
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// read parses a marker file into markers at hz.
+func read(format string, body []byte, hz int) ([]markers.Marker, error) {
+	switch format {
+	case "audacity":
+		return markers.ReadAudacity(bytes.NewReader(body), hz)
+	case "reaper":
+		return markers.ReadReaper(bytes.NewReader(body), hz)
+	case "cue":
+		return markers.ReadCue(bytes.NewReader(body), hz)
+	}
+
+	ms, fileHz, err := markers.ReadWAV(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	if fileHz <= 0 {
+		return nil, errors.New("WAV file has no sample rate")
+	}
+	for i := range ms {
+		ms[i].Start = timebase.Convert(ms[i].Start, int64(fileHz), int64(hz), timebase.Nearest)
+		ms[i].End = timebase.Convert(ms[i].End, int64(fileHz), int64(hz), timebase.Nearest)
+	}
+	return ms, nil
+}
+
+// fillPoints extends point markers to the next marker that starts after
+// them, or to the end of the sound when its length is known.
+func fillPoints(ms []markers.Marker, frames int64) {
+	for i := range ms {
+		if ms[i].End > ms[i].Start {
+			continue
+		}
+		end := frames
+		for _, m := range ms {
+			if m.Start > ms[i].Start && (end <= ms[i].Start || m.Start < end) {
+				end = m.Start
+			}
+		}
+		ms[i].End = end
+	}
+}
+
+// clipKey derives a clip key from the sound and marker, timestamped with the
+// sound's creation time like imported WAV markers.
+func clipKey(soundId, format string, m markers.Marker) string {
+	t := time.Now()
+	if id, err := ksuid.Parse(soundId); err == nil {
+		t = id.Time()
+	}
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s/%s/%d/%d/%s", soundId, format, m.Start, m.End, m.Name)))
+	id, err := ksuid.FromParts(t, sum[:16])
+	if err != nil {
+		return ksuid.New().String()
+	}
+	return id.String()
+}
+
+// put writes a clip unless one with its key exists, reporting whether it
+// was created.
+func (h handler) put(user string, clip Clip) (bool, error) {
+	item := map[string]dynamodbTypes.AttributeValue{
+		"sound": &dynamodbTypes.AttributeValueMemberS{
+			Value: clip.Sound,
+		},
+		"key": &dynamodbTypes.AttributeValueMemberS{
+			Value: clip.Key,
+		},
+		"user": &dynamodbTypes.AttributeValueMemberS{
+			Value: user,
+		},
+		"start": &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.FormatInt(clip.Start, 10),
+		},
+		"end": &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.FormatInt(clip.End, 10),
+		},
+		"hz": &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.FormatInt(clip.Hz, 10),
+		},
+		"version": &dynamodbTypes.AttributeValueMemberN{
+			Value: "1",
+		},
+		"loop": &dynamodbTypes.AttributeValueMemberBOOL{
+			Value: clip.Loop,
+		},
+	}
+	if clip.Name != "" {
+		item["name"] = &dynamodbTypes.AttributeValueMemberS{
+			Value: clip.Name,
+		}
+	}
+	if clip.Notes != "" {
+		item["notes"] = &dynamodbTypes.AttributeValueMemberS{
+			Value: clip.Notes,
+		}
+	}
+
+	_, err := h.dbCl.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           &h.clipsTbl,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#key)"),
+		ExpressionAttributeNames: map[string]string{
+			"#key": "key",
+		},
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// getSound returns the user's sound, or nil if there is no such sound or
+// it is being deleted.
+func (h handler) getSound(user, soundId string) (*clips.Sound, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var sound clips.Sound
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		return nil, err
+	}
+	if sound.Deleting != "" || sound.TrashedAt != 0 {
+		return nil, nil
+	}
+	return &sound, nil
+}
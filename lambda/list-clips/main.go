@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/pagination"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	pager, err := pagination.New(os.Getenv("CURSOR_SECRET"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading cursor secret")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	tableName := os.Getenv("TABLE_NAME")
+
+	h := handler{dbCl, pager, tableName, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl      *dynamodb.Client
+	pager     *pagination.Paginator
+	tableName string
+	log       *zerolog.Logger
+}
+
+// Item is a clip row, as returned by get-clips.
+type Item struct {
+	Key     string   `json:"key"`
+	Sound   string   `json:"sound"`
+	Start   int      `json:"start"`
+	End     int      `json:"end"`
+	Hz      int      `json:"hz"`
+	Name    string   `json:"name,omitempty"`
+	Colour  string   `json:"colour,omitempty"`
+	Notes   string   `json:"notes,omitempty"`
+	Labels  []string `json:"labels,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Loop    bool     `json:"loop,omitempty"`
+	Version int      `json:"version"`
+}
+
+type Page struct {
+	Items      []Item `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GET /clips lists the caller's clips across all sounds, newest first.
+// Query parameters:
+//
+//	limit   page size, 1 to 1000 (default 100)
+//	cursor  nextCursor from the previous page
+//	sort    "-created" (default) or "created" for oldest first
+//
+// Clip keys are KSUIDs, so ordering by key orders by creation time.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	params := event.QueryStringParameters
+
+	limit, err := pagination.ParseLimit(params["limit"])
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	sort := params["sort"]
+	if sort == "" {
+		sort = "-created"
+	}
+	forward := false
+	switch sort {
+	case "-created":
+	case "created":
+		forward = true
+	default:
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "sort must be created or -created",
+		}, nil
+	}
+
+	indexName := "userIndex"
+	keyEx := expression.Key("user").Equal(expression.Value(user))
+	filt := expression.Name("trashedAt").AttributeNotExists()
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error building expression")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	in := &dynamodb.QueryInput{
+		TableName:                 &h.tableName,
+		IndexName:                 &indexName,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ScanIndexForward:          &forward,
+	}
+	// A cursor only makes sense in the order it was made for.
+	scope := "clips/" + user + "/" + sort
+	rows, next, err := h.pager.Query(context.TODO(), h.dbCl, in, scope, params["cursor"], limit)
+	if errors.Is(err, pagination.ErrCursor) {
+		h.log.Info().Err(err).Msg("Invalid cursor")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error querying dynamodb")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	page := Page{Items: []Item{}, NextCursor: next}
+	if err := attributevalue.UnmarshalListOfMaps(rows, &page.Items); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling dynamodb response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	b, err := json.Marshal(&page)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
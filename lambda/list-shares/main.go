@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/pagination"
+	"wavey.ai/pkg/share"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	signer, err := share.NewSigner(os.Getenv("SHARE_SECRET"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading share secret")
+	}
+
+	pager, err := pagination.New(os.Getenv("CURSOR_SECRET"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading cursor secret")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	sharesTbl := os.Getenv("SHARES_TABLE_NAME")
+
+	h := handler{dbCl, signer, pager, sharesTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl      *dynamodb.Client
+	signer    *share.Signer
+	pager     *pagination.Paginator
+	sharesTbl string
+	log       *zerolog.Logger
+}
+
+type Share struct {
+	Key            string `json:"key" dynamodbav:"key"`
+	Token          string `json:"token,omitempty" dynamodbav:"-"`
+	Type           string `json:"type" dynamodbav:"type"`
+	Sound          string `json:"sound" dynamodbav:"sound"`
+	Clip           string `json:"clip,omitempty" dynamodbav:"clip"`
+	CreatedAt      int64  `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt      int64  `json:"expiresAt" dynamodbav:"expiresAt"`
+	RevokedAt      int64  `json:"revokedAt,omitempty" dynamodbav:"revokedAt"`
+	AccessCount    int64  `json:"accessCount" dynamodbav:"accessCount"`
+	LastAccessedAt int64  `json:"lastAccessedAt,omitempty" dynamodbav:"lastAccessedAt"`
+}
+
+type Page struct {
+	Items      []Share `json:"items"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+// GET /shares?sound=<soundId> lists the user's share links, newest first,
+// with how often each has been used. Links that are still live carry their
+// token so they can be copied again. Pages are limit long and continue
+// from cursor, the nextCursor of the previous page.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	params := event.QueryStringParameters
+	limit, err := pagination.ParseLimit(params["limit"])
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	indexName := "userIndex"
+	builder := expression.NewBuilder().
+		WithKeyCondition(expression.Key("user").Equal(expression.Value(user)))
+	if sound := params["sound"]; sound != "" {
+		builder = builder.WithFilter(expression.Name("sound").Equal(expression.Value(sound)))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error building expression")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	in := &dynamodb.QueryInput{
+		TableName:                 &h.sharesTbl,
+		IndexName:                 &indexName,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ScanIndexForward:          aws.Bool(false),
+	}
+	// The sound filter changes which rows a page holds, so it is part of
+	// the cursor's scope.
+	scope := "shares/" + user + "/" + params["sound"]
+	rows, next, err := h.pager.Query(context.TODO(), h.dbCl, in, scope, params["cursor"], limit)
+	if errors.Is(err, pagination.ErrCursor) {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error querying DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	page := Page{Items: []Share{}, NextCursor: next}
+	if err := attributevalue.UnmarshalListOfMaps(rows, &page.Items); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	now := time.Now()
+	for i, s := range page.Items {
+		expires := time.Unix(s.ExpiresAt, 0)
+		if s.RevokedAt == 0 && now.Before(expires) {
+			page.Items[i].Token = h.signer.Sign(share.Token{ID: s.Key, Expires: expires})
+		}
+	}
+
+	b, err := json.Marshal(&page)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/pagination"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	retentionDays, err := strconv.ParseInt(os.Getenv("TRASH_RETENTION_DAYS"), 10, 64)
+	if err != nil || retentionDays < 1 {
+		log.Fatal().Err(err).Msgf("Invalid TRASH_RETENTION_DAYS")
+	}
+
+	pager, err := pagination.New(os.Getenv("CURSOR_SECRET"))
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading cursor secret")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+
+	h := handler{dbCl, pager, formatsTbl, clipsTbl, retentionDays * 24 * 60 * 60, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	pager      *pagination.Paginator
+	formatsTbl string
+	clipsTbl   string
+	// retention is how many seconds items stay in the trash.
+	retention int64
+	log       *zerolog.Logger
+}
+
+type Sound struct {
+	Key       string `json:"key" dynamodbav:"key"`
+	Filename  string `json:"filename" dynamodbav:"filename"`
+	TrashedAt int64  `json:"trashedAt" dynamodbav:"trashedAt"`
+	PurgeAt   int64  `json:"purgeAt" dynamodbav:"-"`
+}
+
+type Clip struct {
+	Key       string `json:"key" dynamodbav:"key"`
+	Sound     string `json:"sound" dynamodbav:"sound"`
+	Name      string `json:"name,omitempty" dynamodbav:"name"`
+	Start     int64  `json:"start" dynamodbav:"start"`
+	End       int64  `json:"end" dynamodbav:"end"`
+	Hz        int64  `json:"hz" dynamodbav:"hz"`
+	Version   int64  `json:"version" dynamodbav:"version"`
+	TrashedAt int64  `json:"trashedAt" dynamodbav:"trashedAt"`
+	PurgeAt   int64  `json:"purgeAt" dynamodbav:"-"`
+}
+
+// Page is one page of trashed sounds or clips.
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// GET /trash?type=sounds|clips lists the user's sounds or clips in the
+// trash, newest first, with when each will be purged. Pages are limit long
+// and continue from cursor, the nextCursor of the previous page.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	params := event.QueryStringParameters
+	limit, err := pagination.ParseLimit(params["limit"])
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	keyEx := expression.Key("user").Equal(expression.Value(user))
+	in := &dynamodb.QueryInput{ScanIndexForward: aws.Bool(false)}
+	var filt expression.ConditionBuilder
+	switch params["type"] {
+	case "sounds":
+		// Sounds already being deleted for good are out of the trash.
+		in.TableName = &h.formatsTbl
+		filt = expression.AttributeExists(expression.Name("trashedAt")).
+			And(expression.AttributeNotExists(expression.Name("deleting")))
+	case "clips":
+		in.TableName = &h.clipsTbl
+		in.IndexName = aws.String("userIndex")
+		filt = expression.AttributeExists(expression.Name("trashedAt"))
+	default:
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "type must be sounds or clips",
+		}, nil
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error building expression")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	in.ExpressionAttributeNames = expr.Names()
+	in.ExpressionAttributeValues = expr.Values()
+	in.KeyConditionExpression = expr.KeyCondition()
+	in.FilterExpression = expr.Filter()
+
+	scope := "trash/" + user + "/" + params["type"]
+	rows, next, err := h.pager.Query(context.TODO(), h.dbCl, in, scope, params["cursor"], limit)
+	if errors.Is(err, pagination.ErrCursor) {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error querying trash")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	page := Page{NextCursor: next}
+	if params["type"] == "sounds" {
+		sounds := []Sound{}
+		err = attributevalue.UnmarshalListOfMaps(rows, &sounds)
+		for i := range sounds {
+			sounds[i].PurgeAt = sounds[i].TrashedAt + h.retention
+		}
+		page.Items = sounds
+	} else {
+		clips := []Clip{}
+		err = attributevalue.UnmarshalListOfMaps(rows, &clips)
+		for i := range clips {
+			clips[i].PurgeAt = clips[i].TrashedAt + h.retention
+		}
+		page.Items = clips
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling DynamoDB response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	b, err := json.Marshal(&page)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
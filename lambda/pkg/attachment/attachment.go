@@ -0,0 +1,33 @@
+// Package attachment builds headers for files served as downloads.
+package attachment
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ContentDisposition builds an attachment header carrying the filename both
+// as an ASCII fallback and RFC 5987 encoded UTF-8.
+func ContentDisposition(filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	var encoded strings.Builder
+	for _, c := range []byte(filename) {
+		if isAttrChar(c) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, encoded.String())
+}
+
+func isAttrChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
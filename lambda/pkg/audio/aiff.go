@@ -0,0 +1,215 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"wavey.ai/pkg/riff"
+)
+
+type aiffDecoder struct {
+	format Format
+	width  int
+	order  binary.ByteOrder
+	frames int64
+	data   *io.SectionReader
+	r      *bufio.Reader
+	buf    []byte
+}
+
+func newAIFFDecoder(r io.ReaderAt, size int64) (*aiffDecoder, error) {
+	f, err := riff.New(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if !f.IsAIFF() {
+		return nil, ErrUnsupported
+	}
+
+	c, ok := f.Chunk("COMM")
+	if !ok || c.Size < 18 {
+		return nil, fmt.Errorf("%w: missing COMM chunk", ErrUnsupported)
+	}
+	b, err := f.Bytes(c, 1<<10)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := int(binary.BigEndian.Uint16(b[0:2]))
+	frames := int64(binary.BigEndian.Uint32(b[2:6]))
+	bits := int(binary.BigEndian.Uint16(b[6:8]))
+	rate := int(riff.Extended(b[8:18]) + 0.5)
+
+	d := &aiffDecoder{
+		format: Format{SampleRate: rate, Channels: channels, BitDepth: bits},
+		width:  (bits + 7) / 8,
+		order:  binary.BigEndian,
+	}
+
+	compression := "NONE"
+	if f.Form == "AIFC" && len(b) >= 22 {
+		compression = string(b[18:22])
+	}
+	switch compression {
+	case "NONE", "twos":
+	case "sowt":
+		d.order = binary.LittleEndian
+	case "fl32", "FL32":
+		d.format.Float, d.format.BitDepth, d.width = true, 32, 4
+	case "fl64", "FL64":
+		d.format.Float, d.format.BitDepth, d.width = true, 64, 8
+	default:
+		return nil, fmt.Errorf("%w: AIFF-C compression %q", ErrUnsupported, compression)
+	}
+	if channels < 1 || d.width < 1 || d.width > 8 || (!d.format.Float && d.width > 4) {
+		return nil, fmt.Errorf("%w: %d channels of %d bits", ErrUnsupported, channels, bits)
+	}
+
+	ssnd, ok := f.Chunk("SSND")
+	if !ok || ssnd.Size < 8 {
+		return nil, fmt.Errorf("%w: missing SSND chunk", ErrUnsupported)
+	}
+	hdr, err := f.Bytes(riff.Chunk{ID: ssnd.ID, Offset: ssnd.Offset, Size: 8}, 8)
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(binary.BigEndian.Uint32(hdr[0:4]))
+
+	data := riff.Chunk{ID: ssnd.ID, Offset: ssnd.Offset + 8 + offset, Size: ssnd.Size - 8 - offset}
+	if data.Size < 0 {
+		data.Size = 0
+	}
+	if n := data.Size / int64(d.width*channels); n < frames {
+		// Truncated upload.
+		frames = n
+	}
+	d.frames = frames
+	d.data = io.NewSectionReader(r, data.Offset, frames*int64(d.width*channels))
+	d.r = bufio.NewReaderSize(d.data, 64<<10)
+
+	return d, nil
+}
+
+func (d *aiffDecoder) SeekFrame(n int64) error {
+	return seekFrame(d.data, d.r, n, d.frames, d.width*d.format.Channels)
+}
+
+func (d *aiffDecoder) Format() Format { return d.format }
+func (d *aiffDecoder) Frames() int64  { return d.frames }
+
+func (d *aiffDecoder) Read(p []float64) (int, error) {
+	n := len(p) / d.format.Channels * d.format.Channels
+	if n == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	if cap(d.buf) < n*d.width {
+		d.buf = make([]byte, n*d.width)
+	}
+	b := d.buf[:n*d.width]
+
+	m, err := io.ReadFull(d.r, b)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	n = m / (d.width * d.format.Channels) * d.format.Channels
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	if d.order == binary.LittleEndian && d.width == 1 {
+		// sowt 8-bit samples are still signed.
+		for i := range b[:n] {
+			p[i] = float64(int8(b[i])) / 128
+		}
+		return n, nil
+	}
+	decodePCM(p[:n], b, d.width, d.format.Float, d.order)
+	return n, nil
+}
+
+// aiffEncoder writes an uncompressed AIFF file. AIFF has no 64-bit variant,
+// so output is limited to 4 GiB.
+type aiffEncoder struct {
+	ws     io.WriteSeeker
+	w      *bufio.Writer
+	format Format
+	width  int
+	data   int64
+	buf    []byte
+}
+
+func newAIFFEncoder(w io.WriteSeeker, f Format) (*aiffEncoder, error) {
+	e := &aiffEncoder{
+		ws:     w,
+		w:      bufio.NewWriterSize(w, 256<<10),
+		format: f,
+		width:  f.BitDepth / 8,
+	}
+	if _, err := e.w.Write(e.header()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *aiffEncoder) header() []byte {
+	be := binary.BigEndian
+	b := make([]byte, 0, 12+8+18+8+8)
+
+	b = append(b, "FORM"...)
+	b = be.AppendUint32(b, uint32(4+8+18+8+8+e.data+e.data&1))
+	b = append(b, "AIFF"...)
+
+	b = append(b, "COMM"...)
+	b = be.AppendUint32(b, 18)
+	b = be.AppendUint16(b, uint16(e.format.Channels))
+	b = be.AppendUint32(b, uint32(e.data/int64(e.width*e.format.Channels)))
+	b = be.AppendUint16(b, uint16(e.format.BitDepth))
+	var rate [10]byte
+	riff.PutExtended(rate[:], float64(e.format.SampleRate))
+	b = append(b, rate[:]...)
+
+	b = append(b, "SSND"...)
+	b = be.AppendUint32(b, uint32(8+e.data))
+	b = be.AppendUint32(b, 0) // offset
+	b = be.AppendUint32(b, 0) // block size
+	return b
+}
+
+func (e *aiffEncoder) Write(p []int32) error {
+	if e.data+int64(len(p)*e.width) > maxRIFFSize-64 {
+		return ErrTooLarge
+	}
+	if cap(e.buf) < len(p)*e.width {
+		e.buf = make([]byte, len(p)*e.width)
+	}
+	b := e.buf[:len(p)*e.width]
+	encodePCM(b, p, e.width, binary.BigEndian)
+	n, err := e.w.Write(b)
+	e.data += int64(n)
+	return err
+}
+
+func (e *aiffEncoder) Close() error {
+	if e.data&1 != 0 {
+		if err := e.w.WriteByte(0); err != nil {
+			return err
+		}
+	}
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := e.ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := e.ws.Write(e.header()); err != nil {
+		return err
+	}
+	_, err := e.ws.Seek(0, io.SeekEnd)
+	return err
+}
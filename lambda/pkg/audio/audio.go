@@ -0,0 +1,173 @@
+// Package audio decodes uploaded sounds to floating point samples and encodes
+// them back out as WAV, FLAC or AIFF, resampling and dithering on the way.
+//
+// Samples are interleaved float64 values nominally in [-1, 1). Integer PCM
+// converts to and from that range exactly, so a decode/encode round trip at
+// the same rate and bit depth is lossless.
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrUnsupported = errors.New("audio: unsupported format")
+	ErrTooLarge    = errors.New("audio: output too large for container")
+)
+
+// Container names an output file format.
+type Container string
+
+const (
+	WAV  Container = "wav"
+	FLAC Container = "flac"
+	AIFF Container = "aiff"
+)
+
+// Ext returns the file extension for c, including the dot.
+func (c Container) Ext() string {
+	if c == AIFF {
+		return ".aif"
+	}
+	return "." + string(c)
+}
+
+// ContentType returns the MIME type for c.
+func (c Container) ContentType() string {
+	switch c {
+	case FLAC:
+		return "audio/flac"
+	case AIFF:
+		return "audio/aiff"
+	}
+	return "audio/wav"
+}
+
+// Format describes a PCM stream.
+type Format struct {
+	SampleRate int
+	Channels   int
+	BitDepth   int
+	// Float is set when samples are stored as IEEE floats.
+	Float bool
+}
+
+// A Decoder reads interleaved samples from an encoded stream.
+type Decoder interface {
+	Format() Format
+	// Frames returns the number of sample frames, or -1 if unknown.
+	Frames() int64
+	// Read decodes whole frames into p and returns the number of samples
+	// written. It returns io.EOF once the stream is exhausted.
+	Read(p []float64) (int, error)
+}
+
+// An Encoder writes interleaved integer samples at its bit depth.
+type Encoder interface {
+	Write(p []int32) error
+	// Close finalises headers. It does not close the underlying writer.
+	Close() error
+}
+
+// Formats of the files Open decodes, as Sniff names them.
+const (
+	FormatWAV  = "wav"
+	FormatAIFF = "aiff"
+	FormatFLAC = "flac"
+	FormatMP3  = "mp3"
+)
+
+// Sniff returns the format of the file in r, which is size bytes long, or
+// "" if it is none Open can decode.
+func Sniff(r io.ReaderAt, size int64) (string, error) {
+	var hdr [12]byte
+	n, err := r.ReadAt(hdr[:], 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	b := hdr[:n]
+
+	switch {
+	case bytes.HasPrefix(b, []byte("RIFF")), bytes.HasPrefix(b, []byte("RF64")),
+		bytes.HasPrefix(b, []byte("BW64")):
+		return FormatWAV, nil
+	case bytes.HasPrefix(b, []byte("FORM")):
+		return FormatAIFF, nil
+	case bytes.HasPrefix(b, []byte("fLaC")), bytes.HasPrefix(b, []byte("ID3")) && isFLAC(r, size):
+		return FormatFLAC, nil
+	case bytes.HasPrefix(b, []byte("ID3")), isMP3Sync(b):
+		return FormatMP3, nil
+	}
+	return "", nil
+}
+
+// Open detects the format of the file in r, which is size bytes long, and
+// returns a decoder for it.
+func Open(r io.ReaderAt, size int64) (Decoder, error) {
+	format, err := Sniff(r, size)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatWAV:
+		return newWAVDecoder(r, size)
+	case FormatAIFF:
+		return newAIFFDecoder(r, size)
+	case FormatFLAC:
+		return newFLACDecoder(r, size)
+	case FormatMP3:
+		return newMP3Decoder(r, size)
+	}
+	return nil, ErrUnsupported
+}
+
+// NewEncoder returns an encoder writing f to w in the given container.
+func NewEncoder(w io.WriteSeeker, c Container, f Format) (Encoder, error) {
+	if err := Validate(c, f); err != nil {
+		return nil, err
+	}
+	switch c {
+	case WAV:
+		return newWAVEncoder(w, f)
+	case FLAC:
+		return newFLACEncoder(w, f)
+	case AIFF:
+		return newAIFFEncoder(w, f)
+	}
+	return nil, ErrUnsupported
+}
+
+// Validate reports whether the container can hold integer PCM in format f.
+func Validate(c Container, f Format) error {
+	if f.SampleRate < 1000 || f.SampleRate > 768000 {
+		return fmt.Errorf("%w: sample rate %d", ErrUnsupported, f.SampleRate)
+	}
+	if f.Channels < 1 || f.Channels > 8 {
+		return fmt.Errorf("%w: %d channels", ErrUnsupported, f.Channels)
+	}
+	if f.Float {
+		return fmt.Errorf("%w: float output", ErrUnsupported)
+	}
+
+	switch c {
+	case WAV, AIFF:
+		if f.BitDepth != 8 && f.BitDepth != 16 && f.BitDepth != 24 && f.BitDepth != 32 {
+			return fmt.Errorf("%w: %d-bit %s", ErrUnsupported, f.BitDepth, c)
+		}
+	case FLAC:
+		if f.BitDepth != 16 && f.BitDepth != 24 {
+			return fmt.Errorf("%w: %d-bit %s", ErrUnsupported, f.BitDepth, c)
+		}
+	default:
+		return fmt.Errorf("%w: container %q", ErrUnsupported, c)
+	}
+	return nil
+}
+
+// scale returns the full-scale value of a signed integer of the given width.
+func scale(bits int) float64 {
+	return float64(int64(1) << uint(bits-1))
+}
@@ -0,0 +1,67 @@
+package audio
+
+import "io"
+
+// convertFrames is the number of frames decoded per step.
+const convertFrames = 8192
+
+// Convert decodes d and encodes it to w in container c at the given sample
+// rate and bit depth, keeping the channel count. Audio is resampled when the
+// rate changes and dithered when the bit depth drops. Resampled audio going
+// to 16 bits or fewer is dithered too, since it no longer sits on the
+// source's sample grid.
+func Convert(w io.WriteSeeker, d Decoder, c Container, sampleRate, bitDepth int) error {
+	in := d.Format()
+	out := Format{SampleRate: sampleRate, Channels: in.Channels, BitDepth: bitDepth}
+
+	enc, err := NewEncoder(w, c, out)
+	if err != nil {
+		return err
+	}
+
+	var rs *Resampler
+	if in.SampleRate != out.SampleRate {
+		if rs, err = NewResampler(in.Channels, in.SampleRate, out.SampleRate); err != nil {
+			return err
+		}
+	}
+	dither := out.BitDepth < in.BitDepth || (rs != nil && out.BitDepth <= 16)
+	q := NewQuantizer(out.BitDepth, dither)
+
+	buf := make([]float64, convertFrames*in.Channels)
+	var res []float64
+	var ints []int32
+
+	write := func(p []float64) error {
+		ints = q.Quantize(ints[:0], p)
+		return enc.Write(ints)
+	}
+
+	for {
+		n, err := d.Read(buf)
+		if n > 0 {
+			p := buf[:n]
+			if rs != nil {
+				res = rs.Process(res[:0], p)
+				p = res
+			}
+			if err := write(p); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if rs != nil {
+		if err := write(rs.Flush(res[:0])); err != nil {
+			return err
+		}
+	}
+
+	return enc.Close()
+}
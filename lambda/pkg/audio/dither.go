@@ -0,0 +1,46 @@
+package audio
+
+import (
+	"math"
+	"math/rand"
+)
+
+// A Quantizer rounds float samples to integers of a given bit depth,
+// optionally adding triangular (TPDF) dither of ±1 LSB first so the
+// quantisation error is signal independent.
+type Quantizer struct {
+	bits   int
+	dither bool
+	rng    *rand.Rand
+}
+
+// NewQuantizer returns a quantizer for the given bit depth. The dither
+// sequence is seeded deterministically so repeated exports are identical.
+func NewQuantizer(bits int, dither bool) *Quantizer {
+	return &Quantizer{
+		bits:   bits,
+		dither: dither,
+		rng:    rand.New(rand.NewSource(int64(bits))),
+	}
+}
+
+// Quantize appends the quantised samples of p to dst.
+func (q *Quantizer) Quantize(dst []int32, p []float64) []int32 {
+	s := scale(q.bits)
+	lo, hi := -s, s-1
+
+	for _, v := range p {
+		x := v * s
+		if q.dither {
+			x += q.rng.Float64() - q.rng.Float64()
+		}
+		x = math.Floor(x + 0.5)
+		if x < lo {
+			x = lo
+		} else if x > hi {
+			x = hi
+		}
+		dst = append(dst, int32(x))
+	}
+	return dst
+}
@@ -0,0 +1,325 @@
+package audio
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// isFLAC reports whether the ID3v2 tag at the start of r is followed by a
+// FLAC stream, as some taggers write.
+func isFLAC(r io.ReaderAt, size int64) bool {
+	var hdr [10]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return false
+	}
+	n := int64(hdr[6])<<21 | int64(hdr[7])<<14 | int64(hdr[8])<<7 | int64(hdr[9])
+	off := 10 + n
+	if hdr[5]&0x10 != 0 {
+		off += 10 // footer
+	}
+	var sig [4]byte
+	if off+4 > size {
+		return false
+	}
+	if _, err := r.ReadAt(sig[:], off); err != nil {
+		return false
+	}
+	return string(sig[:]) == "fLaC"
+}
+
+type flacDecoder struct {
+	stream *flac.Stream
+	format Format
+	frame  *frame.Frame
+	pos    int
+}
+
+func newFLACDecoder(r io.ReaderAt, size int64) (*flacDecoder, error) {
+	stream, err := flac.New(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	return &flacDecoder{
+		stream: stream,
+		format: Format{
+			SampleRate: int(stream.Info.SampleRate),
+			Channels:   int(stream.Info.NChannels),
+			BitDepth:   int(stream.Info.BitsPerSample),
+		},
+	}, nil
+}
+
+func (d *flacDecoder) Format() Format { return d.format }
+
+func (d *flacDecoder) Frames() int64 {
+	if d.stream.Info.NSamples == 0 {
+		return -1
+	}
+	return int64(d.stream.Info.NSamples)
+}
+
+func (d *flacDecoder) Read(p []float64) (int, error) {
+	channels := d.format.Channels
+	if len(p) < channels {
+		return 0, io.ErrShortBuffer
+	}
+	s := scale(d.format.BitDepth)
+
+	n := 0
+	for n+channels <= len(p) {
+		if d.frame == nil || d.pos >= int(d.frame.BlockSize) {
+			f, err := d.stream.ParseNext()
+			if err == io.EOF && n > 0 {
+				break
+			}
+			if err != nil {
+				return n, err
+			}
+			if len(f.Subframes) != channels {
+				return n, fmt.Errorf("audio: FLAC frame has %d channels, want %d", len(f.Subframes), channels)
+			}
+			d.frame, d.pos = f, 0
+		}
+		for ; d.pos < int(d.frame.BlockSize) && n+channels <= len(p); d.pos++ {
+			for _, sub := range d.frame.Subframes {
+				p[n] = float64(sub.Samples[d.pos]) / s
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// flacBlockSize is the number of frames per FLAC block, as used by the
+// reference encoder.
+const flacBlockSize = 4096
+
+// flacMaxPartOrder bounds the Rice partition search.
+const flacMaxPartOrder = 6
+
+// flacEncoder writes FLAC using fixed linear predictors, picking the order
+// and Rice parameters per subframe. It compresses less than libFLAC's LPC
+// search but is lossless and fast.
+type flacEncoder struct {
+	enc     *flac.Encoder
+	format  Format
+	samples [][]int32
+}
+
+// noCloser hides Close so the FLAC encoder doesn't close the caller's file.
+type noCloser struct {
+	io.WriteSeeker
+}
+
+func newFLACEncoder(w io.WriteSeeker, f Format) (*flacEncoder, error) {
+	info := &meta.StreamInfo{
+		BlockSizeMin:  flacBlockSize,
+		BlockSizeMax:  flacBlockSize,
+		SampleRate:    uint32(f.SampleRate),
+		NChannels:     uint8(f.Channels),
+		BitsPerSample: uint8(f.BitDepth),
+	}
+	enc, err := flac.NewEncoder(noCloser{w}, info)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &flacEncoder{
+		enc:     enc,
+		format:  f,
+		samples: make([][]int32, f.Channels),
+	}
+	for i := range e.samples {
+		e.samples[i] = make([]int32, 0, flacBlockSize)
+	}
+	return e, nil
+}
+
+func (e *flacEncoder) Write(p []int32) error {
+	channels := e.format.Channels
+	for i := 0; i+channels <= len(p); i += channels {
+		for c := range e.samples {
+			e.samples[c] = append(e.samples[c], p[i+c])
+		}
+		if len(e.samples[0]) == flacBlockSize {
+			if err := e.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *flacEncoder) flush() error {
+	n := len(e.samples[0])
+	if n == 0 {
+		return nil
+	}
+
+	f := &frame.Frame{
+		Header: frame.Header{
+			HasFixedBlockSize: true,
+			BlockSize:         uint16(n),
+			Channels:          frame.Channels(e.format.Channels - 1),
+			BitsPerSample:     uint8(e.format.BitDepth),
+		},
+	}
+	for c := range e.samples {
+		f.Subframes = append(f.Subframes, flacSubframe(e.samples[c], e.format.BitDepth))
+	}
+
+	if err := e.enc.WriteFrame(f); err != nil {
+		return err
+	}
+	for c := range e.samples {
+		e.samples[c] = make([]int32, 0, flacBlockSize)
+	}
+	return nil
+}
+
+func (e *flacEncoder) Close() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.enc.Close()
+}
+
+// flacSubframe picks the cheapest of constant, verbatim and fixed order 0-4
+// prediction for the samples.
+func flacSubframe(samples []int32, bps int) *frame.Subframe {
+	n := len(samples)
+	sub := &frame.Subframe{Samples: samples, NSamples: n}
+
+	constant := true
+	for _, s := range samples[1:] {
+		if s != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		sub.Pred = frame.PredConstant
+		return sub
+	}
+
+	best := n * bps // verbatim
+	sub.Pred = frame.PredVerbatim
+
+	residuals := make([]int32, n)
+	for order := 0; order <= 4 && order < n; order++ {
+		fixedResiduals(residuals[:n-order], samples, order)
+		rice, bits := riceParams(residuals[:n-order], n, order)
+		bits += order * bps
+		if bits < best {
+			best = bits
+			sub.Pred = frame.PredFixed
+			sub.Order = order
+			sub.RiceSubframe = rice
+		}
+	}
+
+	if sub.Pred == frame.PredFixed {
+		sub.ResidualCodingMethod = frame.ResidualCodingMethodRice1
+		for _, p := range sub.RiceSubframe.Partitions {
+			if p.Param >= 15 {
+				sub.ResidualCodingMethod = frame.ResidualCodingMethodRice2
+			}
+		}
+	}
+	return sub
+}
+
+// fixedResiduals writes the fixed predictor residuals of the given order.
+func fixedResiduals(dst, s []int32, order int) {
+	for i := order; i < len(s); i++ {
+		var pred int64
+		switch order {
+		case 1:
+			pred = int64(s[i-1])
+		case 2:
+			pred = 2*int64(s[i-1]) - int64(s[i-2])
+		case 3:
+			pred = 3*int64(s[i-1]) - 3*int64(s[i-2]) + int64(s[i-3])
+		case 4:
+			pred = 4*int64(s[i-1]) - 6*int64(s[i-2]) + 4*int64(s[i-3]) - int64(s[i-4])
+		}
+		dst[i-order] = int32(int64(s[i]) - pred)
+	}
+}
+
+// riceParams chooses the partition order and per-partition Rice parameters
+// for the residuals of an n-sample subframe, returning them with the
+// resulting size in bits.
+func riceParams(res []int32, n, order int) (*frame.RiceSubframe, int) {
+	var best *frame.RiceSubframe
+	bestBits := -1
+
+	for po := 0; po <= flacMaxPartOrder; po++ {
+		parts := 1 << uint(po)
+		if n%parts != 0 || n/parts <= order {
+			break
+		}
+
+		rice := &frame.RiceSubframe{PartOrder: po}
+		bits := 6 // coding method and partition order
+		start := 0
+		for i := 0; i < parts; i++ {
+			size := n / parts
+			if i == 0 {
+				size -= order
+			}
+			k, b := riceParam(res[start : start+size])
+			rice.Partitions = append(rice.Partitions, frame.RicePartition{Param: k})
+			bits += 5 + b
+			start += size
+		}
+
+		if bestBits < 0 || bits < bestBits {
+			best, bestBits = rice, bits
+		}
+	}
+	return best, bestBits
+}
+
+// riceParam returns the Rice parameter minimising the coded size of res.
+func riceParam(res []int32) (uint, int) {
+	var sum uint64
+	for _, r := range res {
+		sum += uint64(zigzag(r))
+	}
+
+	// Start from the estimate log2(mean) and refine by one either side.
+	k := uint(0)
+	if len(res) > 0 {
+		for mean := sum / uint64(len(res)); mean > 1 && k < 30; mean >>= 1 {
+			k++
+		}
+	}
+
+	bestK, bestBits := k, riceBits(res, k)
+	for _, c := range []uint{k - 1, k + 1} {
+		if c > 30 {
+			continue
+		}
+		if b := riceBits(res, c); b < bestBits {
+			bestK, bestBits = c, b
+		}
+	}
+	return bestK, bestBits
+}
+
+func riceBits(res []int32, k uint) int {
+	bits := len(res) * int(k+1)
+	for _, r := range res {
+		bits += int(zigzag(r) >> k)
+	}
+	return bits
+}
+
+func zigzag(r int32) uint32 {
+	return uint32(r<<1) ^ uint32(r>>31)
+}
@@ -0,0 +1,65 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// isMP3Sync reports whether b starts with an MPEG audio layer I-III frame
+// sync. ADTS AAC shares the sync word but has a zero layer field.
+func isMP3Sync(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0xFF && b[1]&0xE0 == 0xE0 && b[1]&0x06 != 0
+}
+
+// mp3Decoder wraps go-mp3, which always produces 16-bit stereo.
+type mp3Decoder struct {
+	dec *mp3.Decoder
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newMP3Decoder(r io.ReaderAt, size int64) (*mp3Decoder, error) {
+	// Hide Seek so the decoder doesn't scan the whole file for its length
+	// up front.
+	src := struct{ io.Reader }{io.NewSectionReader(r, 0, size)}
+	dec, err := mp3.NewDecoder(src)
+	if err != nil {
+		return nil, err
+	}
+	return &mp3Decoder{dec: dec, r: bufio.NewReaderSize(dec, 64<<10)}, nil
+}
+
+func (d *mp3Decoder) Format() Format {
+	return Format{SampleRate: d.dec.SampleRate(), Channels: 2, BitDepth: 16}
+}
+
+func (d *mp3Decoder) Frames() int64 { return -1 }
+
+func (d *mp3Decoder) Read(p []float64) (int, error) {
+	n := len(p) / 2 * 2
+	if n == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	if cap(d.buf) < n*2 {
+		d.buf = make([]byte, n*2)
+	}
+	b := d.buf[:n*2]
+
+	m, err := io.ReadFull(d.r, b)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	n = m / 4 * 2
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	decodePCM(p[:n], b, 2, false, binary.LittleEndian)
+	return n, nil
+}
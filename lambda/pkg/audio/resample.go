@@ -0,0 +1,183 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// resampleZeros is the number of sinc zero crossings each side of the
+	// filter centre.
+	resampleZeros = 64
+	// resampleRolloff places the cutoff just below Nyquist so the Kaiser
+	// transition band ends at it.
+	resampleRolloff = 0.95
+	// resampleBeta gives roughly 96 dB of stopband attenuation.
+	resampleBeta = 9.6
+	// maxPhases bounds the polyphase table for awkward rate pairs.
+	maxPhases = 16384
+)
+
+// A Resampler converts interleaved samples between sample rates with a
+// polyphase windowed-sinc filter. The rate ratio is reduced to up/down
+// integers and every output sample is computed exactly on the rational grid,
+// with no interpolation between filter phases.
+type Resampler struct {
+	channels int
+	up, down int64
+	taps     int
+	center   int64
+	poly     [][]float64
+
+	// hist holds interleaved input frames from index base onwards.
+	hist []float64
+	base int64
+	in   int64
+	out  int64
+}
+
+// NewResampler returns a resampler from one sample rate to another.
+func NewResampler(channels, from, to int) (*Resampler, error) {
+	if channels < 1 || from < 1 || to < 1 {
+		return nil, fmt.Errorf("%w: resample %d Hz to %d Hz", ErrUnsupported, from, to)
+	}
+	g := gcd(from, to)
+	up, down := to/g, from/g
+	if up > maxPhases {
+		return nil, fmt.Errorf("%w: resample %d Hz to %d Hz", ErrUnsupported, from, to)
+	}
+
+	widest := up
+	if down > widest {
+		widest = down
+	}
+	// Cutoff in cycles per sample at the upsampled rate.
+	fc := 0.5 * resampleRolloff / float64(widest)
+	length := 2 * resampleZeros / (2 * fc)
+	taps := int(math.Ceil(length / float64(up)))
+	if taps%2 != 0 {
+		// Keep the filter centre on an integer tap.
+		taps++
+	}
+
+	n := up * taps
+	half := float64(n / 2)
+	poly := make([][]float64, up)
+	for p := range poly {
+		poly[p] = make([]float64, taps)
+	}
+	i0b := besselI0(resampleBeta)
+	for i := 0; i < n; i++ {
+		t := float64(i - n/2)
+		x := t / half
+		w := 0.0
+		if x > -1 && x < 1 {
+			w = besselI0(resampleBeta*math.Sqrt(1-x*x)) / i0b
+		}
+		// Each phase sees every up'th tap, so scale by up for unity gain.
+		poly[i%up][i/up] = 2 * fc * sinc(2*fc*t) * w * float64(up)
+	}
+
+	return &Resampler{
+		channels: channels,
+		up:       int64(up),
+		down:     int64(down),
+		taps:     taps,
+		center:   int64(n / 2),
+		poly:     poly,
+	}, nil
+}
+
+// Process consumes interleaved input frames and appends the output frames
+// they make available to dst.
+func (r *Resampler) Process(dst, p []float64) []float64 {
+	r.hist = append(r.hist, p[:len(p)/r.channels*r.channels]...)
+	r.in += int64(len(p) / r.channels)
+
+	for {
+		last := (r.out*r.down + r.center) / r.up
+		if last >= r.in {
+			break
+		}
+		dst = r.next(dst)
+	}
+	r.trim()
+	return dst
+}
+
+// Flush appends the remaining output once all input has been processed,
+// treating the signal beyond the end as silence.
+func (r *Resampler) Flush(dst []float64) []float64 {
+	total := (r.in*r.up + r.down - 1) / r.down
+	for r.out < total {
+		dst = r.next(dst)
+	}
+	r.hist = r.hist[:0]
+	return dst
+}
+
+// Frames returns the number of output frames for n input frames.
+func (r *Resampler) Frames(n int64) int64 {
+	return (n*r.up + r.down - 1) / r.down
+}
+
+// next computes output frame r.out.
+func (r *Resampler) next(dst []float64) []float64 {
+	u := r.out*r.down + r.center
+	last := u / r.up
+	h := r.poly[u%r.up]
+
+	for c := 0; c < r.channels; c++ {
+		var sum float64
+		for k, coef := range h {
+			j := last - int64(k)
+			if j < r.base || j >= r.in {
+				continue
+			}
+			sum += coef * r.hist[(j-r.base)*int64(r.channels)+int64(c)]
+		}
+		dst = append(dst, sum)
+	}
+	r.out++
+	return dst
+}
+
+// trim drops input frames no later output depends on.
+func (r *Resampler) trim() {
+	first := (r.out*r.down+r.center)/r.up - int64(r.taps) + 1
+	if drop := first - r.base; drop > 0 {
+		if held := int64(len(r.hist) / r.channels); drop > held {
+			drop = held
+		}
+		n := copy(r.hist, r.hist[drop*int64(r.channels):])
+		r.hist = r.hist[:n]
+		r.base += drop
+	}
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 64; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+		if term < sum*1e-16 {
+			break
+		}
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
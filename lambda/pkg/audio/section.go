@@ -0,0 +1,124 @@
+package audio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// A FrameSeeker is a Decoder that can move to a frame without decoding the
+// audio before it.
+type FrameSeeker interface {
+	SeekFrame(n int64) error
+}
+
+func seekFrame(data *io.SectionReader, r *bufio.Reader, n, frames int64, align int) error {
+	if n < 0 || n > frames {
+		return fmt.Errorf("seek to frame %d of %d", n, frames)
+	}
+	if _, err := data.Seek(n*int64(align), io.SeekStart); err != nil {
+		return err
+	}
+	r.Reset(data)
+	return nil
+}
+
+type section struct {
+	Decoder
+	left int64 // samples
+}
+
+// Section returns a decoder for frames [start, end) of d, which must not have
+// been read from yet. Decoders that cannot seek are read up to start.
+func Section(d Decoder, start, end int64) (Decoder, error) {
+	if n := d.Frames(); n >= 0 && end > n {
+		end = n
+	}
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid section [%d, %d)", start, end)
+	}
+
+	ch := int64(d.Format().Channels)
+	if s, ok := d.(FrameSeeker); ok {
+		if err := s.SeekFrame(start); err != nil {
+			return nil, err
+		}
+	} else if err := discard(d, start*ch); err != nil {
+		return nil, err
+	}
+	return &section{d, (end - start) * ch}, nil
+}
+
+func discard(d Decoder, n int64) error {
+	buf := make([]float64, convertFrames*d.Format().Channels)
+	for n > 0 {
+		p := buf
+		if int64(len(p)) > n {
+			p = p[:n]
+		}
+		m, err := d.Read(p)
+		n -= int64(m)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *section) Frames() int64 { return s.left / int64(s.Format().Channels) }
+
+func (s *section) Read(p []float64) (int, error) {
+	if s.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.Decoder.Read(p)
+	s.left -= int64(n)
+	return n, err
+}
+
+type fade struct {
+	Decoder
+	in, out int64 // frames
+	total   int64
+	pos     int64
+}
+
+// Fade applies linear gain ramps over the first in and last out frames of d,
+// which must know its length.
+func Fade(d Decoder, in, out int64) (Decoder, error) {
+	total := d.Frames()
+	if total < 0 {
+		return nil, fmt.Errorf("%w: fade without a known length", ErrUnsupported)
+	}
+	if in < 0 || out < 0 || in > total || out > total {
+		return nil, fmt.Errorf("fades of %d and %d frames exceed %d frames", in, out, total)
+	}
+	return &fade{Decoder: d, in: in, out: out, total: total}, nil
+}
+
+func (f *fade) Read(p []float64) (int, error) {
+	n, err := f.Decoder.Read(p)
+	ch := f.Format().Channels
+	for i := 0; i+ch <= n; i += ch {
+		g := 1.0
+		if f.pos < f.in {
+			g = float64(f.pos) / float64(f.in)
+		}
+		if r := f.total - 1 - f.pos; r < f.out {
+			g *= float64(r) / float64(f.out)
+		}
+		if g != 1 {
+			for c := i; c < i+ch; c++ {
+				p[c] *= g
+			}
+		}
+		f.pos++
+	}
+	return n, err
+}
@@ -0,0 +1,310 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"wavey.ai/pkg/riff"
+)
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+// maxRIFFSize is the largest RIFF size field; bigger files become RF64.
+const maxRIFFSize = 0xFFFFFFFF
+
+type wavDecoder struct {
+	format Format
+	width  int // bytes per sample
+	frames int64
+	data   *io.SectionReader
+	r      *bufio.Reader
+	buf    []byte
+}
+
+func newWAVDecoder(r io.ReaderAt, size int64) (*wavDecoder, error) {
+	f, err := riff.New(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if !f.IsWAVE() {
+		return nil, ErrUnsupported
+	}
+
+	c, ok := f.Chunk("fmt ")
+	if !ok || c.Size < 16 {
+		return nil, fmt.Errorf("%w: missing fmt chunk", ErrUnsupported)
+	}
+	b, err := f.Bytes(c, 1<<10)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := binary.LittleEndian.Uint16(b[0:2])
+	channels := int(binary.LittleEndian.Uint16(b[2:4]))
+	rate := int(binary.LittleEndian.Uint32(b[4:8]))
+	align := int(binary.LittleEndian.Uint16(b[12:14]))
+	bits := int(binary.LittleEndian.Uint16(b[14:16]))
+	valid := bits
+	if tag == wavFormatExtensible && len(b) >= 40 {
+		if v := int(binary.LittleEndian.Uint16(b[18:20])); v > 0 && v <= bits {
+			valid = v
+		}
+		tag = binary.LittleEndian.Uint16(b[24:26])
+	}
+
+	if channels < 1 || align < channels || align%channels != 0 {
+		return nil, fmt.Errorf("%w: bad block alignment", ErrUnsupported)
+	}
+	width := align / channels
+
+	d := &wavDecoder{
+		format: Format{SampleRate: rate, Channels: channels, BitDepth: valid},
+		width:  width,
+	}
+	switch {
+	case tag == wavFormatPCM && width >= 1 && width <= 4:
+	case tag == wavFormatFloat && (width == 4 || width == 8):
+		d.format.Float = true
+	default:
+		return nil, fmt.Errorf("%w: WAVE format 0x%04x, %d bits", ErrUnsupported, tag, bits)
+	}
+
+	data, ok := f.Chunk("data")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing data chunk", ErrUnsupported)
+	}
+	d.frames = data.Size / int64(align)
+	d.data = io.NewSectionReader(r, data.Offset, d.frames*int64(align))
+	d.r = bufio.NewReaderSize(d.data, 64<<10)
+
+	return d, nil
+}
+
+func (d *wavDecoder) SeekFrame(n int64) error {
+	return seekFrame(d.data, d.r, n, d.frames, d.width*d.format.Channels)
+}
+
+func (d *wavDecoder) Format() Format { return d.format }
+func (d *wavDecoder) Frames() int64  { return d.frames }
+
+func (d *wavDecoder) Read(p []float64) (int, error) {
+	n := len(p) / d.format.Channels * d.format.Channels
+	if n == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	if cap(d.buf) < n*d.width {
+		d.buf = make([]byte, n*d.width)
+	}
+	b := d.buf[:n*d.width]
+
+	m, err := io.ReadFull(d.r, b)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	n = m / (d.width * d.format.Channels) * d.format.Channels
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	decodePCM(p[:n], b, d.width, d.format.Float, binary.LittleEndian)
+	return n, nil
+}
+
+// decodePCM converts packed samples to floats. 8-bit little endian samples
+// are unsigned, as in WAV.
+func decodePCM(p []float64, b []byte, width int, float bool, order binary.ByteOrder) {
+	le := order == binary.LittleEndian
+	for i := range p {
+		s := b[i*width : (i+1)*width]
+		switch {
+		case float && width == 4:
+			p[i] = float64(math.Float32frombits(order.Uint32(s)))
+		case float:
+			p[i] = math.Float64frombits(order.Uint64(s))
+		case width == 1 && le:
+			p[i] = float64(int(s[0])-128) / 128
+		case width == 1:
+			p[i] = float64(int8(s[0])) / 128
+		case width == 2:
+			p[i] = float64(int16(order.Uint16(s))) / scale(16)
+		case width == 3 && le:
+			p[i] = float64(int32(uint32(s[0])<<8|uint32(s[1])<<16|uint32(s[2])<<24)>>8) / scale(24)
+		case width == 3:
+			p[i] = float64(int32(uint32(s[2])<<8|uint32(s[1])<<16|uint32(s[0])<<24)>>8) / scale(24)
+		default:
+			p[i] = float64(int32(order.Uint32(s))) / scale(32)
+		}
+	}
+}
+
+// encodePCM packs integer samples of the given width.
+func encodePCM(b []byte, p []int32, width int, order binary.ByteOrder) {
+	le := order == binary.LittleEndian
+	for i, v := range p {
+		s := b[i*width : (i+1)*width]
+		switch {
+		case width == 1 && le:
+			s[0] = byte(v + 128)
+		case width == 1:
+			s[0] = byte(v)
+		case width == 2:
+			order.PutUint16(s, uint16(v))
+		case width == 3 && le:
+			s[0], s[1], s[2] = byte(v), byte(v>>8), byte(v>>16)
+		case width == 3:
+			s[0], s[1], s[2] = byte(v>>16), byte(v>>8), byte(v)
+		default:
+			order.PutUint32(s, uint32(v))
+		}
+	}
+}
+
+// wavEncoder writes a RIFF WAVE file, reserving a JUNK chunk after the header
+// that is rewritten as ds64 if the file outgrows 4 GiB (EBU Tech 3306).
+type wavEncoder struct {
+	ws     io.WriteSeeker
+	w      *bufio.Writer
+	format Format
+	width  int
+	data   int64
+	buf    []byte
+}
+
+// Chunk body sizes. The extensible fmt chunk is used for more than two
+// channels.
+const (
+	wavDS64Size   = 28
+	wavFmtSize    = 16
+	wavFmtExtSize = 40
+)
+
+func newWAVEncoder(w io.WriteSeeker, f Format) (*wavEncoder, error) {
+	e := &wavEncoder{
+		ws:     w,
+		w:      bufio.NewWriterSize(w, 256<<10),
+		format: f,
+		width:  f.BitDepth / 8,
+	}
+	if _, err := e.w.Write(e.header(false)); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *wavEncoder) fmtSize() int {
+	if e.format.Channels > 2 {
+		return wavFmtExtSize
+	}
+	return wavFmtSize
+}
+
+// riffSize returns the RIFF size field for the current data size.
+func (e *wavEncoder) riffSize() int64 {
+	return 4 + 8 + wavDS64Size + 8 + int64(e.fmtSize()) + 8 + e.data + e.data&1
+}
+
+// header builds the file header for the current data size.
+func (e *wavEncoder) header(rf64 bool) []byte {
+	le := binary.LittleEndian
+	fmtSize := e.fmtSize()
+	riffSize := e.riffSize()
+
+	b := make([]byte, 0, 12+8+wavDS64Size+8+fmtSize+8)
+	u16 := func(v uint16) { b = le.AppendUint16(b, v) }
+	u32 := func(v uint32) { b = le.AppendUint32(b, v) }
+	u64 := func(v uint64) { b = le.AppendUint64(b, v) }
+
+	if rf64 {
+		b = append(b, "RF64"...)
+		u32(maxRIFFSize)
+	} else {
+		b = append(b, "RIFF"...)
+		u32(uint32(riffSize))
+	}
+	b = append(b, "WAVE"...)
+
+	if rf64 {
+		b = append(b, "ds64"...)
+		u32(wavDS64Size)
+		u64(uint64(riffSize))
+		u64(uint64(e.data))
+		u64(uint64(e.data / int64(e.width*e.format.Channels)))
+		u32(0)
+	} else {
+		b = append(b, "JUNK"...)
+		u32(wavDS64Size)
+		b = append(b, make([]byte, wavDS64Size)...)
+	}
+
+	align := e.width * e.format.Channels
+	b = append(b, "fmt "...)
+	u32(uint32(fmtSize))
+	if fmtSize == wavFmtExtSize {
+		u16(wavFormatExtensible)
+	} else {
+		u16(wavFormatPCM)
+	}
+	u16(uint16(e.format.Channels))
+	u32(uint32(e.format.SampleRate))
+	u32(uint32(e.format.SampleRate * align))
+	u16(uint16(align))
+	u16(uint16(e.format.BitDepth))
+	if fmtSize == wavFmtExtSize {
+		u16(22)
+		u16(uint16(e.format.BitDepth))
+		u32(0) // unassigned channel positions
+		// KSDATAFORMAT_SUBTYPE_PCM
+		u16(wavFormatPCM)
+		b = append(b, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71)
+	}
+
+	b = append(b, "data"...)
+	if rf64 {
+		u32(maxRIFFSize)
+	} else {
+		u32(uint32(e.data))
+	}
+	return b
+}
+
+func (e *wavEncoder) Write(p []int32) error {
+	if cap(e.buf) < len(p)*e.width {
+		e.buf = make([]byte, len(p)*e.width)
+	}
+	b := e.buf[:len(p)*e.width]
+	encodePCM(b, p, e.width, binary.LittleEndian)
+	n, err := e.w.Write(b)
+	e.data += int64(n)
+	return err
+}
+
+func (e *wavEncoder) Close() error {
+	if e.data&1 != 0 {
+		if err := e.w.WriteByte(0); err != nil {
+			return err
+		}
+	}
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+
+	rf64 := e.riffSize() > maxRIFFSize
+	if _, err := e.ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := e.ws.Write(e.header(rf64)); err != nil {
+		return err
+	}
+	_, err := e.ws.Seek(0, io.SeekEnd)
+	return err
+}
@@ -0,0 +1,133 @@
+// Package clips holds the rules clips are checked against before they are
+// written, shared by every endpoint that creates or changes them.
+package clips
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+const (
+	// MaxHz is the highest clip timebase accepted.
+	MaxHz = 768000
+	// MaxPosition keeps start and end far enough from overflow that they can
+	// be scaled between sample rates.
+	MaxPosition = 1 << 40
+
+	MaxNameLength  = 200
+	MaxNotesLength = 4000
+	MaxLabels      = 20
+	MaxLabelLength = 50
+)
+
+var colourPattern = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// Sound is the part of a formats row clips are checked against. SampleRate
+// and Frames are zero for uploads whose length could not be determined.
+// Deleting is set once the sound is being deleted and TrashedAt while it
+// is in the trash; no clips should be added to it in either case.
+type Sound struct {
+	Key        string `dynamodbav:"key"`
+	SampleRate int64  `dynamodbav:"sampleRate"`
+	Frames     int64  `dynamodbav:"frames"`
+	Deleting   string `dynamodbav:"deleting"`
+	TrashedAt  int64  `dynamodbav:"trashedAt"`
+}
+
+// FieldError describes a problem with one field of a clip.
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// CheckRange validates a clip's start, end and timebase, and that the range
+// lies within sound when its length is known.
+func CheckRange(start, end, hz int64, sound *Sound) []FieldError {
+	var errs []FieldError
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{field, fmt.Sprintf(format, args...)})
+	}
+
+	if hz <= 0 || hz > MaxHz {
+		fail("hz", "hz must be between 1 and %d", MaxHz)
+	}
+	if start < 0 || start > MaxPosition {
+		fail("start", "start must be between 0 and %d", int64(MaxPosition))
+	}
+	if end <= start || end > MaxPosition {
+		fail("end", "end must be after start")
+	}
+	if len(errs) > 0 || sound == nil || sound.SampleRate <= 0 || sound.Frames <= 0 {
+		return errs
+	}
+
+	// Allow end to round up to the next tick of the clip's timebase.
+	if end*sound.SampleRate >= sound.Frames*hz+sound.SampleRate {
+		fail("end", "end is past the end of the sound (%d frames at %d Hz)", sound.Frames, sound.SampleRate)
+	}
+	return errs
+}
+
+// CheckMeta validates a clip's descriptive fields. Colour and labels should
+// already be normalised with Colour and Labels.
+func CheckMeta(name, colour, notes string, labels []string) []FieldError {
+	var errs []FieldError
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{field, fmt.Sprintf(format, args...)})
+	}
+
+	if utf8.RuneCountInString(name) > MaxNameLength {
+		fail("name", "name must be at most %d characters", MaxNameLength)
+	}
+	if colour != "" && !colourPattern.MatchString(colour) {
+		fail("colour", "colour must be a hex colour like #ff8800")
+	}
+	if utf8.RuneCountInString(notes) > MaxNotesLength {
+		fail("notes", "notes must be at most %d characters", MaxNotesLength)
+	}
+	if len(labels) > MaxLabels {
+		fail("labels", "a clip can have at most %d labels", MaxLabels)
+	}
+	for _, l := range labels {
+		if utf8.RuneCountInString(l) > MaxLabelLength {
+			fail("labels", "label %q is longer than %d characters", l, MaxLabelLength)
+		}
+	}
+	return errs
+}
+
+// Colour normalises a colour to lower case.
+func Colour(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// Labels normalises labels so they match regardless of case and spacing,
+// dropping empty and duplicate ones. The result is never nil.
+func Labels(ls []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, l := range ls {
+		l = strings.ToLower(strings.TrimSpace(l))
+		if l == "" || seen[l] {
+			continue
+		}
+		seen[l] = true
+		out = append(out, l)
+	}
+	return out
+}
+
+// VersionCondition matches a clip still at version v, so that concurrent
+// writes from stale copies fail. Clips written before versions were recorded
+// count as version 0.
+func VersionCondition(v int64) expression.ConditionBuilder {
+	if v == 0 {
+		return expression.Name("key").AttributeExists().
+			And(expression.Name("version").AttributeNotExists())
+	}
+	return expression.Name("version").Equal(expression.Value(v))
+}
@@ -0,0 +1,377 @@
+// Package collections keeps users' named collections of sounds and clips.
+// A collection is one row in the collections table, keyed by user and
+// collection key, holding its items in order, so reading or reordering it
+// is a single read or write. A sound or clip can be in any number of
+// collections.
+//
+// Every write is conditional on the row's version and is retried from a
+// fresh read when another write got in first, so concurrent changes to a
+// collection never undo each other.
+package collections
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+// MaxItems bounds the items in one collection, which keeps its row well
+// inside the DynamoDB item size limit.
+const MaxItems = 1000
+
+// MaxName bounds the length of a collection name in characters.
+const MaxName = 128
+
+// maxAttempts bounds the retries of a write that loses a race.
+const maxAttempts = 5
+
+// Kinds of item.
+const (
+	KindSound = "sound"
+	KindClip  = "clip"
+)
+
+var (
+	// ErrInvalid means a name was empty, too long or not printable.
+	ErrInvalid = errors.New("collections: names must be 1 to " + strconv.Itoa(MaxName) + " printable characters")
+	// ErrTooMany means a collection would hold more than MaxItems items.
+	ErrTooMany = errors.New("collections: at most " + strconv.Itoa(MaxItems) + " items per collection")
+	// ErrChanged means a reorder didn't list exactly the collection's
+	// items, because they changed since they were read.
+	ErrChanged = errors.New("collections: items changed since they were read")
+	// ErrKind means an item wasn't a sound or clip with a key.
+	ErrKind = errors.New(`collections: items must be of kind "sound" or "clip" and have a key`)
+	// ErrBusy means a write kept losing races with other writes.
+	ErrBusy = errors.New("collections: too many concurrent changes")
+)
+
+// Item is a sound or clip in a collection.
+type Item struct {
+	Kind    string `json:"kind" dynamodbav:"kind"`
+	Key     string `json:"key" dynamodbav:"key"`
+	AddedAt int64  `json:"addedAt" dynamodbav:"addedAt"`
+}
+
+// Collection is a user's collection.
+type Collection struct {
+	Key       string `json:"key" dynamodbav:"key"`
+	User      string `json:"-" dynamodbav:"user"`
+	Name      string `json:"name" dynamodbav:"name"`
+	Items     []Item `json:"items" dynamodbav:"items"`
+	Version   int64  `json:"version" dynamodbav:"version"`
+	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt int64  `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// Index returns the position of the item with the given key, or -1.
+func (c *Collection) Index(key string) int {
+	for i, it := range c.Items {
+		if it.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Store reads and writes collections.
+type Store struct {
+	dbCl           *dynamodb.Client
+	collectionsTbl string
+	formatsTbl     string
+	clipsTbl       string
+}
+
+func New(dbCl *dynamodb.Client, collectionsTbl, formatsTbl, clipsTbl string) *Store {
+	return &Store{dbCl, collectionsTbl, formatsTbl, clipsTbl}
+}
+
+// NormalizeName trims a collection name and collapses its spaces.
+func NormalizeName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" || len([]rune(name)) > MaxName {
+		return "", ErrInvalid
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return "", ErrInvalid
+		}
+	}
+	return name, nil
+}
+
+// List returns the user's collections, oldest first.
+func (s *Store) List(ctx context.Context, user string) ([]Collection, error) {
+	keyEx := expression.Key("user").Equal(expression.Value(user))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []Collection{}
+	p := dynamodb.NewQueryPaginator(s.dbCl, &dynamodb.QueryInput{
+		TableName:                 &s.collectionsTbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var cs []Collection
+		if err := attributevalue.UnmarshalListOfMaps(res.Items, &cs); err != nil {
+			return nil, err
+		}
+		out = append(out, cs...)
+	}
+	return out, nil
+}
+
+// Get returns the user's collection, or nil if they have no such
+// collection.
+func (s *Store) Get(ctx context.Context, user, key string) (*Collection, error) {
+	res, err := s.dbCl.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      &s.collectionsTbl,
+		Key:            s.key(user, key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var c Collection
+	if err := attributevalue.UnmarshalMap(res.Item, &c); err != nil {
+		return nil, err
+	}
+	if c.Items == nil {
+		c.Items = []Item{}
+	}
+	return &c, nil
+}
+
+// Create makes a collection holding items, in order. The name must be
+// normalised.
+func (s *Store) Create(ctx context.Context, user, name string, items []Item) (*Collection, error) {
+	now := time.Now().Unix()
+	c := Collection{
+		Key:       ksuid.New().String(),
+		User:      user,
+		Name:      name,
+		Items:     []Item{},
+		Version:   1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := c.add(items, -1, now); err != nil {
+		return nil, err
+	}
+
+	av, err := attributevalue.MarshalMap(&c)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.dbCl.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           &s.collectionsTbl,
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(#key)"),
+		ExpressionAttributeNames: map[string]string{
+			"#key": "key",
+		},
+	}); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Rename renames the user's collection. The name must be normalised. It
+// returns nil if there is no such collection.
+func (s *Store) Rename(ctx context.Context, user, key, name string) (*Collection, error) {
+	return s.change(ctx, user, key, func(c *Collection) error {
+		c.Name = name
+		return nil
+	})
+}
+
+// Add inserts items into the user's collection before position, or at the
+// end if position is negative or past it. Items already in the collection
+// stay where they are. It returns nil if there is no such collection.
+func (s *Store) Add(ctx context.Context, user, key string, items []Item, position int) (*Collection, error) {
+	return s.change(ctx, user, key, func(c *Collection) error {
+		return c.add(items, position, time.Now().Unix())
+	})
+}
+
+// Remove takes the items with the given keys out of the user's
+// collection. Keys not in it are ignored. It returns nil if there is no
+// such collection.
+func (s *Store) Remove(ctx context.Context, user, key string, itemKeys ...string) (*Collection, error) {
+	return s.change(ctx, user, key, func(c *Collection) error {
+		c.remove(itemKeys)
+		return nil
+	})
+}
+
+// Reorder moves the items with the given keys to the front of the user's
+// collection in that order. Items the keys leave out, such as ones hidden
+// while they are in the trash, follow in their current order. It returns
+// ErrChanged, with the collection as it is, if a key isn't in it, and nil
+// if there is no such collection.
+func (s *Store) Reorder(ctx context.Context, user, key string, keys []string) (*Collection, error) {
+	return s.change(ctx, user, key, func(c *Collection) error {
+		byKey := map[string]Item{}
+		for _, it := range c.Items {
+			byKey[it.Key] = it
+		}
+		items := make([]Item, 0, len(c.Items))
+		for _, k := range keys {
+			it, ok := byKey[k]
+			if !ok {
+				if c.Index(k) < 0 {
+					return ErrChanged
+				}
+				// Listed twice.
+				continue
+			}
+			delete(byKey, k)
+			items = append(items, it)
+		}
+		for _, it := range c.Items {
+			if _, ok := byKey[it.Key]; ok {
+				items = append(items, it)
+			}
+		}
+		c.Items = items
+		return nil
+	})
+}
+
+// Delete deletes the user's collection. The items in it are untouched.
+func (s *Store) Delete(ctx context.Context, user, key string) error {
+	_, err := s.dbCl.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &s.collectionsTbl,
+		Key:       s.key(user, key),
+	})
+	return err
+}
+
+// RemoveEverywhere takes the items with the given keys out of all of the
+// user's collections, for when they are deleted for good.
+func (s *Store) RemoveEverywhere(ctx context.Context, user string, itemKeys ...string) error {
+	if len(itemKeys) == 0 {
+		return nil
+	}
+	cs, err := s.List(ctx, user)
+	if err != nil {
+		return err
+	}
+	for _, c := range cs {
+		found := false
+		for _, k := range itemKeys {
+			found = found || c.Index(k) >= 0
+		}
+		if !found {
+			continue
+		}
+		if _, err := s.Remove(ctx, user, c.Key, itemKeys...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// change applies fn to the collection and writes it back if the collection
+// hasn't changed since it was read, starting over if it has.
+func (s *Store) change(ctx context.Context, user, key string, fn func(*Collection) error) (*Collection, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		c, err := s.Get(ctx, user, key)
+		if err != nil || c == nil {
+			return nil, err
+		}
+		version := c.Version
+		if err := fn(c); err != nil {
+			return c, err
+		}
+		c.Version++
+		c.UpdatedAt = time.Now().Unix()
+
+		upd := expression.Set(expression.Name("name"), expression.Value(c.Name)).
+			Set(expression.Name("items"), expression.Value(c.Items)).
+			Set(expression.Name("version"), expression.Value(c.Version)).
+			Set(expression.Name("updatedAt"), expression.Value(c.UpdatedAt))
+		cond := expression.Name("version").Equal(expression.Value(version))
+		expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.dbCl.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 &s.collectionsTbl,
+			Key:                       s.key(user, key),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			UpdateExpression:          expr.Update(),
+			ConditionExpression:       expr.Condition(),
+		})
+		var ccf *dynamodbTypes.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			// Changed or deleted since it was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, ErrBusy
+}
+
+func (c *Collection) add(items []Item, position int, now int64) error {
+	var added []Item
+	seen := map[string]bool{}
+	for _, it := range items {
+		if seen[it.Key] || c.Index(it.Key) >= 0 {
+			continue
+		}
+		seen[it.Key] = true
+		it.AddedAt = now
+		added = append(added, it)
+	}
+	if len(c.Items)+len(added) > MaxItems {
+		return ErrTooMany
+	}
+	if position < 0 || position > len(c.Items) {
+		position = len(c.Items)
+	}
+	c.Items = append(c.Items[:position], append(added, c.Items[position:]...)...)
+	return nil
+}
+
+func (c *Collection) remove(keys []string) {
+	drop := map[string]bool{}
+	for _, k := range keys {
+		drop[k] = true
+	}
+	items := c.Items[:0]
+	for _, it := range c.Items {
+		if !drop[it.Key] {
+			items = append(items, it)
+		}
+	}
+	c.Items = items
+}
+
+func (s *Store) key(user, key string) map[string]dynamodbTypes.AttributeValue {
+	return map[string]dynamodbTypes.AttributeValue{
+		"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+		"key":  &dynamodbTypes.AttributeValueMemberS{Value: key},
+	}
+}
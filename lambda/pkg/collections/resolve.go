@@ -0,0 +1,199 @@
+package collections
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxBatchGet is the most keys DynamoDB reads in one batch.
+const maxBatchGet = 100
+
+// maxUnprocessedRetries bounds the retries of keys a batch hands back.
+const maxUnprocessedRetries = 5
+
+// Entry is an item with what a listing shows of it.
+type Entry struct {
+	Item
+	// Filename is the filename of the sound, or of a clip's sound.
+	Filename string `json:"filename"`
+	// Name and Sound are a clip's name and the key of its sound.
+	Name  string `json:"name,omitempty"`
+	Sound string `json:"sound,omitempty"`
+}
+
+// View is a collection as it is shown, with the items that can be shown.
+type View struct {
+	Key       string  `json:"key"`
+	Name      string  `json:"name"`
+	Items     []Entry `json:"items"`
+	Version   int64   `json:"version"`
+	CreatedAt int64   `json:"createdAt"`
+	UpdatedAt int64   `json:"updatedAt"`
+}
+
+// View resolves the items of the user's collection.
+func (s *Store) View(ctx context.Context, user string, c *Collection) (*View, error) {
+	entries, err := s.Resolve(ctx, user, c.Items)
+	if err != nil {
+		return nil, err
+	}
+	return &View{
+		Key:       c.Key,
+		Name:      c.Name,
+		Items:     entries,
+		Version:   c.Version,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+	}, nil
+}
+
+type row struct {
+	Key       string `dynamodbav:"key"`
+	User      string `dynamodbav:"user"`
+	Sound     string `dynamodbav:"sound"`
+	Filename  string `dynamodbav:"filename"`
+	Name      string `dynamodbav:"name"`
+	Deleting  string `dynamodbav:"deleting"`
+	TrashedAt int64  `dynamodbav:"trashedAt"`
+}
+
+// Resolve looks up the user's items, returning an entry for each that can
+// be shown, in order. Items that are gone, in the trash or being deleted,
+// or that belong to someone else, are left out; a clip without an owner
+// belongs to the owner of its sound.
+func (s *Store) Resolve(ctx context.Context, user string, items []Item) ([]Entry, error) {
+	var soundKeys, clipKeys []map[string]dynamodbTypes.AttributeValue
+	for _, it := range items {
+		switch it.Kind {
+		case KindSound:
+			soundKeys = append(soundKeys, s.key(user, it.Key))
+		case KindClip:
+			clipKeys = append(clipKeys, map[string]dynamodbTypes.AttributeValue{
+				"key": &dynamodbTypes.AttributeValueMemberS{Value: it.Key},
+			})
+		}
+	}
+
+	clips, err := s.batchGet(ctx, s.clipsTbl, dedupe(clipKeys))
+	if err != nil {
+		return nil, err
+	}
+	// Clips need their sounds, for the filename and to check the sound
+	// isn't in the trash.
+	for _, c := range clips {
+		if c.User == "" || c.User == user {
+			soundKeys = append(soundKeys, s.key(user, c.Sound))
+		}
+	}
+	sounds, err := s.batchGet(ctx, s.formatsTbl, dedupe(soundKeys))
+	if err != nil {
+		return nil, err
+	}
+
+	out := []Entry{}
+	for _, it := range items {
+		switch it.Kind {
+		case KindSound:
+			snd, ok := sounds[it.Key]
+			if !ok || snd.Deleting != "" || snd.TrashedAt != 0 {
+				continue
+			}
+			out = append(out, Entry{Item: it, Filename: snd.Filename})
+		case KindClip:
+			c, ok := clips[it.Key]
+			if !ok || c.TrashedAt != 0 || c.User != "" && c.User != user {
+				continue
+			}
+			snd, ok := sounds[c.Sound]
+			if !ok || snd.Deleting != "" || snd.TrashedAt != 0 {
+				continue
+			}
+			out = append(out, Entry{Item: it, Filename: snd.Filename, Name: c.Name, Sound: c.Sound})
+		}
+	}
+	return out, nil
+}
+
+// Check returns the keys of the items the user can't add to a collection,
+// because they are gone, in the trash or someone else's. It returns
+// ErrKind if an item isn't a sound or clip.
+func (s *Store) Check(ctx context.Context, user string, items []Item) ([]string, error) {
+	for _, it := range items {
+		if it.Kind != KindSound && it.Kind != KindClip || it.Key == "" {
+			return nil, ErrKind
+		}
+	}
+	entries, err := s.Resolve(ctx, user, items)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, e := range entries {
+		found[e.Key] = true
+	}
+	var missing []string
+	for _, it := range items {
+		if !found[it.Key] {
+			missing = append(missing, it.Key)
+		}
+	}
+	return missing, nil
+}
+
+// batchGet reads rows by key, returning them by their "key" attribute.
+func (s *Store) batchGet(ctx context.Context, table string, keys []map[string]dynamodbTypes.AttributeValue) (map[string]row, error) {
+	out := map[string]row{}
+	proj := "#key, #user, sound, filename, #name, deleting, trashedAt"
+	names := map[string]string{"#key": "key", "#user": "user", "#name": "name"}
+	for i := 0; i < len(keys); i += maxBatchGet {
+		end := i + maxBatchGet
+		if end > len(keys) {
+			end = len(keys)
+		}
+		req := map[string]dynamodbTypes.KeysAndAttributes{
+			table: {
+				Keys:                     keys[i:end],
+				ProjectionExpression:     &proj,
+				ExpressionAttributeNames: names,
+			},
+		}
+		for attempt := 0; len(req) > 0; attempt++ {
+			if attempt > maxUnprocessedRetries {
+				return nil, errors.New("batch get still unprocessed after retries")
+			}
+			res, err := s.dbCl.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: req,
+			})
+			if err != nil {
+				return nil, err
+			}
+			var rows []row
+			if err := attributevalue.UnmarshalListOfMaps(res.Responses[table], &rows); err != nil {
+				return nil, err
+			}
+			for _, r := range rows {
+				out[r.Key] = r
+			}
+			req = res.UnprocessedKeys
+		}
+	}
+	return out, nil
+}
+
+// dedupe drops repeated keys, which BatchGetItem rejects.
+func dedupe(keys []map[string]dynamodbTypes.AttributeValue) []map[string]dynamodbTypes.AttributeValue {
+	seen := map[string]bool{}
+	out := keys[:0]
+	for _, k := range keys {
+		v := k["key"].(*dynamodbTypes.AttributeValueMemberS).Value
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, k)
+		}
+	}
+	return out
+}
@@ -0,0 +1,225 @@
+// Package deletion starts the permanent deletion of sounds, which the
+// sound-deletions worker carries out. A sound's formats row is marked with
+// its deletion job before the job is written and queued, and the worker
+// removes the row last, so a deletion interrupted at any point can be
+// found from the row and started again.
+package deletion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/segmentio/ksuid"
+)
+
+// JobType is the type of deletion jobs in the jobs table.
+const JobType = "delete-sound"
+
+// ErrChanged means the sound no longer matched the condition it was to be
+// deleted under, such as being restored from the trash.
+var ErrChanged = errors.New("deletion: sound changed")
+
+// Job is a deletion job as returned to clients.
+type Job struct {
+	Key    string `json:"key" dynamodbav:"key"`
+	Status string `json:"status" dynamodbav:"status"`
+	Topic  string `json:"topic" dynamodbav:"topic"`
+}
+
+// Message is the deletion queue message body.
+type Message struct {
+	Job string `json:"job"`
+}
+
+type sound struct {
+	Key       string `dynamodbav:"key"`
+	Bucket    string `dynamodbav:"bucket"`
+	Deleting  string `dynamodbav:"deleting"`
+	TrashedAt int64  `dynamodbav:"trashedAt"`
+}
+
+// Starter starts deletions.
+type Starter struct {
+	dbCl       *dynamodb.Client
+	sqsCl      *sqs.Client
+	formatsTbl string
+	jobsTbl    string
+	queueUrl   string
+}
+
+func NewStarter(dbCl *dynamodb.Client, sqsCl *sqs.Client, formatsTbl, jobsTbl, queueUrl string) *Starter {
+	return &Starter{dbCl, sqsCl, formatsTbl, jobsTbl, queueUrl}
+}
+
+// Start starts deleting the user's sound, or resumes the deletion already
+// started, and returns its job. It returns nil if the user has no such
+// sound. A non-zero trashedAt only starts a deletion of a sound that has
+// been in the trash since then, returning ErrChanged otherwise.
+func (s *Starter) Start(ctx context.Context, user, soundId string, trashedAt int64) (*Job, error) {
+	snd, err := s.getSound(ctx, user, soundId)
+	if err != nil || snd == nil {
+		return nil, err
+	}
+
+	if snd.Deleting == "" {
+		if trashedAt != 0 && snd.TrashedAt != trashedAt {
+			return nil, ErrChanged
+		}
+		snd.Deleting = ksuid.New().String()
+		marked, err := s.mark(ctx, user, soundId, snd.Deleting, trashedAt)
+		if err != nil {
+			return nil, err
+		}
+		if !marked {
+			// Lost a race with another deletion or a restore, or the sound
+			// is gone.
+			if snd, err = s.getSound(ctx, user, soundId); err != nil || snd == nil {
+				return nil, err
+			}
+			if snd.Deleting == "" {
+				return nil, ErrChanged
+			}
+		}
+	}
+
+	job, err := s.job(ctx, user, snd)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(&Message{Job: job.Key})
+	if err != nil {
+		return nil, err
+	}
+	body := string(b)
+	if _, err := s.sqsCl.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    &s.queueUrl,
+		MessageBody: &body,
+	}); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *Starter) getSound(ctx context.Context, user, soundId string) (*sound, error) {
+	res, err := s.dbCl.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &s.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var snd sound
+	if err := attributevalue.UnmarshalMap(res.Item, &snd); err != nil {
+		return nil, err
+	}
+	return &snd, nil
+}
+
+// mark records the deletion job on the sound unless one is already
+// recorded, reporting whether it was.
+func (s *Starter) mark(ctx context.Context, user, soundId, jobId string, trashedAt int64) (bool, error) {
+	upd := expression.Set(expression.Name("deleting"), expression.Value(jobId))
+	cond := expression.AttributeExists(expression.Name("key")).
+		And(expression.AttributeNotExists(expression.Name("deleting")))
+	if trashedAt != 0 {
+		cond = cond.And(expression.Name("trashedAt").Equal(expression.Value(trashedAt)))
+	}
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.dbCl.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &s.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// job returns the sound's deletion job, creating it if it hasn't been
+// written yet.
+func (s *Starter) job(ctx context.Context, user string, snd *sound) (*Job, error) {
+	job := Job{Key: snd.Deleting, Status: "pending", Topic: "jobs/" + snd.Deleting}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	_, err := s.dbCl.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &s.jobsTbl,
+		Item: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{
+				Value: job.Key,
+			},
+			"user": &dynamodbTypes.AttributeValueMemberS{
+				Value: user,
+			},
+			"type": &dynamodbTypes.AttributeValueMemberS{
+				Value: JobType,
+			},
+			"status": &dynamodbTypes.AttributeValueMemberS{
+				Value: job.Status,
+			},
+			"sound": &dynamodbTypes.AttributeValueMemberS{
+				Value: snd.Key,
+			},
+			"bucket": &dynamodbTypes.AttributeValueMemberS{
+				Value: snd.Bucket,
+			},
+			"topic": &dynamodbTypes.AttributeValueMemberS{
+				Value: job.Topic,
+			},
+			"createdAt": &dynamodbTypes.AttributeValueMemberN{
+				Value: now,
+			},
+			"updatedAt": &dynamodbTypes.AttributeValueMemberN{
+				Value: now,
+			},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#key)"),
+		ExpressionAttributeNames: map[string]string{
+			"#key": "key",
+		},
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if !errors.As(err, &ccf) {
+		return &job, err
+	}
+
+	res, err := s.dbCl.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &s.jobsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: job.Key},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := attributevalue.UnmarshalMap(res.Item, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
@@ -0,0 +1,415 @@
+// Package details keeps the details users edit on their sounds: a display
+// name, description, credits, licence and their own named fields. They
+// live in a "details" map on the sound's formats row, apart from the
+// upload's filename, which never changes, and the metadata embedded in the
+// file.
+//
+// Every edit is written together with a row in the history table recording
+// what it changed, in one transaction conditional on the details' version,
+// so the history holds each edit exactly once and in order.
+package details
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"wavey.ai/pkg/pagination"
+)
+
+// Limits on the details, in characters.
+const (
+	MaxName        = 256
+	MaxDescription = 5000
+	MaxCredits     = 2000
+	MaxLicence     = 256
+	MaxFieldName   = 64
+	MaxFieldValue  = 1000
+	// MaxFields bounds the custom fields on one sound.
+	MaxFields = 50
+)
+
+// maxAttempts bounds the retries of an edit that loses a race.
+const maxAttempts = 5
+
+// ErrBusy means an edit kept losing races with other edits.
+var ErrBusy = errors.New("details: too many concurrent changes")
+
+// Details are the editable details of a sound. Empty ones are unset; a
+// sound without a name is shown by its filename.
+type Details struct {
+	Name        string            `json:"name,omitempty" dynamodbav:"name,omitempty"`
+	Description string            `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	Credits     string            `json:"credits,omitempty" dynamodbav:"credits,omitempty"`
+	Licence     string            `json:"licence,omitempty" dynamodbav:"licence,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty" dynamodbav:"fields,omitempty"`
+	Version     int64             `json:"version" dynamodbav:"version"`
+	UpdatedAt   int64             `json:"updatedAt,omitempty" dynamodbav:"updatedAt,omitempty"`
+}
+
+// Change is one detail an edit changed. Field names a custom field as
+// "fields.<name>". From or To is empty where the detail was or became
+// unset.
+type Change struct {
+	Field string `json:"field" dynamodbav:"field"`
+	From  string `json:"from,omitempty" dynamodbav:"from,omitempty"`
+	To    string `json:"to,omitempty" dynamodbav:"to,omitempty"`
+}
+
+// Edit is a row of the history table.
+type Edit struct {
+	Sound    string   `json:"-" dynamodbav:"sound"`
+	Version  int64    `json:"version" dynamodbav:"version"`
+	User     string   `json:"user" dynamodbav:"user"`
+	EditedAt int64    `json:"editedAt" dynamodbav:"editedAt"`
+	Changes  []Change `json:"changes" dynamodbav:"changes"`
+}
+
+// Patch is a partial edit. A nil string leaves the detail as it is and an
+// empty one unsets it. Fields are merged into the custom fields, an empty
+// value removing the field.
+type Patch struct {
+	Name        *string
+	Description *string
+	Credits     *string
+	Licence     *string
+	Fields      map[string]string
+}
+
+// ValidationError says which detail of a patch was invalid and why.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// ParsePatch reads a JSON merge patch of the details. Null, like the empty
+// string, unsets a detail. The filename can't be edited, and other
+// attributes are unknown.
+func ParsePatch(b []byte) (*Patch, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil || raw == nil {
+		return nil, &ValidationError{"body", "must be a JSON object"}
+	}
+	p := &Patch{}
+	for k, v := range raw {
+		var err error
+		switch k {
+		case "name":
+			p.Name, err = text(k, v, MaxName, false)
+		case "description":
+			p.Description, err = text(k, v, MaxDescription, true)
+		case "credits":
+			p.Credits, err = text(k, v, MaxCredits, true)
+		case "licence":
+			p.Licence, err = text(k, v, MaxLicence, false)
+		case "fields":
+			p.Fields, err = fields(v)
+		case "filename":
+			err = &ValidationError{k, "is the uploaded file's name and can't be changed"}
+		default:
+			err = &ValidationError{k, "is not an editable detail"}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// text reads a string detail, trimming it and, unless it may span lines,
+// collapsing its whitespace.
+func text(field string, v json.RawMessage, max int, multiline bool) (*string, error) {
+	var s *string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return nil, &ValidationError{field, "must be a string or null"}
+	}
+	if s == nil {
+		return new(string), nil
+	}
+	t := strings.TrimSpace(*s)
+	if !multiline {
+		t = strings.Join(strings.Fields(t), " ")
+	}
+	if len([]rune(t)) > max {
+		return nil, &ValidationError{field, fmt.Sprintf("must be at most %d characters", max)}
+	}
+	for _, r := range t {
+		if !unicode.IsPrint(r) && !(multiline && (r == '\n' || r == '\t')) {
+			return nil, &ValidationError{field, "must not contain control characters"}
+		}
+	}
+	return &t, nil
+}
+
+func fields(v json.RawMessage) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(v, &raw); err != nil {
+		return nil, &ValidationError{"fields", "must be an object"}
+	}
+	out := make(map[string]string, len(raw))
+	for k, v := range raw {
+		name := strings.Join(strings.Fields(k), " ")
+		if name == "" || len([]rune(name)) > MaxFieldName {
+			return nil, &ValidationError{"fields", fmt.Sprintf("names must be 1 to %d characters", MaxFieldName)}
+		}
+		for _, r := range name {
+			if !unicode.IsPrint(r) || r == '.' {
+				return nil, &ValidationError{"fields", "names must be printable and can't contain ."}
+			}
+		}
+		s, err := text("fields."+name, v, MaxFieldValue, true)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = *s
+	}
+	return out, nil
+}
+
+// apply applies the patch to d and returns what it changed.
+func (p *Patch) apply(d *Details) ([]Change, error) {
+	var changes []Change
+	set := func(field string, to *string, from *string) {
+		if to != nil && *to != *from {
+			changes = append(changes, Change{field, *from, *to})
+			*from = *to
+		}
+	}
+	set("name", p.Name, &d.Name)
+	set("description", p.Description, &d.Description)
+	set("credits", p.Credits, &d.Credits)
+	set("licence", p.Licence, &d.Licence)
+
+	names := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		from, to := d.Fields[k], p.Fields[k]
+		if from == to {
+			continue
+		}
+		changes = append(changes, Change{"fields." + k, from, to})
+		if to == "" {
+			delete(d.Fields, k)
+			continue
+		}
+		if d.Fields == nil {
+			d.Fields = map[string]string{}
+		}
+		d.Fields[k] = to
+	}
+	if len(d.Fields) > MaxFields {
+		return nil, &ValidationError{"fields", fmt.Sprintf("at most %d per sound", MaxFields)}
+	}
+	return changes, nil
+}
+
+// Store reads and writes details and their history.
+type Store struct {
+	dbCl       *dynamodb.Client
+	formatsTbl string
+	historyTbl string
+}
+
+func New(dbCl *dynamodb.Client, formatsTbl, historyTbl string) *Store {
+	return &Store{dbCl, formatsTbl, historyTbl}
+}
+
+// sound is the part of a formats row an edit reads.
+type sound struct {
+	Details   *Details `dynamodbav:"details"`
+	Deleting  string   `dynamodbav:"deleting"`
+	TrashedAt int64    `dynamodbav:"trashedAt"`
+}
+
+// Get returns the details of the user's sound, or nil if they have no
+// such sound or it is in the trash or being deleted.
+func (s *Store) Get(ctx context.Context, user, key string) (*Details, error) {
+	res, err := s.dbCl.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      &s.formatsTbl,
+		Key:            s.key(user, key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var row sound
+	if err := attributevalue.UnmarshalMap(res.Item, &row); err != nil {
+		return nil, err
+	}
+	if row.Deleting != "" || row.TrashedAt != 0 {
+		return nil, nil
+	}
+	if row.Details == nil {
+		return &Details{}, nil
+	}
+	return row.Details, nil
+}
+
+// Update applies the patch to the details of the user's sound, recording
+// what changed in its history, and returns them. A patch that changes
+// nothing writes nothing. It returns nil if there is no such sound, or it
+// is in the trash or being deleted.
+func (s *Store) Update(ctx context.Context, user, key string, p *Patch) (*Details, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		d, err := s.Get(ctx, user, key)
+		if err != nil || d == nil {
+			return nil, err
+		}
+		version := d.Version
+		changes, err := p.apply(d)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) == 0 {
+			return d, nil
+		}
+		now := time.Now().Unix()
+		d.Version++
+		d.UpdatedAt = now
+
+		err = s.write(ctx, user, key, version, d, &Edit{
+			Sound:    key,
+			Version:  d.Version,
+			User:     user,
+			EditedAt: now,
+			Changes:  changes,
+		})
+		var tce *dynamodbTypes.TransactionCanceledException
+		if errors.As(err, &tce) && len(tce.CancellationReasons) > 0 &&
+			aws.ToString(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			// Edited, trashed or deleted since it was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, ErrBusy
+}
+
+func (s *Store) write(ctx context.Context, user, key string, version int64, d *Details, e *Edit) error {
+	upd := expression.Set(expression.Name("details"), expression.Value(d))
+	// A sound that was never edited has no details yet.
+	cond := expression.AttributeNotExists(expression.Name("details"))
+	if version > 0 {
+		cond = expression.Name("details.version").Equal(expression.Value(version))
+	}
+	cond = expression.AttributeExists(expression.Name("key")).
+		And(expression.AttributeNotExists(expression.Name("deleting"))).
+		And(expression.AttributeNotExists(expression.Name("trashedAt"))).
+		And(cond)
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	av, err := attributevalue.MarshalMap(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.dbCl.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []dynamodbTypes.TransactWriteItem{
+			{
+				Update: &dynamodbTypes.Update{
+					TableName:                 &s.formatsTbl,
+					Key:                       s.key(user, key),
+					ExpressionAttributeNames:  expr.Names(),
+					ExpressionAttributeValues: expr.Values(),
+					UpdateExpression:          expr.Update(),
+					ConditionExpression:       expr.Condition(),
+				},
+			},
+			{
+				Put: &dynamodbTypes.Put{
+					TableName:           &s.historyTbl,
+					Item:                av,
+					ConditionExpression: aws.String("attribute_not_exists(sound)"),
+				},
+			},
+		},
+	})
+	return err
+}
+
+// History returns up to limit edits of the sound, newest first, and the
+// cursor for the older ones after them, starting from cursor or from the
+// latest when cursor is empty. Cursors are signed by p under scope.
+func (s *Store) History(ctx context.Context, p *pagination.Paginator, scope, key, cursor string, limit int32) ([]Edit, string, error) {
+	keyEx := expression.Key("sound").Equal(expression.Value(key))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return nil, "", err
+	}
+	rows, next, err := p.Query(ctx, s.dbCl, &dynamodb.QueryInput{
+		TableName:                 &s.historyTbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ScanIndexForward:          aws.Bool(false),
+	}, scope, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	edits := []Edit{}
+	if err := attributevalue.UnmarshalListOfMaps(rows, &edits); err != nil {
+		return nil, "", err
+	}
+	return edits, next, nil
+}
+
+// Forget deletes the history of a sound, for when it is deleted for good.
+func (s *Store) Forget(ctx context.Context, key string) error {
+	keyEx := expression.Key("sound").Equal(expression.Value(key))
+	proj := expression.NamesList(expression.Name("sound"), expression.Name("version"))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithProjection(proj).Build()
+	if err != nil {
+		return err
+	}
+	p := dynamodb.NewQueryPaginator(s.dbCl, &dynamodb.QueryInput{
+		TableName:                 &s.historyTbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range res.Items {
+			if _, err := s.dbCl.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: &s.historyTbl,
+				Key:       item,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) key(user, key string) map[string]dynamodbTypes.AttributeValue {
+	return map[string]dynamodbTypes.AttributeValue{
+		"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+		"key":  &dynamodbTypes.AttributeValueMemberS{Value: key},
+	}
+}
@@ -0,0 +1,215 @@
+// Package features describes the timbre of a sound as a fixed-length vector
+// for similarity search: statistics of its MFCCs and of its spectral
+// centroid, flatness and rolloff over time, and how often it has onsets.
+//
+// Spectra are taken over roughly 46 ms frames at the sound's own sample
+// rate and cut off at 11025 Hz, so sounds at different rates describe the
+// same band. Frames quieter than -60 dBFS are left out of the statistics,
+// so silence around a sound doesn't change how it compares.
+package features
+
+import (
+	"errors"
+	"io"
+	"math"
+
+	"wavey.ai/pkg/audio"
+)
+
+// Version identifies how vectors are computed. Vectors of different
+// versions can't be compared.
+const Version = 1
+
+// Layout of a vector's values.
+const (
+	NumMFCC = 13
+
+	MFCCMean      = 0
+	MFCCStd       = MFCCMean + NumMFCC
+	CentroidMean  = MFCCStd + NumMFCC
+	CentroidStd   = CentroidMean + 1
+	FlatnessMean  = CentroidStd + 1
+	FlatnessStd   = FlatnessMean + 1
+	RolloffMean   = FlatnessStd + 1
+	RolloffStd    = RolloffMean + 1
+	OnsetRate     = RolloffStd + 1
+	Dims          = OnsetRate + 1
+	MaxSeconds    = 30
+	maxFrequency  = 11025
+	melBands      = 40
+	rolloffFactor = 0.85
+	silence       = 1e-3 // -60 dBFS
+)
+
+// ErrSilent means the sound has no frames loud enough to describe.
+var ErrSilent = errors.New("features: sound is silent")
+
+// Features is a sound's feature vector. Centroid and rolloff are in Hz and
+// the onset rate is in onsets per second.
+type Features struct {
+	Version int       `json:"version" dynamodbav:"version"`
+	Values  []float64 `json:"values" dynamodbav:"values"`
+}
+
+// Valid reports whether f was computed the way this version computes
+// vectors.
+func (f *Features) Valid() bool {
+	return f != nil && f.Version == Version && len(f.Values) == Dims
+}
+
+// Extract computes the features of the first MaxSeconds of the sound.
+func Extract(dec audio.Decoder) (*Features, error) {
+	f := dec.Format()
+	if f.SampleRate < 1000 || f.Channels < 1 {
+		return nil, audio.ErrUnsupported
+	}
+
+	mono, err := readMono(dec, f.Channels, f.SampleRate*MaxSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	a := newAnalyzer(f.SampleRate)
+	var (
+		mfcc           [NumMFCC]stats
+		centroid, flat stats
+		rolloff        stats
+		flux           []float64
+		prev           []float64
+		frame          = make([]float64, a.size)
+		loudFrames     int
+	)
+	for start := 0; start+a.size <= len(mono) || start == 0; start += a.hop {
+		for i := range frame {
+			frame[i] = 0
+			if start+i < len(mono) {
+				frame[i] = mono[start+i]
+			}
+		}
+
+		mag := a.spectrum(frame)
+		loud := rms(frame) >= silence
+		flux = append(flux, a.flux(prev, mag, loud))
+		prev = mag
+
+		if !loud {
+			continue
+		}
+		loudFrames++
+		for i, c := range a.mfcc(mag) {
+			mfcc[i].add(c)
+		}
+		c, fl, r := a.shape(mag)
+		centroid.add(c)
+		flat.add(fl)
+		rolloff.add(r)
+	}
+	if loudFrames == 0 {
+		return nil, ErrSilent
+	}
+
+	v := make([]float64, Dims)
+	for i := range mfcc {
+		v[MFCCMean+i], v[MFCCStd+i] = mfcc[i].mean(), mfcc[i].std()
+	}
+	v[CentroidMean], v[CentroidStd] = centroid.mean(), centroid.std()
+	v[FlatnessMean], v[FlatnessStd] = flat.mean(), flat.std()
+	v[RolloffMean], v[RolloffStd] = rolloff.mean(), rolloff.std()
+	seconds := float64(len(mono)) / float64(f.SampleRate)
+	v[OnsetRate] = float64(onsets(flux, float64(f.SampleRate)/float64(a.hop))) / seconds
+
+	return &Features{Version: Version, Values: v}, nil
+}
+
+// readMono reads up to max frames of dec and mixes them down to one
+// channel.
+func readMono(dec audio.Decoder, channels, max int) ([]float64, error) {
+	var mono []float64
+	buf := make([]float64, 4096*channels)
+	for len(mono) < max {
+		n, err := dec.Read(buf)
+		for i := 0; i+channels <= n && len(mono) < max; i += channels {
+			s := 0.0
+			for c := 0; c < channels; c++ {
+				s += buf[i+c]
+			}
+			mono = append(mono, s/float64(channels))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mono, nil
+}
+
+// onsets counts peaks in the spectral flux that stand out from the flux
+// around them, at least 50 ms apart.
+func onsets(flux []float64, framesPerSecond float64) int {
+	const (
+		peak      = 3  // frames either side a peak must beat
+		window    = 16 // frames either side the threshold averages over
+		threshold = 1.5
+		// minFlux is the least flux an onset has, as a fraction of the
+		// frame's spectrum. Steady sounds stay well below it.
+		minFlux = 0.1
+	)
+	minGap := int(math.Ceil(0.05 * framesPerSecond))
+
+	n, last := 0, -minGap
+	for i, f := range flux {
+		if f < minFlux || i-last < minGap {
+			continue
+		}
+		isPeak := true
+		sum, count := 0.0, 0
+		for j := i - window; j <= i+window; j++ {
+			if j < 0 || j >= len(flux) {
+				continue
+			}
+			if j != i && j >= i-peak && j <= i+peak && flux[j] > f {
+				isPeak = false
+				break
+			}
+			sum += flux[j]
+			count++
+		}
+		if isPeak && f > threshold*sum/float64(count) {
+			n++
+			last = i
+		}
+	}
+	return n
+}
+
+func rms(p []float64) float64 {
+	s := 0.0
+	for _, v := range p {
+		s += v * v
+	}
+	return math.Sqrt(s / float64(len(p)))
+}
+
+// stats accumulates a running mean and variance.
+type stats struct {
+	n        int
+	m, sumsq float64
+}
+
+func (s *stats) add(x float64) {
+	s.n++
+	d := x - s.m
+	s.m += d / float64(s.n)
+	s.sumsq += d * (x - s.m)
+}
+
+func (s *stats) mean() float64 { return s.m }
+
+func (s *stats) std() float64 {
+	if s.n < 2 {
+		return 0
+	}
+	return math.Sqrt(s.sumsq / float64(s.n))
+}
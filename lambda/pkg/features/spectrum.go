@@ -0,0 +1,186 @@
+package features
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// analyzer holds what is precomputed for one sample rate.
+type analyzer struct {
+	rate float64
+	size int // frame length, a power of two
+	hop  int
+	// bins is the number of spectrum bins up to maxFrequency.
+	bins   int
+	window []float64
+	// mel holds the triangular filters, each as weights from bin lo.
+	mel []filter
+	// dct holds cosines for coefficients 1 to NumMFCC; coefficient 0 is
+	// overall level, which shouldn't make otherwise alike sounds differ.
+	dct [NumMFCC][melBands]float64
+}
+
+type filter struct {
+	lo      int
+	weights []float64
+}
+
+func newAnalyzer(rate int) *analyzer {
+	size := 1
+	for float64(size) < 0.046*float64(rate) {
+		size <<= 1
+	}
+	a := &analyzer{rate: float64(rate), size: size, hop: size / 4}
+
+	binHz := a.rate / float64(size)
+	top := math.Min(maxFrequency, a.rate/2)
+	a.bins = int(top/binHz) + 1
+
+	a.window = make([]float64, size)
+	for i := range a.window {
+		a.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size))
+	}
+
+	// Filter edges are evenly spaced on the mel scale up to the cutoff.
+	edges := make([]float64, melBands+2)
+	for i := range edges {
+		edges[i] = melToHz(hzToMel(top) * float64(i) / float64(melBands+1))
+	}
+	a.mel = make([]filter, melBands)
+	for b := range a.mel {
+		lo, mid, hi := edges[b], edges[b+1], edges[b+2]
+		f := filter{lo: int(math.Ceil(lo / binHz))}
+		for k := f.lo; k < a.bins && float64(k)*binHz <= hi; k++ {
+			hz := float64(k) * binHz
+			w := (hz - lo) / (mid - lo)
+			if hz > mid {
+				w = (hi - hz) / (hi - mid)
+			}
+			f.weights = append(f.weights, math.Max(w, 0))
+		}
+		a.mel[b] = f
+	}
+
+	for c := range a.dct {
+		for b := range a.dct[c] {
+			a.dct[c][b] = math.Sqrt(2.0/melBands) *
+				math.Cos(math.Pi*float64(c+1)*(float64(b)+0.5)/melBands)
+		}
+	}
+	return a
+}
+
+// spectrum returns the magnitudes of the windowed frame's spectrum up to
+// the cutoff.
+func (a *analyzer) spectrum(frame []float64) []float64 {
+	x := make([]complex128, a.size)
+	for i, s := range frame {
+		x[i] = complex(s*a.window[i], 0)
+	}
+	fft(x)
+	mag := make([]float64, a.bins)
+	for k := range mag {
+		mag[k] = cmplx.Abs(x[k])
+	}
+	return mag
+}
+
+// flux returns how much the spectrum rose since the previous frame, as a
+// fraction of the frame's spectrum. Quiet frames have none, so noise in
+// silence isn't taken for onsets.
+func (a *analyzer) flux(prev, mag []float64, loud bool) float64 {
+	if prev == nil || !loud {
+		return 0
+	}
+	rise, sum := 0.0, 0.0
+	for k, m := range mag {
+		if d := m - prev[k]; d > 0 {
+			rise += d
+		}
+		sum += m
+	}
+	if sum == 0 {
+		return 0
+	}
+	return rise / sum
+}
+
+// mfcc returns the mel-frequency cepstral coefficients of a spectrum.
+func (a *analyzer) mfcc(mag []float64) [NumMFCC]float64 {
+	var logMel [melBands]float64
+	for b, f := range a.mel {
+		e := 0.0
+		for i, w := range f.weights {
+			e += w * mag[f.lo+i] * mag[f.lo+i]
+		}
+		logMel[b] = math.Log(e + 1e-10)
+	}
+	var c [NumMFCC]float64
+	for i := range c {
+		for b, l := range logMel {
+			c[i] += a.dct[i][b] * l
+		}
+	}
+	return c
+}
+
+// shape returns the spectral centroid and rolloff in Hz and the spectral
+// flatness, from 0 for a pure tone to 1 for white noise.
+func (a *analyzer) shape(mag []float64) (centroid, flatness, rolloff float64) {
+	binHz := a.rate / float64(a.size)
+	var sum, weighted, logSum, power float64
+	for k, m := range mag {
+		sum += m
+		weighted += float64(k) * binHz * m
+		p := m * m
+		power += p
+		logSum += math.Log(p + 1e-20)
+	}
+	if sum == 0 {
+		return 0, 0, 0
+	}
+	centroid = weighted / sum
+
+	n := float64(len(mag))
+	flatness = math.Exp(logSum/n) / (power/n + 1e-20)
+
+	acc := 0.0
+	for k, m := range mag {
+		acc += m * m
+		if acc >= rolloffFactor*power {
+			rolloff = float64(k) * binHz
+			break
+		}
+	}
+	return centroid, flatness, rolloff
+}
+
+func hzToMel(hz float64) float64 { return 2595 * math.Log10(1+hz/700) }
+
+func melToHz(mel float64) float64 { return 700 * (math.Pow(10, mel/2595) - 1) }
+
+// fft transforms x in place. Its length must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := x[start+k], x[start+k+size/2]*wk
+				x[start+k], x[start+k+size/2] = u+v, u-v
+				wk *= w
+			}
+		}
+	}
+}
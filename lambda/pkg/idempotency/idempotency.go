@@ -0,0 +1,242 @@
+// Package idempotency lets a client retry a POST safely by sending an
+// Idempotency-Key header: the first request with a key does the work and
+// stores its response, and later requests with the same key get that
+// response back instead of doing the work again.
+//
+// A claimed key is leased rather than locked: if the request holding it
+// dies before completing or aborting, a retry takes the key over once the
+// lease has run out. Completing is conditional on still holding the lease,
+// so a request that outlives its lease can't store a response over the
+// retry's.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+// Header is the request header carrying the key. API Gateway lowercases
+// header names in payload format 2.0.
+const Header = "idempotency-key"
+
+// MaxKeyLength bounds client-supplied keys.
+const MaxKeyLength = 255
+
+// TTL is how long a key is remembered.
+const TTL = 24 * time.Hour
+
+// Lease is how long a claim holds its key. It must outlast the timeout of
+// any function that claims keys.
+const Lease = 30 * time.Second
+
+var (
+	// ErrInProgress means another request with the key has not finished.
+	ErrInProgress = errors.New("idempotency: request with this key is in progress")
+	// ErrLeaseLost means a claim's lease ran out and a retry took the key
+	// over.
+	ErrLeaseLost = errors.New("idempotency: lease on key was lost")
+	// ErrMismatch means the key was used before with a different request.
+	ErrMismatch = errors.New("idempotency: key reused with a different request")
+)
+
+const (
+	statusPending = "pending"
+	statusDone    = "done"
+)
+
+// Response is a stored result.
+type Response struct {
+	StatusCode int    `dynamodbav:"statusCode"`
+	Body       string `dynamodbav:"body"`
+}
+
+type record struct {
+	Key         string `dynamodbav:"key"`
+	Status      string `dynamodbav:"status"`
+	RequestHash string `dynamodbav:"requestHash"`
+	Response
+}
+
+// Claim is a key claimed by Begin, held until its lease runs out.
+type Claim struct {
+	id    string
+	token string
+}
+
+// Store keeps idempotency records in a DynamoDB table keyed by "key", with
+// time to live enabled on "expiresAt".
+type Store struct {
+	dbCl      *dynamodb.Client
+	tableName string
+}
+
+func New(dbCl *dynamodb.Client, tableName string) *Store {
+	return &Store{dbCl, tableName}
+}
+
+// Begin claims key for a request within scope, which should at least
+// identify the caller and endpoint, and returns the claim. If the key has
+// already completed, its stored response is returned instead and the
+// request must not be repeated.
+func (s *Store) Begin(ctx context.Context, scope, key string, request []byte) (*Claim, *Response, error) {
+	sum := sha256.Sum256(request)
+	hash := hex.EncodeToString(sum[:])
+	id := scope + "#" + key
+	now := time.Now()
+	c := &Claim{id, ksuid.New().String()}
+
+	// A pending key whose lease has run out was left by a request that
+	// died, and is taken over. Keys claimed before leases have none.
+	expired := expression.Name("lockedUntil").LessThan(expression.Value(now.Unix())).
+		Or(expression.AttributeNotExists(expression.Name("lockedUntil")))
+	cond := expression.AttributeNotExists(expression.Name("key")).
+		Or(expression.Name("status").Equal(expression.Value(statusPending)).
+			And(expression.Name("requestHash").Equal(expression.Value(hash))).
+			And(expired))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = s.dbCl.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &s.tableName,
+		Item: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{
+				Value: id,
+			},
+			"status": &dynamodbTypes.AttributeValueMemberS{
+				Value: statusPending,
+			},
+			"requestHash": &dynamodbTypes.AttributeValueMemberS{
+				Value: hash,
+			},
+			"lease": &dynamodbTypes.AttributeValueMemberS{
+				Value: c.token,
+			},
+			"lockedUntil": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.FormatInt(now.Add(Lease).Unix(), 10),
+			},
+			"expiresAt": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.FormatInt(now.Add(TTL).Unix(), 10),
+			},
+		},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if err == nil {
+		return c, nil, nil
+	}
+	if !errors.As(err, &ccf) {
+		return nil, nil, err
+	}
+
+	res, err := s.dbCl.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &s.tableName,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: id},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.Item == nil {
+		// Aborted since the put; let the client retry.
+		return nil, nil, ErrInProgress
+	}
+	var rec record
+	if err := attributevalue.UnmarshalMap(res.Item, &rec); err != nil {
+		return nil, nil, err
+	}
+	if rec.RequestHash != hash {
+		return nil, nil, ErrMismatch
+	}
+	if rec.Status != statusDone {
+		return nil, nil, ErrInProgress
+	}
+	return nil, &rec.Response, nil
+}
+
+// Complete stores the response for a claimed key. It returns ErrLeaseLost
+// if the claim's lease ran out and the key was taken over.
+func (s *Store) Complete(ctx context.Context, c *Claim, r Response) error {
+	item, err := s.CompleteItem(c, r)
+	if err != nil {
+		return err
+	}
+	_, err = s.dbCl.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 item.Update.TableName,
+		Key:                       item.Update.Key,
+		ExpressionAttributeNames:  item.Update.ExpressionAttributeNames,
+		ExpressionAttributeValues: item.Update.ExpressionAttributeValues,
+		UpdateExpression:          item.Update.UpdateExpression,
+		ConditionExpression:       item.Update.ConditionExpression,
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// CompleteItem is Complete as part of a transaction, so the response is
+// stored if and only if the work it describes is written. The transaction
+// is cancelled if the lease was lost.
+func (s *Store) CompleteItem(c *Claim, r Response) (dynamodbTypes.TransactWriteItem, error) {
+	upd := expression.Set(expression.Name("status"), expression.Value(statusDone)).
+		Set(expression.Name("statusCode"), expression.Value(r.StatusCode)).
+		Set(expression.Name("body"), expression.Value(r.Body)).
+		Remove(expression.Name("lockedUntil"))
+	cond := expression.Name("lease").Equal(expression.Value(c.token))
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		return dynamodbTypes.TransactWriteItem{}, err
+	}
+	return dynamodbTypes.TransactWriteItem{
+		Update: &dynamodbTypes.Update{
+			TableName: &s.tableName,
+			Key: map[string]dynamodbTypes.AttributeValue{
+				"key": &dynamodbTypes.AttributeValueMemberS{Value: c.id},
+			},
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			UpdateExpression:          expr.Update(),
+			ConditionExpression:       expr.Condition(),
+		},
+	}, nil
+}
+
+// Abort releases a claimed key after the request failed, so that a retry
+// does the work again. A key taken over by a retry is left alone.
+func (s *Store) Abort(ctx context.Context, c *Claim) error {
+	_, err := s.dbCl.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &s.tableName,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: c.id},
+		},
+		ConditionExpression: aws.String("#lease = :lease"),
+		ExpressionAttributeNames: map[string]string{
+			"#lease": "lease",
+		},
+		ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+			":lease": &dynamodbTypes.AttributeValueMemberS{Value: c.token},
+		},
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+// Package jobs records the progress of background jobs in the jobs table
+// and sorts their failures into those worth retrying and those that aren't.
+//
+// A worker returns a retryable error to SQS, which redelivers the message,
+// and marks the job failed only on a permanent one.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as one that retrying won't fix, such as a sound that
+// can't be decoded. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsPermanent reports whether err was marked by Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// Update sets the status of the job with key in tableName, along with
+// updatedAt and any attrs.
+func Update(ctx context.Context, dbCl *dynamodb.Client, tableName, key, status string, attrs map[string]string) error {
+	upd := expression.Set(expression.Name("status"), expression.Value(status)).
+		Set(expression.Name("updatedAt"), expression.Value(time.Now().Unix()))
+	for k, v := range attrs {
+		upd = upd.Set(expression.Name(k), expression.Value(v))
+	}
+	expr, err := expression.NewBuilder().WithUpdate(upd).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = dbCl.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &tableName,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: key},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	return err
+}
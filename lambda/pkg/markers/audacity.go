@@ -0,0 +1,60 @@
+package markers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadAudacity parses an Audacity label track export: one label per line as
+// tab-separated start and end seconds and a name. Spectral selection lines,
+// which start with a backslash, are ignored. Positions are returned as
+// frames at hz.
+func ReadAudacity(r io.Reader, hz int) ([]Marker, error) {
+	var markers []Marker
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "\\") {
+			continue
+		}
+
+		fields := strings.SplitN(text, "\t", 3)
+		if len(fields) < 2 {
+			return nil, &SyntaxError{line, "expected start and end separated by a tab"}
+		}
+		start, err := parseSeconds(fields[0], hz)
+		if err != nil {
+			return nil, &SyntaxError{line, err.Error()}
+		}
+		end, err := parseSeconds(fields[1], hz)
+		if err != nil {
+			return nil, &SyntaxError{line, err.Error()}
+		}
+		if end < start {
+			return nil, &SyntaxError{line, "end is before start"}
+		}
+
+		m := Marker{ID: uint32(len(markers) + 1), Start: start, End: end}
+		if len(fields) == 3 {
+			m.Name = strings.TrimSpace(fields[2])
+		}
+		markers = append(markers, m)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return markers, nil
+}
+
+// WriteAudacity writes markers at hz as an Audacity label track.
+func WriteAudacity(w io.Writer, markers []Marker, hz int) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range markers {
+		if _, err := fmt.Fprintf(bw, "%s\t%s\t%s\n", formatSeconds(m.Start, hz), formatSeconds(m.End, hz), oneLine(m.Name)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
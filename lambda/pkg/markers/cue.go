@@ -0,0 +1,156 @@
+package markers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"wavey.ai/pkg/timebase"
+)
+
+// cueRate is the CD frame rate CUE sheet positions are counted in.
+const cueRate = 75
+
+// MaxCueTracks is the most tracks a CUE sheet can hold.
+const MaxCueTracks = 99
+
+var ErrTooManyTracks = errors.New("markers: a CUE sheet holds at most 99 tracks")
+
+// ReadCue parses the tracks of a CUE sheet. Each track's INDEX 01 is its
+// start and a "REM END" line, as written by WriteCue, its end; tracks
+// without one are points. Positions are returned as frames at hz.
+func ReadCue(r io.Reader, hz int) ([]Marker, error) {
+	var markers []Marker
+	var cur *Marker
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(strings.TrimPrefix(s.Text(), "\ufeff"))
+		cmd, rest := cutField(text)
+
+		switch strings.ToUpper(cmd) {
+		case "TRACK":
+			markers = append(markers, Marker{ID: uint32(len(markers) + 1), Start: -1})
+			cur = &markers[len(markers)-1]
+		case "TITLE":
+			if cur != nil {
+				cur.Name = unquote(rest)
+			}
+		case "INDEX":
+			num, pos := cutField(rest)
+			if cur == nil || num != "01" {
+				continue
+			}
+			t, err := parseCueTime(pos, hz)
+			if err != nil {
+				return nil, &SyntaxError{line, err.Error()}
+			}
+			cur.Start = t
+		case "REM":
+			key, val := cutField(rest)
+			if cur == nil {
+				continue
+			}
+			switch strings.ToUpper(key) {
+			case "END":
+				t, err := parseCueTime(val, hz)
+				if err != nil {
+					return nil, &SyntaxError{line, err.Error()}
+				}
+				cur.End = t
+			case "NOTES":
+				cur.Notes = unquote(val)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, m := range markers {
+		if m.Start < 0 {
+			return nil, fmt.Errorf("markers: track %d has no INDEX 01", i+1)
+		}
+		if m.End < m.Start {
+			markers[i].End = m.Start
+		}
+	}
+	return markers, nil
+}
+
+// WriteCue writes markers at hz as a CUE sheet for the audio file named
+// filename. Positions are rounded to the nearest CD frame (1/75 s).
+func WriteCue(w io.Writer, markers []Marker, hz int, filename string) error {
+	if len(markers) > MaxCueTracks {
+		return ErrTooManyTracks
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "FILE %s WAVE\r\n", quote(filename))
+	for i, m := range markers {
+		fmt.Fprintf(bw, "  TRACK %02d AUDIO\r\n", i+1)
+		if m.Name != "" {
+			fmt.Fprintf(bw, "    TITLE %s\r\n", quote(m.Name))
+		}
+		if m.Notes != "" {
+			fmt.Fprintf(bw, "    REM NOTES %s\r\n", quote(m.Notes))
+		}
+		if m.End > m.Start {
+			fmt.Fprintf(bw, "    REM END %s\r\n", formatCueTime(m.End, hz))
+		}
+		fmt.Fprintf(bw, "    INDEX 01 %s\r\n", formatCueTime(m.Start, hz))
+	}
+	return bw.Flush()
+}
+
+func parseCueTime(s string, hz int) (int64, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var v [3]int64
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 || (i > 0 && n >= 60) || (i == 2 && n >= cueRate) {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		v[i] = n
+	}
+	// Bound the minutes so that frames*hz, which Convert works through,
+	// fits in 64 bits.
+	if hz <= 0 || v[0] >= math.MaxInt64/int64(hz)/(60*cueRate) {
+		return 0, fmt.Errorf("time %q out of range", s)
+	}
+	frames := (v[0]*60+v[1])*cueRate + v[2]
+	return timebase.Convert(frames, cueRate, int64(hz), timebase.Nearest), nil
+}
+
+func formatCueTime(pos int64, hz int) string {
+	f := timebase.Convert(pos, int64(hz), cueRate, timebase.Nearest)
+	return fmt.Sprintf("%02d:%02d:%02d", f/cueRate/60, f/cueRate%60, f%cueRate)
+}
+
+// cutField splits off the first whitespace-separated field of s.
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+func quote(s string) string {
+	return `"` + strings.ReplaceAll(oneLine(s), `"`, "'") + `"`
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
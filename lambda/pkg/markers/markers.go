@@ -0,0 +1,176 @@
+// Package markers reads the cue points, regions and sampler loops that DAWs
+// and samplers embed in WAV files.
+package markers
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"wavey.ai/pkg/riff"
+)
+
+var ErrNotWAVE = errors.New("markers: not a WAVE file")
+
+// maxChunkSize bounds the marker chunks read into memory.
+const maxChunkSize = 4 << 20
+
+// A Marker is a point (End == Start) or region in sample frames. End is
+// exclusive.
+type Marker struct {
+	ID    uint32
+	Name  string
+	Notes string
+	Start int64
+	End   int64
+	Loop  bool
+}
+
+// ReadWAV returns the markers in a WAVE file along with its sample rate.
+// Cue points come from the "cue " chunk, with labels, notes and region
+// lengths from "LIST"/"adtl"; loops come from "smpl". A loop that refers to
+// a cue point is merged into that marker.
+func ReadWAV(r io.ReaderAt, size int64) ([]Marker, int, error) {
+	f, err := riff.New(r, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !f.IsWAVE() {
+		return nil, 0, ErrNotWAVE
+	}
+
+	var sampleRate int
+	if c, ok := f.Chunk("fmt "); ok && c.Size >= 8 {
+		b, err := f.Bytes(riff.Chunk{ID: c.ID, Offset: c.Offset, Size: 8}, 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		sampleRate = int(binary.LittleEndian.Uint32(b[4:8]))
+	}
+
+	var markers []Marker
+	byID := map[uint32]int{}
+
+	if c, ok := f.Chunk("cue "); ok {
+		b, err := f.Bytes(c, maxChunkSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, m := range parseCue(b) {
+			byID[m.ID] = len(markers)
+			markers = append(markers, m)
+		}
+	}
+
+	for _, c := range f.Chunks {
+		if c.ID != "LIST" {
+			continue
+		}
+		b, err := f.Bytes(c, maxChunkSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ, subs := riff.List(b, binary.LittleEndian); typ == "adtl" {
+			applyAdtl(markers, byID, subs)
+		}
+	}
+
+	if c, ok := f.Chunk("smpl"); ok {
+		b, err := f.Bytes(c, maxChunkSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, l := range parseSmpl(b) {
+			if i, ok := byID[l.ID]; ok {
+				markers[i].Start, markers[i].End, markers[i].Loop = l.Start, l.End, true
+				continue
+			}
+			markers = append(markers, l)
+		}
+	}
+
+	sort.SliceStable(markers, func(i, j int) bool {
+		return markers[i].Start < markers[j].Start
+	})
+
+	return markers, sampleRate, nil
+}
+
+// parseCue reads the cue points of a "cue " chunk body.
+func parseCue(b []byte) []Marker {
+	if len(b) < 4 {
+		return nil
+	}
+	n := int(binary.LittleEndian.Uint32(b[0:4]))
+
+	var markers []Marker
+	for i, p := 0, 4; i < n && p+24 <= len(b); i, p = i+1, p+24 {
+		pos := int64(binary.LittleEndian.Uint32(b[p+20 : p+24]))
+		if pos == 0 {
+			// Some writers only fill in the play order position.
+			pos = int64(binary.LittleEndian.Uint32(b[p+4 : p+8]))
+		}
+		markers = append(markers, Marker{
+			ID:    binary.LittleEndian.Uint32(b[p : p+4]),
+			Start: pos,
+			End:   pos,
+		})
+	}
+	return markers
+}
+
+// applyAdtl copies labels, notes and region lengths from an associated data
+// list onto the cue points they refer to.
+func applyAdtl(markers []Marker, byID map[uint32]int, subs []riff.SubChunk) {
+	for _, s := range subs {
+		if len(s.Data) < 4 {
+			continue
+		}
+		i, ok := byID[binary.LittleEndian.Uint32(s.Data[0:4])]
+		if !ok {
+			continue
+		}
+
+		switch s.ID {
+		case "labl":
+			markers[i].Name = riff.CString(s.Data[4:])
+		case "note":
+			markers[i].Notes = riff.CString(s.Data[4:])
+		case "ltxt":
+			if len(s.Data) < 8 {
+				continue
+			}
+			length := int64(binary.LittleEndian.Uint32(s.Data[4:8]))
+			markers[i].End = markers[i].Start + length
+			if markers[i].Name == "" && len(s.Data) > 20 {
+				markers[i].Name = riff.CString(s.Data[20:])
+			}
+		}
+	}
+}
+
+// parseSmpl reads the loops of a sampler chunk. Loop ends are inclusive in
+// the chunk and exclusive in the result.
+func parseSmpl(b []byte) []Marker {
+	if len(b) < 36 {
+		return nil
+	}
+	n := int(binary.LittleEndian.Uint32(b[28:32]))
+
+	var loops []Marker
+	for i, p := 0, 36; i < n && p+24 <= len(b); i, p = i+1, p+24 {
+		start := int64(binary.LittleEndian.Uint32(b[p+8 : p+12]))
+		end := int64(binary.LittleEndian.Uint32(b[p+12:p+16])) + 1
+		if end <= start {
+			continue
+		}
+		loops = append(loops, Marker{
+			ID:    binary.LittleEndian.Uint32(b[p : p+4]),
+			Start: start,
+			End:   end,
+			Loop:  true,
+		})
+	}
+	return loops
+}
@@ -0,0 +1,384 @@
+package markers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"wavey.ai/pkg/riff"
+)
+
+// memFile is an in-memory file for AppendWAV.
+type memFile struct {
+	b []byte
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.b).ReadAt(p, off)
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(f.b) {
+		f.b = append(f.b, make([]byte, end-len(f.b))...)
+	}
+	return copy(f.b[off:], p), nil
+}
+
+// wave returns a 48 kHz mono 16-bit WAVE file holding frames of silence,
+// followed by extra chunks.
+func wave(frames int, extra ...[]byte) []byte {
+	f := make([]byte, 16)
+	binary.LittleEndian.PutUint16(f[0:], 1)
+	binary.LittleEndian.PutUint16(f[2:], 1)
+	binary.LittleEndian.PutUint32(f[4:], 48000)
+	binary.LittleEndian.PutUint32(f[8:], 96000)
+	binary.LittleEndian.PutUint16(f[12:], 2)
+	binary.LittleEndian.PutUint16(f[14:], 16)
+
+	b := []byte("RIFF\x00\x00\x00\x00WAVE")
+	b = appendChunk(b, "fmt ", f)
+	b = appendChunk(b, "data", make([]byte, frames*2))
+	for _, c := range extra {
+		b = append(b, c...)
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+	return b
+}
+
+// renumber returns ms with IDs counting from 1, as readers assign them.
+func renumber(ms []Marker) []Marker {
+	out := append([]Marker(nil), ms...)
+	for i := range out {
+		out[i].ID = uint32(i + 1)
+	}
+	return out
+}
+
+func TestAudacityRoundTrip(t *testing.T) {
+	for _, hz := range []int{44100, 48000, 96000} {
+		ms := []Marker{
+			{Name: "intro", Start: 0, End: int64(hz)},
+			{Name: "hit", Start: int64(hz) + 1, End: int64(hz) + 1},
+			{Name: "verse\tone\nline", Start: 12345, End: 987654321},
+		}
+		var buf bytes.Buffer
+		if err := WriteAudacity(&buf, ms, hz); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadAudacity(&buf, hz)
+		if err != nil {
+			t.Fatalf("ReadAudacity() at %d Hz error = %v", hz, err)
+		}
+		want := renumber(ms)
+		want[2].Name = "verse one line"
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip at %d Hz = %+v, want %+v", hz, got, want)
+		}
+	}
+}
+
+func TestReadAudacity(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []Marker
+		wantErr bool
+	}{
+		{
+			name: "labels",
+			in:   "0.5\t1.0\tone\r\n\\\t100\t200\n\n1:00.25\t1:00.25\n",
+			want: []Marker{
+				{ID: 1, Name: "one", Start: 24000, End: 48000},
+				{ID: 2, Start: 2892000, End: 2892000},
+			},
+		},
+		{
+			name: "decimal comma",
+			in:   "0,5\t1,0\tone\n",
+			want: []Marker{{ID: 1, Name: "one", Start: 24000, End: 48000}},
+		},
+		{"no tab", "0.5 1.0 one\n", nil, true},
+		{"end before start", "1.0\t0.5\n", nil, true},
+		{"negative", "-1\t0\n", nil, true},
+		{"not a number", "nan\tnan\n", nil, true},
+		{"infinite", "0\tinf\n", nil, true},
+		{"huge", "0\t1e300\n", nil, true},
+		{"fractional minutes", "1.5:00\t2:00\n", nil, true},
+		{"too many fields", "1:2:3:4\t5\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadAudacity(strings.NewReader(tt.in), 48000)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadAudacity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var serr *SyntaxError
+			if err != nil && !errors.As(err, &serr) {
+				t.Fatalf("ReadAudacity() error = %v, want a SyntaxError", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ReadAudacity() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReaperRoundTrip(t *testing.T) {
+	ms := []Marker{
+		{Name: "start", Start: 0, End: 0},
+		{Name: "chorus, big", Start: 44100, End: 3 * 44100},
+		{Name: `say "hi"`, Start: 5 * 44100, End: 5 * 44100},
+	}
+	var buf bytes.Buffer
+	if err := WriteReaper(&buf, ms, 44100); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadReaper(&buf, 44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := renumber(ms); !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadReaper(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []Marker
+		wantErr bool
+	}{
+		{
+			name: "reordered columns",
+			in:   "\ufeff#,Start,End,Name\nR1,0:01.5,0:02,verse\nm2,3,,hit\n,,,\n",
+			want: []Marker{
+				{ID: 1, Name: "verse", Start: 72000, End: 96000},
+				{ID: 2, Name: "hit", Start: 144000, End: 144000},
+			},
+		},
+		{
+			name: "no header",
+			in:   "M1,hit,1.0\n",
+			want: []Marker{{ID: 1, Name: "hit", Start: 48000, End: 48000}},
+		},
+		{"bars and beats", "#,Name,Start,End\nM1,hit,1.1.00,\n", nil, true},
+		{"unknown type", "#,Name,Start,End\nX1,hit,1,\n", nil, true},
+		{"region end before start", "#,Name,Start,End\nR1,verse,2,1\n", nil, true},
+		{"huge", "#,Name,Start,End\nM1,hit,1e300,\n", nil, true},
+		{"bad quoting", "#,Name,Start,End\nM1,\"hit,1,\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadReaper(strings.NewReader(tt.in), 48000)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadReaper() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var serr *SyntaxError
+			if err != nil && !errors.As(err, &serr) {
+				t.Fatalf("ReadReaper() error = %v, want a SyntaxError", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ReadReaper() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCueRoundTrip(t *testing.T) {
+	// Whole CD frames at 44.1 kHz are 588 samples, so positions survive
+	// the rounding.
+	ms := []Marker{
+		{Name: "Intro", Notes: "count in", Start: 0, End: 588 * 75},
+		{Name: `The "Hook"`, Start: 588 * 100, End: 588 * 100},
+		{Start: 588 * 75 * 61, End: 588*75*61 + 588},
+	}
+	var buf bytes.Buffer
+	if err := WriteCue(&buf, ms, 44100, "take.wav"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadCue(&buf, 44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := renumber(ms)
+	want[1].Name = "The 'Hook'"
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadCue(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []Marker
+		wantErr bool
+	}{
+		{
+			name: "tracks",
+			in: "FILE \"a.wav\" WAVE\n  TRACK 01 AUDIO\n    TITLE \"One\"\n    INDEX 00 00:00:00\n    INDEX 01 00:01:00\n" +
+				"  TRACK 02 AUDIO\n    REM END 00:02:00\n    INDEX 01 00:03:00\n",
+			want: []Marker{
+				{ID: 1, Name: "One", Start: 48000, End: 48000},
+				{ID: 2, Start: 144000, End: 144000},
+			},
+		},
+		{"no index 01", "TRACK 01 AUDIO\n  INDEX 00 00:00:00\n", nil, true},
+		{"seconds out of range", "TRACK 01 AUDIO\n  INDEX 01 00:60:00\n", nil, true},
+		{"frames out of range", "TRACK 01 AUDIO\n  INDEX 01 00:00:75\n", nil, true},
+		{"missing field", "TRACK 01 AUDIO\n  INDEX 01 00:00\n", nil, true},
+		{"negative", "TRACK 01 AUDIO\n  INDEX 01 -1:00:00\n", nil, true},
+		{"huge minutes", "TRACK 01 AUDIO\n  INDEX 01 9223372036854775807:00:00\n", nil, true},
+		{"huge end minutes", "TRACK 01 AUDIO\n  REM END 99999999999999:00:00\n  INDEX 01 00:00:00\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadCue(strings.NewReader(tt.in), 48000)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadCue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ReadCue() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteCueTooManyTracks(t *testing.T) {
+	ms := make([]Marker, MaxCueTracks+1)
+	if err := WriteCue(&bytes.Buffer{}, ms, 48000, "a.wav"); !errors.Is(err, ErrTooManyTracks) {
+		t.Fatalf("WriteCue() error = %v, want %v", err, ErrTooManyTracks)
+	}
+}
+
+func TestWAVRoundTrip(t *testing.T) {
+	ms := []Marker{
+		{Name: "loop", Start: 100, End: 200, Loop: true},
+		{Name: "hit", Notes: "snare", Start: 50, End: 50},
+		{Name: "region", Start: 300, End: 400},
+		{Name: "too far", Start: 0, End: math.MaxUint32 + 1},
+	}
+	// A file ending in an odd-sized chunk may lack its pad byte.
+	empty := wave(0)
+	unpadded := append(empty[:len(empty)-8], "data\x03\x00\x00\x00\x01\x02\x03"...)
+	binary.LittleEndian.PutUint32(unpadded[4:], uint32(len(unpadded)-8))
+
+	for _, data := range [][]byte{wave(1000), unpadded} {
+		f := &memFile{data}
+		size, err := AppendWAV(f, int64(len(f.b)), ms, 48000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(f.b)) {
+			t.Fatalf("AppendWAV() = %d, file is %d bytes", size, len(f.b))
+		}
+		if got := binary.LittleEndian.Uint32(f.b[4:]); int64(got) != size-8 {
+			t.Fatalf("RIFF size = %d, want %d", got, size-8)
+		}
+
+		got, hz, err := ReadWAV(bytes.NewReader(f.b), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Marker{
+			{ID: 2, Name: "hit", Notes: "snare", Start: 50, End: 50},
+			{ID: 1, Name: "loop", Start: 100, End: 200, Loop: true},
+			{ID: 3, Name: "region", Start: 300, End: 400},
+		}
+		if hz != 48000 || !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadWAV() = %+v, %d Hz; want %+v, 48000 Hz", got, hz, want)
+		}
+	}
+}
+
+func TestAppendWAVNoMarkers(t *testing.T) {
+	f := &memFile{wave(10)}
+	size, err := AppendWAV(f, int64(len(f.b)), []Marker{{Start: 5, End: 4}}, 48000)
+	if err != nil || size != int64(len(wave(10))) {
+		t.Fatalf("AppendWAV() = %d, %v; want the file unchanged", size, err)
+	}
+}
+
+func TestReadWAV(t *testing.T) {
+	cue := func(points ...[2]uint32) []byte {
+		b := binary.LittleEndian.AppendUint32(nil, uint32(len(points)))
+		for _, p := range points {
+			e := make([]byte, 24)
+			binary.LittleEndian.PutUint32(e[0:], p[0])
+			copy(e[8:], "data")
+			binary.LittleEndian.PutUint32(e[20:], p[1])
+			b = append(b, e...)
+		}
+		return b
+	}
+	smpl := func(id, start, end uint32) []byte {
+		b := make([]byte, 36, 60)
+		binary.LittleEndian.PutUint32(b[28:], 1)
+		for _, v := range []uint32{id, 0, start, end, 0, 0} {
+			b = binary.LittleEndian.AppendUint32(b, v)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []Marker
+		wantErr error
+	}{
+		{
+			name: "cue count larger than points",
+			data: wave(10, appendChunk(nil, "cue ", func() []byte {
+				b := cue([2]uint32{1, 5})
+				binary.LittleEndian.PutUint32(b, 1000)
+				return b
+			}())),
+			want: []Marker{{ID: 1, Start: 5, End: 5}},
+		},
+		{
+			name: "loop end before start",
+			data: wave(10, appendChunk(nil, "smpl", smpl(1, 8, 2))),
+		},
+		{
+			name: "loop without cue point",
+			data: wave(10, appendChunk(nil, "smpl", smpl(7, 2, 8))),
+			want: []Marker{{ID: 7, Start: 2, End: 9, Loop: true}},
+		},
+		{
+			name: "short adtl entries",
+			data: wave(10,
+				appendChunk(nil, "cue ", cue([2]uint32{1, 5})),
+				appendChunk(nil, "LIST", append([]byte("adtl"), append(
+					appendChunk(nil, "labl", []byte{1}),
+					appendChunk(nil, "ltxt", []byte{1, 0, 0, 0})...)...)),
+			),
+			want: []Marker{{ID: 1, Start: 5, End: 5}},
+		},
+		{
+			name:    "not wave",
+			data:    []byte("RIFF\x04\x00\x00\x00AVI "),
+			wantErr: ErrNotWAVE,
+		},
+		{
+			name:    "not riff",
+			data:    []byte("OggS\x00\x00\x00\x00\x00\x00\x00\x00"),
+			wantErr: riff.ErrFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := ReadWAV(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadWAV() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ReadWAV() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package markers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadReaper parses a REAPER region/marker manager CSV export with columns
+// "#", "Name", "Start" and "End". Rows numbered "R…" are regions and rows
+// numbered "M…" are markers. Times must be in seconds or h:m:s; bar and beat
+// positions are rejected since they depend on the project tempo. Positions
+// are returned as frames at hz.
+func ReadReaper(r io.Reader, hz int) ([]Marker, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	var markers []Marker
+	cols := map[string]int{"#": 0, "name": 1, "start": 2, "end": 3}
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &SyntaxError{line, err.Error()}
+		}
+		if line == 1 && len(rec) > 0 && strings.TrimSpace(strings.TrimPrefix(rec[0], "\ufeff")) == "#" {
+			for i, c := range rec {
+				cols[strings.ToLower(strings.TrimSpace(c))] = i
+			}
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+
+		id := strings.ToUpper(field("#"))
+		if id == "" {
+			continue
+		}
+		region := strings.HasPrefix(id, "R")
+		if !region && !strings.HasPrefix(id, "M") {
+			return nil, &SyntaxError{line, fmt.Sprintf("unknown marker type %q", id)}
+		}
+
+		startText := field("start")
+		if strings.Count(startText, ".") > 1 {
+			return nil, &SyntaxError{line, "bar and beat positions are not supported; export with the time format set to seconds"}
+		}
+		start, err := parseSeconds(startText, hz)
+		if err != nil {
+			return nil, &SyntaxError{line, err.Error()}
+		}
+		end := start
+		if region {
+			if end, err = parseSeconds(field("end"), hz); err != nil {
+				return nil, &SyntaxError{line, err.Error()}
+			}
+			if end < start {
+				return nil, &SyntaxError{line, "end is before start"}
+			}
+		}
+
+		markers = append(markers, Marker{
+			ID:    uint32(len(markers) + 1),
+			Name:  field("name"),
+			Start: start,
+			End:   end,
+		})
+	}
+	return markers, nil
+}
+
+// WriteReaper writes markers at hz as a REAPER region/marker CSV with times
+// in seconds. Markers with a length become regions.
+func WriteReaper(w io.Writer, markers []Marker, hz int) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"#", "Name", "Start", "End", "Length"}); err != nil {
+		return err
+	}
+
+	var regions, points int
+	for _, m := range markers {
+		var rec []string
+		if m.End > m.Start {
+			regions++
+			rec = []string{
+				fmt.Sprintf("R%d", regions),
+				oneLine(m.Name),
+				formatSeconds(m.Start, hz),
+				formatSeconds(m.End, hz),
+				formatSeconds(m.End-m.Start, hz),
+			}
+		} else {
+			points++
+			rec = []string{fmt.Sprintf("M%d", points), oneLine(m.Name), formatSeconds(m.Start, hz), "", ""}
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,62 @@
+package markers
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"wavey.ai/pkg/timebase"
+)
+
+// A SyntaxError reports a line of a marker file that could not be parsed.
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("markers: line %d: %s", e.Line, e.Msg)
+}
+
+// formatSeconds formats a frame position at hz as seconds with microsecond
+// precision.
+func formatSeconds(pos int64, hz int) string {
+	us := timebase.Convert(pos, int64(hz), timebase.Micros, timebase.Nearest)
+	return strconv.FormatFloat(float64(us)/timebase.Micros, 'f', 6, 64)
+}
+
+// parseSeconds parses seconds written as "s.sss", "m:ss.sss" or
+// "h:mm:ss.sss" into frames at hz.
+func parseSeconds(s string, hz int) (int64, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+
+	var secs float64
+	for i, p := range parts {
+		last := i == len(parts)-1
+		if last {
+			// Some locales write a decimal comma.
+			p = strings.Replace(p, ",", ".", 1)
+		}
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || (!last && v != float64(int64(v))) {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		secs = secs*60 + v
+	}
+	// ParseFloat accepts "NaN" and "Inf", and huge values don't fit a frame
+	// count.
+	if x := secs * float64(hz); math.IsNaN(x) || x >= math.MaxInt64 {
+		return 0, fmt.Errorf("time %q out of range", s)
+	}
+	return timebase.FromSeconds(secs, int64(hz), timebase.Nearest), nil
+}
+
+// oneLine flattens a name for line-based formats.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
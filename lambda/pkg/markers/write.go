@@ -0,0 +1,163 @@
+package markers
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"wavey.ai/pkg/riff"
+)
+
+var ErrTooLarge = errors.New("markers: file too large for a RIFF header")
+
+// WriterReaderAt is a file that can be read and written at offsets.
+type WriterReaderAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// AppendWAV adds markers at hz to the end of the WAVE file f, which is size
+// bytes long, as "cue ", "LIST"/"adtl" and "smpl" chunks that ReadWAV reads
+// back. Markers past the 32-bit frame positions the chunks can hold are
+// left out. It returns the new size of the file.
+func AppendWAV(f WriterReaderAt, size int64, markers []Marker, hz int) (int64, error) {
+	rf, err := riff.New(f, size)
+	if err != nil {
+		return 0, err
+	}
+	if !rf.IsWAVE() {
+		return 0, ErrNotWAVE
+	}
+
+	var ms []Marker
+	for _, m := range markers {
+		if m.Start >= 0 && m.End <= math.MaxUint32 && m.End >= m.Start {
+			ms = append(ms, m)
+		}
+	}
+	if len(ms) == 0 {
+		return size, nil
+	}
+
+	var b []byte
+	if size&1 != 0 {
+		// The last chunk is missing its pad byte.
+		b = append(b, 0)
+	}
+	b = appendChunk(b, "cue ", cueChunk(ms))
+	b = appendChunk(b, "LIST", adtlChunk(ms))
+	if smpl := smplChunk(ms, hz); smpl != nil {
+		b = appendChunk(b, "smpl", smpl)
+	}
+
+	if _, err := f.WriteAt(b, size); err != nil {
+		return 0, err
+	}
+	size += int64(len(b))
+
+	var hdr [8]byte
+	if rf.Container == "RIFF" {
+		if size-8 > math.MaxUint32 {
+			return 0, ErrTooLarge
+		}
+		binary.LittleEndian.PutUint32(hdr[:4], uint32(size-8))
+		_, err = f.WriteAt(hdr[:4], 4)
+		return size, err
+	}
+
+	// RF64 and BW64 keep the real RIFF size in ds64.
+	ds64, ok := rf.Chunk("ds64")
+	if !ok || ds64.Size < 8 {
+		return 0, riff.ErrFormat
+	}
+	binary.LittleEndian.PutUint64(hdr[:], uint64(size-8))
+	_, err = f.WriteAt(hdr[:], ds64.Offset)
+	return size, err
+}
+
+func appendChunk(b []byte, id string, data []byte) []byte {
+	b = append(b, id...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	if len(data)&1 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// cueChunk numbers the cue points from 1 in the order of ms.
+func cueChunk(ms []Marker) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(ms)))
+	for i, m := range ms {
+		b = binary.LittleEndian.AppendUint32(b, uint32(i+1))
+		b = binary.LittleEndian.AppendUint32(b, uint32(m.Start))
+		b = append(b, "data"...)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint32(b, uint32(m.Start))
+	}
+	return b
+}
+
+// adtlChunk holds the names and notes of the cue points, and the lengths of
+// regions other than loops, which are described by smpl instead.
+func adtlChunk(ms []Marker) []byte {
+	b := []byte("adtl")
+	for i, m := range ms {
+		id := uint32(i + 1)
+		if m.Name != "" {
+			b = appendChunk(b, "labl", cstring(id, m.Name))
+		}
+		if m.Notes != "" {
+			b = appendChunk(b, "note", cstring(id, m.Notes))
+		}
+		if m.End > m.Start && !m.Loop {
+			d := binary.LittleEndian.AppendUint32(nil, id)
+			d = binary.LittleEndian.AppendUint32(d, uint32(m.End-m.Start))
+			d = append(d, "rgn "...)
+			// Country, language, dialect and code page.
+			d = append(d, make([]byte, 8)...)
+			b = appendChunk(b, "ltxt", d)
+		}
+	}
+	return b
+}
+
+func cstring(id uint32, s string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, id)
+	b = append(b, s...)
+	return append(b, 0)
+}
+
+// smplChunk describes loops, or returns nil when there are none. Loop ends
+// are inclusive in the chunk.
+func smplChunk(ms []Marker, hz int) []byte {
+	var loops []byte
+	n := 0
+	for i, m := range ms {
+		if !m.Loop || m.End <= m.Start {
+			continue
+		}
+		n++
+		loops = binary.LittleEndian.AppendUint32(loops, uint32(i+1))
+		loops = binary.LittleEndian.AppendUint32(loops, 0) // forward
+		loops = binary.LittleEndian.AppendUint32(loops, uint32(m.Start))
+		loops = binary.LittleEndian.AppendUint32(loops, uint32(m.End-1))
+		loops = binary.LittleEndian.AppendUint32(loops, 0) // fraction
+		loops = binary.LittleEndian.AppendUint32(loops, 0) // play forever
+	}
+	if n == 0 {
+		return nil
+	}
+
+	var period uint32
+	if hz > 0 {
+		period = uint32(1e9 / hz)
+	}
+	b := make([]byte, 36, 36+len(loops))
+	binary.LittleEndian.PutUint32(b[8:12], period)
+	binary.LittleEndian.PutUint32(b[12:16], 60) // MIDI unity note
+	binary.LittleEndian.PutUint32(b[28:32], uint32(n))
+	return append(b, loops...)
+}
@@ -0,0 +1,149 @@
+// Package ogg writes Ogg Opus files (RFC 7845) from already encoded Opus
+// packets.
+package ogg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxSegments is the lacing table limit of a single page.
+const maxSegments = 255
+
+// vendor is written to the OpusTags header.
+const vendor = "wavey.ai"
+
+var ErrPacketTooLarge = errors.New("ogg: packet too large")
+
+var crcTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+func crc(b []byte) uint32 {
+	var c uint32
+	for _, v := range b {
+		c = c<<8 ^ crcTable[byte(c>>24)^v]
+	}
+	return c
+}
+
+// OpusWriter writes a single logical Opus stream.
+type OpusWriter struct {
+	w       io.Writer
+	serial  uint32
+	seq     uint32
+	granule int64
+
+	lacing []byte
+	body   []byte
+}
+
+// NewOpusWriter writes the Opus headers to w. preSkip is the number of
+// samples at 48 kHz to drop from the start of the decoded stream, and
+// inputRate is the original sample rate, for information only.
+func NewOpusWriter(w io.Writer, serial uint32, channels, preSkip, inputRate int) (*OpusWriter, error) {
+	if channels < 1 || channels > 2 {
+		return nil, fmt.Errorf("ogg: %d channels without a mapping table", channels)
+	}
+	if preSkip < 0 || preSkip > 0xffff {
+		return nil, fmt.Errorf("ogg: pre-skip of %d samples", preSkip)
+	}
+	o := &OpusWriter{w: w, serial: serial}
+
+	le := binary.LittleEndian
+	head := append([]byte("OpusHead"), 1, byte(channels))
+	head = le.AppendUint16(head, uint16(preSkip))
+	head = le.AppendUint32(head, uint32(inputRate))
+	head = le.AppendUint16(head, 0) // output gain
+	head = append(head, 0)          // mapping family
+	if err := o.page(head, 0x02); err != nil {
+		return nil, err
+	}
+
+	tags := append([]byte("OpusTags"), le.AppendUint32(nil, uint32(len(vendor)))...)
+	tags = append(tags, vendor...)
+	tags = le.AppendUint32(tags, 0) // comments
+	if err := o.page(tags, 0); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// WritePacket adds a packet holding samples samples at 48 kHz.
+func (o *OpusWriter) WritePacket(p []byte, samples int) error {
+	segs := len(p)/255 + 1
+	if segs > maxSegments {
+		return ErrPacketTooLarge
+	}
+	if len(o.lacing)+segs > maxSegments {
+		if err := o.flush(0, o.granule); err != nil {
+			return err
+		}
+	}
+	o.lacing = lace(o.lacing, len(p))
+	o.body = append(o.body, p...)
+	o.granule += int64(samples)
+	return nil
+}
+
+// Close writes the last page with the given final granule position, which
+// counts the pre-skip and may fall short of the samples written to trim the
+// end of the stream. It does not close the underlying writer.
+func (o *OpusWriter) Close(granule int64) error {
+	if granule > o.granule {
+		return fmt.Errorf("ogg: final granule %d past %d samples written", granule, o.granule)
+	}
+	return o.flush(0x04, granule)
+}
+
+func (o *OpusWriter) flush(flags byte, granule int64) error {
+	err := o.write(o.lacing, o.body, flags, granule)
+	o.lacing, o.body = o.lacing[:0], o.body[:0]
+	return err
+}
+
+// page writes a header packet on a page of its own.
+func (o *OpusWriter) page(p []byte, flags byte) error {
+	return o.write(lace(nil, len(p)), p, flags, 0)
+}
+
+// lace appends the lacing values of an n byte packet.
+func lace(l []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		l = append(l, 255)
+	}
+	return append(l, byte(n))
+}
+
+func (o *OpusWriter) write(lacing, body []byte, flags byte, granule int64) error {
+	le := binary.LittleEndian
+	b := make([]byte, 0, 27+len(lacing)+len(body))
+	b = append(b, "OggS"...)
+	b = append(b, 0, flags)
+	b = le.AppendUint64(b, uint64(granule))
+	b = le.AppendUint32(b, o.serial)
+	b = le.AppendUint32(b, o.seq)
+	b = le.AppendUint32(b, 0) // checksum
+	b = append(b, byte(len(lacing)))
+	b = append(b, lacing...)
+	b = append(b, body...)
+	le.PutUint32(b[22:], crc(b))
+
+	o.seq++
+	_, err := o.w.Write(b)
+	return err
+}
@@ -0,0 +1,182 @@
+// Package pagination pages through DynamoDB queries for list endpoints.
+// The position between pages is handed to clients as an opaque cursor: the
+// query's LastEvaluatedKey, signed together with a scope naming the list
+// and its owner, so a cursor can't be edited or replayed against another
+// user's list.
+package pagination
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MinSecretLength is the shortest signing secret accepted.
+const MinSecretLength = 32
+
+// DefaultLimit is the page size when the client doesn't ask for one.
+const DefaultLimit = 100
+
+// MaxLimit bounds the page size.
+const MaxLimit = 1000
+
+// macLength is the number of bytes of HMAC-SHA256 kept in a cursor.
+const macLength = 16
+
+var (
+	// ErrCursor means a cursor was malformed, tampered with or issued for
+	// a different list.
+	ErrCursor = errors.New("pagination: invalid cursor")
+	// ErrLimit means a limit was not a number between 1 and MaxLimit.
+	ErrLimit = errors.New("pagination: limit must be between 1 and " + strconv.Itoa(MaxLimit))
+)
+
+// Paginator signs and checks cursors with one secret.
+type Paginator struct {
+	secret []byte
+}
+
+// New returns a Paginator for secret, which must be at least
+// MinSecretLength bytes.
+func New(secret string) (*Paginator, error) {
+	if len(secret) < MinSecretLength {
+		return nil, errors.New("pagination: secret must be at least " + strconv.Itoa(MinSecretLength) + " bytes")
+	}
+	return &Paginator{[]byte(secret)}, nil
+}
+
+// ParseLimit parses a limit query parameter, returning DefaultLimit when
+// it is empty.
+func ParseLimit(s string) (int32, error) {
+	if s == "" {
+		return DefaultLimit, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > MaxLimit {
+		return 0, ErrLimit
+	}
+	return int32(n), nil
+}
+
+// Encode returns the cursor for key within scope, or "" if key is empty
+// because there are no more pages.
+func (p *Paginator) Encode(scope string, key map[string]dynamodbTypes.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	m := make(map[string]attr, len(key))
+	for name, v := range key {
+		switch v := v.(type) {
+		case *dynamodbTypes.AttributeValueMemberS:
+			m[name] = attr{S: &v.Value}
+		case *dynamodbTypes.AttributeValueMemberN:
+			m[name] = attr{N: &v.Value}
+		case *dynamodbTypes.AttributeValueMemberB:
+			m[name] = attr{B: v.Value}
+		default:
+			return "", errors.New("pagination: unsupported key attribute " + name)
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(p.mac(scope, payload)), nil
+}
+
+// Decode checks a cursor made by Encode with the same scope and returns
+// the key to start the next page from. An empty cursor decodes to a nil
+// key, which starts from the beginning.
+func (p *Paginator) Decode(scope, cursor string) (map[string]dynamodbTypes.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	payload, sig, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return nil, ErrCursor
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, p.mac(scope, payload)) {
+		return nil, ErrCursor
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrCursor
+	}
+	var m map[string]attr
+	if err := json.Unmarshal(b, &m); err != nil || len(m) == 0 {
+		return nil, ErrCursor
+	}
+
+	key := make(map[string]dynamodbTypes.AttributeValue, len(m))
+	for name, a := range m {
+		switch {
+		case a.S != nil:
+			key[name] = &dynamodbTypes.AttributeValueMemberS{Value: *a.S}
+		case a.N != nil:
+			key[name] = &dynamodbTypes.AttributeValueMemberN{Value: *a.N}
+		case a.B != nil:
+			key[name] = &dynamodbTypes.AttributeValueMemberB{Value: a.B}
+		default:
+			return nil, ErrCursor
+		}
+	}
+	return key, nil
+}
+
+// Query runs in, starting from the cursor, until it has limit items or
+// the query is exhausted. Filter expressions are applied after DynamoDB's
+// own Limit, so a single request can come back short while more items
+// remain; Query keeps going in that case. It returns the items and the
+// cursor for the next page, which is "" after the last.
+func (p *Paginator) Query(ctx context.Context, dbCl *dynamodb.Client, in *dynamodb.QueryInput, scope, cursor string, limit int32) ([]map[string]dynamodbTypes.AttributeValue, string, error) {
+	start, err := p.Decode(scope, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	q := *in
+	q.ExclusiveStartKey = start
+	var items []map[string]dynamodbTypes.AttributeValue
+	for {
+		remaining := limit - int32(len(items))
+		q.Limit = &remaining
+		res, err := dbCl.Query(ctx, &q)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, res.Items...)
+		if len(res.LastEvaluatedKey) == 0 {
+			return items, "", nil
+		}
+		if int32(len(items)) >= limit {
+			next, err := p.Encode(scope, res.LastEvaluatedKey)
+			return items, next, err
+		}
+		q.ExclusiveStartKey = res.LastEvaluatedKey
+	}
+}
+
+func (p *Paginator) mac(scope, payload string) []byte {
+	m := hmac.New(sha256.New, p.secret)
+	m.Write([]byte(scope))
+	m.Write([]byte{0})
+	m.Write([]byte(payload))
+	return m.Sum(nil)[:macLength]
+}
+
+// attr is the JSON form of a key attribute.
+type attr struct {
+	S *string `json:"S,omitempty"`
+	N *string `json:"N,omitempty"`
+	B []byte  `json:"B,omitempty"`
+}
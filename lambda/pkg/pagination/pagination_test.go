@@ -0,0 +1,142 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr bool
+	}{
+		{"empty", "", true},
+		{"one short", testSecret[:MinSecretLength-1], true},
+		{"minimum", testSecret[:MinSecretLength], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.secret)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int32
+		wantErr bool
+	}{
+		{"", DefaultLimit, false},
+		{"1", 1, false},
+		{"1000", MaxLimit, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"1001", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLimit(tt.in)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("ParseLimit(%q) = %d, %v; want %d, wantErr %v", tt.in, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	p, err := New(testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(strings.ToUpper(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const scope = "clips/alice"
+	key := map[string]dynamodbTypes.AttributeValue{
+		"user":    &dynamodbTypes.AttributeValueMemberS{Value: "alice"},
+		"key":     &dynamodbTypes.AttributeValueMemberS{Value: "2NrYkLhEKpHzRdrV1Un6RBH8iO5"},
+		"version": &dynamodbTypes.AttributeValueMemberN{Value: "42"},
+		"hash":    &dynamodbTypes.AttributeValueMemberB{Value: []byte{0, 1, 2}},
+	}
+	mustEncode := func(p *Paginator, scope string, key map[string]dynamodbTypes.AttributeValue) string {
+		c, err := p.Encode(scope, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	valid := mustEncode(p, scope, key)
+	payload, sig, _ := strings.Cut(valid, ".")
+	forged := mustEncode(p, scope, map[string]dynamodbTypes.AttributeValue{
+		"user": &dynamodbTypes.AttributeValueMemberS{Value: "bob"},
+	})
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	signed := func(payload string) string {
+		return payload + "." + encode(p.mac(scope, payload))
+	}
+
+	tests := []struct {
+		name    string
+		scope   string
+		cursor  string
+		want    map[string]dynamodbTypes.AttributeValue
+		wantErr error
+	}{
+		{"valid", scope, valid, key, nil},
+		{"empty", scope, "", nil, nil},
+		{"other user's scope", "clips/bob", valid, nil, ErrCursor},
+		{"other list's scope", "trash/alice", valid, nil, ErrCursor},
+		{"other secret", scope, mustEncode(other, scope, key), nil, ErrCursor},
+		{"payload swapped", scope, forgedPayload + "." + sig, nil, ErrCursor},
+		{"signature changed", scope, payload + "." + strings.Repeat("A", len(sig)), nil, ErrCursor},
+		{"signature truncated", scope, valid[:len(valid)-1], nil, ErrCursor},
+		{"payload truncated", scope, payload[:len(payload)-1] + "." + sig, nil, ErrCursor},
+		{"no signature", scope, payload, nil, ErrCursor},
+		{"bad signature encoding", scope, payload + ".!!", nil, ErrCursor},
+		{"garbage", scope, "not a cursor", nil, ErrCursor},
+		{"signed garbage", scope, signed("!!"), nil, ErrCursor},
+		{"signed non-json", scope, signed(encode([]byte("nope"))), nil, ErrCursor},
+		{"signed empty key", scope, signed(encode([]byte("{}"))), nil, ErrCursor},
+		{"signed untyped attribute", scope, signed(encode([]byte(`{"user":{}}`))), nil, ErrCursor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Decode(tt.scope, tt.cursor)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Decode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeLastPage(t *testing.T) {
+	p, err := New(testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := p.Encode("clips/alice", nil); c != "" || err != nil {
+		t.Fatalf("Encode(nil) = %q, %v; want \"\", nil", c, err)
+	}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,251 @@
+// Package riff walks the chunk structure of RIFF, RF64/BW64 and IFF (AIFF)
+// files. Only chunk headers are read up front, so it is safe to use against
+// multi-gigabyte objects behind a ranged reader.
+package riff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var (
+	ErrFormat   = errors.New("riff: not a RIFF, RF64 or IFF file")
+	ErrTooLarge = errors.New("riff: chunk too large")
+)
+
+// maxChunks bounds how many chunk headers are read from a single file.
+const maxChunks = 4096
+
+// Chunk describes a chunk within a file. Offset points at the chunk body.
+type Chunk struct {
+	ID     string
+	Offset int64
+	Size   int64
+}
+
+// File is the parsed chunk layout of a RIFF or IFF file.
+type File struct {
+	// Container is "RIFF", "RF64", "BW64" or "FORM".
+	Container string
+	// Form is the form type, e.g. "WAVE", "AIFF" or "AIFC".
+	Form   string
+	Chunks []Chunk
+
+	r    io.ReaderAt
+	size int64
+}
+
+// New reads the chunk headers of the file in r, which is size bytes long.
+func New(r io.ReaderAt, size int64) (*File, error) {
+	var hdr [12]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrFormat
+		}
+		return nil, err
+	}
+
+	f := &File{
+		Container: string(hdr[0:4]),
+		Form:      string(hdr[8:12]),
+		r:         r,
+		size:      size,
+	}
+
+	switch f.Container {
+	case "RIFF", "RF64", "BW64", "FORM":
+	default:
+		return nil, ErrFormat
+	}
+
+	// ds64 carries the real sizes of chunks whose 32-bit size field is
+	// saturated in RF64/BW64 files.
+	sizes := map[string]int64{}
+
+	off := int64(12)
+	for len(f.Chunks) < maxChunks && off+8 <= size {
+		var ch [8]byte
+		if _, err := r.ReadAt(ch[:], off); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		c := Chunk{
+			ID:     string(ch[0:4]),
+			Offset: off + 8,
+			Size:   int64(f.ByteOrder().Uint32(ch[4:8])),
+		}
+
+		if c.Size == 0xFFFFFFFF {
+			if s, ok := sizes[c.ID]; ok {
+				c.Size = s
+			}
+		}
+
+		// Compared this way round so a huge ds64 size can't overflow.
+		if c.Size > size-c.Offset {
+			// Truncated uploads are common; keep what is there.
+			c.Size = size - c.Offset
+		}
+		if c.Size < 0 {
+			c.Size = 0
+		}
+
+		if c.ID == "ds64" && len(f.Chunks) == 0 {
+			b, err := f.Bytes(c, 1<<16)
+			if err != nil {
+				return nil, err
+			}
+			parseDS64(b, sizes)
+		}
+
+		f.Chunks = append(f.Chunks, c)
+		off = c.Offset + c.Size + c.Size&1
+	}
+
+	return f, nil
+}
+
+// parseDS64 reads the chunk sizes in a ds64 chunk body into sizes. Sizes
+// that don't fit in an int64 are left out, so their chunks keep the
+// saturated 32-bit size.
+func parseDS64(b []byte, sizes map[string]int64) {
+	if len(b) < 28 {
+		return
+	}
+	add := func(id string, v uint64) {
+		if v <= math.MaxInt64 {
+			sizes[id] = int64(v)
+		}
+	}
+	add("data", binary.LittleEndian.Uint64(b[8:16]))
+	n := int(binary.LittleEndian.Uint32(b[24:28]))
+	for i, p := 0, 28; i < n && p+12 <= len(b); i, p = i+1, p+12 {
+		add(string(b[p:p+4]), binary.LittleEndian.Uint64(b[p+4:p+12]))
+	}
+}
+
+// IsWAVE reports whether f is a WAVE file in any of its container variants.
+func (f *File) IsWAVE() bool {
+	return f.Container != "FORM" && f.Form == "WAVE"
+}
+
+// IsAIFF reports whether f is an AIFF or AIFF-C file.
+func (f *File) IsAIFF() bool {
+	return f.Container == "FORM" && (f.Form == "AIFF" || f.Form == "AIFC")
+}
+
+// ByteOrder returns the byte order of the chunk headers in f.
+func (f *File) ByteOrder() binary.ByteOrder {
+	if f.Container == "FORM" {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// Chunk returns the first chunk with the given id.
+func (f *File) Chunk(id string) (Chunk, bool) {
+	for _, c := range f.Chunks {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return Chunk{}, false
+}
+
+// Bytes reads the body of c, refusing chunks larger than max bytes.
+func (f *File) Bytes(c Chunk, max int64) ([]byte, error) {
+	if c.Size < 0 {
+		return nil, fmt.Errorf("riff: %q has negative size %d", c.ID, c.Size)
+	}
+	if c.Size > max {
+		return nil, fmt.Errorf("%w: %q is %d bytes", ErrTooLarge, c.ID, c.Size)
+	}
+	b := make([]byte, c.Size)
+	if _, err := f.r.ReadAt(b, c.Offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Section returns a reader over the body of c.
+func (f *File) Section(c Chunk) *io.SectionReader {
+	return io.NewSectionReader(f.r, c.Offset, c.Size)
+}
+
+// A SubChunk is a chunk nested in a LIST chunk body.
+type SubChunk struct {
+	ID   string
+	Data []byte
+}
+
+// List splits a LIST chunk body into its list type and sub-chunks.
+func List(b []byte, order binary.ByteOrder) (string, []SubChunk) {
+	if len(b) < 4 {
+		return "", nil
+	}
+
+	typ := string(b[0:4])
+	var subs []SubChunk
+	for p := 4; p+8 <= len(b); {
+		n := int(order.Uint32(b[p+4 : p+8]))
+		start := p + 8
+		end := start + n
+		if n < 0 || end > len(b) {
+			end = len(b)
+		}
+		subs = append(subs, SubChunk{ID: string(b[p : p+4]), Data: b[start:end]})
+		p = end + n&1
+	}
+
+	return typ, subs
+}
+
+// CString returns b up to its first NUL byte with surrounding space trimmed.
+func CString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(bytes.TrimSpace(b))
+}
+
+// Extended decodes an 80-bit IEEE 754 extended precision float, as used for
+// the AIFF sample rate.
+func Extended(b []byte) float64 {
+	exp := int(binary.BigEndian.Uint16(b[0:2]) & 0x7FFF)
+	mant := binary.BigEndian.Uint64(b[2:10])
+	if exp == 0 && mant == 0 {
+		return 0
+	}
+	v := math.Ldexp(float64(mant), exp-16383-63)
+	if b[0]&0x80 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// PutExtended encodes v as an 80-bit IEEE 754 extended precision float into
+// the first 10 bytes of b.
+func PutExtended(b []byte, v float64) {
+	for i := range b[:10] {
+		b[i] = 0
+	}
+	if v == 0 {
+		return
+	}
+
+	var sign uint16
+	if v < 0 {
+		sign = 0x8000
+		v = -v
+	}
+	frac, exp := math.Frexp(v)
+	binary.BigEndian.PutUint16(b[0:2], sign|uint16(exp-1+16383))
+	binary.BigEndian.PutUint64(b[2:10], uint64(math.Ldexp(frac, 64)))
+}
@@ -0,0 +1,250 @@
+package riff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// chunk returns a chunk with a little-endian header, padded to even length.
+func chunk(id string, size uint32, body []byte) []byte {
+	b := make([]byte, 8, 8+len(body)+1)
+	copy(b, id)
+	binary.LittleEndian.PutUint32(b[4:], size)
+	b = append(b, body...)
+	if len(body)&1 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// file returns a file of the given container and form made of chunks.
+func file(container, form string, chunks ...[]byte) []byte {
+	b := []byte(container + "\xff\xff\xff\xff" + form)
+	for _, c := range chunks {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// ds64 returns a ds64 chunk giving dataSize and the sizes in table.
+func ds64(dataSize uint64, table map[string]uint64) []byte {
+	body := make([]byte, 28)
+	binary.LittleEndian.PutUint64(body[8:], dataSize)
+	binary.LittleEndian.PutUint32(body[24:], uint32(len(table)))
+	for id, size := range table {
+		var e [12]byte
+		copy(e[:], id)
+		binary.LittleEndian.PutUint64(e[4:], size)
+		body = append(body, e[:]...)
+	}
+	return chunk("ds64", uint32(len(body)), body)
+}
+
+func TestNew(t *testing.T) {
+	samples := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	type want struct {
+		id   string
+		size int64
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []want
+		wantErr error
+	}{
+		{
+			name: "wave",
+			data: file("RIFF", "WAVE", chunk("fmt ", 2, []byte{1, 0}), chunk("data", 8, samples)),
+			want: []want{{"fmt ", 2}, {"data", 8}},
+		},
+		{
+			name: "odd chunk padded",
+			data: file("RIFF", "WAVE", chunk("LIST", 3, []byte("abc")), chunk("data", 8, samples)),
+			want: []want{{"LIST", 3}, {"data", 8}},
+		},
+		{
+			name: "truncated data",
+			data: file("RIFF", "WAVE", chunk("data", 100, samples)),
+			want: []want{{"data", 8}},
+		},
+		{
+			name: "rf64 data size from ds64",
+			data: file("RF64", "WAVE", ds64(8, nil), chunk("data", 0xFFFFFFFF, samples)),
+			want: []want{{"ds64", 28}, {"data", 8}},
+		},
+		{
+			name: "rf64 table size",
+			data: file("RF64", "WAVE", ds64(0, map[string]uint64{"junk": 2}),
+				chunk("junk", 0xFFFFFFFF, []byte{9, 9}), chunk("data", 8, samples)),
+			want: []want{{"ds64", 40}, {"junk", 2}, {"data", 8}},
+		},
+		{
+			name: "rf64 ds64 size negative as int64",
+			data: file("RF64", "WAVE", ds64(math.MaxUint64, nil), chunk("data", 0xFFFFFFFF, samples)),
+			want: []want{{"ds64", 28}, {"data", 8}},
+		},
+		{
+			name: "rf64 ds64 size max int64",
+			data: file("RF64", "WAVE", ds64(math.MaxInt64, nil), chunk("data", 0xFFFFFFFF, samples)),
+			want: []want{{"ds64", 28}, {"data", 8}},
+		},
+		{
+			name: "rf64 table size negative as int64",
+			data: file("RF64", "WAVE", ds64(8, map[string]uint64{"junk": math.MaxUint64}),
+				chunk("junk", 0xFFFFFFFF, []byte{9, 9})),
+			want: []want{{"ds64", 40}, {"junk", 2}},
+		},
+		{
+			name:    "not riff",
+			data:    []byte("ID3\x04\x00\x00\x00\x00\x00\x00\x00\x00"),
+			wantErr: ErrFormat,
+		},
+		{
+			name:    "too short",
+			data:    []byte("RIFF"),
+			wantErr: ErrFormat,
+		},
+		{
+			name: "header only",
+			data: file("RIFF", "WAVE"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("New() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(f.Chunks) != len(tt.want) {
+				t.Fatalf("New() chunks = %+v, want %+v", f.Chunks, tt.want)
+			}
+			for i, c := range f.Chunks {
+				if c.ID != tt.want[i].id || c.Size != tt.want[i].size {
+					t.Errorf("chunk %d = %q %d bytes, want %q %d bytes", i, c.ID, c.Size, tt.want[i].id, tt.want[i].size)
+				}
+				if c.Offset+c.Size > int64(len(tt.data)) {
+					t.Errorf("chunk %d runs past the end of the file", i)
+				}
+				if _, err := f.Bytes(c, 1<<20); err != nil {
+					t.Errorf("Bytes(%q) error = %v", c.ID, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBytes(t *testing.T) {
+	data := file("RIFF", "WAVE", chunk("data", 8, []byte{1, 2, 3, 4, 5, 6, 7, 8}))
+	f, err := New(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := f.Chunk("data")
+
+	tests := []struct {
+		name    string
+		chunk   Chunk
+		max     int64
+		want    []byte
+		wantErr bool
+	}{
+		{"whole", c, 8, []byte{1, 2, 3, 4, 5, 6, 7, 8}, false},
+		{"over max", c, 7, nil, true},
+		{"negative size", Chunk{ID: "data", Offset: c.Offset, Size: -1}, 8, nil, true},
+		{"empty", Chunk{ID: "data", Offset: c.Offset}, 8, []byte{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := f.Bytes(tt.chunk, tt.max)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Bytes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, tt.want) {
+				t.Fatalf("Bytes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		wantType string
+		want     []SubChunk
+	}{
+		{"empty", nil, "", nil},
+		{"type only", []byte("INFO"), "INFO", nil},
+		{
+			name:     "padded",
+			data:     append([]byte("INFO"), append(chunk("INAM", 3, []byte("abc")), chunk("IART", 2, []byte("de"))...)...),
+			wantType: "INFO",
+			want:     []SubChunk{{"INAM", []byte("abc")}, {"IART", []byte("de")}},
+		},
+		{
+			name:     "size past end",
+			data:     append([]byte("INFO"), chunk("INAM", 100, []byte("abc"))...),
+			wantType: "INFO",
+			want:     []SubChunk{{"INAM", []byte("abc\x00")}},
+		},
+		{
+			name:     "size negative as int",
+			data:     append([]byte("INFO"), chunk("INAM", 0xFFFFFFFF, []byte("ab"))...),
+			wantType: "INFO",
+			want:     []SubChunk{{"INAM", []byte("ab")}},
+		},
+		{
+			name:     "partial header",
+			data:     []byte("INFOINA"),
+			wantType: "INFO",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, subs := List(tt.data, binary.LittleEndian)
+			if typ != tt.wantType || len(subs) != len(tt.want) {
+				t.Fatalf("List() = %q %+v, want %q %+v", typ, subs, tt.wantType, tt.want)
+			}
+			for i := range subs {
+				if subs[i].ID != tt.want[i].ID || !bytes.Equal(subs[i].Data, tt.want[i].Data) {
+					t.Errorf("sub-chunk %d = %+v, want %+v", i, subs[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestExtended(t *testing.T) {
+	for _, v := range []float64{0, 8000, 44100, 48000, 96000, 192000, -1.5} {
+		var b [10]byte
+		PutExtended(b[:], v)
+		if got := Extended(b[:]); got != v {
+			t.Errorf("Extended(PutExtended(%v)) = %v", v, got)
+		}
+	}
+	// 44100 as written by common AIFF encoders.
+	b := []byte{0x40, 0x0E, 0xAC, 0x44, 0, 0, 0, 0, 0, 0}
+	if got := Extended(b); got != 44100 {
+		t.Errorf("Extended(44100) = %v", got)
+	}
+}
+
+func TestCString(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"abc", "abc"},
+		{" abc \x00junk", "abc"},
+		{"\x00abc", ""},
+	}
+	for _, tt := range tests {
+		if got := CString([]byte(tt.in)); got != tt.want {
+			t.Errorf("CString(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
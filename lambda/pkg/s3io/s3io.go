@@ -0,0 +1,196 @@
+// Package s3io gives random access to S3 objects using ranged GETs, so
+// parsers can seek around large uploads without downloading them.
+package s3io
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// BlockSize is the granularity of ranged reads.
+const BlockSize = 4 << 20
+
+// maxBlocks is the number of blocks kept in memory per Reader.
+const maxBlocks = 8
+
+// API is the subset of the S3 client used by Reader.
+type API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+// Reader implements io.ReaderAt and io.ReadSeeker over an S3 object.
+type Reader struct {
+	ctx    context.Context
+	api    API
+	bucket string
+	key    string
+	size   int64
+
+	mu     sync.Mutex
+	blocks map[int64][]byte
+	order  []int64
+	off    int64
+
+	errMu sync.Mutex
+	err   error
+}
+
+// NewReader returns a Reader for an object of known size.
+func NewReader(ctx context.Context, api API, bucket, key string, size int64) *Reader {
+	return &Reader{
+		ctx:    ctx,
+		api:    api,
+		bucket: bucket,
+		key:    key,
+		size:   size,
+		blocks: map[int64][]byte{},
+	}
+}
+
+// Open looks up the size of an object and returns a Reader for it.
+func Open(ctx context.Context, api API, bucket, key string) (*Reader, error) {
+	head, err := api.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(ctx, api, bucket, key, head.ContentLength), nil
+}
+
+// Err returns the first error fetching from S3, if any. Parsers reading
+// through a Reader may wrap or replace its errors, so this tells a failed
+// fetch apart from a malformed object.
+func (r *Reader) Err() error {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	return r.err
+}
+
+// Size returns the object size in bytes.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("s3io: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	want := len(p)
+	if rem := r.size - off; int64(want) > rem {
+		p = p[:rem]
+	}
+
+	var n int
+	var err error
+	if len(p) >= BlockSize {
+		// Large reads skip the cache.
+		n, err = r.fetch(p, off)
+	} else {
+		n, err = r.readCached(p, off)
+	}
+	if err == nil && n < want {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *Reader) readCached(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		start := (off + int64(n)) / BlockSize * BlockSize
+		b, ok := r.blocks[start]
+		if !ok {
+			size := int64(BlockSize)
+			if start+size > r.size {
+				size = r.size - start
+			}
+			b = make([]byte, size)
+			if _, err := r.fetch(b, start); err != nil {
+				return n, err
+			}
+			r.keep(start, b)
+		}
+		n += copy(p[n:], b[off+int64(n)-start:])
+	}
+	return n, nil
+}
+
+// keep caches a block, evicting the oldest once maxBlocks are held.
+func (r *Reader) keep(start int64, b []byte) {
+	if len(r.order) == maxBlocks {
+		delete(r.blocks, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.blocks[start] = b
+	r.order = append(r.order, start)
+}
+
+func (r *Reader) fetch(p []byte, off int64) (int, error) {
+	n, err := r.get(p, off)
+	if err != nil {
+		r.errMu.Lock()
+		if r.err == nil {
+			r.err = err
+		}
+		r.errMu.Unlock()
+	}
+	return n, err
+}
+
+// get reads len(p) bytes at off, which must lie within the object, so a
+// short body is an error.
+func (r *Reader) get(p []byte, off int64) (int, error) {
+	rng := fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)
+	out, err := r.api.GetObject(r.ctx, &s3.GetObjectInput{
+		Bucket: &r.bucket,
+		Key:    &r.key,
+		Range:  &rng,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+
+	return io.ReadFull(out.Body, p)
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("s3io: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3io: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
@@ -0,0 +1,149 @@
+package search
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"wavey.ai/pkg/tagging"
+)
+
+// ErrRange means a range was not "min..max" with either end optional, or
+// a single number.
+var ErrRange = errors.New("search: ranges are min..max, with either end optional")
+
+// anyField matches a term in any text field.
+const anyField = numFields
+
+// Query selects documents. Text is matched against the text fields, and a
+// word in it can be limited to one field as "field:word", e.g.
+// "artist:nils". The other fields filter the matches: every tag in Tags
+// must be present, Keys and Formats match any of their values, and the
+// ranges are inclusive.
+type Query struct {
+	Text     string
+	Tags     []string
+	Keys     []string
+	Formats  []string
+	BPM      Range
+	Duration Range
+	Offset   int
+	Limit    int
+}
+
+// Range is an inclusive range of numbers with either end optional.
+type Range struct {
+	Min, Max       float64
+	HasMin, HasMax bool
+}
+
+// ParseRange parses "min..max", "min..", "..max" or a single number, which
+// is a range of one. The empty string is an empty Range, which matches
+// everything.
+func ParseRange(s string) (Range, error) {
+	if s == "" {
+		return Range{}, nil
+	}
+	lo, hi, ok := strings.Cut(s, "..")
+	if !ok {
+		hi = lo
+	}
+	var r Range
+	var err error
+	if lo != "" {
+		if r.Min, err = strconv.ParseFloat(lo, 64); err != nil {
+			return Range{}, ErrRange
+		}
+		r.HasMin = true
+	}
+	if hi != "" {
+		if r.Max, err = strconv.ParseFloat(hi, 64); err != nil {
+			return Range{}, ErrRange
+		}
+		r.HasMax = true
+	}
+	if !r.HasMin && !r.HasMax || r.HasMin && r.HasMax && r.Min > r.Max {
+		return Range{}, ErrRange
+	}
+	return r, nil
+}
+
+// Contains reports whether v is in the range. Zero means unknown, which
+// only an empty range contains.
+func (r Range) Contains(v float64) bool {
+	if !r.HasMin && !r.HasMax {
+		return true
+	}
+	if v == 0 {
+		return false
+	}
+	return (!r.HasMin || v >= r.Min) && (!r.HasMax || v <= r.Max)
+}
+
+func (q Query) filter(d Document) bool {
+	for _, t := range q.Tags {
+		t, err := tagging.Normalize(t)
+		if err != nil || !contains(d.Tags, t) {
+			return false
+		}
+	}
+	if len(q.Keys) > 0 {
+		ok := false
+		for _, k := range q.Keys {
+			ok = ok || NormalizeKey(k) == d.Key
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(q.Formats) > 0 {
+		ok := false
+		for _, f := range q.Formats {
+			ok = ok || strings.EqualFold(f, d.Format)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return q.BPM.Contains(d.BPM) && q.Duration.Contains(d.Duration)
+}
+
+// term is one word of query text.
+type term struct {
+	value  string
+	field  Field
+	prefix bool
+}
+
+func parseText(text string) []term {
+	var terms []term
+	for _, w := range strings.Fields(text) {
+		field := anyField
+		if name, rest, ok := strings.Cut(w, ":"); ok {
+			if f, ok := fieldNames[strings.ToLower(name)]; ok {
+				field, w = f, rest
+			}
+		}
+		// Words are split the way the index was, but only whole words are
+		// needed; the parts of "120bpm" would match more loosely.
+		for _, t := range strings.FieldsFunc(strings.ToLower(w), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			terms = append(terms, term{value: t, field: field})
+		}
+	}
+	if n := len(terms); n > 0 && !strings.HasSuffix(text, " ") {
+		terms[n-1].prefix = true
+	}
+	return terms
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
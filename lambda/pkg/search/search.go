@@ -0,0 +1,420 @@
+// Package search is a small full-text index over a user's sounds. Each
+// user's index is built from their formats rows and kept whole, documents
+// and postings together, so one read loads everything a query needs.
+// Libraries run to thousands of sounds, not millions, which keeps the
+// index small enough to rebuild on every change and search in memory.
+package search
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Field is a text field of a document.
+type Field uint8
+
+const (
+	FieldFilename Field = iota
+	FieldTitle
+	FieldArtist
+	FieldComment
+	FieldTag
+	numFields
+)
+
+// fieldNames are the names fields go by in queries.
+var fieldNames = map[string]Field{
+	"filename": FieldFilename,
+	"title":    FieldTitle,
+	"artist":   FieldArtist,
+	"comment":  FieldComment,
+	"tag":      FieldTag,
+}
+
+// boosts weight matches by the field they are in.
+var boosts = [numFields]float64{
+	FieldFilename: 2,
+	FieldTitle:    3,
+	FieldArtist:   2,
+	FieldComment:  1,
+	FieldTag:      2.5,
+}
+
+// prefixWeight discounts matches on a prefix of a term rather than the
+// whole term.
+const prefixWeight = 0.5
+
+// maxFacetValues bounds the values listed for each facet.
+const maxFacetValues = 20
+
+// Document is what is indexed about one sound.
+type Document struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Format   string `json:"format,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Artist   string `json:"artist,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+	// Name, Description and Credits are the details the user edited,
+	// searched as the title, comment and artist.
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Credits     string   `json:"credits,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Key         string   `json:"key,omitempty"`
+	BPM         float64  `json:"bpm,omitempty"`
+	Duration    float64  `json:"duration,omitempty"`
+	SampleRate  int64    `json:"sampleRate,omitempty"`
+	Channels    int64    `json:"channels,omitempty"`
+	CreatedAt   int64    `json:"createdAt,omitempty"`
+}
+
+// Posting records that a term occurs Count times in one field of a
+// document.
+type Posting struct {
+	Doc   int   `json:"d"`
+	Field Field `json:"f"`
+	Count int   `json:"n"`
+}
+
+// Index is a user's documents and the postings of every term in them.
+type Index struct {
+	Docs     []Document           `json:"docs"`
+	Postings map[string][]Posting `json:"postings"`
+
+	// terms are the keys of Postings in order, for prefix lookups.
+	terms []string
+}
+
+// Build indexes docs, newest first.
+func Build(docs []Document) *Index {
+	idx := &Index{Docs: docs, Postings: map[string][]Posting{}}
+	sort.SliceStable(idx.Docs, func(i, j int) bool {
+		return idx.Docs[i].ID > idx.Docs[j].ID
+	})
+	for i, d := range idx.Docs {
+		idx.Docs[i].Key = NormalizeKey(d.Key)
+		idx.add(i, FieldFilename, d.Filename)
+		idx.add(i, FieldTitle, d.Title)
+		idx.add(i, FieldTitle, d.Name)
+		idx.add(i, FieldArtist, d.Artist)
+		idx.add(i, FieldArtist, d.Credits)
+		idx.add(i, FieldComment, d.Comment)
+		idx.add(i, FieldComment, d.Description)
+		for _, t := range d.Tags {
+			idx.add(i, FieldTag, t)
+		}
+	}
+	idx.sortTerms()
+	return idx
+}
+
+func (idx *Index) add(doc int, f Field, text string) {
+	counts := map[string]int{}
+	for _, t := range tokenize(text) {
+		counts[t]++
+	}
+	for t, n := range counts {
+		ps := idx.Postings[t]
+		// Tags are added one at a time, so the last posting may already
+		// be this document's.
+		if last := len(ps) - 1; last >= 0 && ps[last].Doc == doc && ps[last].Field == f {
+			ps[last].Count += n
+			continue
+		}
+		idx.Postings[t] = append(ps, Posting{Doc: doc, Field: f, Count: n})
+	}
+}
+
+func (idx *Index) sortTerms() {
+	idx.terms = make([]string, 0, len(idx.Postings))
+	for t := range idx.Postings {
+		idx.terms = append(idx.terms, t)
+	}
+	sort.Strings(idx.terms)
+}
+
+// Hit is a matching document and how well it matched.
+type Hit struct {
+	Document
+	Score float64 `json:"score"`
+}
+
+// Count is how many matches have a value.
+type Count struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// RangeCount is how many matches fall in [Min, Max). Max is zero for the
+// open-ended last range.
+type RangeCount struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max,omitempty"`
+	Count int     `json:"count"`
+}
+
+// Facets break the matches down by tag, key, format, tempo and length.
+type Facets struct {
+	Tags     []Count      `json:"tags"`
+	Keys     []Count      `json:"keys"`
+	Formats  []Count      `json:"formats"`
+	BPM      []RangeCount `json:"bpm"`
+	Duration []RangeCount `json:"duration"`
+}
+
+// Result is a page of hits from a query, with the total number of matches
+// and facets over all of them.
+type Result struct {
+	Total  int    `json:"total"`
+	Hits   []Hit  `json:"hits"`
+	Facets Facets `json:"facets"`
+}
+
+// bpmBucket is the width of the tempo facet ranges.
+const bpmBucket = 10
+
+// durationBounds are the lower bounds in seconds of the length facet
+// ranges.
+var durationBounds = []float64{0, 1, 5, 30, 120}
+
+// Search runs q against the index. Without any text every document
+// matches, newest first.
+func (idx *Index) Search(q Query) Result {
+	scores := idx.match(q.Text)
+
+	var hits []Hit
+	for i, d := range idx.Docs {
+		score := 1.0
+		if scores != nil {
+			s, ok := scores[i]
+			if !ok {
+				continue
+			}
+			score = s
+		}
+		if !q.filter(d) {
+			continue
+		}
+		hits = append(hits, Hit{Document: d, Score: math.Round(score*1000) / 1000})
+	}
+	// Docs are newest first, so a stable sort keeps ties in that order.
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score
+	})
+
+	res := Result{Total: len(hits), Hits: []Hit{}, Facets: facets(hits)}
+	if q.Offset < len(hits) {
+		end := q.Offset + q.Limit
+		if end > len(hits) || q.Limit <= 0 {
+			end = len(hits)
+		}
+		res.Hits = hits[q.Offset:end]
+	}
+	return res
+}
+
+// match scores the documents containing every term of text, returning nil
+// if text has no terms. A term that doesn't end the text with a space is
+// matched as a prefix too, so results keep up while the user types.
+func (idx *Index) match(text string) map[int]float64 {
+	terms := parseText(text)
+	if len(terms) == 0 {
+		return nil
+	}
+	if idx.terms == nil {
+		idx.sortTerms()
+	}
+
+	var scores map[int]float64
+	for _, qt := range terms {
+		found := map[int]float64{}
+		for _, t := range idx.expand(qt) {
+			weight := 1.0
+			if t != qt.value {
+				weight = prefixWeight
+			}
+			ps := idx.Postings[t]
+			idf := math.Log(1 + float64(len(idx.Docs))/float64(docFreq(ps)))
+			for _, p := range ps {
+				if qt.field != anyField && p.Field != qt.field {
+					continue
+				}
+				found[p.Doc] += weight * boosts[p.Field] * (1 + math.Log(float64(p.Count))) * idf
+			}
+		}
+		if scores == nil {
+			scores = found
+			continue
+		}
+		for doc, s := range scores {
+			if f, ok := found[doc]; ok {
+				scores[doc] = s + f
+			} else {
+				delete(scores, doc)
+			}
+		}
+	}
+	return scores
+}
+
+// expand returns the index terms a query term matches.
+func (idx *Index) expand(qt term) []string {
+	if !qt.prefix {
+		if _, ok := idx.Postings[qt.value]; ok {
+			return []string{qt.value}
+		}
+		return nil
+	}
+	var out []string
+	for i := sort.SearchStrings(idx.terms, qt.value); i < len(idx.terms) && strings.HasPrefix(idx.terms[i], qt.value); i++ {
+		out = append(out, idx.terms[i])
+	}
+	return out
+}
+
+// docFreq counts the documents in a term's postings, which are in
+// document order.
+func docFreq(ps []Posting) int {
+	n := 0
+	for i, p := range ps {
+		if i == 0 || ps[i-1].Doc != p.Doc {
+			n++
+		}
+	}
+	return n
+}
+
+func facets(hits []Hit) Facets {
+	tags := map[string]int{}
+	keys := map[string]int{}
+	formats := map[string]int{}
+	bpm := map[int]int{}
+	duration := make([]int, len(durationBounds))
+	for _, h := range hits {
+		for _, t := range h.Tags {
+			tags[t]++
+		}
+		if h.Key != "" {
+			keys[h.Key]++
+		}
+		if h.Format != "" {
+			formats[h.Format]++
+		}
+		if h.BPM > 0 {
+			bpm[int(h.BPM)/bpmBucket]++
+		}
+		if h.Duration > 0 {
+			i := sort.SearchFloat64s(durationBounds, h.Duration)
+			if i == len(durationBounds) || durationBounds[i] != h.Duration {
+				i--
+			}
+			duration[i]++
+		}
+	}
+
+	f := Facets{
+		Tags:     counts(tags),
+		Keys:     counts(keys),
+		Formats:  counts(formats),
+		BPM:      []RangeCount{},
+		Duration: []RangeCount{},
+	}
+	var buckets []int
+	for b := range bpm {
+		buckets = append(buckets, b)
+	}
+	sort.Ints(buckets)
+	for _, b := range buckets {
+		f.BPM = append(f.BPM, RangeCount{
+			Min:   float64(b * bpmBucket),
+			Max:   float64((b + 1) * bpmBucket),
+			Count: bpm[b],
+		})
+	}
+	for i, n := range duration {
+		if n == 0 {
+			continue
+		}
+		rc := RangeCount{Min: durationBounds[i], Count: n}
+		if i+1 < len(durationBounds) {
+			rc.Max = durationBounds[i+1]
+		}
+		f.Duration = append(f.Duration, rc)
+	}
+	return f
+}
+
+// counts lists the most common values, then in value order.
+func counts(m map[string]int) []Count {
+	out := make([]Count, 0, len(m))
+	for v, n := range m {
+		out = append(out, Count{v, n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Value < out[j].Value
+	})
+	if len(out) > maxFacetValues {
+		out = out[:maxFacetValues]
+	}
+	return out
+}
+
+// tokenize lower-cases text and splits it into words. Words mixing letters
+// and digits, like "120bpm", are indexed whole and as their parts.
+func tokenize(text string) []string {
+	var out []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		out = append(out, w)
+		if parts := splitDigits(w); len(parts) > 1 {
+			out = append(out, parts...)
+		}
+	}
+	return out
+}
+
+// splitDigits splits a word where it changes between letters and digits.
+func splitDigits(w string) []string {
+	var parts []string
+	start := 0
+	rs := []rune(w)
+	for i := 1; i < len(rs); i++ {
+		if unicode.IsDigit(rs[i]) != unicode.IsDigit(rs[i-1]) {
+			parts = append(parts, string(rs[start:i]))
+			start = i
+		}
+	}
+	return append(parts, string(rs[start:]))
+}
+
+var keyPattern = regexp.MustCompile(`^([a-g])(#|b|♯|♭)?(m|min|minor|maj|major)?$`)
+
+// NormalizeKey writes a musical key the same way however it was tagged:
+// "A minor", "amin" and "Am" all become "Am", and "F# major" becomes "F#".
+// Keys it can't read are returned trimmed.
+func NormalizeKey(key string) string {
+	key = strings.TrimSpace(key)
+	m := keyPattern.FindStringSubmatch(strings.ToLower(strings.Join(strings.Fields(key), "")))
+	if m == nil {
+		return key
+	}
+	out := strings.ToUpper(m[1])
+	switch m[2] {
+	case "#", "♯":
+		out += "#"
+	case "b", "♭":
+		out += "b"
+	}
+	if strings.HasPrefix(m[3], "m") && !strings.HasPrefix(m[3], "maj") {
+		out += "m"
+	}
+	return out
+}
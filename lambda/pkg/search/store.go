@@ -0,0 +1,203 @@
+package search
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/details"
+	"wavey.ai/pkg/tags"
+)
+
+// row is the part of a formats row that is indexed.
+type row struct {
+	Key        string           `dynamodbav:"key"`
+	Filename   string           `dynamodbav:"filename"`
+	Format     string           `dynamodbav:"format"`
+	SampleRate int64            `dynamodbav:"sampleRate"`
+	Channels   int64            `dynamodbav:"channels"`
+	Frames     int64            `dynamodbav:"frames"`
+	Metadata   *tags.Metadata   `dynamodbav:"metadata"`
+	Tags       []string         `dynamodbav:"tags"`
+	Details    *details.Details `dynamodbav:"details"`
+}
+
+// Store keeps each user's index as a gzipped JSON object in a bucket,
+// built from their rows in the formats table. Loaded indexes are cached
+// and revalidated against the object's ETag, so a warm search lambda only
+// reads the index again after it has been rebuilt.
+type Store struct {
+	dbCl       *dynamodb.Client
+	s3Cl       *s3.Client
+	formatsTbl string
+	bucket     string
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+type cached struct {
+	etag string
+	idx  *Index
+}
+
+func NewStore(dbCl *dynamodb.Client, s3Cl *s3.Client, formatsTbl, bucket string) *Store {
+	return &Store{dbCl: dbCl, s3Cl: s3Cl, formatsTbl: formatsTbl, bucket: bucket, cache: map[string]cached{}}
+}
+
+func objectKey(user string) string {
+	return "indexes/" + user + ".json.gz"
+}
+
+// Load returns the user's index, building it if there isn't one yet.
+func (s *Store) Load(ctx context.Context, user string) (*Index, error) {
+	s.mu.Lock()
+	c, ok := s.cache[user]
+	s.mu.Unlock()
+
+	in := &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    aws.String(objectKey(user)),
+	}
+	if ok {
+		in.IfNoneMatch = &c.etag
+	}
+	res, err := s.s3Cl.GetObject(ctx, in)
+	var status interface{ HTTPStatusCode() int }
+	if ok && errors.As(err, &status) && status.HTTPStatusCode() == 304 {
+		return c.idx, nil
+	}
+	var nsk *s3Types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return s.Rebuild(ctx, user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	zr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var idx Index
+	if err := json.NewDecoder(zr).Decode(&idx); err != nil {
+		return nil, err
+	}
+	idx.sortTerms()
+
+	s.mu.Lock()
+	s.cache[user] = cached{aws.ToString(res.ETag), &idx}
+	s.mu.Unlock()
+	return &idx, nil
+}
+
+// Rebuild indexes the user's sounds afresh and saves the index. Sounds in
+// the trash or being deleted are left out.
+func (s *Store) Rebuild(ctx context.Context, user string) (*Index, error) {
+	docs, err := s.documents(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	idx := Build(docs)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(idx); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	res, err := s.s3Cl.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &s.bucket,
+		Key:         aws.String(objectKey(user)),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/gzip"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.cache[user] = cached{aws.ToString(res.ETag), idx}
+	s.mu.Unlock()
+	return idx, nil
+}
+
+func (s *Store) documents(ctx context.Context, user string) ([]Document, error) {
+	keyEx := expression.Key("user").Equal(expression.Value(user))
+	filt := expression.AttributeNotExists(expression.Name("deleting")).
+		And(expression.AttributeNotExists(expression.Name("trashedAt")))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []Document{}
+	p := dynamodb.NewQueryPaginator(s.dbCl, &dynamodb.QueryInput{
+		TableName:                 &s.formatsTbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var rows []row
+		if err := attributevalue.UnmarshalListOfMaps(res.Items, &rows); err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			docs = append(docs, document(r))
+		}
+	}
+	return docs, nil
+}
+
+func document(r row) Document {
+	d := Document{
+		ID:         r.Key,
+		Filename:   r.Filename,
+		Format:     strings.ToLower(r.Format),
+		Tags:       r.Tags,
+		SampleRate: r.SampleRate,
+		Channels:   r.Channels,
+	}
+	if r.SampleRate > 0 && r.Frames > 0 {
+		d.Duration = float64(r.Frames) / float64(r.SampleRate)
+	}
+	if id, err := ksuid.Parse(r.Key); err == nil {
+		d.CreatedAt = id.Time().Unix()
+	}
+	if m := r.Metadata; m != nil {
+		d.Title = m.Title
+		d.Artist = m.Artist
+		d.Comment = m.Comment
+		d.Key = m.Key
+		d.BPM = m.BPM
+		if m.Broadcast != nil && m.Broadcast.Description != "" {
+			d.Comment = strings.TrimSpace(d.Comment + "\n" + m.Broadcast.Description)
+		}
+	}
+	if e := r.Details; e != nil {
+		d.Name = e.Name
+		d.Description = e.Description
+		d.Credits = e.Credits
+	}
+	return d
+}
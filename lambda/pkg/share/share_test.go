@@ -0,0 +1,85 @@
+package share
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func TestNewSigner(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr bool
+	}{
+		{"empty", "", true},
+		{"one short", testSecret[:MinSecretLength-1], true},
+		{"minimum", testSecret[:MinSecretLength], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSigner(tt.secret)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSigner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	s, err := NewSigner(testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSigner(strings.ToUpper(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Unix(1700000000, 0)
+	valid := s.Sign(Token{ID: "2NrYkLhEKpHzRdrV1Un6RBH8iO5", Expires: expires})
+	payload := valid[:strings.LastIndexByte(valid, '.')]
+	sig := valid[len(payload)+1:]
+	id, _, _ := strings.Cut(payload, ".")
+	later := s.Sign(Token{ID: id, Expires: expires.Add(time.Hour)})
+	before := expires.Add(-time.Second)
+
+	tests := []struct {
+		name    string
+		token   string
+		now     time.Time
+		wantErr error
+	}{
+		{"valid", valid, before, nil},
+		{"expires now", valid, expires, ErrExpired},
+		{"expired", valid, expires.Add(time.Second), ErrExpired},
+		{"other secret", other.Sign(Token{ID: id, Expires: expires}), before, ErrSignature},
+		{"other secret and expired", other.Sign(Token{ID: id, Expires: expires}), expires, ErrSignature},
+		{"expiry extended", payload[:len(id)+1] + later[len(id)+1:strings.LastIndexByte(later, '.')] + "." + sig, expires, ErrSignature},
+		{"id changed", "x" + valid[1:], before, ErrSignature},
+		{"signature changed", payload + "." + strings.Repeat("A", len(sig)), before, ErrSignature},
+		{"signature truncated", valid[:len(valid)-1], before, ErrSignature},
+		{"signature cut to one char", payload + "." + sig[:1], before, ErrMalformed},
+		{"no signature", payload, before, ErrMalformed},
+		{"id only", id, before, ErrMalformed},
+		{"empty", "", before, ErrMalformed},
+		{"empty id", valid[len(id):], before, ErrMalformed},
+		{"bad expiry", id + ".!!." + sig, before, ErrMalformed},
+		{"bad signature encoding", payload + ".!!", before, ErrMalformed},
+		{"garbage", "not a share token", before, ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Parse(tt.token, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (got.ID != id || !got.Expires.Equal(expires)) {
+				t.Fatalf("Parse() = %+v, want ID %q expiring %v", got, id, expires)
+			}
+		})
+	}
+}
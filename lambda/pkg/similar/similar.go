@@ -0,0 +1,228 @@
+// Package similar finds the sounds in a user's library whose feature
+// vectors are nearest to a sound's.
+//
+// Vectors are standardised against the user's library, so each feature
+// counts the same however it is measured, and hashed with random
+// hyperplanes into several tables. A query looks at the sounds sharing a
+// bucket with it, or a bucket one bit away, in any table and ranks those
+// by their distance. Libraries too small to fill the buckets are searched
+// exhaustively.
+package similar
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"wavey.ai/pkg/features"
+)
+
+const (
+	// tables is the number of hash tables, each with its own hyperplanes.
+	tables = 8
+	// bucketSize is roughly how many sounds share a bucket.
+	bucketSize = 8
+	minBits    = 4
+	maxBits    = 16
+	seed       = 1
+)
+
+// Document is a sound in the index.
+type Document struct {
+	ID       string    `json:"id"`
+	Filename string    `json:"filename"`
+	Features []float64 `json:"features"`
+	// Codes are the sound's bucket in each table.
+	Codes []uint32 `json:"codes"`
+}
+
+// Neighbour is a sound near the one queried. Distance is the root mean
+// square difference of their standardised features: 0 for sounds alike in
+// every feature, and around 1.4 for two sounds picked at random.
+type Neighbour struct {
+	ID       string  `json:"key"`
+	Filename string  `json:"filename"`
+	Distance float64 `json:"distance"`
+}
+
+// Index is a user's feature vectors, hashed for lookup.
+type Index struct {
+	Docs []Document `json:"docs"`
+	// Mean and Std standardise vectors.
+	Mean []float64 `json:"mean"`
+	Std  []float64 `json:"std"`
+	Bits int       `json:"bits"`
+
+	planes  [][][]float64
+	buckets []map[uint32][]int
+}
+
+// Build indexes docs, which must all have features of the current version.
+func Build(docs []Document) *Index {
+	idx := &Index{
+		Docs: docs,
+		Mean: make([]float64, features.Dims),
+		Std:  make([]float64, features.Dims),
+		Bits: minBits,
+	}
+	for n := len(docs) / bucketSize; n > 1<<idx.Bits && idx.Bits < maxBits; {
+		idx.Bits++
+	}
+
+	for _, d := range docs {
+		for i, v := range d.Features {
+			idx.Mean[i] += v / float64(len(docs))
+		}
+	}
+	for _, d := range docs {
+		for i, v := range d.Features {
+			idx.Std[i] += (v - idx.Mean[i]) * (v - idx.Mean[i]) / float64(len(docs))
+		}
+	}
+	for i := range idx.Std {
+		idx.Std[i] = math.Sqrt(idx.Std[i])
+	}
+
+	idx.init()
+	for i := range idx.Docs {
+		idx.Docs[i].Codes = idx.hash(idx.standardise(idx.Docs[i].Features))
+	}
+	idx.fill()
+	return idx
+}
+
+// init makes the hyperplanes, which are the same for every index with the
+// same number of bits.
+func (idx *Index) init() {
+	rng := rand.New(rand.NewSource(seed))
+	idx.planes = make([][][]float64, tables)
+	for t := range idx.planes {
+		idx.planes[t] = make([][]float64, idx.Bits)
+		for b := range idx.planes[t] {
+			p := make([]float64, features.Dims)
+			for i := range p {
+				p[i] = rng.NormFloat64()
+			}
+			idx.planes[t][b] = p
+		}
+	}
+}
+
+// fill puts the documents in their buckets.
+func (idx *Index) fill() {
+	idx.buckets = make([]map[uint32][]int, tables)
+	for t := range idx.buckets {
+		idx.buckets[t] = map[uint32][]int{}
+	}
+	for i, d := range idx.Docs {
+		for t, c := range d.Codes {
+			if t < tables {
+				idx.buckets[t][c] = append(idx.buckets[t][c], i)
+			}
+		}
+	}
+}
+
+func (idx *Index) standardise(v []float64) []float64 {
+	z := make([]float64, len(v))
+	for i := range v {
+		if idx.Std[i] > 0 {
+			z[i] = (v[i] - idx.Mean[i]) / idx.Std[i]
+		}
+	}
+	return z
+}
+
+func (idx *Index) hash(z []float64) []uint32 {
+	codes := make([]uint32, tables)
+	for t, planes := range idx.planes {
+		for b, p := range planes {
+			dot := 0.0
+			for i := range p {
+				dot += p[i] * z[i]
+			}
+			if dot >= 0 {
+				codes[t] |= 1 << uint(b)
+			}
+		}
+	}
+	return codes
+}
+
+// Find returns the limit sounds nearest to v, nearest first, leaving out
+// the sound with ID exclude.
+func (idx *Index) Find(v []float64, exclude string, limit int) []Neighbour {
+	if idx.buckets == nil {
+		idx.init()
+		idx.fill()
+	}
+	z := idx.standardise(v)
+	codes := idx.hash(z)
+
+	seen := map[int]bool{}
+	for t, c := range codes {
+		seen = idx.probe(seen, t, c)
+		for b := 0; b < idx.Bits; b++ {
+			seen = idx.probe(seen, t, c^1<<uint(b))
+		}
+	}
+	candidates := make([]int, 0, len(seen))
+	for i := range seen {
+		if idx.Docs[i].ID != exclude {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) < limit {
+		candidates = candidates[:0]
+		for i, d := range idx.Docs {
+			if d.ID != exclude {
+				candidates = append(candidates, i)
+			}
+		}
+	}
+
+	out := make([]Neighbour, 0, len(candidates))
+	for _, i := range candidates {
+		d := idx.Docs[i]
+		out = append(out, Neighbour{
+			ID:       d.ID,
+			Filename: d.Filename,
+			Distance: distance(z, idx.standardise(d.Features)),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Distance != out[j].Distance {
+			return out[i].Distance < out[j].Distance
+		}
+		return out[i].ID > out[j].ID
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+func (idx *Index) probe(seen map[int]bool, table int, code uint32) map[int]bool {
+	for _, i := range idx.buckets[table][code] {
+		seen[i] = true
+	}
+	return seen
+}
+
+// Get returns the document with the given ID.
+func (idx *Index) Get(id string) (Document, bool) {
+	for _, d := range idx.Docs {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	return Document{}, false
+}
+
+func distance(a, b []float64) float64 {
+	s := 0.0
+	for i := range a {
+		s += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return math.Round(math.Sqrt(s/float64(len(a)))*1e4) / 1e4
+}
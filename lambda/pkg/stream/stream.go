@@ -0,0 +1,115 @@
+// Package stream reads the packetised Opus streams the player consumes.
+//
+// A stream starts with a little-endian uint32 packet count n, followed by n
+// uint32 offsets of each packet relative to the end of that table. Each
+// packet is a one byte encoding flag and config id, a channel count byte, a
+// uint16 payload size and the payload. Every packet holds FrameSize samples
+// at SampleRate, so packet i starts at sample i*FrameSize.
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	SampleRate = 48000
+	FrameSize  = 120
+)
+
+// EncodingOpus is the encoding flag of Opus packets.
+const EncodingOpus = 1
+
+// maxPackets bounds the offset table, about 28 hours of audio.
+const maxPackets = 1 << 24
+
+var ErrFormat = errors.New("stream: malformed stream")
+
+// Packet is a single encoded frame.
+type Packet struct {
+	Encoding int
+	Config   int
+	Channels int
+	Data     []byte
+}
+
+// Stream is the packet index of a stream.
+type Stream struct {
+	r       io.ReaderAt
+	size    int64
+	offsets []uint32
+	base    int64
+}
+
+// New reads the packet index of the stream in r, which is size bytes long.
+func New(r io.ReaderAt, size int64) (*Stream, error) {
+	var hdr [4]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrFormat
+		}
+		return nil, err
+	}
+	n := int64(binary.LittleEndian.Uint32(hdr[:]))
+	if n > maxPackets || 4+n*4 > size {
+		return nil, fmt.Errorf("%w: %d packets in %d bytes", ErrFormat, n, size)
+	}
+
+	b := make([]byte, n*4)
+	if _, err := r.ReadAt(b, 4); err != nil {
+		return nil, err
+	}
+	s := &Stream{r: r, size: size, offsets: make([]uint32, n), base: 4 + n*4}
+	for i := range s.offsets {
+		s.offsets[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return s, nil
+}
+
+// Len returns the number of packets.
+func (s *Stream) Len() int { return len(s.offsets) }
+
+// Packets returns packets [from, to).
+func (s *Stream) Packets(from, to int) ([]Packet, error) {
+	if from < 0 || to > len(s.offsets) || from > to {
+		return nil, fmt.Errorf("stream: packets [%d, %d) of %d", from, to, len(s.offsets))
+	}
+	if from == to {
+		return nil, nil
+	}
+
+	// Packets are contiguous, so the range is read in one go.
+	start := s.base + int64(s.offsets[from])
+	end := s.size
+	if to < len(s.offsets) {
+		end = s.base + int64(s.offsets[to])
+	}
+	if end < start || end > s.size {
+		return nil, ErrFormat
+	}
+	b := make([]byte, end-start)
+	if _, err := s.r.ReadAt(b, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	pkts := make([]Packet, 0, to-from)
+	for i := from; i < to; i++ {
+		off := s.base + int64(s.offsets[i]) - start
+		if off < 0 || off+4 > int64(len(b)) {
+			return nil, fmt.Errorf("%w: packet %d", ErrFormat, i)
+		}
+		size := int64(binary.LittleEndian.Uint16(b[off+2:]))
+		if off+4+size > int64(len(b)) {
+			return nil, fmt.Errorf("%w: packet %d", ErrFormat, i)
+		}
+		pkts = append(pkts, Packet{
+			Encoding: int(b[off]&0xe0) >> 5,
+			Config:   int(b[off] & 0x1f),
+			Channels: int(b[off+1]),
+			Data:     b[off+4 : off+4+size],
+		})
+	}
+	return pkts, nil
+}
@@ -0,0 +1,569 @@
+// Package tagging keeps users' tags on sounds and clips. A tagged item
+// carries its tags in a "tags" list, so they come back with it, and each
+// item and tag pair has a row in the taggings table, whose tagIndex finds
+// every item with a tag. The tags table holds a row for each of a user's
+// tags counting the items that carry it. All three are written together in
+// transactions; a rename or delete that stops part way leaves each item
+// either done or untouched, and repeating it finishes the rest.
+package tagging
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MaxTags bounds the tags on one item, which keeps any change to them
+// within a single transaction.
+const MaxTags = 20
+
+// MaxLength bounds the length of a tag in characters.
+const MaxLength = 64
+
+// TagIndex is the taggings table index keyed by "userTag", the user and
+// tag joined by a slash, and "item".
+const TagIndex = "tagIndex"
+
+// maxAttempts bounds the retries of an item whose tags change while a
+// rename or delete is rewriting it.
+const maxAttempts = 3
+
+// Kinds of taggable item.
+const (
+	KindSound = "sound"
+	KindClip  = "clip"
+)
+
+var (
+	// ErrInvalid means a tag was empty, too long or had characters tags
+	// can't contain.
+	ErrInvalid = errors.New("tagging: tags must be 1 to " + strconv.Itoa(MaxLength) + " characters, without / or %")
+	// ErrTooMany means an item was given more than MaxTags tags.
+	ErrTooMany = errors.New("tagging: at most " + strconv.Itoa(MaxTags) + " tags per item")
+	// ErrChanged means an item's tags changed since they were read.
+	ErrChanged = errors.New("tagging: tags changed since they were read")
+)
+
+// Item names a sound or clip.
+type Item struct {
+	Kind string `dynamodbav:"kind"`
+	Key  string `dynamodbav:"item"`
+}
+
+// Tag is one of a user's tags with the number of items carrying it.
+type Tag struct {
+	Name  string `json:"name" dynamodbav:"name"`
+	Count int64  `json:"count" dynamodbav:"count"`
+}
+
+type tagging struct {
+	Item
+	Tag  string `dynamodbav:"tag"`
+	User string `dynamodbav:"user"`
+}
+
+// Tagger reads and writes tags.
+type Tagger struct {
+	dbCl        *dynamodb.Client
+	tagsTbl     string
+	taggingsTbl string
+	formatsTbl  string
+	clipsTbl    string
+}
+
+func New(dbCl *dynamodb.Client, tagsTbl, taggingsTbl, formatsTbl, clipsTbl string) *Tagger {
+	return &Tagger{dbCl, tagsTbl, taggingsTbl, formatsTbl, clipsTbl}
+}
+
+// Normalize normalises one tag so it matches regardless of case and
+// spacing.
+func Normalize(tag string) (string, error) {
+	tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+	if tag == "" || len([]rune(tag)) > MaxLength || strings.ContainsAny(tag, "/%") {
+		return "", ErrInvalid
+	}
+	for _, r := range tag {
+		if !unicode.IsPrint(r) {
+			return "", ErrInvalid
+		}
+	}
+	return tag, nil
+}
+
+// NormalizeAll normalises tags for one item, dropping duplicates. The
+// result is never nil.
+func NormalizeAll(tags []string) ([]string, error) {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t, err := Normalize(t)
+		if err != nil {
+			return nil, err
+		}
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	if len(out) > MaxTags {
+		return nil, ErrTooMany
+	}
+	return out, nil
+}
+
+// List returns the user's tags in name order.
+func (t *Tagger) List(ctx context.Context, user string) ([]Tag, error) {
+	keyEx := expression.Key("user").Equal(expression.Value(user))
+	// Tags whose last item has gone may linger until they are cleaned up.
+	filt := expression.Name("count").GreaterThan(expression.Value(0))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []Tag{}
+	p := dynamodb.NewQueryPaginator(t.dbCl, &dynamodb.QueryInput{
+		TableName:                 &t.tagsTbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []Tag
+		if err := attributevalue.UnmarshalListOfMaps(res.Items, &page); err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
+	}
+	return tags, nil
+}
+
+// Get returns the user's tag, or nil if no item carries it.
+func (t *Tagger) Get(ctx context.Context, user, name string) (*Tag, error) {
+	res, err := t.dbCl.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      &t.tagsTbl,
+		Key:            t.tagKey(user, name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var tag Tag
+	if err := attributevalue.UnmarshalMap(res.Item, &tag); err != nil {
+		return nil, err
+	}
+	if tag.Count <= 0 {
+		return nil, nil
+	}
+	return &tag, nil
+}
+
+// Set replaces the tags on the user's item, which the caller has already
+// checked belongs to them. It returns ErrChanged unless the item still has
+// the tags current, as read alongside it.
+func (t *Tagger) Set(ctx context.Context, user string, it Item, current, tags []string) error {
+	var added, removed []string
+	for _, tag := range tags {
+		if !contains(current, tag) {
+			added = append(added, tag)
+		}
+	}
+	for _, tag := range current {
+		if !contains(tags, tag) {
+			removed = append(removed, tag)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 && equal(current, tags) {
+		return nil
+	}
+
+	update, err := t.updateItem(user, it, current, tags)
+	if err != nil {
+		return err
+	}
+	items := []dynamodbTypes.TransactWriteItem{update}
+	for _, tag := range added {
+		items = append(items, t.putTagging(user, it, tag), t.count(user, tag, 1))
+	}
+	for _, tag := range removed {
+		items = append(items, t.deleteTagging(it, tag), t.count(user, tag, -1))
+	}
+	if err := t.transact(ctx, items); err != nil {
+		return err
+	}
+	t.cleanUp(ctx, user, removed)
+	return nil
+}
+
+// Rename moves every item carrying the user's tag from to the tag to,
+// merging the two if to is already in use. It returns the tag as it ends
+// up. Repeating a rename that stopped part way finishes it.
+func (t *Tagger) Rename(ctx context.Context, user, from, to string) (*Tag, error) {
+	if from != to {
+		if err := t.rewrite(ctx, user, from, to); err != nil {
+			return nil, err
+		}
+	}
+	return t.Get(ctx, user, to)
+}
+
+// Delete removes the user's tag from every item carrying it.
+func (t *Tagger) Delete(ctx context.Context, user, name string) error {
+	return t.rewrite(ctx, user, name, "")
+}
+
+// Untag drops the taggings of an item that is being deleted, leaving the
+// item itself alone.
+func (t *Tagger) Untag(ctx context.Context, itemKey string) error {
+	keyEx := expression.Key("item").Equal(expression.Value(itemKey))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return err
+	}
+	res, err := t.dbCl.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 &t.taggingsTbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	var tgs []tagging
+	if err := attributevalue.UnmarshalListOfMaps(res.Items, &tgs); err != nil {
+		return err
+	}
+	if len(tgs) == 0 {
+		return nil
+	}
+
+	// An item has at most MaxTags taggings, so one transaction holds them.
+	var items []dynamodbTypes.TransactWriteItem
+	var tags []string
+	for _, tg := range tgs {
+		items = append(items, t.deleteTagging(tg.Item, tg.Tag), t.count(tg.User, tg.Tag, -1))
+		tags = append(tags, tg.Tag)
+	}
+	if err := t.transact(ctx, items); err != nil {
+		return err
+	}
+	t.cleanUp(ctx, tgs[0].User, tags)
+	return nil
+}
+
+// rewrite replaces the tag from with to on every item carrying it, or
+// removes it if to is empty, one item per transaction.
+func (t *Tagger) rewrite(ctx context.Context, user, from, to string) error {
+	keyEx := expression.Key("userTag").Equal(expression.Value(user + "/" + from))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return err
+	}
+	indexName := TagIndex
+
+	// The index is eventually consistent, so finished items can still turn
+	// up; rewriting them is a no-op.
+	p := dynamodb.NewQueryPaginator(t.dbCl, &dynamodb.QueryInput{
+		TableName:                 &t.taggingsTbl,
+		IndexName:                 &indexName,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		var tgs []tagging
+		if err := attributevalue.UnmarshalListOfMaps(res.Items, &tgs); err != nil {
+			return err
+		}
+		for _, tg := range tgs {
+			for attempt := 1; ; attempt++ {
+				err := t.rewriteItem(ctx, user, tg.Item, from, to)
+				if !errors.Is(err, ErrChanged) || attempt == maxAttempts {
+					if err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+	}
+	t.cleanUp(ctx, user, []string{from})
+	return nil
+}
+
+func (t *Tagger) rewriteItem(ctx context.Context, user string, it Item, from, to string) error {
+	current, found, err := t.itemTags(ctx, user, it)
+	if err != nil {
+		return err
+	}
+	has, err := t.hasTagging(ctx, it, from)
+	if err != nil || !has {
+		return err
+	}
+
+	// A tagging left behind by an item that has since gone is just
+	// dropped.
+	if !found || !contains(current, from) {
+		return t.transact(ctx, []dynamodbTypes.TransactWriteItem{
+			t.deleteTagging(it, from), t.count(user, from, -1),
+		})
+	}
+
+	tags := []string{}
+	for _, tag := range current {
+		if tag == from {
+			if to != "" && !contains(current, to) {
+				tags = append(tags, to)
+			}
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	update, err := t.updateItem(user, it, current, tags)
+	if err != nil {
+		return err
+	}
+	items := []dynamodbTypes.TransactWriteItem{
+		update, t.deleteTagging(it, from), t.count(user, from, -1),
+	}
+	if to != "" && !contains(current, to) {
+		items = append(items, t.putTagging(user, it, to), t.count(user, to, 1))
+	}
+	return t.transact(ctx, items)
+}
+
+// itemTags reads the tags on an item, reporting whether it exists.
+func (t *Tagger) itemTags(ctx context.Context, user string, it Item) ([]string, bool, error) {
+	table, key := t.itemKey(user, it)
+	proj := expression.NamesList(expression.Name("key"), expression.Name("tags"))
+	expr, err := expression.NewBuilder().WithProjection(proj).Build()
+	if err != nil {
+		return nil, false, err
+	}
+	res, err := t.dbCl.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                &table,
+		Key:                      key,
+		ExpressionAttributeNames: expr.Names(),
+		ProjectionExpression:     expr.Projection(),
+		ConsistentRead:           aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, false, err
+	}
+	var row struct {
+		Tags []string `dynamodbav:"tags"`
+	}
+	if err := attributevalue.UnmarshalMap(res.Item, &row); err != nil {
+		return nil, false, err
+	}
+	return row.Tags, true, nil
+}
+
+func (t *Tagger) hasTagging(ctx context.Context, it Item, tag string) (bool, error) {
+	res, err := t.dbCl.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      &t.taggingsTbl,
+		Key:            taggingKey(it, tag),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.Item != nil, nil
+}
+
+// updateItem writes an item's tags if they are still current. Items
+// without tags have no tags attribute.
+func (t *Tagger) updateItem(user string, it Item, current, tags []string) (dynamodbTypes.TransactWriteItem, error) {
+	var upd expression.UpdateBuilder
+	if len(tags) == 0 {
+		upd = expression.Remove(expression.Name("tags"))
+	} else {
+		upd = expression.Set(expression.Name("tags"), expression.Value(tags))
+	}
+	cond := expression.AttributeExists(expression.Name("key"))
+	if len(current) == 0 {
+		cond = cond.And(expression.AttributeNotExists(expression.Name("tags")))
+	} else {
+		cond = cond.And(expression.Name("tags").Equal(expression.Value(current)))
+	}
+	if it.Kind == KindSound {
+		cond = cond.And(expression.AttributeNotExists(expression.Name("deleting")))
+	}
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		return dynamodbTypes.TransactWriteItem{}, err
+	}
+
+	table, key := t.itemKey(user, it)
+	return dynamodbTypes.TransactWriteItem{
+		Update: &dynamodbTypes.Update{
+			TableName:                 &table,
+			Key:                       key,
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			UpdateExpression:          expr.Update(),
+			ConditionExpression:       expr.Condition(),
+		},
+	}, nil
+}
+
+func (t *Tagger) putTagging(user string, it Item, tag string) dynamodbTypes.TransactWriteItem {
+	return dynamodbTypes.TransactWriteItem{
+		Put: &dynamodbTypes.Put{
+			TableName: &t.taggingsTbl,
+			Item: map[string]dynamodbTypes.AttributeValue{
+				"item": &dynamodbTypes.AttributeValueMemberS{
+					Value: it.Key,
+				},
+				"tag": &dynamodbTypes.AttributeValueMemberS{
+					Value: tag,
+				},
+				"kind": &dynamodbTypes.AttributeValueMemberS{
+					Value: it.Kind,
+				},
+				"user": &dynamodbTypes.AttributeValueMemberS{
+					Value: user,
+				},
+				"userTag": &dynamodbTypes.AttributeValueMemberS{
+					Value: user + "/" + tag,
+				},
+				"createdAt": &dynamodbTypes.AttributeValueMemberN{
+					Value: strconv.FormatInt(time.Now().Unix(), 10),
+				},
+			},
+		},
+	}
+}
+
+func (t *Tagger) deleteTagging(it Item, tag string) dynamodbTypes.TransactWriteItem {
+	return dynamodbTypes.TransactWriteItem{
+		Delete: &dynamodbTypes.Delete{
+			TableName: &t.taggingsTbl,
+			Key:       taggingKey(it, tag),
+		},
+	}
+}
+
+// count adds delta to the number of items carrying the user's tag,
+// creating the tag if need be.
+func (t *Tagger) count(user, tag string, delta int64) dynamodbTypes.TransactWriteItem {
+	return dynamodbTypes.TransactWriteItem{
+		Update: &dynamodbTypes.Update{
+			TableName:        &t.tagsTbl,
+			Key:              t.tagKey(user, tag),
+			UpdateExpression: aws.String("ADD #count :delta SET #updatedAt = :now"),
+			ExpressionAttributeNames: map[string]string{
+				"#count":     "count",
+				"#updatedAt": "updatedAt",
+			},
+			ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+				":delta": &dynamodbTypes.AttributeValueMemberN{
+					Value: strconv.FormatInt(delta, 10),
+				},
+				":now": &dynamodbTypes.AttributeValueMemberN{
+					Value: strconv.FormatInt(time.Now().Unix(), 10),
+				},
+			},
+		},
+	}
+}
+
+// cleanUp removes tags no item carries any more. Failures are left for
+// List to hide and a later change to retry.
+func (t *Tagger) cleanUp(ctx context.Context, user string, tags []string) {
+	for _, tag := range tags {
+		t.dbCl.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:           &t.tagsTbl,
+			Key:                 t.tagKey(user, tag),
+			ConditionExpression: aws.String("#count <= :zero"),
+			ExpressionAttributeNames: map[string]string{
+				"#count": "count",
+			},
+			ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+				":zero": &dynamodbTypes.AttributeValueMemberN{Value: "0"},
+			},
+		})
+	}
+}
+
+// transact runs a transaction, turning a failed check on its first item,
+// the tagged item itself, into ErrChanged.
+func (t *Tagger) transact(ctx context.Context, items []dynamodbTypes.TransactWriteItem) error {
+	_, err := t.dbCl.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	var tce *dynamodbTypes.TransactionCanceledException
+	if errors.As(err, &tce) {
+		if len(tce.CancellationReasons) > 0 && aws.ToString(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return ErrChanged
+		}
+	}
+	return err
+}
+
+func (t *Tagger) itemKey(user string, it Item) (string, map[string]dynamodbTypes.AttributeValue) {
+	if it.Kind == KindSound {
+		return t.formatsTbl, map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: it.Key},
+		}
+	}
+	return t.clipsTbl, map[string]dynamodbTypes.AttributeValue{
+		"key": &dynamodbTypes.AttributeValueMemberS{Value: it.Key},
+	}
+}
+
+func (t *Tagger) tagKey(user, tag string) map[string]dynamodbTypes.AttributeValue {
+	return map[string]dynamodbTypes.AttributeValue{
+		"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+		"name": &dynamodbTypes.AttributeValueMemberS{Value: tag},
+	}
+}
+
+func taggingKey(it Item, tag string) map[string]dynamodbTypes.AttributeValue {
+	return map[string]dynamodbTypes.AttributeValue{
+		"item": &dynamodbTypes.AttributeValueMemberS{Value: it.Key},
+		"tag":  &dynamodbTypes.AttributeValueMemberS{Value: tag},
+	}
+}
+
+func contains(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,365 @@
+package tags
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxID3Size bounds the ID3v2 tag read into memory; artwork can make tags
+// large but anything past this is not worth the round trips.
+const maxID3Size = 32 << 20
+
+// id3Fields maps ID3v2.2, v2.3 and v2.4 frame ids onto normalised fields.
+var id3Fields = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TBPM": "bpm", "TBP": "bpm",
+	"TKEY": "key", "TKE": "key",
+	"TDRC": "recordedDate",
+}
+
+// txxxFields maps user-defined text frame descriptions (upper case) onto
+// normalised fields.
+var txxxFields = map[string]string{
+	"BPM":        "bpm",
+	"TEMPO":      "bpm",
+	"KEY":        "key",
+	"INITIALKEY": "key",
+	"TIMECODE":   "timecode",
+}
+
+func readID3File(m *Metadata, r io.ReaderAt, size int64) error {
+	var hdr [10]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return err
+	}
+
+	n := int64(syncsafe(hdr[6:10])) + 10
+	if n > size || n > maxID3Size {
+		return fmt.Errorf("tags: ID3v2 tag of %d bytes", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, 0); err != nil && err != io.EOF {
+		return err
+	}
+	parseID3(m, b)
+
+	if size >= 128 {
+		var v1 [128]byte
+		if _, err := r.ReadAt(v1[:], size-128); err == nil {
+			parseID3v1(m, v1[:])
+		}
+	}
+
+	return nil
+}
+
+// parseID3 parses a complete ID3v2 tag, header included.
+func parseID3(m *Metadata, b []byte) {
+	if len(b) < 10 || string(b[0:3]) != "ID3" {
+		return
+	}
+
+	version := b[3]
+	flags := b[5]
+	size := int(syncsafe(b[6:10]))
+	body := b[10:]
+	if size < len(body) {
+		body = body[:size]
+	}
+
+	if version < 4 && flags&0x80 != 0 {
+		body = unsync(body)
+	}
+
+	if flags&0x40 != 0 && version >= 3 && len(body) >= 4 {
+		var n int
+		if version == 3 {
+			n = int(binary.BigEndian.Uint32(body[0:4])) + 4
+		} else {
+			n = int(syncsafe(body[0:4]))
+		}
+		if n > len(body) {
+			return
+		}
+		body = body[n:]
+	}
+
+	idLen, hdrLen := 4, 10
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+
+	var year, date, tm string
+
+	for p := 0; p+hdrLen <= len(body); {
+		id := string(body[p : p+idLen])
+		if id[0] == 0 {
+			// Padding.
+			break
+		}
+
+		var n int
+		var fflags uint16
+		switch version {
+		case 2:
+			n = int(body[p+3])<<16 | int(body[p+4])<<8 | int(body[p+5])
+		case 3:
+			n = int(binary.BigEndian.Uint32(body[p+4 : p+8]))
+			fflags = binary.BigEndian.Uint16(body[p+8 : p+10])
+		default:
+			n = int(syncsafe(body[p+4 : p+8]))
+			fflags = binary.BigEndian.Uint16(body[p+8 : p+10])
+		}
+
+		start := p + hdrLen
+		end := start + n
+		if n < 0 || end > len(body) {
+			break
+		}
+		p = end
+
+		data, ok := id3FrameData(version, flags, fflags, body[start:end])
+		if !ok {
+			continue
+		}
+
+		switch id {
+		case "TYER", "TYE":
+			year = id3Text(data)
+			continue
+		case "TDAT", "TDA":
+			date = id3Text(data)
+			continue
+		case "TIME", "TIM":
+			tm = id3Text(data)
+			continue
+		case "COMM", "COM":
+			desc, text := id3Comment(data)
+			if desc == "" {
+				m.set("comment", text)
+			} else {
+				m.raw("id3", id+":"+desc, text)
+			}
+			continue
+		case "TXXX", "TXX":
+			desc, text := id3UserText(data)
+			if f, ok := txxxFields[strings.ToUpper(desc)]; ok {
+				m.set(f, text)
+			} else {
+				m.raw("id3", id+":"+desc, text)
+			}
+			continue
+		case "APIC", "PIC":
+			// Artwork has no place in a metadata record.
+			continue
+		}
+
+		if f, ok := id3Fields[id]; ok {
+			m.set(f, id3Text(data))
+		} else if id[0] == 'T' {
+			m.raw("id3", id, id3Text(data))
+		} else {
+			m.rawData("id3", id, data)
+		}
+	}
+
+	if year != "" {
+		d := year
+		if len(date) == 4 {
+			d += "-" + date[2:4] + "-" + date[0:2]
+			if len(tm) == 4 {
+				d += "T" + tm[0:2] + ":" + tm[2:4]
+			}
+		}
+		m.set("recordedDate", d)
+	}
+}
+
+// id3FrameData undoes per-frame unsynchronisation and compression and strips
+// the extra header bytes frame flags add. It reports false for frames that
+// cannot be read, such as encrypted ones.
+func id3FrameData(version, tagFlags byte, flags uint16, b []byte) ([]byte, bool) {
+	var compressed, encrypted, unsynced bool
+
+	switch version {
+	case 3:
+		compressed = flags&0x0080 != 0
+		encrypted = flags&0x0040 != 0
+		if compressed {
+			if len(b) < 4 {
+				return nil, false
+			}
+			b = b[4:]
+		}
+		if flags&0x0020 != 0 && len(b) > 0 {
+			b = b[1:]
+		}
+	case 4:
+		if flags&0x0040 != 0 && len(b) > 0 {
+			b = b[1:]
+		}
+		compressed = flags&0x0008 != 0
+		encrypted = flags&0x0004 != 0
+		unsynced = flags&0x0002 != 0 || tagFlags&0x80 != 0
+		if flags&0x0001 != 0 {
+			if len(b) < 4 {
+				return nil, false
+			}
+			b = b[4:]
+		}
+	}
+
+	if encrypted {
+		return nil, false
+	}
+	if unsynced {
+		b = unsync(b)
+	}
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, false
+		}
+		defer zr.Close()
+		out, err := io.ReadAll(io.LimitReader(zr, maxID3Size))
+		if err != nil {
+			return nil, false
+		}
+		b = out
+	}
+
+	return b, true
+}
+
+// id3Text decodes a text information frame, returning its first value.
+func id3Text(b []byte) string {
+	if len(b) < 1 {
+		return ""
+	}
+	s, _ := id3String(b[0], b[1:])
+	return s
+}
+
+// id3Comment decodes a COMM frame into its description and text.
+func id3Comment(b []byte) (string, string) {
+	if len(b) < 4 {
+		return "", ""
+	}
+	desc, rest := id3String(b[0], b[4:])
+	text, _ := id3String(b[0], rest)
+	return desc, text
+}
+
+// id3UserText decodes a TXXX frame into its description and value.
+func id3UserText(b []byte) (string, string) {
+	if len(b) < 1 {
+		return "", ""
+	}
+	desc, rest := id3String(b[0], b[1:])
+	text, _ := id3String(b[0], rest)
+	return desc, text
+}
+
+// id3String decodes one NUL-terminated string in the given ID3 text encoding
+// and returns it along with the bytes that follow the terminator.
+func id3String(enc byte, b []byte) (string, []byte) {
+	wide := enc == 1 || enc == 2
+
+	end, next := len(b), len(b)
+	if wide {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				end, next = i, i+2
+				break
+			}
+		}
+	} else if i := bytes.IndexByte(b, 0); i >= 0 {
+		end, next = i, i+1
+	}
+
+	s := b[:end]
+	var out string
+	switch enc {
+	case 0:
+		out = latin1(s)
+	case 1:
+		out = decodeUTF16(s, nil)
+	case 2:
+		out = decodeUTF16(s, binary.BigEndian)
+	default:
+		out = string(s)
+	}
+
+	return strings.TrimSpace(out), b[next:]
+}
+
+// decodeUTF16 decodes UTF-16 text, reading the byte order from a BOM when
+// order is nil.
+func decodeUTF16(b []byte, order binary.ByteOrder) string {
+	if order == nil {
+		order = binary.LittleEndian
+		if len(b) >= 2 {
+			switch {
+			case b[0] == 0xFE && b[1] == 0xFF:
+				order, b = binary.BigEndian, b[2:]
+			case b[0] == 0xFF && b[1] == 0xFE:
+				b = b[2:]
+			}
+		}
+	}
+
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = order.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// unsync reverses ID3 unsynchronisation by dropping the 0x00 inserted after
+// every 0xFF.
+func unsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0x00 {
+			i++
+		}
+	}
+	return out
+}
+
+// parseID3v1 fills in fields still missing after ID3v2 from a trailing
+// ID3v1 tag.
+func parseID3v1(m *Metadata, b []byte) {
+	if string(b[0:3]) != "TAG" {
+		return
+	}
+	m.set("title", latin1(bytes.TrimRight(b[3:33], "\x00 ")))
+	m.set("artist", latin1(bytes.TrimRight(b[33:63], "\x00 ")))
+	m.set("recordedDate", latin1(bytes.TrimRight(b[93:97], "\x00 ")))
+	comment := b[97:127]
+	if b[125] == 0 {
+		// ID3v1.1 keeps a track number in the last comment byte.
+		comment = b[97:125]
+	}
+	m.set("comment", latin1(bytes.TrimRight(comment, "\x00 ")))
+}
@@ -0,0 +1,201 @@
+package tags
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxIlstSize bounds the iTunes item list read into memory.
+const maxIlstSize = 16 << 20
+
+// mp4Fields maps iTunes item list atoms, and freeform "----" names in upper
+// case, onto normalised fields.
+var mp4Fields = map[string]string{
+	"\xa9nam":    "title",
+	"\xa9ART":    "artist",
+	"\xa9cmt":    "comment",
+	"\xa9day":    "recordedDate",
+	"tmpo":       "bpm",
+	"INITIALKEY": "key",
+	"KEY":        "key",
+	"BPM":        "bpm",
+	"TIMECODE":   "timecode",
+}
+
+// readMP4 walks moov/udta/meta/ilst (or moov/meta/ilst) for iTunes-style
+// metadata items.
+func readMP4(m *Metadata, r io.ReaderAt, size int64) error {
+	return mp4Walk(r, 0, size, func(typ string, off, n int64) error {
+		if typ != "moov" {
+			return nil
+		}
+		return mp4Walk(r, off, off+n, func(typ string, off, n int64) error {
+			switch typ {
+			case "udta":
+				return mp4Walk(r, off, off+n, func(typ string, off, n int64) error {
+					if typ == "meta" {
+						return readMP4Meta(m, r, off, n)
+					}
+					return nil
+				})
+			case "meta":
+				return readMP4Meta(m, r, off, n)
+			}
+			return nil
+		})
+	})
+}
+
+func readMP4Meta(m *Metadata, r io.ReaderAt, off, n int64) error {
+	// meta is a full box in MP4 but a plain container in QuickTime; tell
+	// them apart by whether a child atom header starts straight away.
+	var probe [8]byte
+	if _, err := r.ReadAt(probe[:], off); err != nil {
+		return err
+	}
+	if string(probe[4:8]) != "hdlr" {
+		off, n = off+4, n-4
+	}
+
+	return mp4Walk(r, off, off+n, func(typ string, off, n int64) error {
+		if typ != "ilst" || n > maxIlstSize {
+			return nil
+		}
+		b := make([]byte, n)
+		if _, err := r.ReadAt(b, off); err != nil && err != io.EOF {
+			return err
+		}
+		parseIlst(m, b)
+		return nil
+	})
+}
+
+// mp4Walk calls fn with the type, body offset and body size of each atom
+// between start and end.
+func mp4Walk(r io.ReaderAt, start, end int64, fn func(typ string, off, n int64) error) error {
+	for off := start; off+8 <= end; {
+		var hdr [16]byte
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		typ := string(hdr[4:8])
+		body := off + 8
+
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			body += 8
+		}
+		if size < body-off || off+size > end {
+			return nil
+		}
+
+		if err := fn(typ, body, off+size-body); err != nil {
+			return err
+		}
+		off += size
+	}
+	return nil
+}
+
+// parseIlst parses the items of an ilst atom body.
+func parseIlst(m *Metadata, b []byte) {
+	for _, item := range mp4Atoms(b) {
+		var name string
+		var typ uint32
+		var value []byte
+
+		for _, c := range mp4Atoms(item.body) {
+			switch c.typ {
+			case "name":
+				if len(c.body) > 4 {
+					name = string(c.body[4:])
+				}
+			case "data":
+				if len(c.body) >= 8 && value == nil {
+					typ = binary.BigEndian.Uint32(c.body[0:4]) & 0xFFFFFF
+					value = c.body[8:]
+				}
+			}
+		}
+
+		field, ok := mp4Fields[item.typ]
+		// Atom types are Latin-1 ("\xa9nam" is "©nam").
+		id := latin1([]byte(item.typ))
+		if item.typ == "----" {
+			id = "----:" + name
+			field, ok = mp4Fields[strings.ToUpper(name)]
+		}
+
+		text, isText := mp4Value(typ, value)
+		if typ == 0 && !ok {
+			// Implicit types are only safe to read as integers for items
+			// known to hold one.
+			isText = false
+		}
+		if ok && isText {
+			m.set(field, text)
+		} else if item.typ == "covr" {
+			continue
+		} else if isText {
+			m.raw("mp4", id, text)
+		} else {
+			m.rawData("mp4", id, value)
+		}
+	}
+}
+
+// mp4Value renders a data atom payload as text where its well-known type
+// allows it.
+func mp4Value(typ uint32, b []byte) (string, bool) {
+	switch typ {
+	case 1:
+		return string(b), true
+	case 2:
+		return decodeUTF16(b, binary.BigEndian), true
+	case 0, 21, 22:
+		// Integers: tmpo is written with type 0 or 21 by different tools.
+		var v int64
+		switch len(b) {
+		case 1:
+			v = int64(int8(b[0]))
+		case 2:
+			v = int64(int16(binary.BigEndian.Uint16(b)))
+		case 4:
+			v = int64(int32(binary.BigEndian.Uint32(b)))
+		case 8:
+			v = int64(binary.BigEndian.Uint64(b))
+		default:
+			return "", false
+		}
+		return strconv.FormatInt(v, 10), true
+	}
+	return "", false
+}
+
+type mp4Atom struct {
+	typ  string
+	body []byte
+}
+
+// mp4Atoms splits an in-memory atom body into its children.
+func mp4Atoms(b []byte) []mp4Atom {
+	var atoms []mp4Atom
+	for p := 0; p+8 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[p : p+4]))
+		if n < 8 || p+n > len(b) {
+			break
+		}
+		atoms = append(atoms, mp4Atom{typ: string(b[p+4 : p+8]), body: b[p+8 : p+n]})
+		p += n
+	}
+	return atoms
+}
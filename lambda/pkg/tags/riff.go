@@ -0,0 +1,270 @@
+package tags
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"wavey.ai/pkg/riff"
+)
+
+// maxChunkSize bounds the metadata chunks read into memory in full.
+const maxChunkSize = 16 << 20
+
+// infoFields maps RIFF INFO sub-chunks onto normalised fields.
+var infoFields = map[string]string{
+	"INAM": "title",
+	"IART": "artist",
+	"ICMT": "comment",
+	"ICRD": "recordedDate",
+}
+
+// aiffFields maps AIFF text chunks onto normalised fields.
+var aiffFields = map[string]string{
+	"NAME": "title",
+	"AUTH": "artist",
+	"ANNO": "comment",
+}
+
+// skipChunks are structural or padding chunks that carry no metadata, and
+// the marker chunks read by package markers.
+var skipChunks = map[string]bool{
+	"fmt ": true, "data": true, "fact": true, "ds64": true,
+	"JUNK": true, "junk": true, "PAD ": true, "FLLR": true, "filr": true,
+	"COMM": true, "SSND": true, "FVER": true,
+	"cue ": true, "smpl": true,
+}
+
+var noteNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+func readRIFF(m *Metadata, r io.ReaderAt, size int64) error {
+	f, err := riff.New(r, size)
+	if err != nil {
+		return err
+	}
+	order := f.ByteOrder()
+
+	// The sample rate is needed before bext or iXML can yield a timecode,
+	// whichever order the chunks come in.
+	if c, ok := f.Chunk("fmt "); ok && f.IsWAVE() && c.Size >= 8 {
+		if b, err := f.Bytes(riff.Chunk{ID: c.ID, Offset: c.Offset, Size: 8}, 8); err == nil {
+			m.sampleRate = int(binary.LittleEndian.Uint32(b[4:8]))
+		}
+	}
+	if c, ok := f.Chunk("COMM"); ok && f.IsAIFF() && c.Size >= 18 {
+		if b, err := f.Bytes(riff.Chunk{ID: c.ID, Offset: c.Offset, Size: 18}, 18); err == nil {
+			m.sampleRate = int(riff.Extended(b[8:18]))
+		}
+	}
+
+	for _, c := range f.Chunks {
+		if skipChunks[c.ID] {
+			continue
+		}
+
+		if c.Size > maxChunkSize {
+			m.rawData("riff", c.ID, readHead(f, c))
+			continue
+		}
+		b, err := f.Bytes(c, maxChunkSize)
+		if err != nil {
+			return err
+		}
+
+		switch c.ID {
+		case "LIST":
+			typ, subs := riff.List(b, order)
+			if typ == "adtl" {
+				continue
+			}
+			if typ != "INFO" {
+				if len(b) > 4 {
+					m.rawData("riff", "LIST:"+typ, b[4:])
+				}
+				continue
+			}
+			for _, s := range subs {
+				v := riff.CString(s.Data)
+				if field, ok := infoFields[s.ID]; ok {
+					m.set(field, v)
+				} else {
+					m.raw("riff", "INFO:"+s.ID, v)
+				}
+			}
+		case "bext":
+			parseBext(m, b)
+		case "iXML":
+			parseIXML(m, b)
+		case "id3 ", "ID3 ":
+			parseID3(m, b)
+		case "acid":
+			parseAcid(m, b)
+		case "NAME", "AUTH", "ANNO":
+			m.set(aiffFields[c.ID], riff.CString(b))
+		case "COMT":
+			parseComt(m, b)
+		case "(c) ":
+			m.raw("aiff", c.ID, riff.CString(b))
+		default:
+			m.rawData("riff", c.ID, b)
+		}
+	}
+
+	return nil
+}
+
+// readHead returns the leading bytes of an oversized chunk.
+func readHead(f *riff.File, c riff.Chunk) []byte {
+	b := make([]byte, maxRawData)
+	n, _ := f.Section(c).Read(b)
+	return b[:n]
+}
+
+// parseBext reads an EBU Tech 3285 broadcast extension chunk.
+func parseBext(m *Metadata, b []byte) {
+	if len(b) < 346 {
+		return
+	}
+
+	bc := &Broadcast{
+		Description:         riff.CString(b[0:256]),
+		Originator:          riff.CString(b[256:288]),
+		OriginatorReference: riff.CString(b[288:320]),
+		TimeReference: uint64(binary.LittleEndian.Uint32(b[338:342])) |
+			uint64(binary.LittleEndian.Uint32(b[342:346]))<<32,
+	}
+	if len(b) > 602 {
+		bc.CodingHistory = riff.CString(b[602:])
+	}
+	m.Broadcast = bc
+
+	if d := bwfDate(riff.CString(b[320:330]), riff.CString(b[330:338])); d != "" {
+		m.set("recordedDate", d)
+	}
+}
+
+// bwfDate joins a BWF origination date and time. The spec allows any of
+// "-_:. " as separators, so they are normalised.
+func bwfDate(date, tm string) string {
+	norm := func(s string, sep byte) string {
+		b := []byte(s)
+		for i, c := range b {
+			if strings.IndexByte("-_:. /", c) >= 0 {
+				b[i] = sep
+			}
+		}
+		return string(b)
+	}
+
+	if len(date) != 10 {
+		return ""
+	}
+	d := norm(date, '-')
+	if len(tm) == 8 {
+		d += "T" + norm(tm, ':')
+	}
+	return d
+}
+
+type ixml struct {
+	Project string `xml:"PROJECT"`
+	Scene   string `xml:"SCENE"`
+	Take    string `xml:"TAKE"`
+	Tape    string `xml:"TAPE"`
+	Note    string `xml:"NOTE"`
+	Speed   struct {
+		TimecodeRate string `xml:"TIMECODE_RATE"`
+		TimecodeFlag string `xml:"TIMECODE_FLAG"`
+		SampleRate   string `xml:"FILE_SAMPLE_RATE"`
+		SamplesHi    string `xml:"TIMESTAMP_SAMPLES_SINCE_MIDNIGHT_HI"`
+		SamplesLo    string `xml:"TIMESTAMP_SAMPLES_SINCE_MIDNIGHT_LO"`
+	} `xml:"SPEED"`
+	Bext struct {
+		Description string `xml:"BWF_DESCRIPTION"`
+		Originator  string `xml:"BWF_ORIGINATOR"`
+		Date        string `xml:"BWF_ORIGINATION_DATE"`
+		Time        string `xml:"BWF_ORIGINATION_TIME"`
+	} `xml:"BEXT"`
+	User string `xml:"USER"`
+}
+
+// parseIXML reads the production fields of an iXML chunk.
+func parseIXML(m *Metadata, b []byte) {
+	var x ixml
+	if err := xml.Unmarshal([]byte(riff.CString(b)), &x); err != nil {
+		m.raw("ixml", "iXML", riff.CString(b))
+		return
+	}
+
+	m.set("comment", x.Note)
+	for _, kv := range [][2]string{
+		{"PROJECT", x.Project},
+		{"SCENE", x.Scene},
+		{"TAKE", x.Take},
+		{"TAPE", x.Tape},
+		{"USER", x.User},
+	} {
+		if v := strings.TrimSpace(kv[1]); v != "" {
+			m.raw("ixml", kv[0], v)
+		}
+	}
+
+	if x.Speed.TimecodeRate != "" {
+		m.timecodeRate = x.Speed.TimecodeRate
+		m.dropFrame = strings.EqualFold(strings.TrimSpace(x.Speed.TimecodeFlag), "DF")
+	}
+	if m.sampleRate == 0 {
+		if sr, err := strconv.Atoi(strings.TrimSpace(x.Speed.SampleRate)); err == nil {
+			m.sampleRate = sr
+		}
+	}
+
+	if m.Broadcast == nil {
+		hi, err1 := strconv.ParseUint(strings.TrimSpace(x.Speed.SamplesHi), 10, 32)
+		lo, err2 := strconv.ParseUint(strings.TrimSpace(x.Speed.SamplesLo), 10, 32)
+		if err1 == nil && err2 == nil {
+			m.Broadcast = &Broadcast{
+				Description:   strings.TrimSpace(x.Bext.Description),
+				Originator:    strings.TrimSpace(x.Bext.Originator),
+				TimeReference: hi<<32 | lo,
+			}
+		}
+	}
+
+	if d := bwfDate(strings.TrimSpace(x.Bext.Date), strings.TrimSpace(x.Bext.Time)); d != "" {
+		m.set("recordedDate", d)
+	}
+}
+
+// parseAcid reads tempo and root note from an ACID loop chunk.
+func parseAcid(m *Metadata, b []byte) {
+	if len(b) < 24 {
+		return
+	}
+	flags := binary.LittleEndian.Uint32(b[0:4])
+	root := int(binary.LittleEndian.Uint16(b[4:6]))
+	tempo := math.Float32frombits(binary.LittleEndian.Uint32(b[20:24]))
+
+	if tempo > 0 && tempo < 1000 {
+		m.set("bpm", strconv.FormatFloat(float64(tempo), 'f', -1, 32))
+	}
+	if flags&0x02 != 0 && root > 0 && root < 128 {
+		// A loop's root note is only a hint; tagged keys win.
+		m.rootKey = noteNames[root%12]
+	}
+}
+
+// parseComt reads the first comment of an AIFF COMT chunk.
+func parseComt(m *Metadata, b []byte) {
+	if len(b) < 10 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(b[8:10]))
+	if 10+n > len(b) {
+		n = len(b) - 10
+	}
+	m.set("comment", string(b[10:10+n]))
+}
@@ -0,0 +1,148 @@
+// Package tags extracts embedded tag and broadcast metadata from audio files:
+// ID3v2, Vorbis comments (FLAC and Ogg), MP4 atoms, RIFF INFO, BWF bext and
+// iXML. Well-known fields are normalised onto Metadata; anything else is kept
+// verbatim in Metadata.Raw.
+package tags
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupported = errors.New("tags: unsupported container")
+
+// maxRawData caps the number of bytes kept for a single raw field.
+const maxRawData = 16 << 10
+
+// Metadata holds the normalised fields found in a file.
+type Metadata struct {
+	Title        string     `json:"title,omitempty" dynamodbav:"title,omitempty"`
+	Artist       string     `json:"artist,omitempty" dynamodbav:"artist,omitempty"`
+	BPM          float64    `json:"bpm,omitempty" dynamodbav:"bpm,omitempty"`
+	Key          string     `json:"key,omitempty" dynamodbav:"key,omitempty"`
+	Comment      string     `json:"comment,omitempty" dynamodbav:"comment,omitempty"`
+	RecordedDate string     `json:"recordedDate,omitempty" dynamodbav:"recordedDate,omitempty"`
+	Timecode     string     `json:"timecode,omitempty" dynamodbav:"timecode,omitempty"`
+	Broadcast    *Broadcast `json:"broadcast,omitempty" dynamodbav:"broadcast,omitempty"`
+
+	// Raw holds tags, frames and chunks with no normalised mapping.
+	Raw []RawField `json:"raw,omitempty" dynamodbav:"-"`
+
+	// sampleRate and timecodeRate are picked up along the way to turn a
+	// sample-count time reference into a timecode; rootKey is the fallback
+	// key from an ACID chunk.
+	sampleRate   int
+	timecodeRate string
+	dropFrame    bool
+	rootKey      string
+}
+
+// Broadcast holds the BWF bext fields.
+type Broadcast struct {
+	Description         string `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	Originator          string `json:"originator,omitempty" dynamodbav:"originator,omitempty"`
+	OriginatorReference string `json:"originatorReference,omitempty" dynamodbav:"originatorReference,omitempty"`
+	TimeReference       uint64 `json:"timeReference" dynamodbav:"timeReference"`
+	CodingHistory       string `json:"codingHistory,omitempty" dynamodbav:"codingHistory,omitempty"`
+}
+
+// A RawField is a tag, frame or chunk the parser has no mapping for. Text is
+// set for textual values, Data otherwise.
+type RawField struct {
+	Source string `json:"source"`
+	ID     string `json:"id"`
+	Text   string `json:"text,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// Read extracts metadata from the file in r, which is size bytes long.
+func Read(r io.ReaderAt, size int64) (*Metadata, error) {
+	var hdr [12]byte
+	n, err := r.ReadAt(hdr[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	b := hdr[:n]
+
+	m := &Metadata{}
+
+	switch {
+	case bytes.HasPrefix(b, []byte("RIFF")), bytes.HasPrefix(b, []byte("RF64")),
+		bytes.HasPrefix(b, []byte("BW64")), bytes.HasPrefix(b, []byte("FORM")):
+		err = readRIFF(m, r, size)
+	case bytes.HasPrefix(b, []byte("fLaC")):
+		err = readFLAC(m, r, size)
+	case bytes.HasPrefix(b, []byte("OggS")):
+		err = readOgg(m, r, size)
+	case bytes.HasPrefix(b, []byte("ID3")):
+		err = readID3File(m, r, size)
+	case len(b) >= 8 && string(b[4:8]) == "ftyp":
+		err = readMP4(m, r, size)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.finish()
+
+	return m, nil
+}
+
+// finish derives fields that depend on more than one source.
+func (m *Metadata) finish() {
+	m.set("key", m.rootKey)
+	if m.Timecode == "" && m.Broadcast != nil && m.sampleRate > 0 {
+		m.Timecode = Timecode(m.Broadcast.TimeReference, m.sampleRate, m.timecodeRate, m.dropFrame)
+	}
+}
+
+func (m *Metadata) raw(source, id, text string) {
+	m.Raw = append(m.Raw, RawField{Source: source, ID: id, Text: text})
+}
+
+func (m *Metadata) rawData(source, id string, data []byte) {
+	if len(data) > maxRawData {
+		data = data[:maxRawData]
+	}
+	m.Raw = append(m.Raw, RawField{Source: source, ID: id, Data: append([]byte(nil), data...)})
+}
+
+// set assigns a normalised field by its canonical name, keeping the first
+// value seen.
+func (m *Metadata) set(name, value string) {
+	value = strings.TrimSpace(value)
+
+	switch name {
+	case "title":
+		setFirst(&m.Title, value)
+	case "artist":
+		setFirst(&m.Artist, value)
+	case "comment":
+		setFirst(&m.Comment, value)
+	case "key":
+		setFirst(&m.Key, value)
+	case "recordedDate":
+		setFirst(&m.RecordedDate, value)
+	case "timecode":
+		setFirst(&m.Timecode, value)
+	case "bpm":
+		// Values like "120 BPM" turn up in the wild.
+		fields := strings.Fields(value)
+		if m.BPM == 0 && len(fields) > 0 {
+			if f, err := strconv.ParseFloat(fields[0], 64); err == nil && f > 0 {
+				m.BPM = f
+			}
+		}
+	}
+}
+
+func setFirst(dst *string, v string) {
+	if *dst == "" {
+		*dst = v
+	}
+}
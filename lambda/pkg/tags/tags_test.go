@@ -0,0 +1,370 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// id3Frame returns an ID3v2 frame of the given version.
+func id3Frame(version byte, id string, data []byte) []byte {
+	b := []byte(id)
+	switch version {
+	case 2:
+		n := len(data)
+		b = append(b, byte(n>>16), byte(n>>8), byte(n))
+	case 3:
+		b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+		b = append(b, 0, 0)
+	default:
+		b = append(b, syncsafeBytes(len(data))...)
+		b = append(b, 0, 0)
+	}
+	return append(b, data...)
+}
+
+// id3Tag returns an ID3v2 tag holding frames, followed by some padding.
+func id3Tag(version byte, frames ...[]byte) []byte {
+	var body []byte
+	for _, f := range frames {
+		body = append(body, f...)
+	}
+	body = append(body, make([]byte, 16)...)
+	b := append([]byte{'I', 'D', '3', version, 0, 0}, syncsafeBytes(len(body))...)
+	return append(b, body...)
+}
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n>>21) & 0x7F, byte(n>>14) & 0x7F, byte(n>>7) & 0x7F, byte(n) & 0x7F}
+}
+
+// id3v1 returns an ID3v1 tag with a title and artist.
+func id3v1(title, artist string) []byte {
+	b := make([]byte, 128)
+	copy(b, "TAG")
+	copy(b[3:33], title)
+	copy(b[33:63], artist)
+	return b
+}
+
+// vorbisComment returns a Vorbis comment block holding fields.
+func vorbisComment(fields ...string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, 4)
+	b = append(b, "test"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(fields)))
+	for _, f := range fields {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(f)))
+		b = append(b, f...)
+	}
+	return b
+}
+
+// flacBlock returns a FLAC metadata block.
+func flacBlock(typ byte, last bool, body []byte) []byte {
+	if last {
+		typ |= 0x80
+	}
+	n := len(body)
+	return append([]byte{typ, byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+// streamInfo returns a FLAC STREAMINFO body with the given sample rate.
+func streamInfo(rate uint32) []byte {
+	b := make([]byte, 34)
+	binary.BigEndian.PutUint32(b[10:], rate<<12)
+	return b
+}
+
+// oggPage returns an Ogg page holding packets, each shorter than 255 bytes.
+func oggPage(packets ...[]byte) []byte {
+	b := make([]byte, 27)
+	copy(b, "OggS")
+	b[26] = byte(len(packets))
+	for _, p := range packets {
+		b = append(b, byte(len(p)))
+	}
+	for _, p := range packets {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// atom returns an MP4 atom.
+func atom(typ string, children ...[]byte) []byte {
+	var body []byte
+	for _, c := range children {
+		body = append(body, c...)
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	b = append(b, typ...)
+	return append(b, body...)
+}
+
+// dataAtom returns an ilst data atom of the given type.
+func dataAtom(typ uint32, value []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, typ)
+	b = append(b, 0, 0, 0, 0)
+	return atom("data", append(b, value...))
+}
+
+// mp4File returns an MP4 file with ilst items under moov/udta/meta.
+func mp4File(items ...[]byte) []byte {
+	meta := atom("meta", append([]byte{0, 0, 0, 0}, atom("ilst", items...)...))
+	return append(atom("ftyp", []byte("M4A \x00\x00\x00\x00")), atom("moov", atom("udta", meta))...)
+}
+
+// riffChunk returns a little-endian chunk, padded to even length.
+func riffChunk(id string, body []byte) []byte {
+	b := binary.LittleEndian.AppendUint32([]byte(id), uint32(len(body)))
+	b = append(b, body...)
+	if len(body)&1 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// wave returns a 48 kHz WAVE file made of chunks after fmt.
+func wave(chunks ...[]byte) []byte {
+	f := make([]byte, 16)
+	binary.LittleEndian.PutUint16(f[0:], 1)
+	binary.LittleEndian.PutUint16(f[2:], 1)
+	binary.LittleEndian.PutUint32(f[4:], 48000)
+	b := append([]byte("RIFF\xff\xff\xff\xffWAVE"), riffChunk("fmt ", f)...)
+	for _, c := range chunks {
+		b = append(b, c...)
+	}
+	return append(b, riffChunk("data", []byte{0, 0, 0, 0})...)
+}
+
+// bext returns a bext chunk body.
+func bext(description, originator, date, tm string, timeReference uint64) []byte {
+	b := make([]byte, 602)
+	copy(b[0:256], description)
+	copy(b[256:288], originator)
+	copy(b[320:330], date)
+	copy(b[330:338], tm)
+	binary.LittleEndian.PutUint64(b[338:346], timeReference)
+	return b
+}
+
+func utf16LE(s string) []byte {
+	b := []byte{0xFF, 0xFE}
+	for _, r := range s {
+		b = append(b, byte(r), 0)
+	}
+	return b
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    Metadata
+		wantErr error
+	}{
+		{
+			name: "id3v2.4",
+			data: append(id3Tag(4,
+				id3Frame(4, "TIT2", []byte("\x03Title")),
+				id3Frame(4, "TPE1", append([]byte{1}, utf16LE("Artist")...)),
+				id3Frame(4, "TBPM", []byte("\x00120 BPM")),
+				id3Frame(4, "TXXX", []byte("\x00INITIALKEY\x00Am")),
+				id3Frame(4, "COMM", []byte("\x00eng\x00a comment")),
+				id3Frame(4, "TXXX", []byte("\x00Mood\x00calm")),
+				id3Frame(4, "TSSE", []byte("\x00encoder")),
+				id3Frame(4, "APIC", []byte("\x00image/png\x00\x03\x00png")),
+			), 0xFF, 0xFB),
+			want: Metadata{
+				Title:   "Title",
+				Artist:  "Artist",
+				BPM:     120,
+				Key:     "Am",
+				Comment: "a comment",
+				Raw: []RawField{
+					{Source: "id3", ID: "TXXX:Mood", Text: "calm"},
+					{Source: "id3", ID: "TSSE", Text: "encoder"},
+				},
+			},
+		},
+		{
+			name: "id3v2.3 date",
+			data: id3Tag(3,
+				id3Frame(3, "TYER", []byte("\x002023")),
+				id3Frame(3, "TDAT", []byte("\x000504")),
+				id3Frame(3, "TIME", []byte("\x001230")),
+			),
+			want: Metadata{RecordedDate: "2023-04-05T12:30"},
+		},
+		{
+			name: "id3v2.2",
+			data: id3Tag(2, id3Frame(2, "TT2", []byte("\x00Old"))),
+			want: Metadata{Title: "Old"},
+		},
+		{
+			name: "id3v1 fills gaps",
+			data: append(append(id3Tag(4, id3Frame(4, "TIT2", []byte("\x03New"))), make([]byte, 64)...),
+				id3v1("Old", "Band")...),
+			want: Metadata{Title: "New", Artist: "Band"},
+		},
+		{
+			name: "id3 frame past end of tag",
+			data: id3Tag(4, id3Frame(4, "TIT2", []byte("\x03Title")), []byte("TPE1\x7f\x7f\x7f\x7f\x00\x00")),
+			want: Metadata{Title: "Title"},
+		},
+		{
+			name:    "id3 tag past end of file",
+			data:    []byte("ID3\x04\x00\x00\x7f\x7f\x7f\x7f"),
+			wantErr: errAny,
+		},
+		{
+			name: "flac",
+			data: append([]byte("fLaC"), append(flacBlock(0, false, streamInfo(44100)),
+				flacBlock(4, true, vorbisComment(
+					"TITLE=Loop",
+					"artist=Someone",
+					"BPM=98",
+					"DATE=2021",
+					"METADATA_BLOCK_PICTURE=xxx",
+					"CUSTOM=value",
+					"no equals sign",
+				))...)...),
+			want: Metadata{
+				Title:        "Loop",
+				Artist:       "Someone",
+				BPM:          98,
+				RecordedDate: "2021",
+				Raw:          []RawField{{Source: "vorbis", ID: "CUSTOM", Text: "value"}},
+			},
+		},
+		{
+			name: "flac comment field past end",
+			// Cut off part way through ARTIST.
+			data: append([]byte("fLaC"), flacBlock(4, true,
+				vorbisComment("TITLE=Loop", "ARTIST=Someone")[:33])...),
+			want: Metadata{Title: "Loop"},
+		},
+		{
+			name: "ogg vorbis",
+			data: oggPage(
+				[]byte("\x01vorbis\x00\x00\x00\x00\x02\x44\xac\x00\x00"),
+				append([]byte("\x03vorbis"), vorbisComment("TITLE=Ogg", "KEY=C")...),
+			),
+			want: Metadata{Title: "Ogg", Key: "C"},
+		},
+		{
+			name: "ogg opus",
+			data: oggPage(
+				[]byte("OpusHead\x01\x02"),
+				append([]byte("OpusTags"), vorbisComment("DESCRIPTION=notes")...),
+			),
+			want: Metadata{Comment: "notes"},
+		},
+		{
+			name: "mp4",
+			data: mp4File(
+				atom("\xa9nam", dataAtom(1, []byte("Song"))),
+				atom("tmpo", dataAtom(21, []byte{0, 120})),
+				atom("----", atom("mean", []byte("\x00\x00\x00\x00com.apple.iTunes")),
+					atom("name", []byte("\x00\x00\x00\x00initialkey")), dataAtom(1, []byte("F#m"))),
+				atom("\xa9too", dataAtom(1, []byte("Encoder"))),
+				atom("covr", dataAtom(13, []byte("jpeg"))),
+				atom("cpil", dataAtom(0, []byte{1})),
+			),
+			want: Metadata{
+				Title: "Song",
+				BPM:   120,
+				Key:   "F#m",
+				Raw: []RawField{
+					{Source: "mp4", ID: "©too", Text: "Encoder"},
+					{Source: "mp4", ID: "cpil", Data: []byte{1}},
+				},
+			},
+		},
+		{
+			name: "mp4 undersized atom",
+			data: mp4File(atom("\xa9nam", dataAtom(1, []byte("Song"))), []byte("\x00\x00\x00\x04\xa9ART")),
+			want: Metadata{Title: "Song"},
+		},
+		{
+			name: "riff info and bext",
+			data: wave(
+				riffChunk("LIST", append([]byte("INFO"), append(
+					riffChunk("INAM", []byte("Take 1\x00")),
+					append(riffChunk("IART", []byte("Crew\x00")), riffChunk("ISFT", []byte("Recorder\x00"))...)...)...)),
+				riffChunk("bext", bext("Scene 4", "Recorder", "2020-01-02", "03.04.05", 48000*3600)),
+			),
+			want: Metadata{
+				Title:        "Take 1",
+				Artist:       "Crew",
+				RecordedDate: "2020-01-02T03:04:05",
+				Timecode:     "01:00:00:00",
+				Broadcast: &Broadcast{
+					Description:   "Scene 4",
+					Originator:    "Recorder",
+					TimeReference: 48000 * 3600,
+				},
+				Raw: []RawField{{Source: "riff", ID: "INFO:ISFT", Text: "Recorder"}},
+			},
+		},
+		{
+			name: "short bext ignored",
+			data: wave(riffChunk("bext", make([]byte, 100))),
+		},
+		{
+			name:    "unsupported",
+			data:    []byte("not audio at all"),
+			wantErr: ErrUnsupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Read(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if tt.wantErr == errAny {
+				if err == nil {
+					t.Fatalf("Read() = %+v, want an error", got)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Read() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got.sampleRate, got.timecodeRate, got.dropFrame, got.rootKey = 0, "", false, ""
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Read() = %+v, want %+v", *got, tt.want)
+				if got.Broadcast != nil {
+					t.Errorf("Broadcast = %+v", *got.Broadcast)
+				}
+			}
+		})
+	}
+}
+
+// errAny stands for any error in test tables.
+var errAny = errors.New("any error")
+
+func TestTimecode(t *testing.T) {
+	tests := []struct {
+		samples    uint64
+		sampleRate int
+		rate       string
+		drop       bool
+		want       string
+	}{
+		{0, 48000, "25/1", false, "00:00:00:00"},
+		{48000 * 3600, 48000, "", false, "01:00:00:00"},
+		{48000*61 + 24000, 48000, "24", false, "00:01:01:12"},
+		{2882880, 48000, "30000/1001", true, "00:01:00;02"},
+		{2882880, 48000, "29.97", false, "00:01:00:00"},
+		{48000 * 86400, 48000, "25/1", false, "00:00:00:00"},
+	}
+	for _, tt := range tests {
+		if got := Timecode(tt.samples, tt.sampleRate, tt.rate, tt.drop); got != tt.want {
+			t.Errorf("Timecode(%d, %d, %q, %v) = %q, want %q", tt.samples, tt.sampleRate, tt.rate, tt.drop, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package tags
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultTimecodeRate is assumed when a file carries a time reference but no
+// frame rate; bext is an EBU specification, so PAL rate is the safe guess.
+const DefaultTimecodeRate = "25/1"
+
+// Timecode renders a sample count since midnight as SMPTE timecode at the
+// given frame rate, written as a ratio ("30000/1001") or decimal ("29.97").
+// Drop-frame counting is only applied to the 29.97 and 59.94 rates.
+func Timecode(samples uint64, sampleRate int, rate string, dropFrame bool) string {
+	num, den := parseRate(rate)
+	if num == 0 || sampleRate <= 0 {
+		num, den = parseRate(DefaultTimecodeRate)
+	}
+
+	frames := samples * num / (uint64(sampleRate) * den)
+	fps := uint64(math.Round(float64(num) / float64(den)))
+
+	drop := uint64(0)
+	if dropFrame && den == 1001 && (fps == 30 || fps == 60) {
+		drop = fps / 15
+	}
+
+	// Wrap at midnight.
+	perDay := fps * 86400
+	if drop > 0 {
+		perDay = (fps*600 - drop*9) * 144
+	}
+	frames %= perDay
+
+	sep := ":"
+	if drop > 0 {
+		sep = ";"
+		per10 := fps*600 - drop*9
+		perMin := fps*60 - drop
+		d, m := frames/per10, frames%per10
+		frames += drop * 9 * d
+		if m > drop {
+			frames += drop * ((m - drop) / perMin)
+		}
+	}
+
+	f := frames % fps
+	s := frames / fps
+	return fmt.Sprintf("%02d:%02d:%02d%s%02d", s/3600, s/60%60, s%60, sep, f)
+}
+
+// parseRate reads "num/den" or a decimal rate, mapping the NTSC decimal
+// rates onto their exact ratios.
+func parseRate(rate string) (uint64, uint64) {
+	rate = strings.TrimSpace(rate)
+	if n, d, ok := strings.Cut(rate, "/"); ok {
+		num, err1 := strconv.ParseUint(strings.TrimSpace(n), 10, 64)
+		den, err2 := strconv.ParseUint(strings.TrimSpace(d), 10, 64)
+		if err1 != nil || err2 != nil || den == 0 {
+			return 0, 1
+		}
+		return num, den
+	}
+
+	f, err := strconv.ParseFloat(rate, 64)
+	if err != nil || f <= 0 {
+		return 0, 1
+	}
+	for _, ntsc := range []uint64{24, 30, 48, 60} {
+		if math.Abs(f-float64(ntsc)*1000/1001) < 0.005 {
+			return ntsc * 1000, 1001
+		}
+	}
+	return uint64(math.Round(f * 1000)), 1000
+}
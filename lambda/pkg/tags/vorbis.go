@@ -0,0 +1,196 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// maxCommentSize bounds a Vorbis comment block read into memory.
+const maxCommentSize = 16 << 20
+
+// vorbisFields maps Vorbis comment field names (upper case) onto normalised
+// fields.
+var vorbisFields = map[string]string{
+	"TITLE":       "title",
+	"ARTIST":      "artist",
+	"BPM":         "bpm",
+	"TEMPO":       "bpm",
+	"KEY":         "key",
+	"INITIALKEY":  "key",
+	"COMMENT":     "comment",
+	"DESCRIPTION": "comment",
+	"DATE":        "recordedDate",
+	"TIMECODE":    "timecode",
+}
+
+// readFLAC walks the FLAC metadata blocks for STREAMINFO and VORBIS_COMMENT.
+func readFLAC(m *Metadata, r io.ReaderAt, size int64) error {
+	off := int64(4)
+	for off+4 <= size {
+		var hdr [4]byte
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return err
+		}
+		last := hdr[0]&0x80 != 0
+		typ := hdr[0] & 0x7F
+		n := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		off += 4
+
+		switch typ {
+		case 0:
+			var si [18]byte
+			if n >= 18 {
+				if _, err := r.ReadAt(si[:], off); err != nil {
+					return err
+				}
+				m.sampleRate = int(binary.BigEndian.Uint32(si[10:14]) >> 12)
+			}
+		case 4:
+			if n > maxCommentSize {
+				return errors.New("tags: oversized Vorbis comment block")
+			}
+			b := make([]byte, n)
+			if _, err := r.ReadAt(b, off); err != nil && err != io.EOF {
+				return err
+			}
+			parseVorbisComment(m, b)
+		case 6:
+			// PICTURE.
+		default:
+			if n <= maxRawData && typ != 1 {
+				b := make([]byte, n)
+				if _, err := r.ReadAt(b, off); err == nil {
+					m.rawData("flac", flacBlockName(typ), b)
+				}
+			}
+		}
+
+		off += n
+		if last {
+			break
+		}
+	}
+
+	return nil
+}
+
+func flacBlockName(typ byte) string {
+	switch typ {
+	case 2:
+		return "APPLICATION"
+	case 3:
+		return "SEEKTABLE"
+	case 5:
+		return "CUESHEET"
+	}
+	return "BLOCK"
+}
+
+// readOgg finds the comment header of the first logical stream in an Ogg
+// Vorbis or Ogg Opus file.
+func readOgg(m *Metadata, r io.ReaderAt, size int64) error {
+	sr := io.NewSectionReader(r, 0, size)
+
+	var packets [][]byte
+	var cur []byte
+
+	for len(packets) < 2 {
+		var hdr [27]byte
+		if _, err := io.ReadFull(sr, hdr[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		if string(hdr[0:4]) != "OggS" {
+			return errors.New("tags: lost Ogg page sync")
+		}
+
+		segs := make([]byte, hdr[26])
+		if _, err := io.ReadFull(sr, segs); err != nil {
+			return err
+		}
+
+		for _, l := range segs {
+			seg := make([]byte, l)
+			if _, err := io.ReadFull(sr, seg); err != nil {
+				return err
+			}
+			cur = append(cur, seg...)
+			if len(cur) > maxCommentSize {
+				return errors.New("tags: oversized Ogg header packet")
+			}
+			if l < 255 {
+				packets = append(packets, cur)
+				cur = nil
+				if len(packets) == 2 {
+					break
+				}
+			}
+		}
+	}
+
+	if len(packets) < 2 {
+		return nil
+	}
+
+	id, comment := packets[0], packets[1]
+	switch {
+	case bytes.HasPrefix(id, []byte("\x01vorbis")) && len(id) >= 16:
+		m.sampleRate = int(binary.LittleEndian.Uint32(id[12:16]))
+		if bytes.HasPrefix(comment, []byte("\x03vorbis")) {
+			parseVorbisComment(m, comment[7:])
+		}
+	case bytes.HasPrefix(id, []byte("OpusHead")):
+		m.sampleRate = 48000
+		if bytes.HasPrefix(comment, []byte("OpusTags")) {
+			parseVorbisComment(m, comment[8:])
+		}
+	}
+
+	return nil
+}
+
+// parseVorbisComment parses a Vorbis comment block (vendor string, then a
+// list of NAME=value fields), as found in FLAC, Ogg Vorbis and Ogg Opus.
+func parseVorbisComment(m *Metadata, b []byte) {
+	if len(b) < 4 {
+		return
+	}
+	vendor := int(binary.LittleEndian.Uint32(b[0:4]))
+	p := 4 + vendor
+	if vendor < 0 || p+4 > len(b) {
+		return
+	}
+
+	n := int(binary.LittleEndian.Uint32(b[p : p+4]))
+	p += 4
+
+	for i := 0; i < n && p+4 <= len(b); i++ {
+		l := int(binary.LittleEndian.Uint32(b[p : p+4]))
+		p += 4
+		if l < 0 || p+l > len(b) {
+			return
+		}
+		field := string(b[p : p+l])
+		p += l
+
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		name = strings.ToUpper(name)
+
+		if name == "METADATA_BLOCK_PICTURE" || name == "COVERART" {
+			continue
+		}
+		if f, ok := vorbisFields[name]; ok {
+			m.set(f, value)
+		} else {
+			m.raw("vorbis", name, value)
+		}
+	}
+}
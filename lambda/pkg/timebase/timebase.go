@@ -0,0 +1,164 @@
+// Package timebase converts positions between sample rates, seconds and
+// packets of the playback stream.
+//
+// Conversions between rates use exact integer arithmetic with an explicit
+// rounding mode, so a position always maps to the same frame whichever
+// service converts it.
+package timebase
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"wavey.ai/pkg/stream"
+)
+
+// Rounding selects how a position between two frames is resolved.
+type Rounding int
+
+const (
+	// Nearest picks the closest frame, rounding halves away from zero.
+	Nearest Rounding = iota
+	// Floor picks the frame at or before the position.
+	Floor
+	// Ceil picks the frame at or after the position.
+	Ceil
+)
+
+// Micros is the rate of positions expressed in microseconds.
+const Micros = 1000000
+
+// ParseRounding parses "nearest", "floor" or "ceil". The empty string is
+// Nearest.
+func ParseRounding(s string) (Rounding, error) {
+	switch s {
+	case "", "nearest":
+		return Nearest, nil
+	case "floor":
+		return Floor, nil
+	case "ceil":
+		return Ceil, nil
+	}
+	return 0, fmt.Errorf("timebase: unknown rounding %q", s)
+}
+
+func (r Rounding) String() string {
+	switch r {
+	case Floor:
+		return "floor"
+	case Ceil:
+		return "ceil"
+	}
+	return "nearest"
+}
+
+// Convert converts pos frames at rate from to frames at rate to. Both rates
+// must be positive and the result must fit in an int64; Convert panics
+// otherwise, so positions from untrusted input must be bounded first.
+func Convert(pos, from, to int64, r Rounding) int64 {
+	if from <= 0 || to <= 0 {
+		panic("timebase: rates must be positive")
+	}
+	if from == to {
+		return pos
+	}
+	if pos == math.MinInt64 {
+		panic("timebase: position out of range")
+	}
+
+	neg := pos < 0
+	if neg {
+		// Convert the magnitude, flipping directed rounding to match.
+		pos = -pos
+		switch r {
+		case Floor:
+			r = Ceil
+		case Ceil:
+			r = Floor
+		}
+	}
+
+	hi, lo := bits.Mul64(uint64(pos), uint64(to))
+	if hi >= uint64(from) {
+		// The quotient wouldn't fit in 64 bits.
+		panic("timebase: position out of range")
+	}
+	q, rem := bits.Div64(hi, lo, uint64(from))
+	if q > math.MaxInt64 {
+		panic("timebase: position out of range")
+	}
+	switch r {
+	case Ceil:
+		if rem > 0 {
+			q++
+		}
+	case Nearest:
+		if rem >= uint64(from)-rem {
+			q++
+		}
+	}
+
+	if q > math.MaxInt64 {
+		panic("timebase: position out of range")
+	}
+	if neg {
+		return -int64(q)
+	}
+	return int64(q)
+}
+
+// Seconds returns pos frames at hz in seconds.
+func Seconds(pos, hz int64) float64 {
+	return float64(pos) / float64(hz)
+}
+
+// FromSeconds converts s seconds to frames at hz. Products within a
+// millionth of a frame of a whole frame are treated as that frame, so that
+// decimal inputs like 0.1 s don't round up under Ceil.
+func FromSeconds(s float64, hz int64, r Rounding) int64 {
+	x := s * float64(hz)
+	if n := math.Round(x); math.Abs(x-n) < 1e-6 {
+		return int64(n)
+	}
+	switch r {
+	case Floor:
+		return int64(math.Floor(x))
+	case Ceil:
+		return int64(math.Ceil(x))
+	}
+	return int64(math.Round(x))
+}
+
+// Packet returns the index of the stream packet holding frame pos at hz.
+func Packet(pos, hz int64) int64 {
+	return floorDiv(Convert(pos, hz, stream.SampleRate, Floor), stream.FrameSize)
+}
+
+// PacketEnd returns the index just past the last stream packet holding
+// frames before end at hz, so that [Packet(start), PacketEnd(end)) covers
+// the frames [start, end).
+func PacketEnd(end, hz int64) int64 {
+	return ceilDiv(Convert(end, hz, stream.SampleRate, Ceil), stream.FrameSize)
+}
+
+// PacketStart returns the first frame of stream packet i at hz.
+func PacketStart(i, hz int64, r Rounding) int64 {
+	return Convert(i*stream.FrameSize, stream.SampleRate, hz, r)
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func ceilDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) == (b < 0) {
+		q++
+	}
+	return q
+}
@@ -0,0 +1,164 @@
+package timebase
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name               string
+		pos, from, to      int64
+		floor, ceil, round int64
+	}{
+		{"same rate", 12345, 44100, 44100, 12345, 12345, 12345},
+		{"one second up", 44100, 44100, 48000, 48000, 48000, 48000},
+		{"one second down", 48000, 48000, 44100, 44100, 44100, 44100},
+		{"zero", 0, 44100, 48000, 0, 0, 0},
+		{"one frame up", 1, 44100, 48000, 1, 2, 1},
+		{"one frame down", 1, 48000, 44100, 0, 1, 1},
+		{"negative up", -1, 44100, 48000, -2, -1, -1},
+		{"negative down", -1, 48000, 44100, -1, 0, -1},
+		{"half", 1, 2, 1, 0, 1, 1},
+		{"one and a half", 3, 2, 1, 1, 2, 2},
+		{"negative half", -1, 2, 1, -1, 0, -1},
+		{"negative one and a half", -3, 2, 1, -2, -1, -2},
+		{"micros", 1, 44100, Micros, 22, 23, 23},
+		{"max int64 down", math.MaxInt64, 48000, 44100, 8473973058860325272, 8473973058860325273, 8473973058860325273},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, c := range []struct {
+				r    Rounding
+				want int64
+			}{{Floor, tt.floor}, {Ceil, tt.ceil}, {Nearest, tt.round}} {
+				if got := Convert(tt.pos, tt.from, tt.to, c.r); got != c.want {
+					t.Errorf("Convert(%d, %d, %d, %v) = %d, want %d", tt.pos, tt.from, tt.to, c.r, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertPanics(t *testing.T) {
+	tests := []struct {
+		name          string
+		pos, from, to int64
+	}{
+		{"zero from", 1, 0, 48000},
+		{"negative to", 1, 48000, -1},
+		{"max int64 up", math.MaxInt64, 44100, 48000},
+		{"min int64", math.MinInt64, 44100, 48000},
+		// 3*pos is 2*MaxInt64 + 1, so only rounding overflows.
+		{"rounds past max int64", math.MaxUint64 / 3, 2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Convert(%d, %d, %d) didn't panic", tt.pos, tt.from, tt.to)
+				}
+			}()
+			Convert(tt.pos, tt.from, tt.to, Nearest)
+		})
+	}
+}
+
+func TestFromSeconds(t *testing.T) {
+	tests := []struct {
+		name string
+		s    float64
+		hz   int64
+		r    Rounding
+		want int64
+	}{
+		{"tenth at 48k ceil", 0.1, 48000, Ceil, 4800},
+		{"tenth at 44.1k ceil", 0.1, 44100, Ceil, 4410},
+		{"tenth at 44.1k floor", 0.1, 44100, Floor, 4410},
+		{"third at 48k ceil", 1.0 / 3, 48000, Ceil, 16000},
+		{"part frame floor", 0.00001, 44100, Floor, 0},
+		{"part frame ceil", 0.00001, 44100, Ceil, 1},
+		{"part frame nearest", 0.00001, 44100, Nearest, 0},
+		{"half frame nearest", 0.5, 3, Nearest, 2},
+		{"negative half frame nearest", -0.5, 3, Nearest, -2},
+		{"negative ceil", -0.00001, 44100, Ceil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FromSeconds(tt.s, tt.hz, tt.r); got != tt.want {
+				t.Errorf("FromSeconds(%v, %d, %v) = %d, want %d", tt.s, tt.hz, tt.r, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPacket(t *testing.T) {
+	tests := []struct {
+		pos, hz    int64
+		start, end int64
+	}{
+		{0, 48000, 0, 0},
+		{1, 48000, 0, 1},
+		{119, 48000, 0, 1},
+		{120, 48000, 1, 1},
+		{121, 48000, 1, 2},
+		{-1, 48000, -1, 0},
+		{110, 44100, 0, 1},
+		{111, 44100, 1, 2},
+		{44100, 44100, 400, 400},
+	}
+	for _, tt := range tests {
+		if got := Packet(tt.pos, tt.hz); got != tt.start {
+			t.Errorf("Packet(%d, %d) = %d, want %d", tt.pos, tt.hz, got, tt.start)
+		}
+		if got := PacketEnd(tt.pos, tt.hz); got != tt.end {
+			t.Errorf("PacketEnd(%d, %d) = %d, want %d", tt.pos, tt.hz, got, tt.end)
+		}
+	}
+}
+
+func TestPacketsCover(t *testing.T) {
+	// [Packet(start), PacketEnd(end)) must hold every frame of [start, end)
+	// and no packet wholly outside it.
+	for _, hz := range []int64{8000, 22050, 44100, 48000, 96000} {
+		for pos := int64(-300); pos <= 3000; pos += 7 {
+			first := Packet(pos, hz)
+			if s := PacketStart(first, hz, Floor); s > pos {
+				t.Errorf("at %d Hz packet %d starts at %d, after start %d", hz, first, s, pos)
+			}
+			if s := PacketStart(first+1, hz, Ceil); s <= pos {
+				t.Errorf("at %d Hz packet %d ends at %d, before start %d", hz, first, s, pos)
+			}
+			last := PacketEnd(pos, hz)
+			if e := PacketStart(last, hz, Ceil); e < pos {
+				t.Errorf("at %d Hz packets end at %d, before end %d", hz, e, pos)
+			}
+			if e := PacketStart(last-1, hz, Floor); e >= pos {
+				t.Errorf("at %d Hz packet %d starts at %d, at or after end %d", hz, last-1, e, pos)
+			}
+		}
+	}
+}
+
+func TestParseRounding(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Rounding
+		wantErr bool
+	}{
+		{"", Nearest, false},
+		{"nearest", Nearest, false},
+		{"floor", Floor, false},
+		{"ceil", Ceil, false},
+		{"round", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRounding(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRounding(%q) = %v, %v; want %v, wantErr %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil && tt.in != "" && got.String() != tt.in {
+			t.Errorf("%v.String() = %q", got, got.String())
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/attachment"
+	"wavey.ai/pkg/audio"
+	"wavey.ai/pkg/ogg"
+	"wavey.ai/pkg/s3io"
+	"wavey.ai/pkg/stream"
+	"wavey.ai/pkg/timebase"
+)
+
+// urlExpiry is how long a download link stays valid.
+const urlExpiry = time.Hour
+
+// maxFadeMs bounds each fade.
+const maxFadeMs = 60000
+
+// opus is the render format served from the stream rather than the source.
+const opus = "opus"
+
+// opusPreroll is how much audio is decoded ahead of an Opus clip so the
+// decoder has converged by its first sample (RFC 7845 section 4.6).
+const opusPreroll = 3840
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	s3Cl := s3.NewFromConfig(cfg)
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	exportsBucket := os.Getenv("EXPORTS_BUCKET_NAME")
+
+	h := handler{
+		dbCl,
+		s3Cl,
+		s3.NewPresignClient(s3Cl),
+		manager.NewUploader(s3Cl),
+		clipsTbl,
+		formatsTbl,
+		exportsBucket,
+		&log,
+	}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl          *dynamodb.Client
+	s3Cl          *s3.Client
+	presignCl     *s3.PresignClient
+	uploader      *manager.Uploader
+	clipsTbl      string
+	formatsTbl    string
+	exportsBucket string
+	log           *zerolog.Logger
+}
+
+// RenderRequest is the body of POST /clips/{clipId}/render. A zero bitDepth
+// keeps the source depth where the format allows it. Fades are linear and
+// not available for Opus, which is cut from the encoded stream.
+type RenderRequest struct {
+	Format    string `json:"format"`
+	BitDepth  int    `json:"bitDepth"`
+	FadeInMs  int    `json:"fadeInMs"`
+	FadeOutMs int    `json:"fadeOutMs"`
+}
+
+type Render struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Format   string `json:"format"`
+	Frames   int64  `json:"frames"`
+	Hz       int    `json:"hz"`
+}
+
+type Clip struct {
+	Key   string `dynamodbav:"key"`
+	Sound string `dynamodbav:"sound"`
+	User  string `dynamodbav:"user"`
+	Start int64  `dynamodbav:"start"`
+	End   int64  `dynamodbav:"end"`
+	Hz    int64  `dynamodbav:"hz"`
+	Name  string `dynamodbav:"name"`
+}
+
+type Sound struct {
+	Key      string `dynamodbav:"key"`
+	Bucket   string `dynamodbav:"bucket"`
+	Filename string `dynamodbav:"filename"`
+}
+
+// errRender is a problem with the request rather than the service.
+type errRender struct{ msg string }
+
+func (e errRender) Error() string { return e.msg }
+
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	clipId := event.PathParameters["clipId"]
+	if clipId == "" {
+		h.log.Error().Msgf("Cannot get clipid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	var req RenderRequest
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshalling request body")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+	req.Format = strings.ToLower(req.Format)
+	if err := validate(req); err != nil {
+		h.log.Info().Err(err).Msg("Invalid render request")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	clip, sound, err := h.load(clipId, user)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting clip from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if clip == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	if clip.Hz <= 0 || clip.Start < 0 || clip.End <= clip.Start {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusUnprocessableEntity,
+			Body:       "Clip has no audio to render",
+		}, nil
+	}
+
+	log := h.log.With().Str("clip", clip.Key).Str("sound", sound.Key).Logger()
+
+	tmp, err := os.CreateTemp("", "render-*")
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating temporary file")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	start := time.Now()
+	var render Render
+	if req.Format == opus {
+		render, err = h.renderOpus(tmp, clip, sound)
+	} else {
+		render, err = h.renderPCM(tmp, clip, sound, req)
+	}
+	var bad errRender
+	if errors.As(err, &bad) || errors.Is(err, audio.ErrUnsupported) {
+		log.Info().Err(err).Msg("Cannot render clip")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusUnprocessableEntity,
+			Body:       err.Error(),
+		}, nil
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Error rendering clip")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	log.Info().Msgf("Rendered %d frames of %s in %s", render.Frames, render.Format, time.Since(start))
+
+	render.Filename = renderFilename(sound, clip, render.Format)
+	object, err := h.upload(tmp, clip, render)
+	if err != nil {
+		log.Error().Err(err).Msg("Error uploading render")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	disposition := attachment.ContentDisposition(render.Filename)
+	presigned, err := h.presignCl.PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket:                     &h.exportsBucket,
+		Key:                        &object,
+		ResponseContentDisposition: &disposition,
+	}, func(opts *s3.PresignOptions) {
+		opts.Expires = urlExpiry
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Error generating Presigned URL")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	render.URL = presigned.URL
+
+	b, err := json.Marshal(&render)
+	if err != nil {
+		log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+func validate(req RenderRequest) error {
+	if req.FadeInMs < 0 || req.FadeOutMs < 0 || req.FadeInMs > maxFadeMs || req.FadeOutMs > maxFadeMs {
+		return fmt.Errorf("fades must be between 0 and %d ms", maxFadeMs)
+	}
+	if req.Format == opus {
+		if req.FadeInMs != 0 || req.FadeOutMs != 0 {
+			return errors.New("fades are not supported for opus")
+		}
+		if req.BitDepth != 0 {
+			return errors.New("bitDepth is not supported for opus")
+		}
+		return nil
+	}
+	c := audio.Container(req.Format)
+	if c != audio.WAV && c != audio.FLAC {
+		return fmt.Errorf("unsupported format %q", req.Format)
+	}
+	f := audio.Format{SampleRate: 48000, Channels: 1, BitDepth: req.BitDepth}
+	if f.BitDepth == 0 {
+		f.BitDepth = 24
+	}
+	return audio.Validate(c, f)
+}
+
+// load gets a clip and its sound, returning a nil clip if either is missing
+// or the sound belongs to another user.
+func (h handler) load(clipId, user string) (*Clip, *Sound, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.clipsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: clipId},
+		},
+	})
+	if err != nil || res.Item == nil {
+		return nil, nil, err
+	}
+	var clip Clip
+	if err := attributevalue.UnmarshalMap(res.Item, &clip); err != nil {
+		return nil, nil, err
+	}
+	if clip.User != "" && clip.User != user {
+		return nil, nil, nil
+	}
+
+	res, err = h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: clip.Sound},
+		},
+	})
+	if err != nil || res.Item == nil {
+		return nil, nil, err
+	}
+	var sound Sound
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		return nil, nil, err
+	}
+	return &clip, &sound, nil
+}
+
+// renderPCM cuts the clip out of the original upload at its own sample rate.
+func (h handler) renderPCM(w io.WriteSeeker, clip *Clip, sound *Sound, req RenderRequest) (Render, error) {
+	src, err := s3io.Open(context.TODO(), h.s3Cl, sound.Bucket, sound.Key)
+	if err != nil {
+		return Render{}, err
+	}
+	dec, err := audio.Open(src, src.Size())
+	if err != nil {
+		return Render{}, err
+	}
+
+	in := dec.Format()
+	rate := int64(in.SampleRate)
+	start := timebase.Convert(clip.Start, clip.Hz, rate, timebase.Nearest)
+	end := timebase.Convert(clip.End, clip.Hz, rate, timebase.Nearest)
+	if n := dec.Frames(); n >= 0 && start >= n {
+		return Render{}, errRender{"clip starts after the end of the sound"}
+	}
+	if end <= start {
+		return Render{}, errRender{"clip is shorter than a sample"}
+	}
+
+	var d audio.Decoder
+	if d, err = audio.Section(dec, start, end); err != nil {
+		return Render{}, err
+	}
+	if req.FadeInMs != 0 || req.FadeOutMs != 0 {
+		in, out := int64(req.FadeInMs)*rate/1000, int64(req.FadeOutMs)*rate/1000
+		if in+out > d.Frames() {
+			return Render{}, errRender{"fades are longer than the clip"}
+		}
+		if d, err = audio.Fade(d, in, out); err != nil {
+			return Render{}, err
+		}
+	}
+
+	c := audio.Container(req.Format)
+	bitDepth := req.BitDepth
+	if bitDepth == 0 {
+		bitDepth = in.BitDepth
+		if in.Float || audio.Validate(c, audio.Format{SampleRate: in.SampleRate, Channels: in.Channels, BitDepth: bitDepth}) != nil {
+			bitDepth = 24
+		}
+	}
+
+	frames := d.Frames()
+	if err := audio.Convert(w, d, c, in.SampleRate, bitDepth); err != nil {
+		return Render{}, err
+	}
+	return Render{Format: string(c), Frames: frames, Hz: in.SampleRate}, nil
+}
+
+// renderOpus copies the clip's packets out of the playback stream into an
+// Ogg Opus file without re-encoding. Packets are cut on 2.5 ms boundaries
+// and the pre-skip and final granule position trim the decoded audio to the
+// exact clip.
+func (h handler) renderOpus(w io.Writer, clip *Clip, sound *Sound) (Render, error) {
+	key := path.Join("stream", sound.Key, sound.Key+"_stream_96k")
+	src, err := s3io.Open(context.TODO(), h.s3Cl, sound.Bucket, key)
+	var nsk *s3Types.NotFound
+	if errors.As(err, &nsk) {
+		return Render{}, errRender{"sound has no opus stream yet"}
+	}
+	if err != nil {
+		return Render{}, err
+	}
+	st, err := stream.New(src, src.Size())
+	if err != nil {
+		return Render{}, err
+	}
+
+	start := timebase.Convert(clip.Start, clip.Hz, stream.SampleRate, timebase.Nearest)
+	end := timebase.Convert(clip.End, clip.Hz, stream.SampleRate, timebase.Nearest)
+	if max := int64(st.Len()) * stream.FrameSize; end > max {
+		end = max
+	}
+	if end <= start {
+		return Render{}, errRender{"clip is outside the opus stream"}
+	}
+
+	first := timebase.Packet(start-opusPreroll, stream.SampleRate)
+	if first < 0 {
+		first = 0
+	}
+	last := timebase.PacketEnd(end, stream.SampleRate)
+	pkts, err := st.Packets(int(first), int(last))
+	if err != nil {
+		return Render{}, err
+	}
+
+	channels := 0
+	var data [][]byte
+	for _, p := range pkts {
+		if p.Encoding != stream.EncodingOpus {
+			continue
+		}
+		if channels == 0 {
+			channels = p.Channels
+		}
+		data = append(data, p.Data)
+	}
+	if channels == 0 {
+		return Render{}, errRender{"opus stream has no audio for the clip"}
+	}
+	if len(data) != len(pkts) {
+		// Dropped packets would shift everything after them.
+		return Render{}, errRender{"opus stream is not contiguous over the clip"}
+	}
+
+	base := first * stream.FrameSize
+	ow, err := ogg.NewOpusWriter(w, crc32.ChecksumIEEE([]byte(clip.Key)), channels, int(start-base), stream.SampleRate)
+	if err != nil {
+		return Render{}, err
+	}
+	for _, p := range data {
+		if err := ow.WritePacket(p, stream.FrameSize); err != nil {
+			return Render{}, err
+		}
+	}
+	if err := ow.Close(end - base); err != nil {
+		return Render{}, err
+	}
+	return Render{Format: opus, Frames: end - start, Hz: stream.SampleRate}, nil
+}
+
+func (h handler) upload(f *os.File, clip *Clip, render Render) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	ext, contentType := ".opus", "audio/ogg"
+	if render.Format != opus {
+		c := audio.Container(render.Format)
+		ext, contentType = c.Ext(), c.ContentType()
+	}
+	// A fresh key per render keeps concurrent renders of one clip apart.
+	object := path.Join("renders", clip.Key, ksuid.New().String()+ext)
+
+	_, err := h.uploader.Upload(context.TODO(), &s3.PutObjectInput{
+		Bucket:      &h.exportsBucket,
+		Key:         &object,
+		Body:        f,
+		ContentType: &contentType,
+	})
+	return object, err
+}
+
+// renderFilename names a render after its sound and the clip's name, or its
+// position when it has none.
+func renderFilename(sound *Sound, clip *Clip, format string) string {
+	stem := sound.Filename
+	if stem == "" {
+		stem = sound.Key
+	}
+	stem = strings.TrimSuffix(stem, path.Ext(stem))
+
+	name := clip.Name
+	if name == "" {
+		name = fmt.Sprintf("%.3f-%.3f", timebase.Seconds(clip.Start, clip.Hz), timebase.Seconds(clip.End, clip.Hz))
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, name)
+
+	ext := ".opus"
+	if format != opus {
+		ext = audio.Container(format).Ext()
+	}
+	return fmt.Sprintf("%s - %s%s", stem, name, ext)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/collections"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	store := collections.New(dynamodb.NewFromConfig(cfg), os.Getenv("COLLECTIONS_TABLE_NAME"),
+		os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("CLIPS_TABLE_NAME"))
+
+	h := handler{store, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	store *collections.Store
+	log   *zerolog.Logger
+}
+
+// Request is the body of PUT /collections/{collectionId}/items.
+type Request struct {
+	Items []string `json:"items"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+	// Collection is the collection as it is now, when its items changed.
+	Collection *collections.View `json:"collection,omitempty"`
+}
+
+// PUT /collections/{collectionId}/items reorders the user's collection to
+// {"items": [key, ...]} and returns it. Items left out, like ones in the
+// trash, keep their order after the ones listed. A key that isn't in the
+// collection, because the item was removed since it was read, is a 409
+// with the collection as it is now.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	collectionId := event.PathParameters["collectionId"]
+	if collectionId == "" {
+		h.log.Error().Msgf("Cannot get collectionid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	var req Request
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+		return h.respond(http.StatusBadRequest, &ErrorResponse{
+			Message: "Invalid JSON body",
+		}), nil
+	}
+
+	c, err := h.store.Reorder(ctx, user, collectionId, req.Items)
+	if errors.Is(err, collections.ErrChanged) {
+		res := ErrorResponse{Message: "Items have been changed since they were read"}
+		if v, err := h.store.View(ctx, user, c); err == nil {
+			res.Collection = v
+		}
+		return h.respond(http.StatusConflict, &res), nil
+	}
+	if errors.Is(err, collections.ErrBusy) {
+		return h.respond(http.StatusConflict, &ErrorResponse{
+			Message: err.Error(),
+		}), nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error reordering collection")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if c == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	v, err := h.store.View(ctx, user, c)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error resolving collection items")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	return h.respond(http.StatusOK, v), nil
+}
+
+// respond writes v as the JSON body of a response with the given status.
+func (h handler) respond(status int, v interface{}) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(v)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
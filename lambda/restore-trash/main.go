@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+
+	h := handler{dbCl, formatsTbl, clipsTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	formatsTbl string
+	clipsTbl   string
+	log        *zerolog.Logger
+}
+
+type Sound struct {
+	Key       string `dynamodbav:"key"`
+	Deleting  string `dynamodbav:"deleting"`
+	TrashedAt int64  `dynamodbav:"trashedAt"`
+}
+
+type Clip struct {
+	Key       string `dynamodbav:"key"`
+	Sound     string `dynamodbav:"sound"`
+	User      string `dynamodbav:"user"`
+	Version   int64  `dynamodbav:"version"`
+	TrashedAt int64  `dynamodbav:"trashedAt"`
+}
+
+// Restored is the item brought back from the trash.
+type Restored struct {
+	Type    string `json:"type"`
+	Key     string `json:"key"`
+	Version int64  `json:"version,omitempty"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+// POST /trash/{key}/restore brings a sound or clip back out of the trash.
+// The key may name either; the user's sounds are looked in first. A clip
+// can't be restored while its sound is in the trash or being deleted.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	key := event.PathParameters["key"]
+	if key == "" {
+		h.log.Error().Msgf("Cannot get key from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	sound, err := h.getSound(user, key)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if sound != nil {
+		return h.restoreSound(user, sound), nil
+	}
+
+	clip, err := h.getClip(user, key)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting clip from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if clip == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	return h.restoreClip(user, clip), nil
+}
+
+func (h handler) restoreSound(user string, sound *Sound) events.APIGatewayV2HTTPResponse {
+	if sound.Deleting != "" {
+		return h.errorResponse(http.StatusConflict, "Sound is being deleted")
+	}
+	if sound.TrashedAt == 0 {
+		return h.errorResponse(http.StatusConflict, "Sound is not in the trash")
+	}
+
+	upd := expression.Remove(expression.Name("trashedAt")).
+		Remove(expression.Name("trashed"))
+	cond := expression.AttributeExists(expression.Name("trashedAt")).
+		And(expression.AttributeNotExists(expression.Name("deleting")))
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error building expression")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	_, err = h.dbCl.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: sound.Key},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		// Restored by another request, or purged in the meantime.
+		return h.errorResponse(http.StatusConflict, "Sound is not in the trash")
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error restoring sound")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	h.log.Info().Str("sound", sound.Key).Msg("Restored sound from trash")
+
+	return h.response(Restored{Type: "sound", Key: sound.Key})
+}
+
+func (h handler) restoreClip(user string, clip *Clip) events.APIGatewayV2HTTPResponse {
+	if clip.TrashedAt == 0 {
+		return h.errorResponse(http.StatusConflict, "Clip is not in the trash")
+	}
+	sound, err := h.getSound(user, clip.Sound)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	if sound == nil || sound.Deleting != "" {
+		return h.errorResponse(http.StatusConflict, "Clip's sound has been deleted")
+	}
+	if sound.TrashedAt != 0 {
+		return h.errorResponse(http.StatusConflict, "Clip's sound is in the trash")
+	}
+
+	// Restoring is a write like any other, so it bumps the version.
+	upd := expression.Remove(expression.Name("trashedAt")).
+		Remove(expression.Name("trashed")).
+		Set(expression.Name("version"), expression.Value(clip.Version+1))
+	cond := expression.Name("trashedAt").Equal(expression.Value(clip.TrashedAt))
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error building expression")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	_, err = h.dbCl.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: &h.clipsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: clip.Key},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return h.errorResponse(http.StatusConflict, "Clip is not in the trash")
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error restoring clip")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	h.log.Info().Str("clip", clip.Key).Msg("Restored clip from trash")
+
+	return h.response(Restored{Type: "clip", Key: clip.Key, Version: clip.Version + 1})
+}
+
+// getSound returns the user's sound, or nil if there is no such sound.
+func (h handler) getSound(user, soundId string) (*Sound, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var sound Sound
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		return nil, err
+	}
+	return &sound, nil
+}
+
+// getClip returns the user's clip, or nil if it is missing or belongs to
+// another user. Trashing a clip records its owner, so clips without one
+// can't be in the trash and are left to restoreClip to turn away.
+func (h handler) getClip(user, clipId string) (*Clip, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.clipsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: clipId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var clip Clip
+	if err := attributevalue.UnmarshalMap(res.Item, &clip); err != nil {
+		return nil, err
+	}
+	if clip.User != "" && clip.User != user {
+		return nil, nil
+	}
+	if clip.User == "" {
+		sound, err := h.getSound(user, clip.Sound)
+		if err != nil || sound == nil {
+			return nil, err
+		}
+	}
+	return &clip, nil
+}
+
+func (h handler) response(r Restored) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(&r)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
+
+func (h handler) errorResponse(status int, message string) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(&ErrorResponse{Message: message})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshalling error response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: status,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/search"
+	"wavey.ai/pkg/similar"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+
+	invocationId := ksuid.New().String()
+	log := log.With().Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	s3Cl := s3.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	bucket := os.Getenv("SEARCH_BUCKET_NAME")
+
+	h := handler{
+		search.NewStore(dbCl, s3Cl, formatsTbl, bucket),
+		similar.NewStore(dbCl, s3Cl, formatsTbl, bucket),
+		&log,
+	}
+
+	lambda.Start(h.handler)
+}
+
+type handler struct {
+	store   *search.Store
+	similar *similar.Store
+	log     *zerolog.Logger
+}
+
+// handler keeps the search and similarity indexes in step with the formats
+// table. Every change to a sound, from the upload pipeline writing it to
+// tagging, trashing and deleting it, arrives on the table's stream, and
+// each user whose sounds changed has their indexes rebuilt once per batch.
+// Rebuilds read the table as it is now, so a rebuild that fails is simply
+// retried with the batch.
+func (h handler) handler(ctx context.Context, evt events.DynamoDBEvent) error {
+	users := map[string]bool{}
+	for _, rec := range evt.Records {
+		if user, ok := rec.Change.Keys["user"]; ok {
+			users[user.String()] = true
+		}
+	}
+
+	for user := range users {
+		idx, err := h.store.Rebuild(ctx, user)
+		if err != nil {
+			h.log.Error().Err(err).Str("user", user).Msg("Error rebuilding search index")
+			return fmt.Errorf("rebuilding index for %s: %w", user, err)
+		}
+		h.log.Info().Str("user", user).Msgf("Indexed %d sounds", len(idx.Docs))
+
+		sim, err := h.similar.Rebuild(ctx, user)
+		if err != nil {
+			h.log.Error().Err(err).Str("user", user).Msg("Error rebuilding similarity index")
+			return fmt.Errorf("rebuilding similarity index for %s: %w", user, err)
+		}
+		h.log.Info().Str("user", user).Msgf("Indexed features of %d sounds", len(sim.Docs))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/search"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	store := search.NewStore(dynamodb.NewFromConfig(cfg), s3.NewFromConfig(cfg),
+		os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("SEARCH_BUCKET_NAME"))
+
+	h := handler{store, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	store *search.Store
+	log   *zerolog.Logger
+}
+
+// GET /search searches the user's sounds. Query parameters:
+//
+//	q         words to find in the filename, title, artist, comment and
+//	          tags; "field:word" looks in one of those fields only, and
+//	          the last word also matches as a prefix
+//	tag       only sounds with all of these tags
+//	key       only sounds in any of these musical keys
+//	format    only sounds in any of these formats
+//	bpm       only sounds with a tempo in this range, e.g. 120..128
+//	duration  only sounds of a length in seconds in this range, e.g. ..10
+//	limit     hits per page, up to 200 (default 50)
+//	offset    hits to skip
+//
+// List parameters are comma-separated or repeated. The response has the
+// total number of matches, a page of hits with their scores, and facets
+// counting the matches by tag, key, format, tempo and length.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	params := event.QueryStringParameters
+	q := search.Query{
+		Text:    params["q"],
+		Tags:    list(params["tag"]),
+		Keys:    list(params["key"]),
+		Formats: list(params["format"]),
+		Limit:   defaultLimit,
+	}
+	var err error
+	if q.BPM, err = search.ParseRange(params["bpm"]); err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "bpm: " + err.Error(),
+		}, nil
+	}
+	if q.Duration, err = search.ParseRange(params["duration"]); err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "duration: " + err.Error(),
+		}, nil
+	}
+	if s := params["limit"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxLimit {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "limit must be between 1 and " + strconv.Itoa(maxLimit),
+			}, nil
+		}
+		q.Limit = n
+	}
+	if s := params["offset"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "offset must be a number of hits",
+			}, nil
+		}
+		q.Offset = n
+	}
+
+	idx, err := h.store.Load(ctx, user)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error loading search index")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	res := idx.Search(q)
+
+	b, err := json.Marshal(&res)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// list splits a list parameter. API Gateway joins repeated query
+// parameters with commas.
+func list(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
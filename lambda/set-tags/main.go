@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/tagging"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
+	tagger := tagging.New(dbCl, os.Getenv("TAGS_TABLE_NAME"), os.Getenv("TAGGINGS_TABLE_NAME"), formatsTbl, clipsTbl)
+
+	h := handler{dbCl, tagger, formatsTbl, clipsTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	tagger     *tagging.Tagger
+	formatsTbl string
+	clipsTbl   string
+	log        *zerolog.Logger
+}
+
+type Request struct {
+	Tags []string `json:"tags"`
+}
+
+type Response struct {
+	Tags []string `json:"tags"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+	// Tags are the item's tags when they changed since they were read.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// row is the part of a formats or clips row that tagging looks at.
+type row struct {
+	Key       string   `dynamodbav:"key"`
+	Sound     string   `dynamodbav:"sound"`
+	User      string   `dynamodbav:"user"`
+	Tags      []string `dynamodbav:"tags"`
+	Deleting  string   `dynamodbav:"deleting"`
+	TrashedAt int64    `dynamodbav:"trashedAt"`
+}
+
+// PUT /sounds/{soundId}/tags and PUT /clips/{clipId}/tags replace the tags
+// on a sound or clip with {"tags": [...]}. Tags are normalised to lower
+// case with single spaces, and returned as stored. If the tags change
+// while the request is handled the response is a 409 with the tags as
+// they now are.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	it := tagging.Item{Kind: tagging.KindSound, Key: event.PathParameters["soundId"]}
+	if it.Key == "" {
+		it = tagging.Item{Kind: tagging.KindClip, Key: event.PathParameters["clipId"]}
+	}
+	if it.Key == "" {
+		h.log.Error().Msgf("Cannot get item key from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	var req Request
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+		return h.errorResponse(http.StatusBadRequest, ErrorResponse{
+			Message: "Invalid JSON body",
+		}), nil
+	}
+	tags, err := tagging.NormalizeAll(req.Tags)
+	if err != nil {
+		return h.errorResponse(http.StatusUnprocessableEntity, ErrorResponse{
+			Message: err.Error(),
+		}), nil
+	}
+
+	current, err := h.load(user, it)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting item from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if current == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+
+	err = h.tagger.Set(ctx, user, it, current.Tags, tags)
+	if errors.Is(err, tagging.ErrChanged) {
+		h.log.Info().Str(it.Kind, it.Key).Msg("Lost tagging race")
+		now, _ := h.load(user, it)
+		res := ErrorResponse{Message: "Tags have been changed since they were read"}
+		if now != nil {
+			res.Tags = now.Tags
+		}
+		return h.errorResponse(http.StatusConflict, res), nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error setting tags")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	h.log.Info().Str(it.Kind, it.Key).Strs("tags", tags).Msg("Set tags")
+
+	b, err := json.Marshal(&Response{Tags: tags})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// load gets the user's sound or clip, returning nil if it is missing, in
+// the trash, being deleted or belongs to another user. Clips without an
+// owner belong to the owner of their sound.
+func (h handler) load(user string, it tagging.Item) (*row, error) {
+	if it.Kind == tagging.KindSound {
+		return h.getSound(user, it.Key)
+	}
+
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.clipsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: it.Key},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var clip row
+	if err := attributevalue.UnmarshalMap(res.Item, &clip); err != nil {
+		return nil, err
+	}
+	if clip.TrashedAt != 0 || clip.User != "" && clip.User != user {
+		return nil, nil
+	}
+	sound, err := h.getSound(user, clip.Sound)
+	if err != nil || sound == nil {
+		return nil, err
+	}
+	return &clip, nil
+}
+
+func (h handler) getSound(user, soundId string) (*row, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var sound row
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		return nil, err
+	}
+	if sound.Deleting != "" || sound.TrashedAt != 0 {
+		return nil, nil
+	}
+	return &sound, nil
+}
+
+func (h handler) errorResponse(status int, body ErrorResponse) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(&body)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshalling error response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: status,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
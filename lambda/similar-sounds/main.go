@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/features"
+	"wavey.ai/pkg/similar"
+)
+
+const (
+	defaultLimit = 10
+	maxLimit     = 100
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	store := similar.NewStore(dbCl, s3.NewFromConfig(cfg), formatsTbl, os.Getenv("SEARCH_BUCKET_NAME"))
+
+	h := handler{dbCl, store, formatsTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	store      *similar.Store
+	formatsTbl string
+	log        *zerolog.Logger
+}
+
+type Sound struct {
+	Key       string             `dynamodbav:"key"`
+	Deleting  string             `dynamodbav:"deleting"`
+	TrashedAt int64              `dynamodbav:"trashedAt"`
+	Features  *features.Features `dynamodbav:"features"`
+}
+
+type Response struct {
+	Key     string              `json:"key"`
+	Similar []similar.Neighbour `json:"similar"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+// GET /sounds/{soundId}/similar returns the sounds in the user's library
+// that sound most like this one, nearest first, with their distances.
+// limit sets how many, up to 100 (default 10). A sound still being
+// processed, or one the features couldn't be read from, has no matches yet
+// and is a 409.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	soundId := event.PathParameters["soundId"]
+	if soundId == "" {
+		h.log.Error().Msgf("Cannot get soundid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	limit := defaultLimit
+	if s := event.QueryStringParameters["limit"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxLimit {
+			return events.APIGatewayV2HTTPResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "limit must be between 1 and " + strconv.Itoa(maxLimit),
+			}, nil
+		}
+		limit = n
+	}
+
+	sound, err := h.getSound(ctx, user, soundId)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting sound from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if sound == nil || sound.Deleting != "" || sound.TrashedAt != 0 {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+		}, nil
+	}
+	if !sound.Features.Valid() {
+		return h.errorResponse(http.StatusConflict, "Sound has not been analysed"), nil
+	}
+
+	idx, err := h.store.Load(ctx, user)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error loading similarity index")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	// The sound's own vector is used rather than the index's copy, so a
+	// sound analysed since the index was last rebuilt can still be matched.
+	res := Response{
+		Key:     soundId,
+		Similar: idx.Find(sound.Features.Values, soundId, limit),
+	}
+
+	b, err := json.Marshal(&res)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+func (h handler) getSound(ctx context.Context, user, soundId string) (*Sound, error) {
+	res, err := h.dbCl.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: soundId},
+		},
+		ProjectionExpression: aws.String("#key, deleting, trashedAt, features"),
+		ExpressionAttributeNames: map[string]string{
+			"#key": "key",
+		},
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	var sound Sound
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		return nil, err
+	}
+	return &sound, nil
+}
+
+func (h handler) errorResponse(status int, message string) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(&ErrorResponse{Message: message})
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshalling error response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: status,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
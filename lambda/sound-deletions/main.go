@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/collections"
+	"wavey.ai/pkg/details"
+	"wavey.ai/pkg/tagging"
+)
+
+// maxBatchWrite is the most requests DynamoDB takes in one BatchWriteItem.
+const maxBatchWrite = 25
+
+// maxUnprocessedRetries bounds the retries of throttled batch deletes
+// before the job is left for SQS to redeliver.
+const maxUnprocessedRetries = 5
+
+// derivedPrefixes are where the renditions and analyses of a sound are
+// written, each followed by the sound key.
+var derivedPrefixes = []string{"stream", "av", "png-fs8"}
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+
+	invocationId := ksuid.New().String()
+	log := log.With().Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	h := handler{
+		dbCl,
+		s3.NewFromConfig(cfg),
+		sns.NewFromConfig(cfg),
+		os.Getenv("JOBS_TABLE_NAME"),
+		os.Getenv("CLIPS_TABLE_NAME"),
+		os.Getenv("UPLOADS_TABLE_NAME"),
+		os.Getenv("FORMATS_TABLE_NAME"),
+		os.Getenv("TOPIC_ARN"),
+		tagging.New(dbCl, os.Getenv("TAGS_TABLE_NAME"), os.Getenv("TAGGINGS_TABLE_NAME"),
+			os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("CLIPS_TABLE_NAME")),
+		collections.New(dbCl, os.Getenv("COLLECTIONS_TABLE_NAME"),
+			os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("CLIPS_TABLE_NAME")),
+		details.New(dbCl, os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("HISTORY_TABLE_NAME")),
+		&log,
+	}
+
+	lambda.Start(h.handler)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	s3Cl       *s3.Client
+	snsCl      *sns.Client
+	jobsTbl    string
+	clipsTbl   string
+	uploadsTbl string
+	formatsTbl string
+	topicArn   string
+	tagger     *tagging.Tagger
+	colls      *collections.Store
+	details    *details.Store
+	log        *zerolog.Logger
+}
+
+type Message struct {
+	Job string `json:"job"`
+}
+
+type Job struct {
+	Key    string `dynamodbav:"key"`
+	User   string `dynamodbav:"user"`
+	Status string `dynamodbav:"status"`
+	Sound  string `dynamodbav:"sound"`
+	Bucket string `dynamodbav:"bucket"`
+	Topic  string `dynamodbav:"topic"`
+}
+
+// Event is published when a deletion starts, finishes or fails: to the
+// job's topic, and once the sound is gone to "sounds/<soundId>" as well.
+type Event struct {
+	Type   string `json:"type"`
+	Job    string `json:"job"`
+	Sound  string `json:"sound"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Notification is the message format ws-pub fans out to subscribers.
+type Notification struct {
+	Topic string `json:"topic"`
+	Data  Event  `json:"data"`
+}
+
+// handler deletes sounds. Every step can be repeated, and the formats row
+// that marks the sound as being deleted goes last, so a job that fails
+// part way is retried from the top by SQS redelivery, or by the owner
+// sending DELETE again, until nothing of the sound is left.
+func (h handler) handler(evt events.SQSEvent) error {
+	for _, message := range evt.Records {
+		var msg Message
+		if err := json.Unmarshal([]byte(message.Body), &msg); err != nil {
+			h.log.Error().Msgf("Error unmarshalling SQS message: %v", err)
+			continue
+		}
+
+		res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+			TableName: &h.jobsTbl,
+			Key: map[string]dynamodbTypes.AttributeValue{
+				"key": &dynamodbTypes.AttributeValueMemberS{Value: msg.Job},
+			},
+		})
+		if err != nil {
+			h.log.Err(err).Msg("Error getting job from DynamoDB")
+			return err
+		}
+		if res.Item == nil {
+			h.log.Error().Str("job", msg.Job).Msg("Job not found")
+			continue
+		}
+
+		var job Job
+		if err := attributevalue.UnmarshalMap(res.Item, &job); err != nil {
+			h.log.Err(err).Msg("Error unmarshaling job")
+			continue
+		}
+		if job.Status == "done" {
+			// Redelivered after completing.
+			continue
+		}
+
+		log := h.log.With().Str("job", job.Key).Str("sound", job.Sound).Logger()
+
+		if err := h.update(job.Key, "running", nil); err != nil {
+			return err
+		}
+		h.publish(job.Topic, Event{Type: "progress", Job: job.Key, Sound: job.Sound, Status: "running"})
+
+		if err := h.delete(job); err != nil {
+			log.Err(err).Msg("Deletion failed")
+			if err := h.update(job.Key, "failed", map[string]string{"error": err.Error()}); err != nil {
+				return err
+			}
+			h.publish(job.Topic, Event{Type: "failed", Job: job.Key, Sound: job.Sound, Status: "failed", Error: err.Error()})
+			// Left on the queue to be retried.
+			return err
+		}
+
+		if err := h.update(job.Key, "done", nil); err != nil {
+			return err
+		}
+		done := Event{Type: "deleted", Job: job.Key, Sound: job.Sound, Status: "done"}
+		h.publish(job.Topic, done)
+		h.publish("sounds/"+job.Sound, done)
+		log.Info().Msg("Sound deleted")
+	}
+	return nil
+}
+
+// delete removes the sound's clips, objects, uploads row, taggings and
+// places in collections, then its formats row. A conditional check failure
+// on the formats row means an earlier attempt already removed it.
+func (h handler) delete(job Job) error {
+	n, err := h.deleteClips(job.User, job.Sound)
+	if err != nil {
+		return fmt.Errorf("deleting clips: %w", err)
+	}
+	h.log.Info().Str("job", job.Key).Msgf("Deleted %d clips", n)
+
+	if job.Bucket != "" {
+		n, err := h.deleteObjects(job.Bucket, job.Sound)
+		if err != nil {
+			return fmt.Errorf("deleting objects: %w", err)
+		}
+		h.log.Info().Str("job", job.Key).Msgf("Deleted %d objects", n)
+	}
+
+	if _, err := h.dbCl.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: &h.uploadsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: job.Sound},
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: job.User},
+		},
+	}); err != nil {
+		return fmt.Errorf("deleting upload: %w", err)
+	}
+
+	if err := h.tagger.Untag(context.TODO(), job.Sound); err != nil {
+		return fmt.Errorf("untagging sound: %w", err)
+	}
+
+	if err := h.colls.RemoveEverywhere(context.TODO(), job.User, job.Sound); err != nil {
+		return fmt.Errorf("removing sound from collections: %w", err)
+	}
+
+	if err := h.details.Forget(context.TODO(), job.Sound); err != nil {
+		return fmt.Errorf("deleting sound history: %w", err)
+	}
+
+	// Only the deletion that marked the row may remove it.
+	cond := expression.Name("deleting").Equal(expression.Value(job.Key))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+	_, err = h.dbCl.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: job.User},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: job.Sound},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &ccf) {
+		return fmt.Errorf("deleting sound: %w", err)
+	}
+
+	// Sweep up clips written by requests that read the sound before it was
+	// marked.
+	if _, err := h.deleteClips(job.User, job.Sound); err != nil {
+		return fmt.Errorf("deleting clips: %w", err)
+	}
+	return nil
+}
+
+// deleteClips deletes every clip of the sound, returning how many there
+// were.
+func (h handler) deleteClips(user, soundId string) (int, error) {
+	indexName := "soundIndex"
+	keyEx := expression.Key("sound").Equal(expression.Value(soundId))
+	proj := expression.NamesList(expression.Name("key"))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithProjection(proj).Build()
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	p := dynamodb.NewQueryPaginator(h.dbCl, &dynamodb.QueryInput{
+		TableName:                 &h.clipsTbl,
+		IndexName:                 &indexName,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ProjectionExpression:      expr.Projection(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(context.TODO())
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range res.Items {
+			if k, ok := item["key"].(*dynamodbTypes.AttributeValueMemberS); ok {
+				keys = append(keys, k.Value)
+			}
+		}
+	}
+
+	for i := 0; i < len(keys); i += maxBatchWrite {
+		end := i + maxBatchWrite
+		if end > len(keys) {
+			end = len(keys)
+		}
+		// Like untagging, taken out of collections before the clips go.
+		if err := h.colls.RemoveEverywhere(context.TODO(), user, keys[i:end]...); err != nil {
+			return 0, err
+		}
+		reqs := make([]dynamodbTypes.WriteRequest, 0, end-i)
+		for _, k := range keys[i:end] {
+			// Untagged first, so a retry still finds the clip to untag.
+			if err := h.tagger.Untag(context.TODO(), k); err != nil {
+				return 0, err
+			}
+			reqs = append(reqs, dynamodbTypes.WriteRequest{
+				DeleteRequest: &dynamodbTypes.DeleteRequest{
+					Key: map[string]dynamodbTypes.AttributeValue{
+						"key": &dynamodbTypes.AttributeValueMemberS{Value: k},
+					},
+				},
+			})
+		}
+		if err := h.batchWrite(h.clipsTbl, reqs); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// batchWrite runs write requests against one table, retrying those that
+// DynamoDB hands back unprocessed.
+func (h handler) batchWrite(table string, reqs []dynamodbTypes.WriteRequest) error {
+	for attempt := 0; len(reqs) > 0; attempt++ {
+		if attempt > maxUnprocessedRetries {
+			return errors.New("batch write still unprocessed after retries")
+		}
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * 50 * time.Millisecond)
+		}
+		res, err := h.dbCl.BatchWriteItem(context.TODO(), &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]dynamodbTypes.WriteRequest{table: reqs},
+		})
+		if err != nil {
+			return err
+		}
+		reqs = res.UnprocessedItems[table]
+	}
+	return nil
+}
+
+// deleteObjects deletes the uploaded original and everything under the
+// sound's derived prefixes, returning how many objects were deleted.
+func (h handler) deleteObjects(bucket, soundId string) (int, error) {
+	n := 0
+	for _, prefix := range derivedPrefixes {
+		prefix := path.Join(prefix, soundId) + "/"
+		p := s3.NewListObjectsV2Paginator(h.s3Cl, &s3.ListObjectsV2Input{
+			Bucket: &bucket,
+			Prefix: &prefix,
+		})
+		for p.HasMorePages() {
+			res, err := p.NextPage(context.TODO())
+			if err != nil {
+				return n, err
+			}
+			if len(res.Contents) == 0 {
+				continue
+			}
+			ids := make([]s3Types.ObjectIdentifier, len(res.Contents))
+			for i, o := range res.Contents {
+				ids[i] = s3Types.ObjectIdentifier{Key: o.Key}
+			}
+			if err := h.deleteBatch(bucket, ids); err != nil {
+				return n, err
+			}
+			n += len(ids)
+		}
+	}
+
+	// Deleting a missing key succeeds, so this is safe to repeat.
+	if _, err := h.s3Cl.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &soundId,
+	}); err != nil {
+		return n, err
+	}
+	return n + 1, nil
+}
+
+// deleteBatch deletes up to 1000 objects, failing if any could not be.
+func (h handler) deleteBatch(bucket string, ids []s3Types.ObjectIdentifier) error {
+	res, err := h.s3Cl.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+		Bucket: &bucket,
+		Delete: &s3Types.Delete{Objects: ids, Quiet: true},
+	})
+	if err != nil {
+		return err
+	}
+	if len(res.Errors) > 0 {
+		e := res.Errors[0]
+		return fmt.Errorf("%d objects not deleted, first %s: %s", len(res.Errors), *e.Key, *e.Message)
+	}
+	return nil
+}
+
+// publish sends an event to a websocket topic. Events are best effort;
+// clients can always poll GET /jobs/{jobId}.
+func (h handler) publish(topic string, e Event) {
+	if topic == "" || h.topicArn == "" {
+		return
+	}
+	b, err := json.Marshal(&Notification{Topic: topic, Data: e})
+	if err != nil {
+		h.log.Err(err).Msg("Error marshalling deletion event")
+		return
+	}
+	msg := string(b)
+	if _, err := h.snsCl.Publish(context.TODO(), &sns.PublishInput{
+		Message:  &msg,
+		TopicArn: &h.topicArn,
+	}); err != nil {
+		h.log.Err(err).Str("topic", topic).Msg("Error publishing deletion event")
+	}
+}
+
+// update sets the status of a job along with any extra string attributes.
+func (h handler) update(key, status string, attrs map[string]string) error {
+	upd := expression.Set(expression.Name("status"), expression.Value(status)).
+		Set(expression.Name("updatedAt"), expression.Value(time.Now().Unix()))
+	for k, v := range attrs {
+		upd = upd.Set(expression.Name(k), expression.Value(v))
+	}
+	expr, err := expression.NewBuilder().WithUpdate(upd).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = h.dbCl.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: &h.jobsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: key},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		h.log.Err(err).Str("job", key).Msg("Error updating job")
+	}
+	return err
+}
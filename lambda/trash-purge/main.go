@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/collections"
+	"wavey.ai/pkg/deletion"
+	"wavey.ai/pkg/tagging"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+
+	invocationId := ksuid.New().String()
+	log := log.With().Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	retentionDays, err := strconv.ParseInt(os.Getenv("TRASH_RETENTION_DAYS"), 10, 64)
+	if err != nil || retentionDays < 1 {
+		log.Fatal().Err(err).Msgf("Invalid TRASH_RETENTION_DAYS")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+
+	h := handler{
+		dbCl,
+		deletion.NewStarter(dbCl, sqs.NewFromConfig(cfg), formatsTbl,
+			os.Getenv("JOBS_TABLE_NAME"), os.Getenv("QUEUE_URL")),
+		formatsTbl,
+		os.Getenv("CLIPS_TABLE_NAME"),
+		tagging.New(dbCl, os.Getenv("TAGS_TABLE_NAME"), os.Getenv("TAGGINGS_TABLE_NAME"),
+			formatsTbl, os.Getenv("CLIPS_TABLE_NAME")),
+		collections.New(dbCl, os.Getenv("COLLECTIONS_TABLE_NAME"), formatsTbl, os.Getenv("CLIPS_TABLE_NAME")),
+		os.Getenv("TRASH_INDEX"),
+		time.Duration(retentionDays) * 24 * time.Hour,
+		&log,
+	}
+
+	lambda.Start(h.handler)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	starter    *deletion.Starter
+	formatsTbl string
+	clipsTbl   string
+	tagger     *tagging.Tagger
+	colls      *collections.Store
+	// trashIndex is the sparse index of trashed rows on both tables, or ""
+	// until the stack has it.
+	trashIndex string
+	retention  time.Duration
+	log        *zerolog.Logger
+}
+
+// Trashed is the part of a trashed sound or clip needed to purge it.
+// Indexed is set once the row carries the trashed attribute that puts it
+// in trashIndex.
+type Trashed struct {
+	User      string `dynamodbav:"user"`
+	Key       string `dynamodbav:"key"`
+	TrashedAt int64  `dynamodbav:"trashedAt"`
+	Indexed   int64  `dynamodbav:"trashed"`
+}
+
+// handler runs on a schedule and permanently deletes whatever has been in
+// the trash longer than the retention window. Sounds are handed to the
+// sound-deletions worker, which also removes their clips. Each purge is
+// conditional on the item still having been trashed at the same time, so
+// anything restored in the meantime is left alone. Failures are logged and
+// the rest carried on with; the next run picks them up again.
+func (h handler) handler(ctx context.Context, event events.CloudWatchEvent) error {
+	cutoff := time.Now().Add(-h.retention).Unix()
+	var failed int
+
+	sounds, err := h.trashed(ctx, h.formatsTbl, cutoff, true)
+	if err != nil {
+		return err
+	}
+	for _, s := range sounds {
+		job, err := h.starter.Start(ctx, s.User, s.Key, s.TrashedAt)
+		if errors.Is(err, deletion.ErrChanged) {
+			h.log.Info().Str("sound", s.Key).Msg("Sound changed since scan, skipping")
+			continue
+		}
+		if err != nil {
+			h.log.Error().Err(err).Str("sound", s.Key).Msg("Error starting deletion")
+			failed++
+			continue
+		}
+		if job != nil {
+			h.log.Info().Str("sound", s.Key).Str("job", job.Key).Msg("Purging sound")
+		}
+	}
+
+	clips, err := h.trashed(ctx, h.clipsTbl, cutoff, false)
+	if err != nil {
+		return err
+	}
+	for _, c := range clips {
+		deleted, err := h.deleteClip(c)
+		if err != nil {
+			h.log.Error().Err(err).Str("clip", c.Key).Msg("Error deleting clip")
+			failed++
+			continue
+		}
+		if !deleted {
+			// Restored since the scan, so its taggings still stand.
+			h.log.Info().Str("clip", c.Key).Msg("Clip changed since scan, skipping")
+			continue
+		}
+		h.log.Info().Str("clip", c.Key).Msg("Purged clip")
+		if err := h.tagger.Untag(ctx, c.Key); err != nil {
+			h.log.Error().Err(err).Str("clip", c.Key).Msg("Error untagging clip")
+		}
+		if err := h.colls.RemoveEverywhere(ctx, c.User, c.Key); err != nil {
+			h.log.Error().Err(err).Str("clip", c.Key).Msg("Error removing clip from collections")
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d purges failed", failed, len(sounds)+len(clips))
+	}
+	return nil
+}
+
+// trashed returns the items of tbl trashed before cutoff, from trashIndex
+// once the stack has it. Sounds already being deleted are left to their
+// job.
+func (h handler) trashed(ctx context.Context, tbl string, cutoff int64, sounds bool) ([]Trashed, error) {
+	if h.trashIndex == "" {
+		return h.scan(ctx, tbl, cutoff, sounds)
+	}
+
+	keyEx := expression.Key("trashed").Equal(expression.Value(1)).
+		And(expression.Key("trashedAt").LessThan(expression.Value(cutoff)))
+	proj := expression.NamesList(expression.Name("user"), expression.Name("key"), expression.Name("trashedAt"))
+	builder := expression.NewBuilder().WithKeyCondition(keyEx).WithProjection(proj)
+	if sounds {
+		builder = builder.WithFilter(expression.AttributeNotExists(expression.Name("deleting")))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []map[string]dynamodbTypes.AttributeValue
+	p := dynamodb.NewQueryPaginator(h.dbCl, &dynamodb.QueryInput{
+		TableName:                 &tbl,
+		IndexName:                 &h.trashIndex,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, res.Items...)
+	}
+
+	var trashed []Trashed
+	if err := attributevalue.UnmarshalListOfMaps(items, &trashed); err != nil {
+		return nil, err
+	}
+	return trashed, nil
+}
+
+// scan finds trashed items by scanning all of tbl, for stacks without
+// trashIndex. Rows trashed before the trashed attribute was written get it
+// on the way, so they are in the index once it is created.
+func (h handler) scan(ctx context.Context, tbl string, cutoff int64, sounds bool) ([]Trashed, error) {
+	filt := expression.AttributeExists(expression.Name("trashedAt"))
+	if sounds {
+		filt = filt.And(expression.AttributeNotExists(expression.Name("deleting")))
+	}
+	proj := expression.NamesList(expression.Name("user"), expression.Name("key"),
+		expression.Name("trashedAt"), expression.Name("trashed"))
+	expr, err := expression.NewBuilder().WithFilter(filt).WithProjection(proj).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []map[string]dynamodbTypes.AttributeValue
+	p := dynamodb.NewScanPaginator(h.dbCl, &dynamodb.ScanInput{
+		TableName:                 &tbl,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+	})
+	for p.HasMorePages() {
+		res, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, res.Items...)
+	}
+
+	var all, trashed []Trashed
+	if err := attributevalue.UnmarshalListOfMaps(items, &all); err != nil {
+		return nil, err
+	}
+	for _, t := range all {
+		if t.Indexed == 0 {
+			if err := h.index(ctx, tbl, t, sounds); err != nil {
+				h.log.Error().Err(err).Str("key", t.Key).Msg("Error marking trashed row")
+			}
+		}
+		if t.TrashedAt < cutoff {
+			trashed = append(trashed, t)
+		}
+	}
+	return trashed, nil
+}
+
+// index sets trashed on a row trashed before it was written, unless the
+// row has been restored or trashed again since the scan.
+func (h handler) index(ctx context.Context, tbl string, t Trashed, sound bool) error {
+	upd := expression.Set(expression.Name("trashed"), expression.Value(1))
+	cond := expression.Name("trashedAt").Equal(expression.Value(t.TrashedAt))
+	expr, err := expression.NewBuilder().WithUpdate(upd).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	key := map[string]dynamodbTypes.AttributeValue{
+		"key": &dynamodbTypes.AttributeValueMemberS{Value: t.Key},
+	}
+	if sound {
+		key["user"] = &dynamodbTypes.AttributeValueMemberS{Value: t.User}
+	}
+	_, err = h.dbCl.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 &tbl,
+		Key:                       key,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil
+	}
+	return err
+}
+
+// deleteClip removes a trashed clip unless it has been restored, or
+// restored and trashed again, since it was scanned, and reports whether it
+// did.
+func (h handler) deleteClip(c Trashed) (bool, error) {
+	cond := expression.Name("trashedAt").Equal(expression.Value(c.TrashedAt))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = h.dbCl.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: &h.clipsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: c.Key},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+	return err == nil, err
+}
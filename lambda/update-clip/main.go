@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/clips"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	tableName := os.Getenv("TABLE_NAME")
+	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+
+	h := handler{dbCl, tableName, formatsTbl, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	dbCl       *dynamodb.Client
+	tableName  string
+	formatsTbl string
+	log        *zerolog.Logger
+}
+
+// UpdateRequest is the body of PATCH /clips/{clipId}. Version must be the
+// version the client last read; absent fields are left unchanged.
+type UpdateRequest struct {
+	Version *int64    `json:"version"`
+	Start   *int64    `json:"start"`
+	End     *int64    `json:"end"`
+	Hz      *int64    `json:"hz"`
+	Name    *string   `json:"name"`
+	Colour  *string   `json:"colour"`
+	Notes   *string   `json:"notes"`
+	Labels  *[]string `json:"labels"`
+	Loop    *bool     `json:"loop"`
+}
+
+type Item struct {
+	Key     string   `json:"key" dynamodbav:"key"`
+	Sound   string   `json:"sound" dynamodbav:"sound"`
+	User    string   `json:"-" dynamodbav:"user"`
+	Start   int64    `json:"start" dynamodbav:"start"`
+	End     int64    `json:"end" dynamodbav:"end"`
+	Hz      int64    `json:"hz" dynamodbav:"hz"`
+	Name    string   `json:"name,omitempty" dynamodbav:"name"`
+	Colour  string   `json:"colour,omitempty" dynamodbav:"colour"`
+	Notes   string   `json:"notes,omitempty" dynamodbav:"notes"`
+	Labels  []string `json:"labels,omitempty" dynamodbav:"labels"`
+	Tags    []string `json:"tags,omitempty" dynamodbav:"tags"`
+	Loop    bool     `json:"loop,omitempty" dynamodbav:"loop"`
+	Version int64    `json:"version" dynamodbav:"version"`
+	// TrashedAt is set while the clip is in the trash.
+	TrashedAt int64 `json:"-" dynamodbav:"trashedAt"`
+}
+
+type ErrorResponse struct {
+	Message string             `json:"message"`
+	Errors  []clips.FieldError `json:"errors,omitempty"`
+	// Current is the stored clip when a write lost a race.
+	Current *Item `json:"current,omitempty"`
+}
+
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	clipId := event.PathParameters["clipId"]
+	if clipId == "" {
+		h.log.Error().Msgf("Cannot get clipid from request: %+v", event)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Bad Request",
+		}, nil
+	}
+
+	var req UpdateRequest
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshalling request body")
+		return h.errorResponse(http.StatusBadRequest, ErrorResponse{
+			Message: "Request body must be a JSON object",
+		}), nil
+	}
+	if req.Version == nil {
+		return h.errorResponse(http.StatusBadRequest, ErrorResponse{
+			Message: "version is required",
+		}), nil
+	}
+
+	clip, sound, err := h.load(clipId, user)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting clip from DynamoDB")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if clip == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	if clip.Version != *req.Version {
+		return h.errorResponse(http.StatusConflict, ErrorResponse{
+			Message: "Clip has been changed since it was read",
+			Current: clip,
+		}), nil
+	}
+
+	next := *clip
+	if req.Start != nil {
+		next.Start = *req.Start
+	}
+	if req.End != nil {
+		next.End = *req.End
+	}
+	if req.Hz != nil {
+		next.Hz = *req.Hz
+	}
+	if req.Name != nil {
+		next.Name = *req.Name
+	}
+	if req.Colour != nil {
+		next.Colour = clips.Colour(*req.Colour)
+	}
+	if req.Notes != nil {
+		next.Notes = *req.Notes
+	}
+	if req.Labels != nil {
+		next.Labels = clips.Labels(*req.Labels)
+	}
+	if req.Loop != nil {
+		next.Loop = *req.Loop
+	}
+	errs := clips.CheckRange(next.Start, next.End, next.Hz, sound)
+	errs = append(errs, clips.CheckMeta(next.Name, next.Colour, next.Notes, next.Labels)...)
+	if len(errs) > 0 {
+		return h.errorResponse(http.StatusUnprocessableEntity, ErrorResponse{
+			Message: "Invalid clip",
+			Errors:  errs,
+		}), nil
+	}
+
+	// Clips from before versions and owners were recorded are claimed by
+	// their first update.
+	upd := expression.Set(expression.Name("start"), expression.Value(next.Start)).
+		Set(expression.Name("end"), expression.Value(next.End)).
+		Set(expression.Name("hz"), expression.Value(next.Hz)).
+		Set(expression.Name("name"), expression.Value(next.Name)).
+		Set(expression.Name("colour"), expression.Value(next.Colour)).
+		Set(expression.Name("notes"), expression.Value(next.Notes)).
+		Set(expression.Name("labels"), expression.Value(clips.Labels(next.Labels))).
+		Set(expression.Name("loop"), expression.Value(next.Loop)).
+		Set(expression.Name("user"), expression.Value(user)).
+		Set(expression.Name("version"), expression.Value(clip.Version+1))
+	expr, err := expression.NewBuilder().
+		WithUpdate(upd).
+		WithCondition(clips.VersionCondition(clip.Version)).
+		Build()
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error building expression")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	res, err := h.dbCl.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: &h.tableName,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: clipId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ReturnValues:              dynamodbTypes.ReturnValueAllNew,
+	})
+	var ccf *dynamodbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		h.log.Info().Str("clip", clipId).Msg("Lost update race")
+		current, _, _ := h.load(clipId, user)
+		return h.errorResponse(http.StatusConflict, ErrorResponse{
+			Message: "Clip has been changed since it was read",
+			Current: current,
+		}), nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error updating clip")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	var item Item
+	if err := attributevalue.UnmarshalMap(res.Attributes, &item); err != nil {
+		h.log.Error().Err(err).Msg("Error unmarshaling dynamodb response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	b, err := json.Marshal(&item)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// load gets a clip and the sound it belongs to, returning a nil clip if
+// either is missing, in the trash or belongs to another user.
+func (h handler) load(clipId, user string) (*Item, *clips.Sound, error) {
+	res, err := h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.tableName,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"key": &dynamodbTypes.AttributeValueMemberS{Value: clipId},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, nil, err
+	}
+	var clip Item
+	if err := attributevalue.UnmarshalMap(res.Item, &clip); err != nil {
+		return nil, nil, err
+	}
+	if clip.TrashedAt != 0 || clip.User != "" && clip.User != user {
+		return nil, nil, nil
+	}
+
+	res, err = h.dbCl.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: &h.formatsTbl,
+		Key: map[string]dynamodbTypes.AttributeValue{
+			"user": &dynamodbTypes.AttributeValueMemberS{Value: user},
+			"key":  &dynamodbTypes.AttributeValueMemberS{Value: clip.Sound},
+		},
+	})
+	if err != nil || res.Item == nil {
+		return nil, nil, err
+	}
+	var sound clips.Sound
+	if err := attributevalue.UnmarshalMap(res.Item, &sound); err != nil {
+		return nil, nil, err
+	}
+	if sound.Deleting != "" || sound.TrashedAt != 0 {
+		return nil, nil, nil
+	}
+	return &clip, &sound, nil
+}
+
+func (h handler) errorResponse(status int, body ErrorResponse) events.APIGatewayV2HTTPResponse {
+	b, err := json.Marshal(&body)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshalling error response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: status,
+		}
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
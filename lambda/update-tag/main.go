@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/tagging"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	invocationId := ksuid.New().String()
+	log := log.With().
+		Str("invocationId", invocationId).Logger()
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Error loading SDK config")
+	}
+
+	dbCl := dynamodb.NewFromConfig(cfg)
+	tagger := tagging.New(dbCl, os.Getenv("TAGS_TABLE_NAME"), os.Getenv("TAGGINGS_TABLE_NAME"),
+		os.Getenv("FORMATS_TABLE_NAME"), os.Getenv("CLIPS_TABLE_NAME"))
+
+	h := handler{tagger, &log}
+
+	lambda.Start(h.handleRequest)
+}
+
+type handler struct {
+	tagger *tagging.Tagger
+	log    *zerolog.Logger
+}
+
+type Request struct {
+	Name string `json:"name"`
+}
+
+type Response struct {
+	tagging.Tag
+	// Merged is set when the tag was renamed to one already in use.
+	Merged bool `json:"merged"`
+}
+
+// PUT /tags/{tag} renames one of the user's tags with {"name": "..."},
+// rewriting every sound and clip that carries it. Renaming to a tag that
+// is already in use merges the two. Items are rewritten one at a time, so
+// a rename cut short by the timeout has done some of them; repeating the
+// request finishes the rest.
+func (h handler) handleRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	user, ok := event.RequestContext.Authorizer.JWT.Claims["cognito:username"]
+	if !ok {
+		h.log.Error().Msgf("Cannot get userid from JWT claims: %+v", event.RequestContext.Authorizer.JWT.Claims)
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	h.log.Info().Msgf("Got user %s from claims", user)
+
+	// Tags never contain %, so unescaping is safe whether or not API
+	// Gateway already has.
+	raw, err := url.PathUnescape(event.PathParameters["tag"])
+	if err != nil {
+		raw = ""
+	}
+	name, err := tagging.Normalize(raw)
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	var req Request
+	if err := json.Unmarshal([]byte(event.Body), &req); err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Invalid JSON body",
+		}, nil
+	}
+	to, err := tagging.Normalize(req.Name)
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusUnprocessableEntity,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	from, err := h.tagger.Get(ctx, user, name)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting tag")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if from == nil {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Not Found",
+		}, nil
+	}
+	existing, err := h.tagger.Get(ctx, user, to)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error getting tag")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	tag, err := h.tagger.Rename(ctx, user, name, to)
+	if errors.Is(err, tagging.ErrChanged) {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusConflict,
+			Body:       "Tagged items kept changing, try again",
+		}, nil
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error renaming tag")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+	if tag == nil {
+		// Every item lost the tag while it was being renamed.
+		tag = &tagging.Tag{Name: to}
+	}
+
+	res := Response{Tag: *tag, Merged: existing != nil && name != to}
+	h.log.Info().Str("from", name).Str("to", to).Bool("merged", res.Merged).Msg("Renamed tag")
+
+	b, err := json.Marshal(&res)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Error marshaling JSON response")
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusInternalServerError,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(b),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
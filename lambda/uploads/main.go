@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"strconv"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
@@ -19,8 +23,21 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/segmentio/ksuid"
+	"wavey.ai/pkg/audio"
+	"wavey.ai/pkg/features"
+	"wavey.ai/pkg/markers"
+	"wavey.ai/pkg/riff"
+	"wavey.ai/pkg/s3io"
+	"wavey.ai/pkg/tags"
 )
 
+// maxRawMetadata keeps the raw metadata JSON well inside the DynamoDB item
+// size limit.
+const maxRawMetadata = 64 << 10
+
+// maxMarkers caps the number of clips imported from a single file.
+const maxMarkers = 1000
+
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
@@ -39,6 +56,7 @@ func main() {
 	topicArn := os.Getenv("TOPIC_ARN")
 	uploadsTbl := os.Getenv("UPLOADS_TABLE_NAME")
 	formatsTbl := os.Getenv("FORMATS_TABLE_NAME")
+	clipsTbl := os.Getenv("CLIPS_TABLE_NAME")
 
 	h := handler{
 		dbCl,
@@ -47,6 +65,7 @@ func main() {
 		topicArn,
 		uploadsTbl,
 		formatsTbl,
+		clipsTbl,
 		&log,
 	}
 
@@ -60,6 +79,7 @@ type handler struct {
 	topicArn   string
 	uploadsTbl string
 	formatsTbl string
+	clipsTbl   string
 	log        *zerolog.Logger
 }
 
@@ -135,6 +155,34 @@ func (h handler) handler(evt events.SQSEvent) (msg string, err error) {
 				},
 			}
 
+			// Keys are ksuids, made when the upload started.
+			if id, err := ksuid.Parse(objectKey); err == nil {
+				input.Item["createdAt"] = &dynamodbTypes.AttributeValueMemberN{
+					Value: strconv.FormatInt(id.Time().Unix(), 10),
+				}
+			}
+
+			obj := s3io.NewReader(context.TODO(), h.s3cl, bucket, objectPath, record.S3.Object.Size)
+			if err := h.addMetadata(input.Item, obj); err != nil {
+				// non-fatal error
+				h.log.Err(err).Str("objectKey", objectKey).Msg("Error reading embedded metadata")
+			}
+
+			if err := h.addFormat(input.Item, obj); err != nil {
+				// non-fatal error
+				h.log.Err(err).Str("objectKey", objectKey).Msg("Error reading audio format")
+			}
+
+			if err := h.addFeatures(input.Item, obj); err != nil {
+				// non-fatal error
+				h.log.Err(err).Str("objectKey", objectKey).Msg("Error extracting audio features")
+			}
+
+			if err := h.importMarkers(items[0].User, objectKey, obj); err != nil {
+				h.log.Err(err).Str("objectKey", objectKey).Msg("Error importing markers")
+				return msg, err
+			}
+
 			if _, err := h.dbCl.PutItem(context.TODO(), input); err != nil {
 				log.Err(err).Msgf("Error putting to dynamo")
 				return msg, err
@@ -153,3 +201,210 @@ func (h handler) handler(evt events.SQSEvent) (msg string, err error) {
 	}
 	return
 }
+
+// addMetadata parses the tags embedded in the uploaded object and adds them
+// to the formats item: normalised fields under "metadata", everything else
+// as JSON under "rawMetadata".
+func (h handler) addMetadata(item map[string]dynamodbTypes.AttributeValue, obj *s3io.Reader) error {
+	meta, err := tags.Read(obj, obj.Size())
+	if err == tags.ErrUnsupported {
+		h.log.Info().Msg("No embedded metadata parser for upload")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	av, err := attributevalue.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	item["metadata"] = av
+
+	raw := meta.Raw
+	for len(raw) > 0 {
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		if len(b) <= maxRawMetadata {
+			item["rawMetadata"] = &dynamodbTypes.AttributeValueMemberS{
+				Value: string(b),
+			}
+			break
+		}
+		// Drop fields from the end until it fits.
+		raw = raw[:len(raw)-1]
+	}
+
+	return nil
+}
+
+// addFormat records the file format, sample rate, channel count and, where
+// the container declares it, the length in frames and seconds of the
+// upload on the formats item.
+func (h handler) addFormat(item map[string]dynamodbTypes.AttributeValue, obj *s3io.Reader) error {
+	format, err := audio.Sniff(obj, obj.Size())
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		h.log.Info().Msg("No decoder for upload")
+		return nil
+	}
+	item["format"] = &dynamodbTypes.AttributeValueMemberS{
+		Value: format,
+	}
+
+	dec, err := audio.Open(obj, obj.Size())
+	if errors.Is(err, audio.ErrUnsupported) {
+		h.log.Info().Msg("No decoder for upload")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f := dec.Format()
+	item["sampleRate"] = &dynamodbTypes.AttributeValueMemberN{
+		Value: strconv.Itoa(f.SampleRate),
+	}
+	item["channels"] = &dynamodbTypes.AttributeValueMemberN{
+		Value: strconv.Itoa(f.Channels),
+	}
+	if n := dec.Frames(); n > 0 {
+		item["frames"] = &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.FormatInt(n, 10),
+		}
+		item["duration"] = &dynamodbTypes.AttributeValueMemberN{
+			Value: strconv.FormatFloat(float64(n)/float64(f.SampleRate), 'f', 3, 64),
+		}
+	}
+	return nil
+}
+
+// addFeatures records the timbral feature vector of the upload on the
+// formats item, for finding similar sounds.
+func (h handler) addFeatures(item map[string]dynamodbTypes.AttributeValue, obj *s3io.Reader) error {
+	dec, err := audio.Open(obj, obj.Size())
+	if errors.Is(err, audio.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := features.Extract(dec)
+	if errors.Is(err, features.ErrSilent) || errors.Is(err, audio.ErrUnsupported) {
+		h.log.Info().Msg("No features for upload")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	av, err := attributevalue.Marshal(f)
+	if err != nil {
+		return err
+	}
+	item["features"] = av
+	return nil
+}
+
+// importMarkers creates a clip for each cue point, region and sampler loop in
+// an uploaded WAV file. Clip keys are derived from the sound key and marker
+// position, and a clip is only written if its key is new, so a redelivered
+// message neither duplicates clips nor undoes the user's edits to them.
+func (h handler) importMarkers(user, soundKey string, obj *s3io.Reader) error {
+	ms, hz, err := markers.ReadWAV(obj, obj.Size())
+	if errors.Is(err, riff.ErrFormat) || errors.Is(err, markers.ErrNotWAVE) {
+		return nil
+	}
+	if err != nil {
+		// An unreadable marker chunk shouldn't fail the upload.
+		h.log.Err(err).Str("objectKey", soundKey).Msg("Error reading markers")
+		return nil
+	}
+	if len(ms) == 0 || hz <= 0 {
+		return nil
+	}
+	if len(ms) > maxMarkers {
+		h.log.Warn().Msgf("Importing first %d of %d markers", maxMarkers, len(ms))
+		ms = ms[:maxMarkers]
+	}
+
+	sound, err := ksuid.Parse(soundKey)
+	if err != nil {
+		return err
+	}
+
+	var imported int
+	for i, m := range ms {
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s/%d/%d", soundKey, i, m.ID)))
+		id, err := ksuid.FromParts(sound.Time(), sum[:16])
+		if err != nil {
+			return err
+		}
+
+		item := map[string]dynamodbTypes.AttributeValue{
+			"sound": &dynamodbTypes.AttributeValueMemberS{
+				Value: soundKey,
+			},
+			"key": &dynamodbTypes.AttributeValueMemberS{
+				Value: id.String(),
+			},
+			"user": &dynamodbTypes.AttributeValueMemberS{
+				Value: user,
+			},
+			"start": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.FormatInt(m.Start, 10),
+			},
+			"end": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.FormatInt(m.End, 10),
+			},
+			"hz": &dynamodbTypes.AttributeValueMemberN{
+				Value: strconv.Itoa(hz),
+			},
+			// The first version; the put below never replaces a clip, so
+			// a redelivery can't reset one the user has since edited.
+			"version": &dynamodbTypes.AttributeValueMemberN{
+				Value: "1",
+			},
+			"loop": &dynamodbTypes.AttributeValueMemberBOOL{
+				Value: m.Loop,
+			},
+		}
+		if m.Name != "" {
+			item["name"] = &dynamodbTypes.AttributeValueMemberS{
+				Value: m.Name,
+			}
+		}
+		if m.Notes != "" {
+			item["notes"] = &dynamodbTypes.AttributeValueMemberS{
+				Value: m.Notes,
+			}
+		}
+
+		_, err = h.dbCl.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName:           &h.clipsTbl,
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(#key)"),
+			ExpressionAttributeNames: map[string]string{
+				"#key": "key",
+			},
+		})
+		var ccf *dynamodbTypes.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			// Already imported by an earlier delivery.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		imported++
+	}
+
+	h.log.Info().Msgf("Imported %d of %d markers as clips", imported, len(ms))
+
+	return nil
+}
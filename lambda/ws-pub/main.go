@@ -3,12 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	gwTypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dynamodbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go/aws"
@@ -36,75 +44,252 @@ func main() {
 	db := dynamodb.NewFromConfig(cfg)
 	gw := apigatewaymanagementapi.NewFromConfig(cfg)
 
-	h := handler{db, gw, &log}
+	h := handler{db, gw, os.Getenv("METRICS_NAMESPACE"), &log}
 	lambda.Start(h.handleRequest)
 }
 
 type handler struct {
-	db  *dynamodb.Client
-	gw  *apigatewaymanagementapi.Client
-	log *zerolog.Logger
+	db        *dynamodb.Client
+	gw        *apigatewaymanagementapi.Client
+	namespace string
+	log       *zerolog.Logger
 }
 
+// topicIndex is the connections table index keyed by topic, so finding a
+// topic's subscribers reads only their rows.
+const topicIndex = "topicIndex"
+
+// concurrency bounds the posts in flight at once.
+const concurrency = 16
+
+// maxRetries and retryBase bound the retries of a throttled post, which
+// back off exponentially with jitter from retryBase.
+const (
+	maxRetries = 4
+	retryBase  = 50 * time.Millisecond
+)
+
 type Message struct {
 	Topic string                 `json:"topic"`
 	Data  map[string]interface{} `json:"data"`
 }
 
-func (h handler) handleRequest(ctx context.Context, snsEvent events.SNSEvent) (err error) {
+// Delivery counts the outcome of fanning a message out to a topic.
+type Delivery struct {
+	Subscribers int64
+	Delivered   int64
+	Gone        int64
+	Failed      int64
+	Retries     int64
+}
+
+// handleRequest posts a message to every connection subscribed to its
+// topic. A post that fails doesn't hold up the others: connections that
+// have gone away are unsubscribed from everything, throttled posts are
+// retried, and whatever still fails is logged and counted. The counts are
+// reported as CloudWatch metrics.
+func (h handler) handleRequest(ctx context.Context, snsEvent events.SNSEvent) error {
 	if len(snsEvent.Records) == 0 {
-		log.Info().Msg("No records in the event")
+		h.log.Info().Msg("No records in the event")
 		return nil
 	}
 
 	msg := Message{}
-	if err = json.Unmarshal([]byte(snsEvent.Records[0].SNS.Message), &msg); err != nil {
-		log.Err(err).Msgf("Error unmarshalling JSON")
-		return
+	if err := json.Unmarshal([]byte(snsEvent.Records[0].SNS.Message), &msg); err != nil {
+		h.log.Err(err).Msgf("Error unmarshalling JSON")
+		return nil
 	}
 
-	input := &dynamodb.ScanInput{
-		TableName:            aws.String(os.Getenv("TABLE_NAME")),
-		ProjectionExpression: aws.String("connectionId"),
-		FilterExpression:     aws.String("topic = :topic"),
-		ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
-			":topic": &dynamodbTypes.AttributeValueMemberS{
-				Value: msg.Topic,
-			},
-		},
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		h.log.Err(err).Msgf("Error marshalling JSON")
+		return nil
 	}
 
-	output, err := h.db.Scan(ctx, input)
+	start := time.Now()
+	connIDs, err := h.subscribers(ctx, msg.Topic)
 	if err != nil {
-		log.Err(err).Msgf("Error scanning dynamo")
-		return
+		// Returned so SNS delivers the message again.
+		h.log.Err(err).Msgf("Error querying dynamo")
+		return err
 	}
 
-	if len(output.Items) == 0 {
-		log.Info().Msg("No items foundt")
-		return
+	d := h.fanOut(ctx, connIDs, data)
+	h.log.Info().Str("topic", msg.Topic).Int64("subscribers", d.Subscribers).
+		Int64("delivered", d.Delivered).Int64("gone", d.Gone).Int64("failed", d.Failed).
+		Msg("Fanned out message")
+	h.metrics(msg.Topic, d, time.Since(start))
+	return nil
+}
+
+// fanOut posts data to each connection, at most concurrency at a time.
+func (h handler) fanOut(ctx context.Context, connIDs []string, data []byte) Delivery {
+	d := Delivery{Subscribers: int64(len(connIDs))}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, connID := range connIDs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(connID string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			h.deliver(ctx, connID, data, &d)
+		}(connID)
 	}
+	wg.Wait()
+	return d
+}
 
-	data, err := json.Marshal(msg.Data)
-	if err != nil {
-		log.Err(err).Msgf("Error unmarshalling JSON")
-		return
+func (h handler) deliver(ctx context.Context, connID string, data []byte, d *Delivery) {
+	for attempt := 0; ; attempt++ {
+		_, err := h.gw.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+			ConnectionId: aws.String(connID),
+			Data:         data,
+		})
+		if err == nil {
+			atomic.AddInt64(&d.Delivered, 1)
+			return
+		}
+
+		var gone *gwTypes.GoneException
+		if errors.As(err, &gone) {
+			atomic.AddInt64(&d.Gone, 1)
+			// The $disconnect route isn't guaranteed to run, so closed
+			// connections are cleaned up as they are found.
+			if err := h.unsubscribe(ctx, connID); err != nil {
+				h.log.Err(err).Str("connectionId", connID).Msg("Error deleting gone connection")
+			}
+			return
+		}
+		if !throttled(err) || attempt == maxRetries {
+			atomic.AddInt64(&d.Failed, 1)
+			h.log.Err(err).Str("connectionId", connID).Msgf("Error posting to connection")
+			return
+		}
+
+		atomic.AddInt64(&d.Retries, 1)
+		backoff := retryBase << attempt
+		select {
+		case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))):
+		case <-ctx.Done():
+			atomic.AddInt64(&d.Failed, 1)
+			h.log.Err(ctx.Err()).Str("connectionId", connID).Msgf("Error posting to connection")
+			return
+		}
 	}
+}
 
-	for _, item := range output.Items {
-		if connID, ok := item["connectionId"].(*dynamodbTypes.AttributeValueMemberS); ok {
-			_, err = h.gw.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
-				ConnectionId: aws.String(connID.Value),
-				Data:         data,
-			})
-			if err != nil {
-				log.Err(err).Msgf("Error posting to connection")
-				return
+// throttled reports whether a post was turned away for the rate it was
+// sent at rather than for anything wrong with it.
+func throttled(err error) bool {
+	var limit *gwTypes.LimitExceededException
+	if errors.As(err, &limit) {
+		return true
+	}
+	var status interface{ HTTPStatusCode() int }
+	return errors.As(err, &status) && status.HTTPStatusCode() == 429
+}
+
+// subscribers returns the connections subscribed to topic, reading every
+// page of the index.
+func (h handler) subscribers(ctx context.Context, topic string) ([]string, error) {
+	var connIDs []string
+	p := dynamodb.NewQueryPaginator(h.db, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("TABLE_NAME")),
+		IndexName:              aws.String(topicIndex),
+		KeyConditionExpression: aws.String("topic = :topic"),
+		ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+			":topic": &dynamodbTypes.AttributeValueMemberS{
+				Value: topic,
+			},
+		},
+	})
+	for p.HasMorePages() {
+		output, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			if connID, ok := item["connectionId"].(*dynamodbTypes.AttributeValueMemberS); ok {
+				connIDs = append(connIDs, connID.Value)
+			} else {
+				h.log.Info().Msgf("Invalid connectionId: %s", item["connectionId"])
 			}
-		} else {
-			log.Info().Msgf("Invalid connectionId: %s", item["connectionId"])
 		}
 	}
+	return connIDs, nil
+}
 
-	return
+// unsubscribe deletes a connection's subscriptions to every topic.
+func (h handler) unsubscribe(ctx context.Context, connID string) error {
+	p := dynamodb.NewQueryPaginator(h.db, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("TABLE_NAME")),
+		KeyConditionExpression: aws.String("connectionId = :connectionId"),
+		ProjectionExpression:   aws.String("connectionId, topic"),
+		ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+			":connectionId": &dynamodbTypes.AttributeValueMemberS{
+				Value: connID,
+			},
+		},
+	})
+	for p.HasMorePages() {
+		output, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			if _, err := h.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(os.Getenv("TABLE_NAME")),
+				Key:       item,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// metrics writes the delivery counts as a CloudWatch embedded metric
+// format record. Topics name a job or sound, so the metrics are
+// dimensioned by the kind of topic, the part before the first slash, and
+// the topic itself is kept on the record for querying the logs.
+func (h handler) metrics(topic string, d Delivery, elapsed time.Duration) {
+	kind, _, _ := strings.Cut(topic, "/")
+	metric := func(name, unit string) map[string]string {
+		return map[string]string{"Name": name, "Unit": unit}
+	}
+	record := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  h.namespace,
+				"Dimensions": [][]string{{"TopicKind"}},
+				"Metrics": []map[string]string{
+					metric("Subscribers", "Count"),
+					metric("Delivered", "Count"),
+					metric("Gone", "Count"),
+					metric("Failed", "Count"),
+					metric("Retries", "Count"),
+					metric("FanOutTime", "Milliseconds"),
+				},
+			}},
+		},
+		"TopicKind":   kind,
+		"Topic":       topic,
+		"Subscribers": d.Subscribers,
+		"Delivered":   d.Delivered,
+		"Gone":        d.Gone,
+		"Failed":      d.Failed,
+		"Retries":     d.Retries,
+		"FanOutTime":  elapsed.Milliseconds(),
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		h.log.Err(err).Msg("Error marshalling metrics")
+		return
+	}
+	// Lambda sends stdout to CloudWatch Logs, which extracts the metrics.
+	fmt.Fprintln(os.Stdout, string(b))
 }
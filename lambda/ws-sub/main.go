@@ -55,16 +55,7 @@ func (h *handler) handleRequest(ctx context.Context, request events.APIGatewayWe
 		return events.APIGatewayProxyResponse{Body: "Hi.", StatusCode: 200}, nil
 
 	case "$disconnect":
-		input := &dynamodb.DeleteItemInput{
-			TableName: aws.String(os.Getenv("TABLE_NAME")),
-			Key: map[string]dynamodbTypes.AttributeValue{
-				"connectionId": &dynamodbTypes.AttributeValueMemberS{
-					Value: request.RequestContext.ConnectionID,
-				},
-			},
-		}
-
-		_, err := h.db.DeleteItem(ctx, input)
+		err := h.unsubscribe(ctx, request.RequestContext.ConnectionID)
 		if err != nil {
 			log.Err(err).Msgf("Error deleting from dynamo")
 
@@ -106,3 +97,33 @@ func (h *handler) handleRequest(ctx context.Context, request events.APIGatewayWe
 
 	return events.APIGatewayProxyResponse{Body: "", StatusCode: 404}, nil
 }
+
+// unsubscribe deletes a connection's subscriptions to every topic. Rows
+// are keyed by connection and topic, so they are found first.
+func (h *handler) unsubscribe(ctx context.Context, connID string) error {
+	p := dynamodb.NewQueryPaginator(h.db, &dynamodb.QueryInput{
+		TableName:              aws.String(os.Getenv("TABLE_NAME")),
+		KeyConditionExpression: aws.String("connectionId = :connectionId"),
+		ProjectionExpression:   aws.String("connectionId, topic"),
+		ExpressionAttributeValues: map[string]dynamodbTypes.AttributeValue{
+			":connectionId": &dynamodbTypes.AttributeValueMemberS{
+				Value: connID,
+			},
+		},
+	})
+	for p.HasMorePages() {
+		output, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			if _, err := h.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(os.Getenv("TABLE_NAME")),
+				Key:       item,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
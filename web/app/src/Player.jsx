@@ -226,7 +226,9 @@ export const Player = ({ audioManager, soundId, theme, mode, tiny }) => {
   const startRecordAt = useRef(null);
   const [draftClips, setDraftClips] = useState([]);
   const [clips, setClips] = useState([]);
+  const [sharedClips, setSharedClips] = useState({});
   const isRecordingRef = useRef(isRecording); // declare this in your component
+  const pendingSave = useRef(null); // { body, key } of a save that hasn't succeeded yet
 
   const trueSampleRate = 48000;
 
@@ -279,13 +281,16 @@ export const Player = ({ audioManager, soundId, theme, mode, tiny }) => {
         hz: sampleRate
       });
     }
+    // A retry of the same save must send the same key, or the server would
+    // create the clips twice; only a different set of clips gets a new one.
+    const body = JSON.stringify(req);
+    if (!pendingSave.current || pendingSave.current.body !== body) {
+      pendingSave.current = { body, key: crypto.randomUUID() };
+    }
+    const key = pendingSave.current.key;
     try {
-      const urlResponse = await axios.post(`https://${apiHost()}/clips`, req, {
-        headers: {
-          Authorization: `Bearer ${apiToken()}`
-        },
-        responseType: "json"
-      });
+      const urlResponse = await postClips(req, key);
+      pendingSave.current = null;
 
       const savedClips = urlResponse.data;
 
@@ -305,6 +310,53 @@ export const Player = ({ audioManager, soundId, theme, mode, tiny }) => {
     }
   }
 
+  async function postClips(req, key) {
+    for (let attempt = 0; ; attempt++) {
+      try {
+        return await axios.post(`https://${apiHost()}/clips`, req, {
+          headers: {
+            Authorization: `Bearer ${apiToken()}`,
+            "Idempotency-Key": key
+          },
+          responseType: "json"
+        });
+      } catch (error) {
+        // Network errors, 5xx and 409 (the first attempt is still in flight)
+        // are worth retrying with the same key; anything else is final.
+        const status = error.response && error.response.status;
+        const retryable = !status || status >= 500 || status === 409;
+        if (!retryable || attempt >= 3) {
+          throw error;
+        }
+        await new Promise((resolve) => setTimeout(resolve, 500 * 2 ** attempt));
+      }
+    }
+  }
+
+  async function shareClip(clip) {
+    try {
+      const urlResponse = await axios.post(
+        `https://${apiHost()}/shares`,
+        { sound: soundId, clip: clip.key },
+        {
+          headers: {
+            Authorization: `Bearer ${apiToken()}`
+          },
+          responseType: "json"
+        }
+      );
+
+      const link = `https://${apiHost()}/shared/${urlResponse.data.token}`;
+      await navigator.clipboard.writeText(link);
+      setSharedClips((shared) => ({ ...shared, [clip.key]: link }));
+
+      return true;
+    } catch (error) {
+      console.error(error);
+      return false;
+    }
+  }
+
   async function getClips(id) {
     try {
       const urlResponse = await axios.get(`https://${apiHost()}/clips/${id}`, {
@@ -1007,6 +1059,7 @@ export const Player = ({ audioManager, soundId, theme, mode, tiny }) => {
                     <thead>
                       <tr>
                         <th></th>
+                        <th className='px-4 py-2 text-gray-600'>Name</th>
                         <th className='px-4 py-2 text-gray-600'>Start</th>
                         <th className='px-4 py-2 text-gray-600'>End</th>
                         <th className='px-4 py-2 text-gray-600'>Duration</th>
@@ -1027,6 +1080,22 @@ export const Player = ({ audioManager, soundId, theme, mode, tiny }) => {
                             Play
                           </td>
 
+                          <td className='px-4 py-2 border-b-2 border-gray-200' title={item.notes}>
+                            {item.colour && (
+                              <span
+                                className='inline-block w-3 h-3 mr-2 rounded-full'
+                                style={{ backgroundColor: item.colour }}
+                              ></span>
+                            )}
+                            {item.name}
+                            {item.loop && <span className='ml-2 text-gray-500'>loop</span>}
+                            {(item.labels || []).map((label) => (
+                              <span key={label} className='ml-2 px-2 text-xs bg-gray-200 rounded'>
+                                {label}
+                              </span>
+                            ))}
+                          </td>
+
                           <td
                             className='px-4 py-2 border-b-2 border-gray-200 underline cursor-pointer'
                             onClick={() => peaksInstance.current.player.seek(frameToSeconds(item.start))}
@@ -1045,7 +1114,13 @@ export const Player = ({ audioManager, soundId, theme, mode, tiny }) => {
                           </td>
                           <td className='px-4 py-2 border-b-2 border-gray-200'>{item.hz}</td>
                           <td className='px-4 py-2 border-b-2 border-gray-200'>{item.key}</td>
-                          <td className='px-4 py-2 border-b-2 border-gray-200'>Soical login required</td>
+                          <td
+                            className='px-4 py-2 border-b-2 border-gray-200 underline cursor-pointer'
+                            title={sharedClips[item.key]}
+                            onClick={() => shareClip(item)}
+                          >
+                            {sharedClips[item.key] ? "Link copied" : "Share"}
+                          </td>
                         </tr>
                       ))}
                     </tbody>
@@ -14,13 +14,20 @@ export const StoreProvider = ({ children, }) => {
 
   const refreshData = async () => {
     if (apiToken()) {
-      const urlResponse = await axios.get(`https://${apiHost()}/sounds`, {
-        headers: {
-          Authorization: `Bearer ${apiToken()}`
-        }
-      });
-      const data = urlResponse.data;
-      setStore(data || []);
+      const sounds = [];
+      let cursor = null;
+      do {
+        const urlResponse = await axios.get(`https://${apiHost()}/sounds`, {
+          headers: {
+            Authorization: `Bearer ${apiToken()}`
+          },
+          params: cursor ? { cursor } : {}
+        });
+        const data = urlResponse.data;
+        sounds.push(...(data.items || []));
+        cursor = data.nextCursor;
+      } while (cursor);
+      setStore(sounds);
       setInitialFetch(true);
     }
   };